@@ -1,28 +1,36 @@
 package agentkit
 
 import (
+	"context"
+	"time"
+
 	"github.com/rsaranusc/agentkit/llm"
 )
 
 // Agent represents an entity with specific attributes and behaviors.
 type Agent struct {
-	Name              string                                               // The name of the agent.
-	Model             string                                               // The model identifier.
-	Provider          llm.LLMProvider                                      // The LLM provider to use.
-	Config            *ClientConfig                                        // Provider-specific configuration.
-	Instructions      string                                               // Static instructions for the agent.
-	InstructionsFunc  func(contextVariables map[string]interface{}) string // Function to generate dynamic instructions based on context.
-	Functions         []AgentFunction                                      // A list of functions the agent can perform.
-	Memory            *MemoryStore                                         // Memory store for the agent.
-	ParallelToolCalls bool                                                 // Whether to allow parallel tool calls.
+	Name                 string                                               // The name of the agent.
+	Model                string                                               // The model identifier.
+	Provider             llm.LLMProvider                                      // The LLM provider to use.
+	Config               *ClientConfig                                        // Provider-specific configuration.
+	Instructions         string                                               // Static instructions for the agent.
+	InstructionsFunc     func(contextVariables map[string]interface{}) string // Function to generate dynamic instructions based on context.
+	Functions            []AgentFunction                                      // A list of functions the agent can perform.
+	Memory               *MemoryStore                                         // Memory store for the agent.
+	ParallelToolCalls    bool                                                 // Whether to allow parallel tool calls.
+	MaxParallelToolCalls int                                                  // Tool calls run at once when parallel; 0 uses the Swarm's limit.
 }
 
 // AgentFunction represents a function that can be performed by an agent
 type AgentFunction struct {
-	Name        string                                                                            // The name of the function.
-	Description string                                                                            // Description of what the function does.
-	Parameters  map[string]interface{}                                                            // Parameters for the function.
-	Function    func(args map[string]interface{}, contextVariables map[string]interface{}) Result // The actual function implementation.
+	Name                string                                                                                                 // The name of the function.
+	Description         string                                                                                                 // Description of what the function does.
+	Parameters          map[string]interface{}                                                                                 // Parameters for the function.
+	Function            func(args map[string]interface{}, contextVariables map[string]interface{}) Result                      // The actual function implementation.
+	FunctionWithContext func(ctx context.Context, args map[string]interface{}, contextVariables map[string]interface{}) Result // Context-aware implementation; takes precedence over Function.
+	Timeout             time.Duration                                                                                          // Limit for each attempt; 0 means no limit.
+	MaxRetries          int                                                                                                    // Extra attempts after a failed call.
+	RetryBackoff        time.Duration                                                                                          // Wait before each retry.
 }
 
 // FunctionToDefinition converts an AgentFunction to a llm.Function
@@ -73,3 +81,9 @@ func (a *Agent) WithParallelToolCalls(enabled bool) *Agent {
 	a.ParallelToolCalls = enabled
 	return a
 }
+
+// WithMaxParallelToolCalls limits how many tool calls run at once when parallel tool calls are enabled
+func (a *Agent) WithMaxParallelToolCalls(limit int) *Agent {
+	a.MaxParallelToolCalls = limit
+	return a
+}
@@ -0,0 +1,176 @@
+package agentkittest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/rsaranusc/agentkit"
+	"github.com/rsaranusc/agentkit/agentkittest"
+	"github.com/rsaranusc/agentkit/llm"
+	"github.com/stretchr/testify/assert"
+)
+
+func weatherAgent() *agentkit.Agent {
+	return &agentkit.Agent{
+		Name:         "WeatherAgent",
+		Model:        "gpt-4o",
+		Instructions: "You report the weather.",
+		Functions: []agentkit.AgentFunction{{
+			Name:        "getWeather",
+			Description: "Get the weather in a city.",
+			Parameters: map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{"location": map[string]interface{}{"type": "string"}},
+				"required":   []string{"location"},
+			},
+			Function: func(args map[string]interface{}, contextVariables map[string]interface{}) agentkit.Result {
+				return agentkit.Result{Success: true, Data: fmt.Sprintf("sunny in %v", args["location"])}
+			},
+		}},
+	}
+}
+
+// TestFakeLLMRunsAgent tests scripting an agent run and asserting on what it sent
+func TestFakeLLMRunsAgent(t *testing.T) {
+	fake := agentkittest.NewFakeLLM().
+		ToolCall("getWeather", map[string]interface{}{"location": "Paris"}).
+		ToolCall("getWeather", `{"location": "Rome"}`).
+		Reply("Sunny in both")
+	swarm := agentkit.NewSwarmWithClient(fake, &agentkit.Config{})
+
+	response, err := swarm.Run(context.Background(), weatherAgent(),
+		[]llm.Message{{Role: llm.RoleUser, Content: "Weather in Paris and Rome?"}}, nil, "", false, false, 5, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "Sunny in both", response.Messages[len(response.Messages)-1].Content)
+	assert.Len(t, fake.Requests(), 3)
+	assert.Zero(t, fake.Remaining())
+
+	last := fake.LastRequest()
+	agentkittest.AssertSystemPrompt(t, last, "You report the weather.")
+	agentkittest.AssertSystemPromptContains(t, last, "weather")
+	agentkittest.AssertTools(t, last, "getWeather")
+	agentkittest.AssertToolSchema(t, last, "getWeather", map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"location": map[string]interface{}{"type": "string"}},
+		"required":   []interface{}{"location"},
+	})
+	agentkittest.AssertToolResultOrder(t, last, "call_1", "call_2")
+	agentkittest.AssertRoles(t, last, llm.RoleSystem, llm.RoleUser,
+		llm.RoleAssistant, llm.RoleTool, llm.RoleAssistant, llm.RoleTool)
+
+	_, err = fake.CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{Model: "gpt-4o"})
+	assert.ErrorIs(t, err, agentkittest.ErrScriptExhausted)
+}
+
+// TestFakeLLMInjectsErrors tests that injected errors reach the retry policy
+func TestFakeLLMInjectsErrors(t *testing.T) {
+	fake := agentkittest.NewFakeLLM().
+		Fail(agentkittest.RateLimitError(time.Millisecond)).
+		Fail(agentkittest.TimeoutError()).
+		Reply("Done")
+	swarm := agentkit.NewSwarmWithClient(fake, &agentkit.Config{
+		RetryPolicy: &agentkit.RetryPolicy{MaxRetries: 2, InitialBackoff: time.Millisecond},
+	})
+
+	response, err := swarm.Run(context.Background(), &agentkit.Agent{Name: "Agent", Model: "gpt-4o"},
+		[]llm.Message{{Role: llm.RoleUser, Content: "Hi"}}, nil, "", false, false, 1, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "Done", response.Messages[0].Content)
+	assert.Len(t, fake.Requests(), 3)
+
+	fake.Fail(agentkittest.ServerError())
+	_, err = fake.CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{})
+	assert.ErrorIs(t, err, llm.ErrServer)
+	assert.True(t, llm.IsRetryable(err))
+}
+
+func readAll(stream llm.ChatCompletionStream) (string, error) {
+	var content string
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return content, nil
+		}
+		if err != nil {
+			return content, err
+		}
+		content += chunk.Choices[0].Message.Content
+	}
+}
+
+// TestFakeLLMStreams tests scripted streams and how steps convert between call kinds
+func TestFakeLLMStreams(t *testing.T) {
+	ctx := context.Background()
+	broken := errors.New("connection reset")
+	fake := agentkittest.NewFakeLLM().
+		Stream("Hel", "lo").
+		FailStream(broken, "Hal").
+		Reply("Whole").
+		Stream("Jo", "ined")
+
+	stream, err := fake.CreateChatCompletionStream(ctx, llm.ChatCompletionRequest{})
+	assert.NoError(t, err)
+	content, err := readAll(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", content)
+
+	stream, err = fake.CreateChatCompletionStream(ctx, llm.ChatCompletionRequest{})
+	assert.NoError(t, err)
+	content, err = readAll(stream)
+	assert.ErrorIs(t, err, broken)
+	assert.Equal(t, "Hal", content)
+
+	stream, err = fake.CreateChatCompletionStream(ctx, llm.ChatCompletionRequest{})
+	assert.NoError(t, err)
+	content, err = readAll(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, "Whole", content)
+
+	resp, err := fake.CreateChatCompletion(ctx, llm.ChatCompletionRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, "Joined", resp.Choices[0].Message.Content)
+}
+
+// recordingT records the failures reported through it
+type recordingT struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recordingT) Helper() {}
+
+func (r *recordingT) Errorf(format string, args ...interface{}) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+// TestAssertionsReportFailures tests that assertions explain what differs
+func TestAssertionsReportFailures(t *testing.T) {
+	req := llm.ChatCompletionRequest{
+		Messages: []llm.Message{
+			{Role: llm.RoleSystem, Content: "Be brief."},
+			{Role: llm.RoleAssistant, ToolCalls: []llm.ToolCall{agentkittest.NewToolCall("a", "f", nil), agentkittest.NewToolCall("b", "f", nil)}},
+			{Role: llm.RoleTool, ToolCallID: "b"},
+			{Role: llm.RoleTool, ToolCallID: "a"},
+		},
+		Tools: []llm.Tool{{Type: "function", Function: &llm.Function{Name: "f", Parameters: map[string]interface{}{"type": "object"}}}},
+	}
+
+	rt := &recordingT{TB: t}
+	assert.False(t, agentkittest.AssertSystemPrompt(rt, req, "Be verbose."))
+	assert.False(t, agentkittest.AssertTools(rt, req, "f", "g"))
+	assert.False(t, agentkittest.AssertToolSchema(rt, req, "f", map[string]interface{}{"type": "array"}))
+	assert.False(t, agentkittest.AssertToolSchema(rt, req, "g", nil))
+	assert.False(t, agentkittest.AssertToolResultOrder(rt, req, "a", "b"))
+	assert.True(t, agentkittest.AssertToolResultOrder(rt, req, "b", "a"))
+	assert.Equal(t, []string{
+		`system prompt is "Be brief.", want "Be verbose."`,
+		"request offers tools [f], want [f g]",
+		`tool f has schema {"type":"object"}, want {"type":"array"}`,
+		"request does not offer tool g; it offers [f]",
+		"tool results answer calls [b a], want [a b]",
+	}, rt.failures)
+}
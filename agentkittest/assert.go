@@ -0,0 +1,151 @@
+package agentkittest
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rsaranusc/agentkit/llm"
+)
+
+// SystemPrompt returns the content of the first system message of req
+func SystemPrompt(req llm.ChatCompletionRequest) (string, bool) {
+	for _, msg := range req.Messages {
+		if msg.Role == llm.RoleSystem {
+			return msg.Content, true
+		}
+	}
+	return "", false
+}
+
+// AssertSystemPrompt checks that the system prompt of req is want
+func AssertSystemPrompt(t testing.TB, req llm.ChatCompletionRequest, want string) bool {
+	t.Helper()
+	got, ok := SystemPrompt(req)
+	if !ok {
+		t.Errorf("request has no system prompt, want %q", want)
+		return false
+	}
+	if got != want {
+		t.Errorf("system prompt is %q, want %q", got, want)
+		return false
+	}
+	return true
+}
+
+// AssertSystemPromptContains checks that the system prompt of req contains substr
+func AssertSystemPromptContains(t testing.TB, req llm.ChatCompletionRequest, substr string) bool {
+	t.Helper()
+	got, ok := SystemPrompt(req)
+	if !ok || !strings.Contains(got, substr) {
+		t.Errorf("system prompt %q does not contain %q", got, substr)
+		return false
+	}
+	return true
+}
+
+// ToolNames returns the names of the tools offered in req, in order
+func ToolNames(req llm.ChatCompletionRequest) []string {
+	var names []string
+	for _, tool := range req.Tools {
+		if tool.Function != nil {
+			names = append(names, tool.Function.Name)
+		}
+	}
+	return names
+}
+
+// AssertTools checks that req offers exactly the tools named, in any order
+func AssertTools(t testing.TB, req llm.ChatCompletionRequest, names ...string) bool {
+	t.Helper()
+	got := map[string]int{}
+	for _, name := range ToolNames(req) {
+		got[name]++
+	}
+	want := map[string]int{}
+	for _, name := range names {
+		want[name]++
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("request offers tools %v, want %v", ToolNames(req), names)
+		return false
+	}
+	return true
+}
+
+// AssertToolSchema checks that req offers the tool name with the parameter
+// schema want. Schemas are compared by their JSON encoding, so a schema built
+// from []string matches one built from []interface{}.
+func AssertToolSchema(t testing.TB, req llm.ChatCompletionRequest, name string, want map[string]interface{}) bool {
+	t.Helper()
+	for _, tool := range req.Tools {
+		if tool.Function == nil || tool.Function.Name != name {
+			continue
+		}
+		got, wantJSON := normalize(tool.Function.Parameters), normalize(want)
+		if !reflect.DeepEqual(got, wantJSON) {
+			gotData, _ := json.Marshal(tool.Function.Parameters)
+			wantData, _ := json.Marshal(want)
+			t.Errorf("tool %s has schema %s, want %s", name, gotData, wantData)
+			return false
+		}
+		return true
+	}
+	t.Errorf("request does not offer tool %s; it offers %v", name, ToolNames(req))
+	return false
+}
+
+// AssertToolResultOrder checks that the tool results in the history of req
+// answer the calls with ids in order, and that each result comes after the
+// assistant message making its call
+func AssertToolResultOrder(t testing.TB, req llm.ChatCompletionRequest, ids ...string) bool {
+	t.Helper()
+	called := map[string]bool{}
+	var got []string
+	for i, msg := range req.Messages {
+		for _, call := range msg.ToolCalls {
+			called[call.ID] = true
+		}
+		if msg.Role != llm.RoleTool {
+			continue
+		}
+		if !called[msg.ToolCallID] {
+			t.Errorf("tool result %d answers call %q before it was made", i, msg.ToolCallID)
+			return false
+		}
+		got = append(got, msg.ToolCallID)
+	}
+	if !reflect.DeepEqual(got, ids) && !(len(got) == 0 && len(ids) == 0) {
+		t.Errorf("tool results answer calls %v, want %v", got, ids)
+		return false
+	}
+	return true
+}
+
+// AssertRoles checks the roles of the messages of req, in order
+func AssertRoles(t testing.TB, req llm.ChatCompletionRequest, roles ...llm.Role) bool {
+	t.Helper()
+	got := make([]llm.Role, len(req.Messages))
+	for i, msg := range req.Messages {
+		got[i] = msg.Role
+	}
+	if !reflect.DeepEqual(got, roles) && !(len(got) == 0 && len(roles) == 0) {
+		t.Errorf("messages have roles %v, want %v", got, roles)
+		return false
+	}
+	return true
+}
+
+// normalize returns the generic JSON form of v
+func normalize(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return v
+	}
+	return decoded
+}
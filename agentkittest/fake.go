@@ -0,0 +1,283 @@
+// Package agentkittest provides a scripted fake llm.LLM and assertions on the
+// requests an agent sends, for testing agents without a provider.
+//
+//	fake := agentkittest.NewFakeLLM().
+//		ToolCall("getWeather", map[string]interface{}{"location": "Paris"}).
+//		Reply("It is sunny in Paris")
+//	swarm := agentkit.NewSwarmWithClient(fake, nil)
+//	// ... run the agent ...
+//	agentkittest.AssertToolResultOrder(t, fake.LastRequest(), "call_1")
+package agentkittest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rsaranusc/agentkit/llm"
+)
+
+// ErrScriptExhausted is returned for calls made after every scripted step was used
+var ErrScriptExhausted = errors.New("agentkittest: no scripted response left")
+
+// step is one scripted answer: a response, a stream of chunks or an error
+type step struct {
+	response  *llm.ChatCompletionResponse
+	chunks    []llm.ChatCompletionResponse
+	err       error // Returned by the call, or by the stream after its chunks
+	streamErr bool  // err ends the stream instead of failing the call
+}
+
+// FakeLLM is an llm.LLM that answers calls with scripted steps, in the order
+// they were queued, and records every request. Each call, streaming or not,
+// consumes one step: a queued response is streamed as a single chunk and a
+// queued stream is returned as one response joining its chunks. It is safe
+// for concurrent use.
+type FakeLLM struct {
+	mu       sync.Mutex
+	steps    []step
+	requests []llm.ChatCompletionRequest
+	calls    int
+	callIDs  int // Tool call IDs assigned by ToolCall
+}
+
+// NewFakeLLM returns a FakeLLM with an empty script
+func NewFakeLLM() *FakeLLM {
+	return &FakeLLM{}
+}
+
+// Respond queues a complete response
+func (f *FakeLLM) Respond(resp llm.ChatCompletionResponse) *FakeLLM {
+	return f.push(step{response: &resp})
+}
+
+// Reply queues an assistant message with content
+func (f *FakeLLM) Reply(content string) *FakeLLM {
+	return f.Respond(Response(llm.Message{Role: llm.RoleAssistant, Content: content}))
+}
+
+// ToolCall queues an assistant message calling one tool with args, which are
+// encoded as JSON unless they already are a string. Calls get the IDs call_1,
+// call_2 and so on, in the order they are queued.
+func (f *FakeLLM) ToolCall(name string, args interface{}) *FakeLLM {
+	f.mu.Lock()
+	f.callIDs++
+	id := fmt.Sprintf("call_%d", f.callIDs)
+	f.mu.Unlock()
+	return f.ToolCalls(NewToolCall(id, name, args))
+}
+
+// ToolCalls queues an assistant message making several tool calls at once
+func (f *FakeLLM) ToolCalls(calls ...llm.ToolCall) *FakeLLM {
+	return f.Respond(Response(llm.Message{Role: llm.RoleAssistant, ToolCalls: calls}))
+}
+
+// Stream queues a stream sending each string as a chunk of assistant content
+func (f *FakeLLM) Stream(chunks ...string) *FakeLLM {
+	return f.StreamResponses(contentChunks(chunks)...)
+}
+
+// StreamResponses queues a stream sending chunks as they are
+func (f *FakeLLM) StreamResponses(chunks ...llm.ChatCompletionResponse) *FakeLLM {
+	return f.push(step{chunks: chunks})
+}
+
+// Fail queues a call that fails with err
+func (f *FakeLLM) Fail(err error) *FakeLLM {
+	return f.push(step{err: err})
+}
+
+// FailStream queues a stream that sends chunks, then fails with err
+func (f *FakeLLM) FailStream(err error, chunks ...string) *FakeLLM {
+	return f.push(step{chunks: contentChunks(chunks), err: err, streamErr: true})
+}
+
+// push appends a step to the script
+func (f *FakeLLM) push(s step) *FakeLLM {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.steps = append(f.steps, s)
+	return f
+}
+
+// next records req and takes the next step of the script
+func (f *FakeLLM) next(req llm.ChatCompletionRequest) (step, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, req)
+	f.calls++
+	if len(f.steps) == 0 {
+		return step{}, fmt.Errorf("%w for call %d (model %s, %d messages)", ErrScriptExhausted, f.calls, req.Model, len(req.Messages))
+	}
+	s := f.steps[0]
+	f.steps = f.steps[1:]
+	return s, nil
+}
+
+// CreateChatCompletion answers with the next step of the script
+func (f *FakeLLM) CreateChatCompletion(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return llm.ChatCompletionResponse{}, err
+	}
+	s, err := f.next(req)
+	if err != nil {
+		return llm.ChatCompletionResponse{}, err
+	}
+	if s.err != nil {
+		return llm.ChatCompletionResponse{}, s.err
+	}
+	if s.response != nil {
+		return *s.response, nil
+	}
+	return joinChunks(s.chunks), nil
+}
+
+// CreateChatCompletionStream answers with the next step of the script
+func (f *FakeLLM) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionStream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s, err := f.next(req)
+	if err != nil {
+		return nil, err
+	}
+	if s.err != nil && !s.streamErr {
+		return nil, s.err
+	}
+	if s.response != nil {
+		return &fakeStream{chunks: []llm.ChatCompletionResponse{*s.response}}, nil
+	}
+	return &fakeStream{chunks: s.chunks, err: s.err}, nil
+}
+
+// Requests returns every request received so far
+func (f *FakeLLM) Requests() []llm.ChatCompletionRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]llm.ChatCompletionRequest(nil), f.requests...)
+}
+
+// LastRequest returns the latest request received, or an empty request if
+// there was none
+func (f *FakeLLM) LastRequest() llm.ChatCompletionRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.requests) == 0 {
+		return llm.ChatCompletionRequest{}
+	}
+	return f.requests[len(f.requests)-1]
+}
+
+// Remaining returns the number of scripted steps not used yet
+func (f *FakeLLM) Remaining() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.steps)
+}
+
+// fakeStream streams scripted chunks, then err or io.EOF
+type fakeStream struct {
+	chunks []llm.ChatCompletionResponse
+	err    error
+	closed bool
+}
+
+func (s *fakeStream) Recv() (llm.ChatCompletionResponse, error) {
+	if s.closed {
+		return llm.ChatCompletionResponse{}, io.EOF
+	}
+	if len(s.chunks) == 0 {
+		if s.err != nil {
+			return llm.ChatCompletionResponse{}, s.err
+		}
+		return llm.ChatCompletionResponse{}, io.EOF
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return chunk, nil
+}
+
+func (s *fakeStream) Close() error {
+	s.closed = true
+	return nil
+}
+
+// Response returns a response with msg as its only choice
+func Response(msg llm.Message) llm.ChatCompletionResponse {
+	finishReason := "stop"
+	if len(msg.ToolCalls) > 0 {
+		finishReason = "tool_calls"
+	}
+	return llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{Message: msg, FinishReason: finishReason}},
+	}
+}
+
+// NewToolCall returns a function call with args encoded as JSON, unless they
+// already are a string
+func NewToolCall(id, name string, args interface{}) llm.ToolCall {
+	arguments, ok := args.(string)
+	if !ok {
+		data, err := json.Marshal(args)
+		if err != nil {
+			panic(fmt.Sprintf("agentkittest: cannot encode arguments of %s: %v", name, err))
+		}
+		arguments = string(data)
+	}
+	return llm.ToolCall{
+		ID:       id,
+		Type:     "function",
+		Function: llm.ToolCallFunction{Name: name, Arguments: arguments},
+	}
+}
+
+// RateLimitError returns the error a provider returns when rate limited,
+// asking to wait retryAfter before the next attempt
+func RateLimitError(retryAfter time.Duration) error {
+	return &llm.ProviderError{Provider: "fake", Kind: llm.ErrRateLimited, StatusCode: 429, Message: "rate limited", RetryAfter: retryAfter}
+}
+
+// TimeoutError returns the error a provider returns when a request times out
+func TimeoutError() error {
+	return &llm.ProviderError{Provider: "fake", Kind: llm.ErrTimeout, Message: "request timed out", Err: context.DeadlineExceeded}
+}
+
+// ServerError returns the error a provider returns when it fails
+func ServerError() error {
+	return &llm.ProviderError{Provider: "fake", Kind: llm.ErrServer, StatusCode: 500, Message: "internal server error"}
+}
+
+// contentChunks returns one chunk of assistant content per string
+func contentChunks(chunks []string) []llm.ChatCompletionResponse {
+	responses := make([]llm.ChatCompletionResponse, len(chunks))
+	for i, content := range chunks {
+		responses[i] = llm.ChatCompletionResponse{
+			Choices: []llm.Choice{{Message: llm.Message{Role: llm.RoleAssistant, Content: content}}},
+		}
+	}
+	return responses
+}
+
+// joinChunks returns the response a stream of chunks adds up to
+func joinChunks(chunks []llm.ChatCompletionResponse) llm.ChatCompletionResponse {
+	var content strings.Builder
+	var toolCalls []llm.ToolCall
+	var resp llm.ChatCompletionResponse
+	for _, chunk := range chunks {
+		if len(chunk.Choices) > 0 {
+			content.WriteString(chunk.Choices[0].Message.Content)
+			toolCalls = append(toolCalls, chunk.Choices[0].Message.ToolCalls...)
+		}
+		if chunk.Usage.TotalTokens > 0 {
+			resp.Usage = chunk.Usage
+		}
+	}
+	resp.Choices = Response(llm.Message{Role: llm.RoleAssistant, Content: content.String(), ToolCalls: toolCalls}).Choices
+	return resp
+}
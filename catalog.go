@@ -0,0 +1,269 @@
+package agentkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rsaranusc/agentkit/llm"
+	"gopkg.in/yaml.v3"
+)
+
+// ModelCapabilities lists the features a model supports
+type ModelCapabilities struct {
+	Tools     bool `json:"tools" yaml:"tools"`
+	Streaming bool `json:"streaming" yaml:"streaming"`
+	Vision    bool `json:"vision" yaml:"vision"`
+	JSONMode  bool `json:"json_mode" yaml:"json_mode"`
+	Reasoning bool `json:"reasoning" yaml:"reasoning"`
+}
+
+// ModelInfo describes a model's limits, prices and capabilities. Prices are in
+// US dollars per million tokens; a zero price means the cost is unknown.
+type ModelInfo struct {
+	Name             string            `json:"name" yaml:"name"`
+	Aliases          []string          `json:"aliases,omitempty" yaml:"aliases,omitempty"`
+	ContextWindow    int               `json:"context_window" yaml:"context_window"`
+	MaxOutputTokens  int               `json:"max_output_tokens" yaml:"max_output_tokens"`
+	InputPrice       float64           `json:"input_price" yaml:"input_price"`
+	OutputPrice      float64           `json:"output_price" yaml:"output_price"`
+	CachedInputPrice float64           `json:"cached_input_price,omitempty" yaml:"cached_input_price,omitempty"`
+	Capabilities     ModelCapabilities `json:"capabilities" yaml:"capabilities"`
+}
+
+// Cost returns the dollar cost of usage. Cached prompt tokens are charged at
+// CachedInputPrice when it is set and at InputPrice otherwise.
+func (m ModelInfo) Cost(usage llm.Usage) float64 {
+	cached := usage.CachedPromptTokens
+	if cached > usage.PromptTokens {
+		cached = usage.PromptTokens
+	}
+	cachedPrice := m.CachedInputPrice
+	if cachedPrice == 0 {
+		cachedPrice = m.InputPrice
+	}
+
+	cost := float64(usage.PromptTokens-cached)*m.InputPrice +
+		float64(cached)*cachedPrice +
+		float64(usage.CompletionTokens)*m.OutputPrice
+	return cost / 1e6
+}
+
+// modelCatalogFile is the layout of catalog files read by LoadFile
+type modelCatalogFile struct {
+	Models []ModelInfo `json:"models" yaml:"models"`
+}
+
+// ModelCatalog looks up model information by model name. A model is found by
+// its name or one of its aliases, ignoring case. Failing that, the longest name
+// or alias the model starts with is used when it is followed by '-', ':' or '@',
+// so "gpt-4o-2024-08-06" finds "gpt-4o" and "llama3.1:8b" finds "llama3.1".
+type ModelCatalog struct {
+	mu     sync.RWMutex
+	models []ModelInfo
+	index  map[string]int // Lower-cased names and aliases to positions in models
+}
+
+// NewModelCatalog creates a catalog holding the given models
+func NewModelCatalog(models ...ModelInfo) *ModelCatalog {
+	c := &ModelCatalog{index: make(map[string]int)}
+	c.Add(models...)
+	return c
+}
+
+// Add adds models to the catalog, replacing any entry with the same name
+func (c *ModelCatalog) Add(models ...ModelInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, model := range models {
+		replaced := false
+		for i := range c.models {
+			if strings.EqualFold(c.models[i].Name, model.Name) {
+				c.models[i] = model
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			c.models = append(c.models, model)
+		}
+	}
+
+	// Rebuild the index so aliases of replaced entries are dropped
+	c.index = make(map[string]int, len(c.models))
+	for i, model := range c.models {
+		for _, alias := range model.Aliases {
+			c.index[strings.ToLower(alias)] = i
+		}
+	}
+	for i, model := range c.models {
+		c.index[strings.ToLower(model.Name)] = i
+	}
+}
+
+// Lookup returns the information for model. Names are matched ignoring case;
+// dated or tagged variants, such as gpt-4o-2024-08-06 or llama3.1:8b, match the
+// entry with the longest name or alias they extend.
+func (c *ModelCatalog) Lookup(model string) (ModelInfo, bool) {
+	if c == nil || model == "" {
+		return ModelInfo{}, false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	name := strings.ToLower(model)
+	if i, ok := c.index[name]; ok {
+		return c.models[i], true
+	}
+
+	best, bestLen := -1, 0
+	for key, i := range c.index {
+		if len(key) <= bestLen || len(key) >= len(name) || !strings.HasPrefix(name, key) {
+			continue
+		}
+		if strings.ContainsRune("-:@", rune(name[len(key)])) {
+			best, bestLen = i, len(key)
+		}
+	}
+	if best < 0 {
+		return ModelInfo{}, false
+	}
+	return c.models[best], true
+}
+
+// Models returns every model in the catalog
+func (c *ModelCatalog) Models() []ModelInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	models := make([]ModelInfo, len(c.models))
+	copy(models, c.models)
+	return models
+}
+
+// LoadJSON adds the models of a JSON catalog, an object with a "models" list
+func (c *ModelCatalog) LoadJSON(data []byte) error {
+	var file modelCatalogFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("invalid model catalog: %w", err)
+	}
+	return c.load(file)
+}
+
+// LoadYAML adds the models of a YAML catalog, a mapping with a "models" list
+func (c *ModelCatalog) LoadYAML(data []byte) error {
+	var file modelCatalogFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("invalid model catalog: %w", err)
+	}
+	return c.load(file)
+}
+
+// LoadFile adds the models of a catalog file. Files ending in .yaml or .yml are
+// read as YAML and all others as JSON.
+func (c *ModelCatalog) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read model catalog: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return c.LoadYAML(data)
+	default:
+		return c.LoadJSON(data)
+	}
+}
+
+// load checks the models of a catalog file before adding them
+func (c *ModelCatalog) load(file modelCatalogFile) error {
+	for i, model := range file.Models {
+		if model.Name == "" {
+			return fmt.Errorf("invalid model catalog: model %d has no name", i)
+		}
+	}
+	c.Add(file.Models...)
+	return nil
+}
+
+// LoadModelCatalog reads a catalog file into a new catalog
+func LoadModelCatalog(path string) (*ModelCatalog, error) {
+	c := NewModelCatalog()
+	if err := c.LoadFile(path); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// DefaultModelCatalog returns a catalog of commonly used models. Open-weight
+// models are priced by whoever hosts them, so their prices are left unset.
+func DefaultModelCatalog() *ModelCatalog {
+	all := ModelCapabilities{Tools: true, Streaming: true, Vision: true, JSONMode: true}
+	text := ModelCapabilities{Tools: true, Streaming: true, JSONMode: true}
+	reasoning := func(c ModelCapabilities) ModelCapabilities {
+		c.Reasoning = true
+		return c
+	}
+
+	return NewModelCatalog(
+		// OpenAI
+		ModelInfo{Name: "gpt-3.5-turbo", ContextWindow: 16385, MaxOutputTokens: 4096,
+			InputPrice: 0.5, OutputPrice: 1.5, Capabilities: text},
+		ModelInfo{Name: "gpt-4", ContextWindow: 8192, MaxOutputTokens: 4096,
+			InputPrice: 30, OutputPrice: 60,
+			Capabilities: ModelCapabilities{Tools: true, Streaming: true}},
+		ModelInfo{Name: "gpt-4-32k", ContextWindow: 32768, MaxOutputTokens: 4096,
+			InputPrice: 60, OutputPrice: 120,
+			Capabilities: ModelCapabilities{Tools: true, Streaming: true}},
+		ModelInfo{Name: "gpt-4-turbo", ContextWindow: 128000, MaxOutputTokens: 4096,
+			InputPrice: 10, OutputPrice: 30, Capabilities: all},
+		ModelInfo{Name: "gpt-4-turbo-preview", Aliases: []string{"gpt-4-0125-preview", "gpt-4-1106-preview"},
+			ContextWindow: 128000, MaxOutputTokens: 4096, InputPrice: 10, OutputPrice: 30, Capabilities: text},
+		ModelInfo{Name: "gpt-4-vision-preview", Aliases: []string{"gpt-4-1106-vision-preview"},
+			ContextWindow: 128000, MaxOutputTokens: 4096, InputPrice: 10, OutputPrice: 30,
+			Capabilities: ModelCapabilities{Streaming: true, Vision: true}},
+		ModelInfo{Name: "gpt-4o", Aliases: []string{"chatgpt-4o-latest"}, ContextWindow: 128000, MaxOutputTokens: 16384,
+			InputPrice: 2.5, OutputPrice: 10, CachedInputPrice: 1.25, Capabilities: all},
+		ModelInfo{Name: "gpt-4o-mini", ContextWindow: 128000, MaxOutputTokens: 16384,
+			InputPrice: 0.15, OutputPrice: 0.6, CachedInputPrice: 0.075, Capabilities: all},
+		ModelInfo{Name: "o1", ContextWindow: 200000, MaxOutputTokens: 100000,
+			InputPrice: 15, OutputPrice: 60, CachedInputPrice: 7.5, Capabilities: reasoning(all)},
+		ModelInfo{Name: "o3-mini", ContextWindow: 200000, MaxOutputTokens: 100000,
+			InputPrice: 1.1, OutputPrice: 4.4, CachedInputPrice: 0.55, Capabilities: reasoning(text)},
+
+		// Anthropic
+		ModelInfo{Name: "claude-3-opus", Aliases: []string{"claude-3-opus-latest"}, ContextWindow: 200000, MaxOutputTokens: 4096,
+			InputPrice: 15, OutputPrice: 75, CachedInputPrice: 1.5, Capabilities: all},
+		ModelInfo{Name: "claude-3-5-sonnet", Aliases: []string{"claude-3-5-sonnet-latest"}, ContextWindow: 200000, MaxOutputTokens: 8192,
+			InputPrice: 3, OutputPrice: 15, CachedInputPrice: 0.3, Capabilities: all},
+		ModelInfo{Name: "claude-3-5-haiku", Aliases: []string{"claude-3-5-haiku-latest"}, ContextWindow: 200000, MaxOutputTokens: 8192,
+			InputPrice: 0.8, OutputPrice: 4, CachedInputPrice: 0.08, Capabilities: text},
+		ModelInfo{Name: "claude-3-7-sonnet", Aliases: []string{"claude-3-7-sonnet-latest"}, ContextWindow: 200000, MaxOutputTokens: 64000,
+			InputPrice: 3, OutputPrice: 15, CachedInputPrice: 0.3, Capabilities: reasoning(all)},
+
+		// Google
+		ModelInfo{Name: "gemini-1.5-pro", ContextWindow: 2097152, MaxOutputTokens: 8192,
+			InputPrice: 1.25, OutputPrice: 5, CachedInputPrice: 0.3125, Capabilities: all},
+		ModelInfo{Name: "gemini-1.5-flash", ContextWindow: 1048576, MaxOutputTokens: 8192,
+			InputPrice: 0.075, OutputPrice: 0.3, CachedInputPrice: 0.01875, Capabilities: all},
+		ModelInfo{Name: "gemini-2.0-flash", ContextWindow: 1048576, MaxOutputTokens: 8192,
+			InputPrice: 0.1, OutputPrice: 0.4, CachedInputPrice: 0.025, Capabilities: all},
+
+		// DeepSeek
+		ModelInfo{Name: "deepseek-chat", ContextWindow: 64000, MaxOutputTokens: 8192,
+			InputPrice: 0.27, OutputPrice: 1.1, CachedInputPrice: 0.07, Capabilities: text},
+		ModelInfo{Name: "deepseek-reasoner", ContextWindow: 64000, MaxOutputTokens: 8192,
+			InputPrice: 0.55, OutputPrice: 2.19, CachedInputPrice: 0.14,
+			Capabilities: ModelCapabilities{Streaming: true, Reasoning: true}},
+
+		// Open-weight models
+		ModelInfo{Name: "meta-llama/Llama-3.3-70B-Instruct", ContextWindow: 128000, Capabilities: text},
+		ModelInfo{Name: "Qwen/Qwen2.5-32B-Instruct", ContextWindow: 128000, Capabilities: text},
+		ModelInfo{Name: "deepseek-ai/DeepSeek-V3", ContextWindow: 128000, Capabilities: text},
+	)
+}
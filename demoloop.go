@@ -180,6 +180,10 @@ func RunDemoLoopWithConfig(client *Swarm, agent *Agent, config *DemoLoopConfig)
 				if startIdx < 0 {
 					startIdx = 0
 				}
+				// Don't start with tool results whose call was trimmed
+				for startIdx < len(messages) && messages[startIdx].Role == llm.RoleTool {
+					startIdx++
+				}
 
 				newMessages = append(newMessages, messages[startIdx:]...)
 				messages = newMessages
@@ -216,9 +220,6 @@ func RunDemoLoopWithConfig(client *Swarm, agent *Agent, config *DemoLoopConfig)
 			}
 
 			// Process the response and print it to the console
-			var lastAssistantMessage llm.Message
-			var functionMessages []llm.Message
-
 			// Display response messages
 			for _, msg := range response.Messages {
 				switch msg.Role {
@@ -231,15 +232,13 @@ func RunDemoLoopWithConfig(client *Swarm, agent *Agent, config *DemoLoopConfig)
 
 						printColoredText(config.ColorOutput, fmt.Sprintf("%s: ", name), "blue")
 						fmt.Println(msg.Content)
-						lastAssistantMessage = msg
 					}
-				case llm.RoleFunction:
+				case llm.RoleTool, llm.RoleFunction:
 					if config.ShowFunctionResults {
 						printColoredText(config.ColorOutput,
 							fmt.Sprintf("%s function result: ", msg.Name), "magenta")
 						fmt.Println(msg.Content)
 					}
-					functionMessages = append(functionMessages, msg)
 				}
 			}
 
@@ -256,11 +255,8 @@ func RunDemoLoopWithConfig(client *Swarm, agent *Agent, config *DemoLoopConfig)
 				}
 			}
 
-			// Add function results to history first, then the assistant message
-			messages = append(messages, functionMessages...)
-			if lastAssistantMessage.Content != "" {
-				messages = append(messages, lastAssistantMessage)
-			}
+			// Keep the whole turn in history so tool calls stay paired with their results
+			messages = append(messages, response.Messages...)
 
 			// Handle agent transfer
 			if response.Agent != nil && response.Agent.Name != activeAgent.Name {
@@ -2,7 +2,6 @@ package agentkit
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
@@ -103,24 +102,17 @@ func (dwc *DynamicWorkflowCreator) CreateWorkflowFromTask(ctx context.Context, u
 		{Role: llm.RoleUser, Content: fmt.Sprintf("Analyze the following task and design an optimal workflow: %s", userTask)},
 	}
 
-	response, err := dwc.swarm.Run(ctx, dwc.taskAnalyzer, messages, nil, dwc.plannerModel, false, false, 1, false)
+	spec, _, err := RunStructured[WorkflowSpec](ctx, dwc.swarm, dwc.taskAnalyzer, messages, nil, dwc.plannerModel, 0)
 	if err != nil {
 		return nil, fmt.Errorf("error analyzing task: %w", err)
 	}
 
-	// Extract and parse the JSON specification
-	assistantMsg := response.Messages[len(response.Messages)-1].Content
-	spec, err := extractJSONSpec(assistantMsg)
-	if err != nil {
-		return nil, fmt.Errorf("error extracting workflow specification: %w", err)
-	}
-
 	// Validate the workflow specification
-	if err := validateWorkflowSpec(spec); err != nil {
+	if err := validateWorkflowSpec(&spec); err != nil {
 		return nil, fmt.Errorf("invalid workflow specification: %w", err)
 	}
 
-	return spec, nil
+	return &spec, nil
 }
 
 // BuildWorkflow creates a concrete Workflow instance from a WorkflowSpec
@@ -205,28 +197,6 @@ func (dwc *DynamicWorkflowCreator) CreateAndExecuteWorkflow(ctx context.Context,
 	return result, nil
 }
 
-// Helper function to extract JSON from text
-func extractJSONSpec(text string) (*WorkflowSpec, error) {
-	var spec WorkflowSpec
-
-	// Find JSON content between braces
-	startIdx := strings.Index(text, "{")
-	endIdx := strings.LastIndex(text, "}")
-
-	if startIdx == -1 || endIdx == -1 || endIdx <= startIdx {
-		return nil, errors.New("could not find valid JSON in the response")
-	}
-
-	jsonContent := text[startIdx : endIdx+1]
-
-	// Unmarshal JSON
-	if err := json.Unmarshal([]byte(jsonContent), &spec); err != nil {
-		return nil, fmt.Errorf("error parsing JSON specification: %w", err)
-	}
-
-	return &spec, nil
-}
-
 // Helper function to validate a workflow specification
 func validateWorkflowSpec(spec *WorkflowSpec) error {
 	if spec.MainGoal == "" {
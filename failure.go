@@ -0,0 +1,288 @@
+package agentkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/rsaranusc/agentkit/llm"
+)
+
+// ErrAborted is returned when a failure handler aborts; it wraps the error
+// that caused the failure
+var ErrAborted = errors.New("aborted by failure handler")
+
+// errSkipped tells the caller that a failure handler skipped the failed step
+var errSkipped = errors.New("skipped by failure handler")
+
+// maxFailureAttempts bounds the retries failure handlers can ask for on a
+// single call, so a handler that always retries cannot loop forever
+const maxFailureAttempts = 10
+
+// FailurePhase tells where a failure happened
+type FailurePhase string
+
+const (
+	FailureLLMCall      FailurePhase = "llm_call"      // A chat completion failed after its retries
+	FailureStream       FailurePhase = "stream"        // Opening or reading a stream failed
+	FailureTool         FailurePhase = "tool"          // A tool function returned an error
+	FailureWorkflowStep FailurePhase = "workflow_step" // An agent failed during a workflow step; seen by the workflow's handlers only
+)
+
+// Failure describes a failure passed to the failure handlers
+type Failure struct {
+	Phase   FailurePhase
+	Agent   *Agent
+	Model   string
+	Tool    string // Name of the failed tool, for FailureTool
+	Attempt int    // 1 on the first failure, increased by each retry a handler asks for
+	Err     error  // The error as returned by the provider or tool; use errors.Is and errors.As on it
+
+	// Request is the failed request, for FailureLLMCall and FailureStream. It
+	// must not be modified; retry with a changed copy through RetryWithRequest.
+	Request *llm.ChatCompletionRequest
+}
+
+// FailureAction is what a failure handler decides to do about a failure
+type FailureAction int
+
+const (
+	FailureDefault        FailureAction = iota // Leave the failure to the next handler, then to the usual behaviour
+	FailureRetry                               // Try the call again
+	FailureRetryWithModel                      // Try the call again with another model
+	FailureSubstitute                          // Use a canned response instead
+	FailureSkip                                // Give up on the step and carry on
+	FailureAbort                               // Stop with an error
+)
+
+// FailureDecision is the answer of a failure handler
+type FailureDecision struct {
+	Action  FailureAction
+	Model   string                     // Model to retry with, for FailureRetryWithModel
+	Request *llm.ChatCompletionRequest // Request to retry with instead of the failed one, for FailureRetry
+	Content string                     // Canned response or tool result, for FailureSubstitute
+	Err     error                      // Error to stop with, for FailureAbort; nil keeps the failure's error
+}
+
+// FailureHandler decides what to do about a failure. Handlers run in order and
+// the first decision other than FailureDefault is applied.
+type FailureHandler func(f Failure) FailureDecision
+
+// Retry asks for the failed call to be tried again
+func Retry() FailureDecision {
+	return FailureDecision{Action: FailureRetry}
+}
+
+// RetryWithModel asks for the failed call to be tried again with model. An
+// empty model retries with the same model. Tools do not use a model, so a
+// tool failure is left to the next handler instead.
+func RetryWithModel(model string) FailureDecision {
+	return FailureDecision{Action: FailureRetryWithModel, Model: model}
+}
+
+// RetryWithRequest asks for a failed LLM call to be tried again with req
+func RetryWithRequest(req llm.ChatCompletionRequest) FailureDecision {
+	return FailureDecision{Action: FailureRetry, Request: &req}
+}
+
+// Substitute answers the failed call with content: an assistant message for
+// LLM calls, streams and workflow steps, the result of a tool call
+func Substitute(content string) FailureDecision {
+	return FailureDecision{Action: FailureSubstitute, Content: content}
+}
+
+// Skip gives up on the failed step. A run ends with the turns completed so far,
+// a stream completes with what it received, a tool call is reported to the
+// model as skipped and a workflow moves on without the step's output.
+func Skip() FailureDecision {
+	return FailureDecision{Action: FailureSkip}
+}
+
+// Abort stops with err, or with the failure's error when err is nil
+func Abort(err error) FailureDecision {
+	return FailureDecision{Action: FailureAbort, Err: err}
+}
+
+// handleFailure asks the configured failure handlers what to do about f
+func (s *Swarm) handleFailure(f Failure) FailureDecision {
+	if s.config == nil {
+		return FailureDecision{}
+	}
+	return decideFailure(s.config.FailureHandlers, f)
+}
+
+// decideFailure returns the decision of the first of handlers deciding about f
+func decideFailure(handlers []FailureHandler, f Failure) FailureDecision {
+	if f.Attempt > maxFailureAttempts {
+		return FailureDecision{}
+	}
+	for _, handler := range handlers {
+		decision := handler(f)
+		switch {
+		case decision.Action == FailureRetryWithModel && f.Phase == FailureTool:
+			continue
+		case decision.Action == FailureRetryWithModel && decision.Model == "":
+			decision.Action = FailureRetry
+		}
+		if decision.Action != FailureDefault {
+			return decision
+		}
+	}
+	return FailureDecision{}
+}
+
+// abortError returns the error a FailureAbort decision stops with
+func (d FailureDecision) abortError(err error) error {
+	if d.Err != nil {
+		err = d.Err
+	}
+	return fmt.Errorf("%w: %w", ErrAborted, err)
+}
+
+// substituteMessage returns the assistant message of a FailureSubstitute decision
+func (d FailureDecision) substituteMessage(agent *Agent) llm.Message {
+	msg := llm.Message{Role: llm.RoleAssistant, Content: d.Content}
+	if agent != nil {
+		msg.Name = agent.Name
+	}
+	return msg
+}
+
+// withFailureHandlers makes an LLM call through call, consulting the failure
+// handlers when it fails. Retries may change the request; a substitute is
+// built by substitute. A skipped call returns errSkipped.
+func withFailureHandlers[T any](
+	ctx context.Context,
+	s *Swarm,
+	phase FailurePhase,
+	agent *Agent,
+	req llm.ChatCompletionRequest,
+	call func(llm.ChatCompletionRequest) (T, error),
+	substitute func(llm.Message) T,
+) (T, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := call(req)
+		if err == nil || ctx.Err() != nil {
+			return result, err
+		}
+
+		decision := s.handleFailure(Failure{
+			Phase:   phase,
+			Agent:   agent,
+			Model:   req.Model,
+			Attempt: attempt,
+			Err:     err,
+			Request: &req,
+		})
+		switch decision.Action {
+		case FailureRetry:
+			if decision.Request != nil {
+				req = *decision.Request
+			}
+		case FailureRetryWithModel:
+			req.Model = decision.Model
+		case FailureSubstitute:
+			return substitute(decision.substituteMessage(agent)), nil
+		case FailureSkip:
+			return result, errSkipped
+		case FailureAbort:
+			return result, decision.abortError(err)
+		default:
+			return result, err
+		}
+	}
+}
+
+// completeWithHandlers requests a chat completion for agent, consulting the
+// failure handlers when it fails after its retries. A response from a retry
+// with another model reports that model.
+func (s *Swarm) completeWithHandlers(ctx context.Context, agent *Agent, client agentClient, req llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error) {
+	return withFailureHandlers(ctx, s, FailureLLMCall, agent, req,
+		func(attempt llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error) {
+			resp, err := s.createChatCompletion(ctx, client, attempt)
+			if err == nil && resp.Model == "" && attempt.Model != req.Model {
+				resp.Model = attempt.Model
+			}
+			return resp, err
+		},
+		func(msg llm.Message) llm.ChatCompletionResponse {
+			return llm.ChatCompletionResponse{Choices: []llm.Choice{{Message: msg, FinishReason: "stop"}}}
+		})
+}
+
+// streamWithHandlers opens a stream for agent, consulting the failure handlers
+// when it cannot be opened. A substitute is streamed as a single chunk.
+func (s *Swarm) streamWithHandlers(ctx context.Context, agent *Agent, client agentClient, req llm.ChatCompletionRequest) (llm.ChatCompletionStream, error) {
+	return withFailureHandlers(ctx, s, FailureStream, agent, req,
+		func(attempt llm.ChatCompletionRequest) (llm.ChatCompletionStream, error) {
+			return s.createChatCompletionStream(ctx, client, attempt)
+		},
+		func(msg llm.Message) llm.ChatCompletionStream {
+			return &messageStream{message: &msg}
+		})
+}
+
+// handleToolFailure consults the failure handlers about a failed tool call.
+// rerun calls the tool again. An aborting handler is reported through the
+// result's error, which then wraps ErrAborted. A skipped call keeps its error,
+// but the model is only told that the tool was skipped.
+func (s *Swarm) handleToolFailure(agent *Agent, name string, result Result, rerun func() Result) Result {
+	for attempt := 1; result.Error != nil; attempt++ {
+		decision := s.handleFailure(Failure{
+			Phase:   FailureTool,
+			Agent:   agent,
+			Model:   agent.Model,
+			Tool:    name,
+			Attempt: attempt,
+			Err:     result.Error,
+		})
+		switch decision.Action {
+		case FailureRetry:
+			result = rerun()
+		case FailureSubstitute:
+			return Result{Success: true, Data: decision.Content}
+		case FailureSkip:
+			return Result{
+				Success: false,
+				Data:    fmt.Sprintf("Tool %s was skipped.", name),
+				Error:   fmt.Errorf("%w: %w", errSkipped, result.Error),
+			}
+		case FailureAbort:
+			return Result{Success: false, Error: decision.abortError(result.Error)}
+		default:
+			return result
+		}
+	}
+	return result
+}
+
+// abortedToolCall returns the error of the first tool result a failure
+// handler aborted on, if any
+func abortedToolCall(results []ToolResult) error {
+	for _, r := range results {
+		if errors.Is(r.Result.Error, ErrAborted) {
+			return r.Result.Error
+		}
+	}
+	return nil
+}
+
+// messageStream streams a single message as one chunk
+type messageStream struct {
+	message *llm.Message
+}
+
+func (s *messageStream) Recv() (llm.ChatCompletionResponse, error) {
+	if s.message == nil {
+		return llm.ChatCompletionResponse{}, io.EOF
+	}
+	msg := *s.message
+	s.message = nil
+	return llm.ChatCompletionResponse{Choices: []llm.Choice{{Message: msg, FinishReason: "stop"}}}, nil
+}
+
+func (s *messageStream) Close() error {
+	s.message = nil
+	return nil
+}
@@ -0,0 +1,180 @@
+package agentkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rsaranusc/agentkit/llm"
+)
+
+// ErrVetoed is returned when a hook vetoes an LLM request or tool call; it wraps
+// the hook's error
+var ErrVetoed = errors.New("vetoed by hook")
+
+// Hooks observes the lifecycle of runs, streamed or not, and of the workflows
+// and graphs making them. Hooks may be called from several goroutines at once,
+// for parallel tool calls and concurrent runs. Embed DefaultHooks to implement
+// only some events.
+type Hooks interface {
+	// OnRunStart is called when a run starts with agent and messages
+	OnRunStart(ctx context.Context, agent *Agent, messages []llm.Message)
+
+	// OnLLMRequest is called with the final request of each turn. It may modify
+	// req; an error vetoes the request and ends the run with ErrVetoed.
+	OnLLMRequest(ctx context.Context, agent *Agent, req *llm.ChatCompletionRequest) error
+
+	// OnLLMResponse is called with the response to each request
+	OnLLMResponse(ctx context.Context, agent *Agent, resp llm.ChatCompletionResponse)
+
+	// OnToolStart is called before a tool call runs. It may modify call; an error
+	// vetoes the call, which is reported to the model as failed with ErrVetoed.
+	OnToolStart(ctx context.Context, agent *Agent, call *llm.ToolCall) error
+
+	// OnToolEnd is called with the result of each tool call, vetoed ones included
+	OnToolEnd(ctx context.Context, agent *Agent, call llm.ToolCall, result Result)
+
+	// OnHandoff is called when a tool hands the run over to another agent
+	OnHandoff(ctx context.Context, from, to *Agent)
+
+	// OnContextVariablesChanged is called after tool calls changed the context
+	// variables, with their new values
+	OnContextVariablesChanged(ctx context.Context, agent *Agent, contextVariables map[string]interface{})
+
+	// OnError is called when a run fails, just before OnRunEnd
+	OnError(ctx context.Context, agent *Agent, err error)
+
+	// OnRunEnd is called when a run ends, with its response and error
+	OnRunEnd(ctx context.Context, agent *Agent, response Response, err error)
+
+	// OnWorkflowEvent is called on workflow transitions and graph events
+	OnWorkflowEvent(ctx context.Context, event WorkflowEvent)
+}
+
+// WorkflowEvent is a step of a workflow or graph execution
+type WorkflowEvent struct {
+	Name   string     // "transition" for workflows; for graphs, an event of Graph.AddEventHook
+	Graph  string     // Name of the graph; empty for workflows
+	Node   NodeID     // Node visited; empty for graph_start
+	From   string     // Agent a workflow transition leaves, or "start"
+	To     string     // Agent a workflow transition enters, or "end"
+	Reason string     // Why a workflow transitioned
+	State  GraphState // State of the graph at the event
+}
+
+// DefaultHooks provides a Hooks implementation that ignores every event
+type DefaultHooks struct{}
+
+func (h *DefaultHooks) OnRunStart(context.Context, *Agent, []llm.Message) {}
+func (h *DefaultHooks) OnLLMRequest(context.Context, *Agent, *llm.ChatCompletionRequest) error {
+	return nil
+}
+func (h *DefaultHooks) OnLLMResponse(context.Context, *Agent, llm.ChatCompletionResponse) {}
+func (h *DefaultHooks) OnToolStart(context.Context, *Agent, *llm.ToolCall) error          { return nil }
+func (h *DefaultHooks) OnToolEnd(context.Context, *Agent, llm.ToolCall, Result)           {}
+func (h *DefaultHooks) OnHandoff(context.Context, *Agent, *Agent)                         {}
+func (h *DefaultHooks) OnContextVariablesChanged(context.Context, *Agent, map[string]interface{}) {
+}
+func (h *DefaultHooks) OnError(context.Context, *Agent, error)            {}
+func (h *DefaultHooks) OnRunEnd(context.Context, *Agent, Response, error) {}
+func (h *DefaultHooks) OnWorkflowEvent(context.Context, WorkflowEvent)    {}
+
+// hooksKey is the context key of the hooks added with WithHooks
+type hooksKey struct{}
+
+// WithHooks returns a context whose runs, workflows and graphs call hooks, after
+// those already in ctx. Runs nested under ctx, such as those made by tools and
+// graph nodes, call them too.
+func WithHooks(ctx context.Context, hooks ...Hooks) context.Context {
+	if len(hooks) == 0 {
+		return ctx
+	}
+	existing := hooksFrom(ctx)
+	combined := make(hookList, 0, len(existing)+len(hooks))
+	combined = append(append(combined, existing...), hooks...)
+	return context.WithValue(ctx, hooksKey{}, combined)
+}
+
+// hooksFrom returns the hooks added to ctx with WithHooks
+func hooksFrom(ctx context.Context) hookList {
+	hooks, _ := ctx.Value(hooksKey{}).(hookList)
+	return hooks
+}
+
+// hooks returns the hooks of the Swarm's Config followed by those of ctx
+func (s *Swarm) hooks(ctx context.Context) hookList {
+	var hooks hookList
+	if s.config != nil {
+		hooks = append(hooks, s.config.Hooks...)
+	}
+	return append(hooks, hooksFrom(ctx)...)
+}
+
+// hookList calls each of its hooks in order
+type hookList []Hooks
+
+func (l hookList) runStart(ctx context.Context, agent *Agent, messages []llm.Message) {
+	for _, h := range l {
+		h.OnRunStart(ctx, agent, messages)
+	}
+}
+
+// llmRequest lets the hooks modify req, stopping at the first veto
+func (l hookList) llmRequest(ctx context.Context, agent *Agent, req *llm.ChatCompletionRequest) error {
+	for _, h := range l {
+		if err := h.OnLLMRequest(ctx, agent, req); err != nil {
+			return fmt.Errorf("%w: %w", ErrVetoed, err)
+		}
+	}
+	return nil
+}
+
+func (l hookList) llmResponse(ctx context.Context, agent *Agent, resp llm.ChatCompletionResponse) {
+	for _, h := range l {
+		h.OnLLMResponse(ctx, agent, resp)
+	}
+}
+
+// toolStart lets the hooks modify call, stopping at the first veto
+func (l hookList) toolStart(ctx context.Context, agent *Agent, call *llm.ToolCall) error {
+	for _, h := range l {
+		if err := h.OnToolStart(ctx, agent, call); err != nil {
+			return fmt.Errorf("%w: %w", ErrVetoed, err)
+		}
+	}
+	return nil
+}
+
+func (l hookList) toolEnd(ctx context.Context, agent *Agent, call llm.ToolCall, result Result) {
+	for _, h := range l {
+		h.OnToolEnd(ctx, agent, call, result)
+	}
+}
+
+func (l hookList) handoff(ctx context.Context, from, to *Agent) {
+	for _, h := range l {
+		h.OnHandoff(ctx, from, to)
+	}
+}
+
+func (l hookList) contextVariablesChanged(ctx context.Context, agent *Agent, contextVariables map[string]interface{}) {
+	for _, h := range l {
+		h.OnContextVariablesChanged(ctx, agent, contextVariables)
+	}
+}
+
+// runEnd reports the end of a run, and its error if any
+func (l hookList) runEnd(ctx context.Context, agent *Agent, response Response, err error) {
+	for _, h := range l {
+		if err != nil {
+			h.OnError(ctx, agent, err)
+		}
+		h.OnRunEnd(ctx, agent, response, err)
+	}
+}
+
+func (l hookList) workflowEvent(ctx context.Context, event WorkflowEvent) {
+	for _, h := range l {
+		h.OnWorkflowEvent(ctx, event)
+	}
+}
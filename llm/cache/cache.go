@@ -0,0 +1,229 @@
+// Package cache stores LLM responses so identical requests are answered
+// without calling the provider again. It plugs in front of any llm.LLM as a
+// middleware and keeps its entries in a Store: memory, a directory of JSON
+// files or a SQLite database.
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rsaranusc/agentkit/llm"
+)
+
+// Entry is a cached response. Completions keep the response; streams keep
+// every chunk in the order it was received.
+type Entry struct {
+	Response  llm.ChatCompletionResponse   `json:"response"`
+	Chunks    []llm.ChatCompletionResponse `json:"chunks,omitempty"`
+	CreatedAt time.Time                    `json:"created_at"`
+	ExpiresAt time.Time                    `json:"expires_at,omitempty"` // Zero means the entry never expires
+}
+
+// Expired reports whether the entry has expired at now
+func (e *Entry) Expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
+}
+
+// Store keeps cache entries by key. Get returns a nil entry for keys it does
+// not hold; expired entries may be returned and are discarded by the caller.
+type Store interface {
+	Get(ctx context.Context, key string) (*Entry, error)
+	Set(ctx context.Context, key string, entry *Entry) error
+	Delete(ctx context.Context, key string) error
+}
+
+// Options configures the cache middleware
+type Options struct {
+	TTL     time.Duration // How long entries stay valid; 0 keeps them forever
+	OnError func(error)   // Called when the store fails or a request has no key; the call then goes to the provider
+}
+
+// bypassKey is the context key set by Bypass
+type bypassKey struct{}
+
+// Bypass returns a context whose requests skip the cache: they are sent to the
+// provider and their responses are not stored
+func Bypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassKey{}, true)
+}
+
+// bypassed reports whether ctx was returned by Bypass
+func bypassed(ctx context.Context) bool {
+	skip, _ := ctx.Value(bypassKey{}).(bool)
+	return skip
+}
+
+// Key returns the cache key of a request: a hash of its model, messages,
+// tools, sampling parameters and response format. Streaming and regular
+// requests for the same conversation have different keys. It fails for
+// requests that cannot be encoded, such as tools with non-JSON parameters.
+func Key(req llm.ChatCompletionRequest) (string, error) {
+	stream := req.Stream
+	req.Stream = false
+
+	// encoding/json sorts map keys, so equal requests encode the same way
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("cache: cannot compute request key: %w", err)
+	}
+	if stream {
+		data = append(data, "\x00stream"...)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Middleware returns a middleware that answers repeated requests from store.
+// Responses served from the cache report no token usage, since no tokens were
+// spent. Cached streams are replayed chunk by chunk; a stream is stored only
+// once it has been read to the end.
+func Middleware(store Store, opts Options) llm.Middleware {
+	c := &cache{store: store, opts: opts}
+	return func(next llm.LLM) llm.LLM {
+		return llm.LLMFuncs{
+			Completion: func(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error) {
+				if bypassed(ctx) {
+					return next.CreateChatCompletion(ctx, req)
+				}
+
+				req.Stream = false
+				key, err := Key(req)
+				if err != nil {
+					c.fail(err)
+					return next.CreateChatCompletion(ctx, req)
+				}
+				if entry := c.lookup(ctx, key); entry != nil {
+					return withoutUsage(entry.Response), nil
+				}
+
+				resp, err := next.CreateChatCompletion(ctx, req)
+				if err == nil && len(resp.Choices) > 0 {
+					c.save(ctx, key, &Entry{Response: resp})
+				}
+				return resp, err
+			},
+			Stream: func(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionStream, error) {
+				if bypassed(ctx) {
+					return next.CreateChatCompletionStream(ctx, req)
+				}
+
+				req.Stream = true
+				key, err := Key(req)
+				if err != nil {
+					c.fail(err)
+					return next.CreateChatCompletionStream(ctx, req)
+				}
+				if entry := c.lookup(ctx, key); entry != nil {
+					return &replayStream{chunks: entry.Chunks}, nil
+				}
+
+				stream, err := next.CreateChatCompletionStream(ctx, req)
+				if err != nil {
+					return nil, err
+				}
+				return &recordingStream{stream: stream, save: func(chunks []llm.ChatCompletionResponse) {
+					c.save(context.WithoutCancel(ctx), key, &Entry{Chunks: chunks})
+				}}, nil
+			},
+		}
+	}
+}
+
+// cache holds the state shared by the two halves of the middleware
+type cache struct {
+	store Store
+	opts  Options
+}
+
+// lookup returns the live entry for key, dropping it if it has expired
+func (c *cache) lookup(ctx context.Context, key string) *Entry {
+	entry, err := c.store.Get(ctx, key)
+	if err != nil {
+		c.fail(err)
+		return nil
+	}
+	if entry == nil {
+		return nil
+	}
+	if entry.Expired(time.Now()) {
+		if err := c.store.Delete(ctx, key); err != nil {
+			c.fail(err)
+		}
+		return nil
+	}
+	return entry
+}
+
+// save stores entry under key with the configured TTL
+func (c *cache) save(ctx context.Context, key string, entry *Entry) {
+	entry.CreatedAt = time.Now()
+	if c.opts.TTL > 0 {
+		entry.ExpiresAt = entry.CreatedAt.Add(c.opts.TTL)
+	}
+	if err := c.store.Set(ctx, key, entry); err != nil {
+		c.fail(err)
+	}
+}
+
+// fail reports a store error
+func (c *cache) fail(err error) {
+	if c.opts.OnError != nil {
+		c.opts.OnError(err)
+	}
+}
+
+// withoutUsage clears the usage of a response served from the cache
+func withoutUsage(resp llm.ChatCompletionResponse) llm.ChatCompletionResponse {
+	resp.Usage = llm.Usage{}
+	return resp
+}
+
+// replayStream streams cached chunks
+type replayStream struct {
+	chunks []llm.ChatCompletionResponse
+}
+
+func (s *replayStream) Recv() (llm.ChatCompletionResponse, error) {
+	if len(s.chunks) == 0 {
+		return llm.ChatCompletionResponse{}, io.EOF
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return withoutUsage(chunk), nil
+}
+
+func (s *replayStream) Close() error {
+	s.chunks = nil
+	return nil
+}
+
+// recordingStream collects the chunks of a live stream and saves them when
+// the stream ends normally
+type recordingStream struct {
+	stream llm.ChatCompletionStream
+	chunks []llm.ChatCompletionResponse
+	save   func([]llm.ChatCompletionResponse)
+	done   bool
+}
+
+func (s *recordingStream) Recv() (llm.ChatCompletionResponse, error) {
+	resp, err := s.stream.Recv()
+	if err == io.EOF && !s.done {
+		s.done = true
+		s.save(s.chunks)
+	}
+	if err == nil {
+		s.chunks = append(s.chunks, resp)
+	}
+	return resp, err
+}
+
+func (s *recordingStream) Close() error {
+	return s.stream.Close()
+}
@@ -0,0 +1,247 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rsaranusc/agentkit/llm"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingLLM answers every call and counts the calls that reach it
+type countingLLM struct {
+	calls int
+}
+
+func (c *countingLLM) CreateChatCompletion(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error) {
+	c.calls++
+	return llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{Message: llm.Message{Role: llm.RoleAssistant, Content: "hello"}}},
+		Usage:   llm.Usage{PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12},
+	}, nil
+}
+
+func (c *countingLLM) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionStream, error) {
+	c.calls++
+	return &replayStream{chunks: []llm.ChatCompletionResponse{
+		{Choices: []llm.Choice{{Message: llm.Message{Content: "Hel"}}}},
+		{Choices: []llm.Choice{{Message: llm.Message{Content: "lo"}}}},
+	}}, nil
+}
+
+func request(content string) llm.ChatCompletionRequest {
+	return llm.ChatCompletionRequest{
+		Model:    "gpt-4o",
+		Messages: []llm.Message{{Role: llm.RoleUser, Content: content}},
+	}
+}
+
+// readAll returns the content of every chunk of stream
+func readAll(t *testing.T, stream llm.ChatCompletionStream) string {
+	var content string
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return content
+		}
+		assert.NoError(t, err)
+		content += chunk.Choices[0].Message.Content
+	}
+}
+
+// TestKey tests that keys depend on the request contents
+func TestKey(t *testing.T) {
+	key := func(req llm.ChatCompletionRequest) string {
+		k, err := Key(req)
+		assert.NoError(t, err)
+		return k
+	}
+	base := key(request("hi"))
+	assert.Equal(t, base, key(request("hi")))
+	assert.NotEqual(t, base, key(request("bye")))
+
+	sampled := request("hi")
+	sampled.Temperature = 0.5
+	assert.NotEqual(t, base, key(sampled))
+
+	stream := request("hi")
+	stream.Stream = true
+	assert.NotEqual(t, base, key(stream))
+}
+
+// TestMiddlewareSkipsUnencodableRequests tests that requests without a key bypass the cache
+func TestMiddlewareSkipsUnencodableRequests(t *testing.T) {
+	ctx := context.Background()
+	req := request("hi")
+	req.Tools = []llm.Tool{{Type: "function", Function: &llm.Function{
+		Name:       "lookup",
+		Parameters: map[string]interface{}{"default": func() {}},
+	}}}
+	_, err := Key(req)
+	assert.Error(t, err)
+
+	provider := &countingLLM{}
+	store := NewMemoryStore(10)
+	var failures []error
+	client := llm.Chain(provider, Middleware(store, Options{OnError: func(err error) { failures = append(failures, err) }}))
+	for i := 0; i < 2; i++ {
+		_, err := client.CreateChatCompletion(ctx, req)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, provider.calls)
+	assert.Len(t, failures, 2)
+	assert.Empty(t, store.items)
+}
+
+// TestStores tests the store backends
+func TestStores(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	fileStore, err := NewFileStore(filepath.Join(dir, "files"))
+	assert.NoError(t, err)
+	sqliteStore, err := NewSQLiteStore(filepath.Join(dir, "cache.db"))
+	assert.NoError(t, err)
+	defer sqliteStore.Close()
+
+	stores := map[string]Store{
+		"memory": NewMemoryStore(10),
+		"file":   fileStore,
+		"sqlite": sqliteStore,
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			entry, err := store.Get(ctx, "missing")
+			assert.NoError(t, err)
+			assert.Nil(t, entry)
+
+			want := &Entry{
+				Response:  llm.ChatCompletionResponse{ID: "resp"},
+				Chunks:    []llm.ChatCompletionResponse{{ID: "chunk"}},
+				CreatedAt: time.Now().Round(0),
+			}
+			assert.NoError(t, store.Set(ctx, "key", want))
+
+			entry, err = store.Get(ctx, "key")
+			assert.NoError(t, err)
+			if assert.NotNil(t, entry) {
+				assert.Equal(t, "resp", entry.Response.ID)
+				assert.Equal(t, "chunk", entry.Chunks[0].ID)
+				assert.True(t, want.CreatedAt.Equal(entry.CreatedAt))
+			}
+
+			assert.NoError(t, store.Delete(ctx, "key"))
+			entry, err = store.Get(ctx, "key")
+			assert.NoError(t, err)
+			assert.Nil(t, entry)
+		})
+	}
+}
+
+// TestMemoryStoreEvictsLeastRecentlyUsed tests the LRU capacity
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(2)
+	store.Set(ctx, "a", &Entry{})
+	store.Set(ctx, "b", &Entry{})
+	store.Get(ctx, "a")
+	store.Set(ctx, "c", &Entry{})
+
+	assert.Equal(t, 2, store.Len())
+	entry, _ := store.Get(ctx, "b")
+	assert.Nil(t, entry)
+	entry, _ = store.Get(ctx, "a")
+	assert.NotNil(t, entry)
+}
+
+// TestMiddleware tests hits, misses, bypass and expiry
+func TestMiddleware(t *testing.T) {
+	ctx := context.Background()
+	next := &countingLLM{}
+	client := llm.Chain(next, Middleware(NewMemoryStore(0), Options{TTL: 50 * time.Millisecond}))
+
+	resp, err := client.CreateChatCompletion(ctx, request("hi"))
+	assert.NoError(t, err)
+	assert.Equal(t, 12, resp.Usage.TotalTokens)
+
+	resp, err = client.CreateChatCompletion(ctx, request("hi"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", resp.Choices[0].Message.Content)
+	assert.Zero(t, resp.Usage.TotalTokens, "cached responses spend no tokens")
+	assert.Equal(t, 1, next.calls)
+
+	_, err = client.CreateChatCompletion(ctx, request("bye"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, next.calls)
+
+	_, err = client.CreateChatCompletion(Bypass(ctx), request("hi"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, next.calls)
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = client.CreateChatCompletion(ctx, request("hi"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, next.calls, "expired entries are refreshed")
+}
+
+// TestMiddlewareStream tests that finished streams are replayed from the cache
+func TestMiddlewareStream(t *testing.T) {
+	ctx := context.Background()
+	next := &countingLLM{}
+	client := llm.Chain(next, Middleware(NewMemoryStore(0), Options{}))
+
+	// A stream closed early is not cached
+	stream, err := client.CreateChatCompletionStream(ctx, request("hi"))
+	assert.NoError(t, err)
+	stream.Recv()
+	stream.Close()
+
+	stream, err = client.CreateChatCompletionStream(ctx, request("hi"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", readAll(t, stream))
+	assert.Equal(t, 2, next.calls)
+
+	stream, err = client.CreateChatCompletionStream(ctx, request("hi"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", readAll(t, stream))
+	assert.Equal(t, 2, next.calls)
+
+	// Streams and completions are cached separately
+	_, err = client.CreateChatCompletion(ctx, request("hi"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, next.calls)
+}
+
+// failingStore fails every operation
+type failingStore struct{}
+
+func (failingStore) Get(ctx context.Context, key string) (*Entry, error) {
+	return nil, errors.New("store down")
+}
+
+func (failingStore) Set(ctx context.Context, key string, entry *Entry) error {
+	return errors.New("store down")
+}
+
+func (failingStore) Delete(ctx context.Context, key string) error {
+	return errors.New("store down")
+}
+
+// TestMiddlewareStoreErrors tests that store failures fall through to the provider
+func TestMiddlewareStoreErrors(t *testing.T) {
+	var errs []error
+	next := &countingLLM{}
+	client := llm.Chain(next, Middleware(failingStore{}, Options{OnError: func(err error) {
+		errs = append(errs, err)
+	}}))
+
+	resp, err := client.CreateChatCompletion(context.Background(), request("hi"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", resp.Choices[0].Message.Content)
+	assert.Equal(t, 1, next.calls)
+	assert.Len(t, errs, 2)
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// MemoryStore keeps entries in memory, evicting the least recently used entry
+// once it holds capacity entries
+type MemoryStore struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // Most recently used first
+	items    map[string]*list.Element
+}
+
+// memoryItem is an element of MemoryStore.order
+type memoryItem struct {
+	key   string
+	entry *Entry
+}
+
+// NewMemoryStore returns an in-memory LRU store. A capacity of 0 or less means
+// no limit.
+func NewMemoryStore(capacity int) *MemoryStore {
+	return &MemoryStore{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the entry stored under key and marks it as recently used
+func (m *MemoryStore) Get(ctx context.Context, key string) (*Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elem, ok := m.items[key]
+	if !ok {
+		return nil, nil
+	}
+	m.order.MoveToFront(elem)
+	return elem.Value.(*memoryItem).entry, nil
+}
+
+// Set stores entry under key, evicting the least recently used entry if full
+func (m *MemoryStore) Set(ctx context.Context, key string, entry *Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elem, ok := m.items[key]; ok {
+		elem.Value.(*memoryItem).entry = entry
+		m.order.MoveToFront(elem)
+		return nil
+	}
+
+	m.items[key] = m.order.PushFront(&memoryItem{key: key, entry: entry})
+	if m.capacity > 0 && m.order.Len() > m.capacity {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.items, oldest.Value.(*memoryItem).key)
+	}
+	return nil
+}
+
+// Delete removes the entry stored under key
+func (m *MemoryStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elem, ok := m.items[key]; ok {
+		m.order.Remove(elem)
+		delete(m.items, key)
+	}
+	return nil
+}
+
+// Len returns the number of entries stored
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
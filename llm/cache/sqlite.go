@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStore keeps entries in a SQLite database
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore opens or creates the SQLite database at path and prepares its
+// cache table. Close releases the database.
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache database: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS llm_cache (
+		key TEXT PRIMARY KEY,
+		value BLOB NOT NULL,
+		expires_at INTEGER NOT NULL DEFAULT 0
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create cache table: %w", err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// Get reads the entry stored under key
+func (s *SQLiteStore) Get(ctx context.Context, key string) (*Entry, error) {
+	var data []byte
+	err := s.db.QueryRowContext(ctx, `SELECT value FROM llm_cache WHERE key = ?`, key).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache entry: %w", err)
+	}
+
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("failed to decode cache entry %s: %w", key, err)
+	}
+	return &entry, nil
+}
+
+// Set writes entry under key, replacing any previous entry
+func (s *SQLiteStore) Set(ctx context.Context, key string, entry *Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache entry: %w", err)
+	}
+
+	var expiresAt int64
+	if !entry.ExpiresAt.IsZero() {
+		expiresAt = entry.ExpiresAt.Unix()
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT OR REPLACE INTO llm_cache (key, value, expires_at) VALUES (?, ?, ?)`,
+		key, data, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the entry stored under key
+func (s *SQLiteStore) Delete(ctx context.Context, key string) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM llm_cache WHERE key = ?`, key); err != nil {
+		return fmt.Errorf("failed to delete cache entry: %w", err)
+	}
+	return nil
+}
+
+// Prune removes every entry that has expired
+func (s *SQLiteStore) Prune(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx,
+		`DELETE FROM llm_cache WHERE expires_at > 0 AND expires_at <= ?`, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to prune cache: %w", err)
+	}
+	return nil
+}
+
+// Close closes the database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
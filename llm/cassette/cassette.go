@@ -0,0 +1,114 @@
+// Package cassette records LLM calls to a fixture file and replays them
+// offline, so agent behavior can be tested deterministically without a
+// provider. Record once against a real client with a Recorder, save the
+// cassette, then serve it with a Replayer in tests.
+package cassette
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rsaranusc/agentkit/llm"
+)
+
+// Interaction is one recorded call: the request and either its response, the
+// chunks of its stream or the error it failed with
+type Interaction struct {
+	Request       llm.ChatCompletionRequest    `json:"request"`
+	Response      *llm.ChatCompletionResponse  `json:"response,omitempty"`
+	Chunks        []llm.ChatCompletionResponse `json:"chunks,omitempty"`
+	Error         string                       `json:"error,omitempty"`
+	ProviderError *ProviderError               `json:"provider_error,omitempty"` // Set when Error was an *llm.ProviderError
+}
+
+// ProviderError is a recorded *llm.ProviderError. Replayers rebuild it, so the
+// replayed error keeps its kind, status code and Retry-After.
+type ProviderError struct {
+	Provider   llm.LLMProvider `json:"provider"`
+	Kind       string          `json:"kind"` // Text of the llm.Err* kind, such as "rate limited"
+	StatusCode int             `json:"status_code,omitempty"`
+	Message    string          `json:"message,omitempty"`
+	RetryAfter time.Duration   `json:"retry_after,omitempty"`
+}
+
+// errorKinds are the kinds of llm.ProviderError
+var errorKinds = []error{
+	llm.ErrRateLimited,
+	llm.ErrAuthentication,
+	llm.ErrInvalidRequest,
+	llm.ErrContextTooLong,
+	llm.ErrContentFiltered,
+	llm.ErrServer,
+	llm.ErrTimeout,
+}
+
+// setError records err as the error of the interaction
+func (i *Interaction) setError(err error) {
+	i.Error = err.Error()
+	var providerErr *llm.ProviderError
+	if errors.As(err, &providerErr) && providerErr.Kind != nil {
+		i.ProviderError = &ProviderError{
+			Provider:   providerErr.Provider,
+			Kind:       providerErr.Kind.Error(),
+			StatusCode: providerErr.StatusCode,
+			Message:    providerErr.Message,
+			RetryAfter: providerErr.RetryAfter,
+		}
+	}
+}
+
+// err returns the recorded error: an *llm.ProviderError when one was recorded,
+// otherwise an error with the recorded text. It is nil if the call succeeded.
+func (i *Interaction) err() error {
+	if i.Error == "" {
+		return nil
+	}
+	if p := i.ProviderError; p != nil {
+		for _, kind := range errorKinds {
+			if kind.Error() == p.Kind {
+				return &llm.ProviderError{
+					Provider:   p.Provider,
+					Kind:       kind,
+					StatusCode: p.StatusCode,
+					Message:    p.Message,
+					RetryAfter: p.RetryAfter,
+				}
+			}
+		}
+	}
+	return errors.New(i.Error)
+}
+
+// Cassette is a list of recorded interactions in the order they happened
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Load reads a cassette from a JSON file
+func Load(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cassette: %w", err)
+	}
+
+	var c Cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to decode cassette %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// Save writes the cassette to a JSON file
+func (c *Cassette) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode cassette: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write cassette: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package cassette
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rsaranusc/agentkit/llm"
+	"github.com/stretchr/testify/assert"
+)
+
+// echoLLM replies with the content of the last message, or fails when it is "fail"
+type echoLLM struct{}
+
+func (echoLLM) CreateChatCompletion(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error) {
+	content := req.Messages[len(req.Messages)-1].Content
+	if content == "fail" {
+		return llm.ChatCompletionResponse{}, errors.New("provider down")
+	}
+	return llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{Message: llm.Message{Role: llm.RoleAssistant, Content: "echo: " + content}}},
+	}, nil
+}
+
+func (echoLLM) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionStream, error) {
+	return &replayStream{chunks: []llm.ChatCompletionResponse{
+		{Choices: []llm.Choice{{Message: llm.Message{Content: "Hel"}}}},
+		{Choices: []llm.Choice{{Message: llm.Message{Content: "lo"}}}},
+	}}, nil
+}
+
+func request(content string) llm.ChatCompletionRequest {
+	return llm.ChatCompletionRequest{
+		Model:    "gpt-4o",
+		Messages: []llm.Message{{Role: llm.RoleUser, Content: content}},
+	}
+}
+
+func readAll(t *testing.T, stream llm.ChatCompletionStream) string {
+	var content string
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return content
+		}
+		assert.NoError(t, err)
+		content += chunk.Choices[0].Message.Content
+	}
+}
+
+// record plays a few calls through a Recorder and returns the saved cassette's path
+func record(t *testing.T) string {
+	ctx := context.Background()
+	recorder := NewRecorder(echoLLM{})
+
+	_, err := recorder.CreateChatCompletion(ctx, request("one"))
+	assert.NoError(t, err)
+	_, err = recorder.CreateChatCompletion(ctx, request("fail"))
+	assert.EqualError(t, err, "provider down")
+	stream, err := recorder.CreateChatCompletionStream(ctx, request("stream"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", readAll(t, stream))
+	_, err = recorder.CreateChatCompletion(ctx, request("two"))
+	assert.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	assert.NoError(t, recorder.Save(path))
+	return path
+}
+
+// TestRecordAndReplay tests that a recorded cassette is replayed offline
+func TestRecordAndReplay(t *testing.T) {
+	ctx := context.Background()
+	replayer, err := LoadReplayer(record(t), ReplayOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, replayer.Unused(), 4)
+
+	// Exact matching serves interactions out of order
+	resp, err := replayer.CreateChatCompletion(ctx, request("two"))
+	assert.NoError(t, err)
+	assert.Equal(t, "echo: two", resp.Choices[0].Message.Content)
+
+	stream, err := replayer.CreateChatCompletionStream(ctx, request("stream"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", readAll(t, stream))
+
+	_, err = replayer.CreateChatCompletion(ctx, request("fail"))
+	assert.EqualError(t, err, "provider down")
+
+	// A regular request does not match a recorded stream
+	_, err = replayer.CreateChatCompletion(ctx, request("stream"))
+	assert.ErrorIs(t, err, ErrUnexpectedRequest)
+
+	resp, err = replayer.CreateChatCompletion(ctx, request("one"))
+	assert.NoError(t, err)
+	assert.Equal(t, "echo: one", resp.Choices[0].Message.Content)
+	assert.Empty(t, replayer.Unused())
+
+	// Each interaction is served once
+	_, err = replayer.CreateChatCompletion(ctx, request("one"))
+	assert.ErrorIs(t, err, ErrUnexpectedRequest)
+	assert.Contains(t, err.Error(), `last user: "one"`)
+}
+
+// TestReplayMatching tests the matchers and in-order replay
+func TestReplayMatching(t *testing.T) {
+	ctx := context.Background()
+	cassette, err := Load(record(t))
+	assert.NoError(t, err)
+
+	sampled := request("one")
+	sampled.Temperature = 0.7
+	sampled.MaxTokens = 100
+
+	_, err = NewReplayer(cassette, ReplayOptions{}).CreateChatCompletion(ctx, sampled)
+	assert.ErrorIs(t, err, ErrUnexpectedRequest)
+
+	resp, err := NewReplayer(cassette, ReplayOptions{Match: MatchIgnoreSampling}).CreateChatCompletion(ctx, sampled)
+	assert.NoError(t, err)
+	assert.Equal(t, "echo: one", resp.Choices[0].Message.Content)
+
+	// In order, only the next interaction may answer
+	inOrder := NewReplayer(cassette, ReplayOptions{InOrder: true})
+	_, err = inOrder.CreateChatCompletion(ctx, request("two"))
+	assert.ErrorIs(t, err, ErrUnexpectedRequest)
+	assert.Contains(t, err.Error(), "recorded interaction 1")
+
+	// By sequence alone, any request gets the next interaction
+	sequence := NewReplayer(cassette, ReplayOptions{Match: MatchAny, InOrder: true})
+	resp, err = sequence.CreateChatCompletion(ctx, request("anything"))
+	assert.NoError(t, err)
+	assert.Equal(t, "echo: one", resp.Choices[0].Message.Content)
+	_, err = sequence.CreateChatCompletion(ctx, request("anything"))
+	assert.EqualError(t, err, "provider down")
+}
+
+// TestReplayProviderErrors tests that replayed provider errors keep their kind, status and Retry-After
+func TestReplayProviderErrors(t *testing.T) {
+	ctx := context.Background()
+	rateErr := &llm.ProviderError{Provider: llm.OpenAI, Kind: llm.ErrRateLimited, StatusCode: 429, Message: "slow down", RetryAfter: 2 * time.Second}
+	recorder := NewRecorder(llm.LLMFuncs{
+		Completion: func(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error) {
+			return llm.ChatCompletionResponse{}, rateErr
+		},
+		Stream: func(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionStream, error) {
+			return nil, rateErr
+		},
+	})
+	_, err := recorder.CreateChatCompletion(ctx, request("one"))
+	assert.ErrorIs(t, err, llm.ErrRateLimited)
+	_, err = recorder.CreateChatCompletionStream(ctx, request("two"))
+	assert.ErrorIs(t, err, llm.ErrRateLimited)
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	assert.NoError(t, recorder.Save(path))
+
+	replayer, err := LoadReplayer(path, ReplayOptions{})
+	assert.NoError(t, err)
+	_, completionErr := replayer.CreateChatCompletion(ctx, request("one"))
+	_, streamErr := replayer.CreateChatCompletionStream(ctx, request("two"))
+	for _, err := range []error{completionErr, streamErr} {
+		var providerErr *llm.ProviderError
+		if assert.ErrorAs(t, err, &providerErr) {
+			assert.ErrorIs(t, err, llm.ErrRateLimited)
+			assert.Equal(t, 429, providerErr.StatusCode)
+			assert.Equal(t, 2*time.Second, providerErr.RetryAfter)
+			assert.Equal(t, rateErr.Error(), err.Error())
+			assert.True(t, llm.IsRetryable(err))
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package cassette
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rsaranusc/agentkit/llm"
+)
+
+// Recorder is an LLM that forwards calls to another LLM and records them.
+// Streams are recorded when they end or are closed.
+type Recorder struct {
+	next llm.LLM
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// NewRecorder returns a Recorder that forwards calls to next
+func NewRecorder(next llm.LLM) *Recorder {
+	return &Recorder{next: next}
+}
+
+// CreateChatCompletion forwards the call and records it
+func (r *Recorder) CreateChatCompletion(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error) {
+	req.Stream = false
+	resp, err := r.next.CreateChatCompletion(ctx, req)
+
+	interaction := Interaction{Request: req}
+	if err != nil {
+		interaction.setError(err)
+	} else {
+		interaction.Response = &resp
+	}
+	r.record(interaction)
+	return resp, err
+}
+
+// CreateChatCompletionStream forwards the call and records the stream's chunks
+func (r *Recorder) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionStream, error) {
+	req.Stream = true
+	stream, err := r.next.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		interaction := Interaction{Request: req}
+		interaction.setError(err)
+		r.record(interaction)
+		return nil, err
+	}
+
+	interaction := Interaction{Request: req}
+	return llm.WatchStream(stream, func(chunk llm.ChatCompletionResponse) {
+		interaction.Chunks = append(interaction.Chunks, chunk)
+	}, func(err error) {
+		if err != nil {
+			interaction.setError(err)
+		}
+		r.record(interaction)
+	}), nil
+}
+
+// record appends an interaction to the cassette
+func (r *Recorder) record(interaction Interaction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, interaction)
+}
+
+// Cassette returns a copy of the interactions recorded so far
+func (r *Recorder) Cassette() *Cassette {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &Cassette{Interactions: append([]Interaction(nil), r.cassette.Interactions...)}
+}
+
+// Save writes the interactions recorded so far to path
+func (r *Recorder) Save(path string) error {
+	return r.Cassette().Save(path)
+}
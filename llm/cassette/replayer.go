@@ -0,0 +1,212 @@
+package cassette
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/rsaranusc/agentkit/llm"
+)
+
+// ErrUnexpectedRequest is returned by a Replayer for requests that match no
+// remaining interaction of its cassette
+var ErrUnexpectedRequest = errors.New("cassette: unexpected request")
+
+// Matcher reports whether a recorded request answers an actual one
+type Matcher func(recorded, actual llm.ChatCompletionRequest) bool
+
+// MatchExact matches requests that are identical
+func MatchExact(recorded, actual llm.ChatCompletionRequest) bool {
+	return reflect.DeepEqual(encode(recorded), encode(actual))
+}
+
+// MatchIgnoreSampling matches requests that differ only in their sampling
+// parameters: temperature, top_p, n, stop, max_tokens, penalties and user
+func MatchIgnoreSampling(recorded, actual llm.ChatCompletionRequest) bool {
+	return MatchExact(withoutSampling(recorded), withoutSampling(actual))
+}
+
+// MatchAny matches every request. Use it with ReplayOptions.InOrder to replay
+// a cassette by sequence alone.
+func MatchAny(recorded, actual llm.ChatCompletionRequest) bool {
+	return true
+}
+
+// ReplayOptions configures a Replayer
+type ReplayOptions struct {
+	Match Matcher // How requests are matched; nil means MatchExact
+
+	// InOrder serves interactions strictly in recorded order: each request is
+	// matched against the next unused interaction only
+	InOrder bool
+}
+
+// Replayer is an LLM that answers requests from a cassette. Each recorded
+// interaction is served once; a streaming request only matches a recorded
+// stream and a regular request only matches a recorded completion.
+type Replayer struct {
+	opts ReplayOptions
+
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+	calls        int
+}
+
+// NewReplayer returns a Replayer serving the interactions of c
+func NewReplayer(c *Cassette, opts ReplayOptions) *Replayer {
+	if opts.Match == nil {
+		opts.Match = MatchExact
+	}
+	return &Replayer{
+		opts:         opts,
+		interactions: c.Interactions,
+		used:         make([]bool, len(c.Interactions)),
+	}
+}
+
+// LoadReplayer returns a Replayer serving the cassette stored at path
+func LoadReplayer(path string, opts ReplayOptions) (*Replayer, error) {
+	c, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplayer(c, opts), nil
+}
+
+// CreateChatCompletion returns the recorded response to req
+func (r *Replayer) CreateChatCompletion(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error) {
+	req.Stream = false
+	interaction, err := r.next(req)
+	if err != nil {
+		return llm.ChatCompletionResponse{}, err
+	}
+	if err := interaction.err(); err != nil {
+		return llm.ChatCompletionResponse{}, err
+	}
+	if interaction.Response == nil {
+		return llm.ChatCompletionResponse{}, nil
+	}
+	return *interaction.Response, nil
+}
+
+// CreateChatCompletionStream replays the recorded stream for req
+func (r *Replayer) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionStream, error) {
+	req.Stream = true
+	interaction, err := r.next(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := interaction.err(); err != nil && len(interaction.Chunks) == 0 {
+		return nil, err
+	}
+	return &replayStream{chunks: interaction.Chunks, err: interaction.err()}, nil
+}
+
+// next claims the interaction answering req
+func (r *Replayer) next(req llm.ChatCompletionRequest) (Interaction, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+
+	for i, interaction := range r.interactions {
+		if r.used[i] {
+			continue
+		}
+		if interaction.Request.Stream == req.Stream && r.opts.Match(interaction.Request, req) {
+			r.used[i] = true
+			return interaction, nil
+		}
+		if r.opts.InOrder {
+			return Interaction{}, fmt.Errorf("%w: call %d %s does not match recorded interaction %d %s",
+				ErrUnexpectedRequest, r.calls, describe(req), i+1, describe(interaction.Request))
+		}
+	}
+	return Interaction{}, fmt.Errorf("%w: call %d %s matches no remaining interaction",
+		ErrUnexpectedRequest, r.calls, describe(req))
+}
+
+// Unused returns the interactions that have not been served yet. Tests can
+// check it is empty to make sure the agent made every recorded call.
+func (r *Replayer) Unused() []Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var unused []Interaction
+	for i, interaction := range r.interactions {
+		if !r.used[i] {
+			unused = append(unused, interaction)
+		}
+	}
+	return unused
+}
+
+// replayStream streams recorded chunks, then the recorded error or io.EOF
+type replayStream struct {
+	chunks []llm.ChatCompletionResponse
+	err    error
+}
+
+func (s *replayStream) Recv() (llm.ChatCompletionResponse, error) {
+	if len(s.chunks) == 0 {
+		if s.err != nil {
+			return llm.ChatCompletionResponse{}, s.err
+		}
+		return llm.ChatCompletionResponse{}, io.EOF
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return chunk, nil
+}
+
+func (s *replayStream) Close() error {
+	s.chunks = nil
+	s.err = nil
+	return nil
+}
+
+// encode returns the generic JSON form of req, so requests that only differ
+// in how they were built, such as nil and empty slices, compare equal
+func encode(req llm.ChatCompletionRequest) any {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil
+	}
+	var decoded any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil
+	}
+	return decoded
+}
+
+// withoutSampling clears the sampling parameters of req
+func withoutSampling(req llm.ChatCompletionRequest) llm.ChatCompletionRequest {
+	req.Temperature = 0
+	req.TopP = 0
+	req.N = 0
+	req.Stop = nil
+	req.MaxTokens = 0
+	req.PresencePenalty = 0
+	req.FrequencyPenalty = 0
+	req.User = ""
+	return req
+}
+
+// describe summarizes a request for error messages
+func describe(req llm.ChatCompletionRequest) string {
+	summary := fmt.Sprintf("(model %s, stream %t, %d messages", req.Model, req.Stream, len(req.Messages))
+	if len(req.Messages) > 0 {
+		last := req.Messages[len(req.Messages)-1]
+		content := last.Content
+		if len(content) > 60 {
+			content = content[:60] + "..."
+		}
+		summary += fmt.Sprintf(", last %s: %q", last.Role, strings.TrimSpace(content))
+	}
+	return summary + ")"
+}
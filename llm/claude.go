@@ -3,8 +3,10 @@ package llm
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 
 	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/anthropics/anthropic-sdk-go/option"
@@ -25,62 +27,62 @@ func NewClaudeLLM(apiKey string) *ClaudeLLM {
 	return &ClaudeLLM{client: client}
 }
 
-// convertToClaudeMessages converts our generic Message type to Claude's message format
+// NewClaudeLLMWithOptions creates a Claude LLM client with Anthropic client
+// options, such as option.WithAPIKey, option.WithBaseURL or option.WithHTTPClient
+func NewClaudeLLMWithOptions(opts ...option.RequestOption) *ClaudeLLM {
+	return &ClaudeLLM{client: anthropic.NewClient(opts...)}
+}
+
+// convertToClaudeMessages converts our generic Message type to Claude's message format.
+// An assistant message becomes a single message holding its text and tool_use
+// blocks, and the results answering it are grouped into the following user
+// message as tool_result blocks keyed by their tool call ID.
 func convertToClaudeMessages(messages []Message) []anthropic.MessageParam {
 	var claudeMessages []anthropic.MessageParam
 
-	// First pass: collect tool calls and their results
-	toolCallMap := make(map[string]string) // map[tool_id]result
-	for _, msg := range messages {
-		if msg.Role == RoleFunction {
-			toolCallMap[msg.Name] = msg.Content
+	// appendBlocks adds blocks to the conversation, merging consecutive
+	// messages of the same role since Claude requires alternating roles
+	appendBlocks := func(role anthropic.MessageParamRole, blocks ...anthropic.ContentBlockParamUnion) {
+		if len(blocks) == 0 {
+			return
+		}
+		if n := len(claudeMessages); n > 0 && claudeMessages[n-1].Role.Value == role {
+			claudeMessages[n-1].Content = anthropic.F(append(claudeMessages[n-1].Content.Value, blocks...))
+			return
 		}
+		claudeMessages = append(claudeMessages, anthropic.MessageParam{
+			Role:    anthropic.F(role),
+			Content: anthropic.F(blocks),
+		})
 	}
 
-	for i, msg := range messages {
+	for _, msg := range normalizeToolMessages(messages) {
 		switch msg.Role {
 		case RoleSystem:
 			// Claude handles system messages differently - we'll add it as a system prompt
 			continue
 		case RoleUser:
-			claudeMessages = append(claudeMessages, anthropic.NewUserMessage(anthropic.NewTextBlock(msg.Content)))
+			appendBlocks(anthropic.MessageParamRoleUser, anthropic.NewTextBlock(msg.Content))
 		case RoleAssistant:
-			// Skip assistant messages that are the last message when there are tool calls
-			if len(msg.ToolCalls) > 0 && i == len(messages)-1 {
-				continue
+			var blocks []anthropic.ContentBlockParamUnion
+			if msg.Content != "" {
+				blocks = append(blocks, anthropic.NewTextBlock(msg.Content))
 			}
-			
-			// If there are tool calls, we need to split this into multiple messages
-			if len(msg.ToolCalls) > 0 {
-				// First message: just the text content if any
-				if msg.Content != "" {
-					claudeMessages = append(claudeMessages, anthropic.NewAssistantMessage(anthropic.NewTextBlock(msg.Content)))
-				}
-				
-				// Then for each tool call, create a tool use message
-				for _, tc := range msg.ToolCalls {
-					var args interface{}
-					if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err == nil {
-						// Create the tool use message
-						toolMsg := anthropic.NewAssistantMessage(
-							anthropic.NewToolUseBlockParam(tc.ID, tc.Function.Name, args))
-						claudeMessages = append(claudeMessages, toolMsg)
-						
-						// Add the tool result immediately after if available
-						if result, ok := toolCallMap[tc.Function.Name]; ok {
-							toolResult := anthropic.NewUserMessage(
-								anthropic.NewToolResultBlock(tc.ID, result, false))
-							claudeMessages = append(claudeMessages, toolResult)
-						}
-					}
+			for _, tc := range msg.ToolCalls {
+				var args interface{}
+				if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err != nil || args == nil {
+					args = map[string]interface{}{}
 				}
-			} else {
-				// No tool calls, just add the content
-				claudeMessages = append(claudeMessages, anthropic.NewAssistantMessage(anthropic.NewTextBlock(msg.Content)))
+				blocks = append(blocks, anthropic.NewToolUseBlockParam(tc.ID, tc.Function.Name, args))
 			}
-		case RoleFunction:
-			// Function messages are handled with tool calls
-			continue
+			appendBlocks(anthropic.MessageParamRoleAssistant, blocks...)
+		case RoleTool, RoleFunction:
+			if msg.ToolCallID == "" {
+				// A result that answers no tool_use block would be rejected
+				continue
+			}
+			appendBlocks(anthropic.MessageParamRoleUser,
+				anthropic.NewToolResultBlock(msg.ToolCallID, msg.Content, false))
 		}
 	}
 
@@ -138,6 +140,66 @@ func convertToClaudeTools(tools []Tool) []anthropic.ToolParam {
 	return claudeTools
 }
 
+// applyClaudeResponseFormat makes Claude reply with structured data. Claude has no
+// JSON mode, so the request is given a tool whose input schema is the wanted
+// reply, and the model is made to call it. It returns the tool's name, or ""
+// when the request asks for no structured reply.
+func applyClaudeResponseFormat(params *anthropic.MessageNewParams, req ChatCompletionRequest) string {
+	format := req.ResponseFormat
+	if !format.wantsJSON() {
+		return ""
+	}
+
+	schema := format.Schema
+	if format.Type != ResponseFormatJSONSchema || len(schema) == 0 {
+		schema = map[string]interface{}{"type": "object"}
+	}
+	description := format.Description
+	if description == "" {
+		description = "Reply with the final answer as structured data."
+	}
+
+	name := format.schemaName()
+	tools := append(convertToClaudeTools(req.Tools), anthropic.ToolParam{
+		Name:        anthropic.F(name),
+		Description: anthropic.F(description),
+		InputSchema: anthropic.F[interface{}](schema),
+	})
+	params.Tools = anthropic.F(tools)
+
+	// With other tools available the model must still be free to call them, so it
+	// is only required to call some tool; the output tool ends the conversation
+	if len(req.Tools) > 0 {
+		params.ToolChoice = anthropic.F[anthropic.ToolChoiceUnionParam](anthropic.ToolChoiceAnyParam{
+			Type: anthropic.F(anthropic.ToolChoiceAnyTypeAny),
+		})
+	} else {
+		params.ToolChoice = anthropic.F[anthropic.ToolChoiceUnionParam](anthropic.ToolChoiceToolParam{
+			Type: anthropic.F(anthropic.ToolChoiceToolTypeTool),
+			Name: anthropic.F(name),
+		})
+	}
+	return name
+}
+
+// extractStructuredOutput turns the call to the structured output tool into the
+// message content, which is where callers expect the JSON reply
+func extractStructuredOutput(msg Message, outputTool string) Message {
+	if outputTool == "" {
+		return msg
+	}
+	var toolCalls []ToolCall
+	for _, call := range msg.ToolCalls {
+		if call.Function.Name == outputTool {
+			msg.Content = call.Function.Arguments
+			continue
+		}
+		toolCalls = append(toolCalls, call)
+	}
+	msg.ToolCalls = toolCalls
+	return msg
+}
+
 // convertFromClaudeMessage converts Claude's message type to our generic Message type
 func convertFromClaudeMessage(msg anthropic.Message) Message {
 	var content string
@@ -204,15 +266,16 @@ func (c *ClaudeLLM) CreateChatCompletion(ctx context.Context, req ChatCompletion
 	if req.Temperature > 0 {
 		claudeReq.Temperature = anthropic.F(float64(req.Temperature))
 	}
+	outputTool := applyClaudeResponseFormat(&claudeReq, req)
 
 	// Make request to Claude API
-	resp, err := c.client.Messages.New(ctx, claudeReq)
+	resp, err := c.client.Messages.New(ctx, claudeReq, claudeHeaderOptions(ctx)...)
 	if err != nil {
-		return ChatCompletionResponse{}, fmt.Errorf("claude API error: %v", err)
+		return ChatCompletionResponse{}, fmt.Errorf("claude API error: %w", wrapClaudeError(err))
 	}
 
 	// Convert response
-	message := convertFromClaudeMessage(*resp)
+	message := extractStructuredOutput(convertFromClaudeMessage(*resp), outputTool)
 
 	return ChatCompletionResponse{
 		ID: resp.ID,
@@ -221,14 +284,47 @@ func (c *ClaudeLLM) CreateChatCompletion(ctx context.Context, req ChatCompletion
 			Message:      message,
 			FinishReason: "stop", // Claude doesn't provide this explicitly
 		}},
-		Usage: Usage{
-			PromptTokens:     int(resp.Usage.InputTokens),
-			CompletionTokens: int(resp.Usage.OutputTokens),
-			TotalTokens:      int(resp.Usage.InputTokens + resp.Usage.OutputTokens),
-		},
+		Usage: convertFromClaudeUsage(resp.Usage),
 	}, nil
 }
 
+// claudeHeaderOptions turns the headers added with WithHeaders into request options
+func claudeHeaderOptions(ctx context.Context) []option.RequestOption {
+	var opts []option.RequestOption
+	for key, values := range HeadersFromContext(ctx) {
+		opts = append(opts, option.WithHeaderDel(key))
+		for _, value := range values {
+			opts = append(opts, option.WithHeaderAdd(key, value))
+		}
+	}
+	return opts
+}
+
+// wrapClaudeError converts errors from the Anthropic client into a *ProviderError
+func wrapClaudeError(err error) error {
+	var apiErr *anthropic.Error
+	if errors.As(err, &apiErr) {
+		var header http.Header
+		if apiErr.Response != nil {
+			header = apiErr.Response.Header
+		}
+		return newStatusError(Claude, apiErr.StatusCode, apiErr.JSON.RawJSON(), header, err)
+	}
+	return wrapTransportError(Claude, err)
+}
+
+// convertFromClaudeUsage converts Claude's usage to our generic type. Claude
+// counts tokens read from the prompt cache apart from the other input tokens.
+func convertFromClaudeUsage(usage anthropic.Usage) Usage {
+	prompt := int(usage.InputTokens + usage.CacheReadInputTokens)
+	return Usage{
+		PromptTokens:       prompt,
+		CompletionTokens:   int(usage.OutputTokens),
+		TotalTokens:        prompt + int(usage.OutputTokens),
+		CachedPromptTokens: int(usage.CacheReadInputTokens),
+	}
+}
+
 // CreateChatCompletionStream implements the LLM interface for Claude streaming
 func (c *ClaudeLLM) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
 	// Extract system message if present
@@ -267,12 +363,14 @@ func (c *ClaudeLLM) CreateChatCompletionStream(ctx context.Context, req ChatComp
 	if req.Temperature > 0 {
 		claudeReq.Temperature = anthropic.F(float64(req.Temperature))
 	}
+	outputTool := applyClaudeResponseFormat(&claudeReq, req)
 
 	// Create streaming response
-	stream := c.client.Messages.NewStreaming(ctx, claudeReq)
+	stream := c.client.Messages.NewStreaming(ctx, claudeReq, claudeHeaderOptions(ctx)...)
 
 	return &claudeStreamWrapper{
 		stream:          stream,
+		outputTool:      outputTool,
 		message:         anthropic.Message{},
 		currentToolCall: nil,
 		currentContent:  "",
@@ -285,12 +383,13 @@ type claudeStreamWrapper struct {
 	message         anthropic.Message
 	currentToolCall *ToolCall
 	currentContent  string
+	outputTool      string // Tool carrying the structured reply, streamed as content
 }
 
 func (w *claudeStreamWrapper) Recv() (ChatCompletionResponse, error) {
 	if !w.stream.Next() {
 		if err := w.stream.Err(); err != nil {
-			return ChatCompletionResponse{}, err
+			return ChatCompletionResponse{}, wrapClaudeError(err)
 		}
 		return ChatCompletionResponse{}, io.EOF
 	}
@@ -323,7 +422,10 @@ func (w *claudeStreamWrapper) Recv() (ChatCompletionResponse, error) {
 			w.currentContent += delta.Text
 			message.Content = w.currentContent
 		}
-		if delta.PartialJSON != "" && w.currentToolCall != nil {
+		if delta.PartialJSON != "" && w.currentToolCall != nil && w.currentToolCall.Function.Name == w.outputTool {
+			w.currentContent += delta.PartialJSON
+			message.Content = w.currentContent
+		} else if delta.PartialJSON != "" && w.currentToolCall != nil {
 			if w.currentToolCall.Function.Arguments == "" {
 				w.currentToolCall.Function.Arguments = delta.PartialJSON
 			} else {
@@ -332,7 +434,9 @@ func (w *claudeStreamWrapper) Recv() (ChatCompletionResponse, error) {
 		}
 	case anthropic.ContentBlockStopEvent:
 		if w.currentToolCall != nil {
-			message.ToolCalls = []ToolCall{*w.currentToolCall}
+			if w.currentToolCall.Function.Name != w.outputTool {
+				message.ToolCalls = []ToolCall{*w.currentToolCall}
+			}
 			w.currentToolCall = nil
 		}
 	case anthropic.MessageStopEvent:
@@ -350,6 +454,8 @@ func (w *claudeStreamWrapper) Recv() (ChatCompletionResponse, error) {
 			Message:      message,
 			FinishReason: string(event.Type),
 		}},
+		// The accumulated message holds the usage reported so far
+		Usage: convertFromClaudeUsage(w.message.Usage),
 	}, nil
 }
 
@@ -8,21 +8,39 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 )
 
 const deepseekAPIEndpoint = "https://api.deepseek.com/chat/completions"
 
 // DeepSeekLLM implements the LLM interface for DeepSeek
 type DeepSeekLLM struct {
-	apiKey string
-	client *http.Client
+	apiKey   string
+	endpoint string
+	client   *http.Client
 }
 
 // NewDeepSeekLLM creates a new DeepSeek LLM client
 func NewDeepSeekLLM(apiKey string) *DeepSeekLLM {
 	return &DeepSeekLLM{
-		apiKey: apiKey,
-		client: &http.Client{},
+		apiKey:   apiKey,
+		endpoint: deepseekAPIEndpoint,
+		client:   newHeaderClient(),
+	}
+}
+
+// NewDeepSeekLLMWithURL creates a DeepSeek LLM client for a DeepSeek-compatible
+// API at baseURL, such as https://api.deepseek.com, sending its requests with
+// httpClient. An empty baseURL or nil httpClient uses the defaults.
+func NewDeepSeekLLMWithURL(apiKey, baseURL string, httpClient *http.Client) *DeepSeekLLM {
+	endpoint := deepseekAPIEndpoint
+	if baseURL != "" {
+		endpoint = strings.TrimSuffix(baseURL, "/") + "/chat/completions"
+	}
+	return &DeepSeekLLM{
+		apiKey:   apiKey,
+		endpoint: endpoint,
+		client:   withHeaderTransport(httpClient),
 	}
 }
 
@@ -37,10 +55,11 @@ type deepseekMessage struct {
 // Convert Message to deepseekMessage
 func convertToDeepSeekMessage(msg Message) deepseekMessage {
 	dsMsg := deepseekMessage{
-		Role:      convertToDeepSeekRole(msg.Role),
-		Content:   msg.Content,
-		Name:      msg.Name,
-		ToolCalls: msg.ToolCalls,
+		Role:       convertToDeepSeekRole(msg.Role),
+		Content:    msg.Content,
+		Name:       msg.Name,
+		ToolCalls:  msg.ToolCalls,
+		ToolCallID: msg.ToolCallID,
 	}
 	return dsMsg
 }
@@ -48,22 +67,55 @@ func convertToDeepSeekMessage(msg Message) deepseekMessage {
 // Convert deepseekMessage to Message
 func convertFromDeepSeekMessage(msg deepseekMessage) Message {
 	return Message{
-		Role:      convertFromDeepSeekRole(msg.Role),
-		Content:   msg.Content,
-		Name:      msg.Name,
-		ToolCalls: msg.ToolCalls,
+		Role:       convertFromDeepSeekRole(msg.Role),
+		Content:    msg.Content,
+		Name:       msg.Name,
+		ToolCalls:  msg.ToolCalls,
+		ToolCallID: msg.ToolCallID,
 	}
 }
 
+// convertToDeepSeekMessages converts a conversation to DeepSeek's format. Tool
+// results are sent with the ID of the call they answer; every call of the last
+// assistant message must have been answered.
+func convertToDeepSeekMessages(messages []Message) ([]deepseekMessage, error) {
+	var deepseekMessages []deepseekMessage
+	var lastToolCalls []ToolCall
+
+	for _, msg := range normalizeToolMessages(messages) {
+		if isToolResult(msg) && msg.ToolCallID == "" {
+			// A result that answers no tool call would be rejected, skip it
+			continue
+		}
+		deepseekMessages = append(deepseekMessages, convertToDeepSeekMessage(msg))
+		if msg.Role == RoleAssistant && len(msg.ToolCalls) > 0 {
+			lastToolCalls = msg.ToolCalls
+		}
+	}
+
+	for _, toolCall := range lastToolCalls {
+		found := false
+		for _, msg := range deepseekMessages {
+			if msg.Role == "tool" && msg.ToolCallID == toolCall.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("missing tool response for call %s", toolCall.ID)
+		}
+	}
+
+	return deepseekMessages, nil
+}
+
 type deepseekRequest struct {
 	Model            string           `json:"model"`
 	Messages         []deepseekMessage `json:"messages"`
 	FrequencyPenalty float32          `json:"frequency_penalty,omitempty"`
 	MaxTokens        int              `json:"max_tokens,omitempty"`
 	PresencePenalty  float32          `json:"presence_penalty,omitempty"`
-	ResponseFormat   *struct {
-		Type string `json:"type"`
-	} `json:"response_format,omitempty"`
+	ResponseFormat   *deepseekResponseFormat `json:"response_format,omitempty"`
 	Stream      bool     `json:"stream,omitempty"`
 	Temperature float32  `json:"temperature,omitempty"`
 	TopP        float32  `json:"top_p,omitempty"`
@@ -71,6 +123,20 @@ type deepseekRequest struct {
 	Stop        []string `json:"stop,omitempty"`
 }
 
+// deepseekResponseFormat selects DeepSeek's JSON mode, which takes no schema
+type deepseekResponseFormat struct {
+	Type string `json:"type"`
+}
+
+// convertToDeepSeekResponseFormat maps our generic response format to DeepSeek's.
+// DeepSeek only has a plain JSON mode, so a schema is sent as an instruction.
+func convertToDeepSeekResponseFormat(format *ResponseFormat) *deepseekResponseFormat {
+	if !format.wantsJSON() {
+		return nil
+	}
+	return &deepseekResponseFormat{Type: string(ResponseFormatJSONObject)}
+}
+
 type deepseekResponse struct {
 	ID      string   `json:"id"`
 	Choices []Choice `json:"choices"`
@@ -85,76 +151,21 @@ type deepseekStreamResponse struct {
 
 func convertToDeepSeekRole(role Role) string {
 	if role == RoleFunction {
-		return "tool"
+		return string(RoleTool)
 	}
 	return string(role)
 }
 
 func convertFromDeepSeekRole(role string) Role {
-	if role == "tool" {
-		return RoleFunction
-	}
 	return Role(role)
 }
 
 // CreateChatCompletion implements the LLM interface for DeepSeek
 func (l *DeepSeekLLM) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
 	// Convert messages to DeepSeek format
-	var deepseekMessages []deepseekMessage
-	var lastToolCalls []ToolCall
-
-	for i, msg := range req.Messages {
-		if msg.Role == RoleFunction {
-			// For function responses, we need to find the corresponding tool call
-			var toolCallID string
-			for j := i - 1; j >= 0; j-- {
-				if req.Messages[j].Role == RoleAssistant && len(req.Messages[j].ToolCalls) > 0 {
-					for _, toolCall := range req.Messages[j].ToolCalls {
-						if toolCall.Function.Name == msg.Name {
-							toolCallID = toolCall.ID
-							break
-						}
-					}
-					if toolCallID != "" {
-						break
-					}
-				}
-			}
-			if toolCallID == "" {
-				// If we can't find a tool call ID, skip this message
-				continue
-			}
-			dsMsg := convertToDeepSeekMessage(msg)
-			dsMsg.ToolCallID = toolCallID
-			deepseekMessages = append(deepseekMessages, dsMsg)
-		} else {
-			dsMsg := convertToDeepSeekMessage(msg)
-			deepseekMessages = append(deepseekMessages, dsMsg)
-			if msg.Role == RoleAssistant && len(msg.ToolCalls) > 0 {
-				lastToolCalls = msg.ToolCalls
-			}
-		}
-	}
-
-	// If the last message had tool calls but no responses, skip the follow-up
-	if len(lastToolCalls) > 0 {
-		hasAllResponses := true
-		for _, toolCall := range lastToolCalls {
-			found := false
-			for _, msg := range deepseekMessages {
-				if msg.Role == "tool" && msg.ToolCallID == toolCall.ID {
-					found = true
-					break
-				}
-			}
-			if !found {
-				hasAllResponses = false
-				break
-			}
-		}
-		if !hasAllResponses {
-			return ChatCompletionResponse{}, fmt.Errorf("missing tool responses")
-		}
+	deepseekMessages, err := convertToDeepSeekMessages(withSchemaInstruction(req.Messages, req.ResponseFormat))
+	if err != nil {
+		return ChatCompletionResponse{}, err
 	}
 
 	deepseekReq := deepseekRequest{
@@ -167,11 +178,7 @@ func (l *DeepSeekLLM) CreateChatCompletion(ctx context.Context, req ChatCompleti
 		TopP:             req.TopP,
 		Tools:            req.Tools,
 		Stop:             req.Stop,
-	}
-
-	// For follow-up responses after tool calls, disable tools to prevent loops
-	if len(req.Messages) > 0 && req.Messages[len(req.Messages)-1].Role == RoleFunction {
-		deepseekReq.Tools = nil
+		ResponseFormat:   convertToDeepSeekResponseFormat(req.ResponseFormat),
 	}
 
 	// Set default values if not provided
@@ -190,7 +197,7 @@ func (l *DeepSeekLLM) CreateChatCompletion(ctx context.Context, req ChatCompleti
 		return ChatCompletionResponse{}, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", deepseekAPIEndpoint, bytes.NewReader(body))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", l.endpoint, bytes.NewReader(body))
 	if err != nil {
 		return ChatCompletionResponse{}, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -200,13 +207,12 @@ func (l *DeepSeekLLM) CreateChatCompletion(ctx context.Context, req ChatCompleti
 
 	resp, err := l.client.Do(httpReq)
 	if err != nil {
-		return ChatCompletionResponse{}, fmt.Errorf("failed to send request: %w", err)
+		return ChatCompletionResponse{}, fmt.Errorf("failed to send request: %w", wrapTransportError(DeepSeek, err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return ChatCompletionResponse{}, fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(body))
+		return ChatCompletionResponse{}, deepseekStatusError(resp)
 	}
 
 	var deepseekResp deepseekResponse
@@ -221,6 +227,27 @@ func (l *DeepSeekLLM) CreateChatCompletion(ctx context.Context, req ChatCompleti
 	}, nil
 }
 
+// deepseekStatusError converts an error response from the DeepSeek API into a *ProviderError
+func deepseekStatusError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	message := string(body)
+	var errResp struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &errResp) == nil && errResp.Error.Message != "" {
+		message = errResp.Error.Message
+	}
+
+	providerErr := newStatusError(DeepSeek, resp.StatusCode, message, resp.Header, nil)
+	// DeepSeek reports an exhausted balance with 402
+	if resp.StatusCode == http.StatusPaymentRequired {
+		providerErr.Kind = ErrAuthentication
+	}
+	return providerErr
+}
+
 type deepseekStreamWrapper struct {
 	ctx             context.Context
 	reader          *bufio.Reader
@@ -254,7 +281,7 @@ func (s *deepseekStreamWrapper) Recv() (ChatCompletionResponse, error) {
 		if err == io.EOF {
 			return ChatCompletionResponse{}, io.EOF
 		}
-		return ChatCompletionResponse{}, fmt.Errorf("failed to read stream: %w", err)
+		return ChatCompletionResponse{}, fmt.Errorf("failed to read stream: %w", wrapTransportError(DeepSeek, err))
 	}
 
 	// Remove "data: " prefix
@@ -281,61 +308,9 @@ func (s *deepseekStreamWrapper) Recv() (ChatCompletionResponse, error) {
 // CreateChatCompletionStream implements the LLM interface for DeepSeek streaming
 func (l *DeepSeekLLM) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
 	// Convert messages to DeepSeek format
-	var deepseekMessages []deepseekMessage
-	var lastToolCalls []ToolCall
-
-	for i, msg := range req.Messages {
-		if msg.Role == RoleFunction {
-			// For function responses, we need to find the corresponding tool call
-			var toolCallID string
-			for j := i - 1; j >= 0; j-- {
-				if req.Messages[j].Role == RoleAssistant && len(req.Messages[j].ToolCalls) > 0 {
-					for _, toolCall := range req.Messages[j].ToolCalls {
-						if toolCall.Function.Name == msg.Name {
-							toolCallID = toolCall.ID
-							break
-						}
-					}
-					if toolCallID != "" {
-						break
-					}
-				}
-			}
-			if toolCallID == "" {
-				// If we can't find a tool call ID, skip this message
-				continue
-			}
-			dsMsg := convertToDeepSeekMessage(msg)
-			dsMsg.ToolCallID = toolCallID
-			deepseekMessages = append(deepseekMessages, dsMsg)
-		} else {
-			dsMsg := convertToDeepSeekMessage(msg)
-			deepseekMessages = append(deepseekMessages, dsMsg)
-			if msg.Role == RoleAssistant && len(msg.ToolCalls) > 0 {
-				lastToolCalls = msg.ToolCalls
-			}
-		}
-	}
-
-	// If the last message had tool calls but no responses, skip the follow-up
-	if len(lastToolCalls) > 0 {
-		hasAllResponses := true
-		for _, toolCall := range lastToolCalls {
-			found := false
-			for _, msg := range deepseekMessages {
-				if msg.Role == "tool" && msg.ToolCallID == toolCall.ID {
-					found = true
-					break
-				}
-			}
-			if !found {
-				hasAllResponses = false
-				break
-			}
-		}
-		if !hasAllResponses {
-			return nil, fmt.Errorf("missing tool responses")
-		}
+	deepseekMessages, err := convertToDeepSeekMessages(withSchemaInstruction(req.Messages, req.ResponseFormat))
+	if err != nil {
+		return nil, err
 	}
 
 	req.Stream = true
@@ -349,14 +324,10 @@ func (l *DeepSeekLLM) CreateChatCompletionStream(ctx context.Context, req ChatCo
 		TopP:             req.TopP,
 		Tools:            req.Tools,
 		Stop:             req.Stop,
+		ResponseFormat:   convertToDeepSeekResponseFormat(req.ResponseFormat),
 		Stream:           true,
 	}
 
-	// For follow-up responses after tool calls, disable tools to prevent loops
-	if len(req.Messages) > 0 && req.Messages[len(req.Messages)-1].Role == RoleFunction {
-		deepseekReq.Tools = nil
-	}
-
 	// Set default values if not provided
 	if deepseekReq.Temperature == 0 {
 		deepseekReq.Temperature = 0.7
@@ -373,7 +344,7 @@ func (l *DeepSeekLLM) CreateChatCompletionStream(ctx context.Context, req ChatCo
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", deepseekAPIEndpoint, bytes.NewReader(body))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", l.endpoint, bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -383,13 +354,12 @@ func (l *DeepSeekLLM) CreateChatCompletionStream(ctx context.Context, req ChatCo
 
 	resp, err := l.client.Do(httpReq)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return nil, fmt.Errorf("failed to send request: %w", wrapTransportError(DeepSeek, err))
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(body))
+		defer resp.Body.Close()
+		return nil, deepseekStatusError(resp)
 	}
 
 	return newDeepseekStreamWrapper(ctx, resp), nil
@@ -0,0 +1,174 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors identifying the kind of a ProviderError. Test for them with errors.Is.
+var (
+	ErrRateLimited     = errors.New("rate limited")
+	ErrAuthentication  = errors.New("authentication failed")
+	ErrInvalidRequest  = errors.New("invalid request")
+	ErrContextTooLong  = errors.New("context too long")
+	ErrContentFiltered = errors.New("content filtered")
+	ErrServer          = errors.New("server error")
+	ErrTimeout         = errors.New("request timed out")
+)
+
+// ProviderError is an error returned by a provider, classified into one of the
+// kinds above. Every LLM implementation in this package returns its request
+// errors as a *ProviderError, wrapping the provider's own error.
+type ProviderError struct {
+	Provider   LLMProvider
+	Kind       error         // One of the Err* kinds above
+	StatusCode int           // HTTP status code, when there is one
+	Message    string        // Provider's error message
+	RetryAfter time.Duration // How long the provider asked to wait, when it did
+	Err        error         // Provider's original error
+}
+
+func (e *ProviderError) Error() string {
+	msg := fmt.Sprintf("%s: %v", e.Provider, e.Kind)
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(" (status %d)", e.StatusCode)
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Unwrap returns the error kind and the provider's original error
+func (e *ProviderError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// Retryable reports whether the request may succeed if sent again
+func (e *ProviderError) Retryable() bool {
+	return e.Kind == ErrRateLimited || e.Kind == ErrServer || e.Kind == ErrTimeout
+}
+
+// IsRetryable reports whether err is worth retrying: a retryable provider
+// error, or a network failure raised before the provider answered. Other
+// errors, such as requests rejected before they were sent, are not.
+func IsRetryable(err error) bool {
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		return providerErr.Retryable()
+	}
+	switch {
+	case err == nil || errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, ErrRateLimited) || errors.Is(err, ErrServer) || errors.Is(err, ErrTimeout):
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// RetryAfter returns how long the provider asked to wait before retrying err
+func RetryAfter(err error) (time.Duration, bool) {
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) && providerErr.RetryAfter > 0 {
+		return providerErr.RetryAfter, true
+	}
+	return 0, false
+}
+
+// contextTooLongHints are phrases providers use when a prompt exceeds the context window
+var contextTooLongHints = []string{
+	"context_length_exceeded",
+	"maximum context length",
+	"context window",
+	"prompt is too long",
+	"too many tokens",
+	"input token count",
+}
+
+// newStatusError classifies an HTTP error response from provider
+func newStatusError(provider LLMProvider, status int, message string, header http.Header, err error) *ProviderError {
+	return &ProviderError{
+		Provider:   provider,
+		Kind:       statusKind(status, message),
+		StatusCode: status,
+		Message:    message,
+		RetryAfter: parseRetryAfter(header),
+		Err:        err,
+	}
+}
+
+// statusKind maps an HTTP status code, and for client errors the message, to an error kind
+func statusKind(status int, message string) error {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrAuthentication
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		return ErrTimeout
+	case status == http.StatusRequestEntityTooLarge || mentionsContextTooLong(message):
+		return ErrContextTooLong
+	case status >= 500:
+		return ErrServer
+	default:
+		return ErrInvalidRequest
+	}
+}
+
+// mentionsContextTooLong reports whether an error message says the prompt is too long
+func mentionsContextTooLong(message string) bool {
+	message = strings.ToLower(message)
+	for _, hint := range contextTooLongHints {
+		if strings.Contains(message, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// wrapTransportError classifies errors raised before a provider answered.
+// Timeouts become provider errors; other errors, including cancellation, are
+// returned unchanged.
+func wrapTransportError(provider LLMProvider, err error) error {
+	if err == nil {
+		return nil
+	}
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) {
+		return err
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &ProviderError{Provider: provider, Kind: ErrTimeout, Message: err.Error(), Err: err}
+	}
+	return err
+}
@@ -0,0 +1,196 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNoBackends is returned by a Fallback without entries
+var ErrNoBackends = errors.New("fallback has no backends")
+
+// FallbackEntry is one backend of a Fallback
+type FallbackEntry struct {
+	Name      string // Reported in ChatCompletionResponse.Backend; defaults to the model
+	Client    LLM
+	Model     string // Replaces the request's model when set
+	MaxTokens int    // Caps the request's MaxTokens when set, for models with smaller limits
+}
+
+// Fallback is an LLM that sends each request to its entries in order until one
+// answers. An entry is skipped when it fails with an error ShouldFallback
+// accepts; other errors are returned at once. Responses record the entry that
+// answered in Backend and Model.
+//
+// Requests keep the provider-neutral history, so each backend converts the
+// whole conversation to its own format, including turns and tool calls made
+// by other backends.
+type Fallback struct {
+	Entries []FallbackEntry
+
+	// ShouldFallback reports whether an error moves the request to the next
+	// entry; nil means FallbackOnRetryable
+	ShouldFallback func(error) bool
+}
+
+// NewFallback returns a Fallback trying entries in order on retryable errors
+func NewFallback(entries ...FallbackEntry) *Fallback {
+	return &Fallback{Entries: entries}
+}
+
+// FallbackOnRetryable falls back on the errors IsRetryable accepts: rate
+// limits, server errors, timeouts and network failures
+func FallbackOnRetryable(err error) bool {
+	return IsRetryable(err)
+}
+
+// FallbackOn returns a rule that falls back on errors matching any of kinds,
+// such as ErrRateLimited or ErrContextTooLong
+func FallbackOn(kinds ...error) func(error) bool {
+	return func(err error) bool {
+		for _, kind := range kinds {
+			if errors.Is(err, kind) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// shouldFallback applies the fallback rule, never falling back once ctx is done
+func (f *Fallback) shouldFallback(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if f.ShouldFallback != nil {
+		return f.ShouldFallback(err)
+	}
+	return FallbackOnRetryable(err)
+}
+
+// request adapts req to entry
+func (e FallbackEntry) request(req ChatCompletionRequest) ChatCompletionRequest {
+	if e.Model != "" {
+		req.Model = e.Model
+	}
+	if e.MaxTokens > 0 && (req.MaxTokens == 0 || req.MaxTokens > e.MaxTokens) {
+		req.MaxTokens = e.MaxTokens
+	}
+	return req
+}
+
+// name returns the name reported for entry i
+func (e FallbackEntry) name(i int, model string) string {
+	if e.Name != "" {
+		return e.Name
+	}
+	if model != "" {
+		return model
+	}
+	return fmt.Sprintf("backend %d", i)
+}
+
+// fallbackError returns the error of the last entry tried, noting the earlier failures
+func fallbackError(errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return fmt.Errorf("all %d backends failed: %w", len(errs), errors.Join(errs...))
+}
+
+// CreateChatCompletion sends req to the entries in order until one answers
+func (f *Fallback) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	if len(f.Entries) == 0 {
+		return ChatCompletionResponse{}, ErrNoBackends
+	}
+
+	var errs []error
+	for i, entry := range f.Entries {
+		entryReq := entry.request(req)
+		resp, err := entry.Client.CreateChatCompletion(ctx, entryReq)
+		if err == nil {
+			resp.Backend = entry.name(i, entryReq.Model)
+			resp.Model = entryReq.Model
+			return resp, nil
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w", entry.name(i, entryReq.Model), err))
+		if !f.shouldFallback(ctx, err) {
+			break
+		}
+	}
+	return ChatCompletionResponse{}, fallbackError(errs)
+}
+
+// CreateChatCompletionStream opens a stream from the entries in order until
+// one succeeds. A stream that fails before sending its first chunk also moves
+// to the next entry; once a chunk was sent, errors are returned as they are.
+func (f *Fallback) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	if len(f.Entries) == 0 {
+		return nil, ErrNoBackends
+	}
+	stream := &fallbackStream{ctx: ctx, fallback: f, req: req}
+	if err := stream.open(0); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// fallbackStream is a stream from the first Fallback entry that answers
+type fallbackStream struct {
+	ctx      context.Context
+	fallback *Fallback
+	req      ChatCompletionRequest
+	errs     []error
+
+	stream  ChatCompletionStream
+	entry   int
+	backend string
+	model   string
+	started bool // A chunk was sent, so the stream can no longer move on
+}
+
+// open opens the stream of the first entry from start that succeeds
+func (s *fallbackStream) open(start int) error {
+	for i := start; i < len(s.fallback.Entries); i++ {
+		entry := s.fallback.Entries[i]
+		entryReq := entry.request(s.req)
+		stream, err := entry.Client.CreateChatCompletionStream(s.ctx, entryReq)
+		if err == nil {
+			s.stream, s.entry = stream, i
+			s.backend, s.model = entry.name(i, entryReq.Model), entryReq.Model
+			return nil
+		}
+
+		s.errs = append(s.errs, fmt.Errorf("%s: %w", entry.name(i, entryReq.Model), err))
+		if !s.fallback.shouldFallback(s.ctx, err) {
+			break
+		}
+	}
+	return fallbackError(s.errs)
+}
+
+func (s *fallbackStream) Recv() (ChatCompletionResponse, error) {
+	for {
+		resp, err := s.stream.Recv()
+		if err == nil {
+			s.started = true
+			resp.Backend, resp.Model = s.backend, s.model
+			return resp, nil
+		}
+		if s.started || errors.Is(err, io.EOF) || !s.fallback.shouldFallback(s.ctx, err) {
+			return resp, err
+		}
+
+		s.stream.Close()
+		s.errs = append(s.errs, fmt.Errorf("%s: %w", s.backend, err))
+		if openErr := s.open(s.entry + 1); openErr != nil {
+			return ChatCompletionResponse{}, openErr
+		}
+	}
+}
+
+func (s *fallbackStream) Close() error {
+	return s.stream.Close()
+}
@@ -3,10 +3,14 @@ package llm
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
 
 	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
@@ -38,78 +42,99 @@ func NewGeminiLLM(apiKey string, opts ...GeminiOptions) (*GeminiLLM, error) {
 	}, nil
 }
 
-// convertToGeminiMessages converts our generic Message type to Gemini's content type
-func convertToGeminiMessages(messages []Message) []genai.Part {
-	var parts []genai.Part
+// NewGeminiLLMWithClientOptions creates a Gemini LLM client with Google API
+// client options, such as option.WithEndpoint or option.WithHTTPClient
+func NewGeminiLLMWithClientOptions(apiKey string, opts ...option.ClientOption) (*GeminiLLM, error) {
+	client, err := genai.NewClient(context.Background(), append([]option.ClientOption{option.WithAPIKey(apiKey)}, opts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Gemini client: %w", err)
+	}
+	return &GeminiLLM{client: client}, nil
+}
 
-	for _, msg := range messages {
-		content := strings.TrimSpace(msg.Content)
-		if content == "" {
-			continue // Skip empty messages
+// convertToGeminiContents converts our generic Message type to Gemini's chat contents.
+// System messages are returned separately as the system instruction. Tool calls
+// and their results become FunctionCall and FunctionResponse parts; Gemini pairs
+// them by position, so results are sent in the order of the calls they answer.
+func convertToGeminiContents(messages []Message) (*genai.Content, []*genai.Content) {
+	var systemParts []string
+	var contents []*genai.Content
+
+	// appendParts adds parts to the conversation, merging consecutive turns of the same role
+	appendParts := func(role string, parts ...genai.Part) {
+		if len(parts) == 0 {
+			return
+		}
+		if n := len(contents); n > 0 && contents[n-1].Role == role {
+			contents[n-1].Parts = append(contents[n-1].Parts, parts...)
+			return
 		}
+		contents = append(contents, &genai.Content{Role: role, Parts: parts})
+	}
+
+	for _, msg := range normalizeToolMessages(messages) {
+		content := strings.TrimSpace(msg.Content)
 
 		switch msg.Role {
 		case RoleSystem:
-			parts = append(parts, genai.Text(fmt.Sprintf("[System]\n%s", content)))
-		case "function":
-			if msg.Name != "" {
-				parts = append(parts, genai.Text(fmt.Sprintf("[Function: %s]\n%s", msg.Name, content)))
-			} else {
-				parts = append(parts, genai.Text(fmt.Sprintf("[Function Result]\n%s", content)))
+			if content != "" {
+				systemParts = append(systemParts, content)
 			}
-		case RoleAssistant:
-			parts = append(parts, genai.Text(fmt.Sprintf("[Assistant]\n%s", content)))
 		case RoleUser:
-			parts = append(parts, genai.Text(fmt.Sprintf("[User]\n%s", content)))
+			if content != "" {
+				appendParts("user", genai.Text(content))
+			}
+		case RoleAssistant:
+			var parts []genai.Part
+			if content != "" {
+				parts = append(parts, genai.Text(content))
+			}
+			for _, tc := range msg.ToolCalls {
+				args := make(map[string]any)
+				_ = json.Unmarshal([]byte(tc.Function.Arguments), &args)
+				parts = append(parts, genai.FunctionCall{Name: tc.Function.Name, Args: args})
+			}
+			appendParts("model", parts...)
+		case RoleTool, RoleFunction:
+			appendParts("user", genai.FunctionResponse{
+				Name:     msg.Name,
+				Response: convertToGeminiFunctionResponse(msg.Content),
+			})
 		}
 	}
 
-	return parts
+	var system *genai.Content
+	if len(systemParts) > 0 {
+		system = genai.NewUserContent(genai.Text(strings.Join(systemParts, "\n\n")))
+	}
+	return system, contents
 }
 
-// convertFromGeminiResponse converts Gemini's response to our generic Message type
-func convertFromGeminiResponse(resp *genai.GenerateContentResponse) Message {
-	if resp == nil || len(resp.Candidates) == 0 {
-		return Message{Role: RoleAssistant, Content: ""}
+// convertToGeminiFunctionResponse wraps a tool result in the JSON object Gemini expects
+func convertToGeminiFunctionResponse(content string) map[string]any {
+	var response map[string]any
+	if err := json.Unmarshal([]byte(content), &response); err == nil && response != nil {
+		return response
 	}
+	return map[string]any{"result": content}
+}
 
-	content := resp.Candidates[0].Content
-	if content == nil || len(content.Parts) == 0 {
-		return Message{Role: RoleAssistant, Content: ""}
+// convertFromGeminiCandidate converts a Gemini candidate to our generic Message type
+func convertFromGeminiCandidate(c *genai.Candidate) Message {
+	msg := Message{Role: RoleAssistant}
+	if c == nil || c.Content == nil {
+		return msg
 	}
 
 	var textParts []string
-	var toolCalls []ToolCall
-
-	for _, part := range content.Parts {
-		switch p := part.(type) {
-		case genai.Text:
-			text := string(p)
-			// Remove role prefixes if present
-			text = strings.TrimPrefix(text, "[Assistant]\n")
-			text = strings.TrimSpace(text)
-			if text != "" {
-				textParts = append(textParts, text)
-			}
-		case genai.FunctionCall:
-			args, err := json.Marshal(p.Args)
-			if err == nil {
-				toolCalls = append(toolCalls, ToolCall{
-					Type: "function",
-					Function: ToolCallFunction{
-						Name:      p.Name,
-						Arguments: string(args),
-					},
-				})
-			}
+	for _, part := range c.Content.Parts {
+		if t, ok := part.(genai.Text); ok {
+			textParts = append(textParts, string(t))
 		}
 	}
-
-	return Message{
-		Role:      RoleAssistant,
-		Content:   strings.Join(textParts, "\n"),
-		ToolCalls: toolCalls,
-	}
+	msg.Content = strings.Join(textParts, "")
+	msg.ToolCalls = convertFromGeminiToolCalls(c.Content.Parts)
+	return msg
 }
 
 // convertToGeminiTools converts our generic Tool type to Gemini's tool type
@@ -120,38 +145,9 @@ func convertToGeminiTools(tools []Tool) []*genai.Tool {
 
 	geminiTools := make([]*genai.Tool, len(tools))
 	for i, tool := range tools {
-		schema := &genai.Schema{
-			Type: genai.TypeObject,
-		}
-
-
-			schema.Properties = make(map[string]*genai.Schema)
-			
-			if properties, ok := tool.Function.Parameters["properties"].(map[string]interface{}); ok {
-				for name, prop := range properties {
-					if propMap, ok := prop.(map[string]interface{}); ok {
-						propSchema := &genai.Schema{}
-						if typ, ok := propMap["type"].(string); ok {
-							propSchema.Type = convertSchemaType(typ)
-						}
-						if desc, ok := propMap["description"].(string); ok {
-							propSchema.Description = desc
-						}
-						schema.Properties[name] = propSchema
-					}
-				}
-			}
-
-			if required, ok := tool.Function.Parameters["required"].([]interface{}); ok {
-				reqFields := make([]string, len(required))
-				for i, r := range required {
-					if str, ok := r.(string); ok {
-						reqFields[i] = str
-					}
-				}
-				schema.Required = reqFields
-			}
-		
+		// Parameters are always an object, even when the schema leaves out its type
+		schema := convertToGeminiSchema(tool.Function.Parameters)
+		schema.Type = genai.TypeObject
 
 		geminiTools[i] = &genai.Tool{
 			FunctionDeclarations: []*genai.FunctionDeclaration{
@@ -186,6 +182,63 @@ func convertSchemaType(typ string) genai.Type {
 	}
 }
 
+// convertToGeminiSchema converts a JSON schema to Gemini's schema type. Gemini
+// supports a subset of JSON schema; keywords it lacks are dropped.
+func convertToGeminiSchema(schema map[string]interface{}) *genai.Schema {
+	result := &genai.Schema{}
+
+	switch typ := schema["type"].(type) {
+	case string:
+		result.Type = convertSchemaType(typ)
+	case []interface{}:
+		// A list of types such as ["string", "null"] becomes a nullable type
+		for _, t := range typ {
+			if name, ok := t.(string); ok {
+				if name == "null" {
+					result.Nullable = true
+				} else {
+					result.Type = convertSchemaType(name)
+				}
+			}
+		}
+	}
+	if desc, ok := schema["description"].(string); ok {
+		result.Description = desc
+	}
+	result.Enum = schemaStrings(schema["enum"])
+	result.Required = schemaStrings(schema["required"])
+
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		result.Items = convertToGeminiSchema(items)
+	}
+	if properties, ok := schema["properties"].(map[string]interface{}); ok {
+		result.Properties = make(map[string]*genai.Schema, len(properties))
+		for name, prop := range properties {
+			if propMap, ok := prop.(map[string]interface{}); ok {
+				result.Properties[name] = convertToGeminiSchema(propMap)
+			}
+		}
+	}
+	return result
+}
+
+// schemaStrings reads a list of strings from a JSON schema keyword
+func schemaStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		var strs []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		return strs
+	}
+	return nil
+}
+
 // convertFromGeminiToolCalls converts Gemini's tool calls to our generic type
 func convertFromGeminiToolCalls(parts []genai.Part) []ToolCall {
 	var calls []ToolCall
@@ -194,6 +247,7 @@ func convertFromGeminiToolCalls(parts []genai.Part) []ToolCall {
 		if fc, ok := part.(genai.FunctionCall); ok {
 			args, _ := json.Marshal(fc.Args)
 			calls = append(calls, ToolCall{
+				ID:   NewToolCallID(), // Gemini doesn't assign IDs to its function calls
 				Type: "function",
 				Function: ToolCallFunction{
 					Name:      fc.Name,
@@ -206,9 +260,9 @@ func convertFromGeminiToolCalls(parts []genai.Part) []ToolCall {
 	return calls
 }
 
-// CreateChatCompletion implements the LLM interface for Gemini
-func (g *GeminiLLM) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
-	// Create model and configure settings
+// startChat configures a model for the request and returns a chat session
+// holding the earlier turns, along with the parts of the turn to send
+func (g *GeminiLLM) startChat(req ChatCompletionRequest) (*genai.ChatSession, []genai.Part, error) {
 	model := g.client.GenerativeModel(req.Model)
 
 	if req.Temperature > 0 {
@@ -220,127 +274,72 @@ func (g *GeminiLLM) CreateChatCompletion(ctx context.Context, req ChatCompletion
 	if req.MaxTokens > 0 {
 		model.SetMaxOutputTokens(int32(req.MaxTokens))
 	}
+	if len(req.Tools) > 0 {
+		model.Tools = convertToGeminiTools(req.Tools)
+	}
+	// Gemini cannot combine JSON output with function calling; with tools the
+	// schema is sent as an instruction instead
+	messages := req.Messages
+	if req.ResponseFormat.wantsJSON() && len(req.Tools) > 0 {
+		messages = withSchemaInstruction(messages, req.ResponseFormat)
+	} else if req.ResponseFormat.wantsJSON() {
+		model.ResponseMIMEType = "application/json"
+		if req.ResponseFormat.Type == ResponseFormatJSONSchema && len(req.ResponseFormat.Schema) > 0 {
+			model.ResponseSchema = convertToGeminiSchema(req.ResponseFormat.Schema)
+		}
+	}
 
-	// Check if we're in a function calling cycle
-	inFunctionCall := false
-	if len(req.Messages) > 0 {
-		lastMsg := req.Messages[len(req.Messages)-1]
-		inFunctionCall = lastMsg.Role == "function"
+	system, contents := convertToGeminiContents(messages)
+	model.SystemInstruction = system
+
+	if len(contents) == 0 || contents[len(contents)-1].Role != "user" {
+		return nil, nil, fmt.Errorf("conversation must end with a user message or tool result")
 	}
 
-	// Only set tools if we're not in a function calling cycle
-	if len(req.Tools) > 0 && !inFunctionCall {
-		model.Tools = convertToGeminiTools(req.Tools)
+	session := model.StartChat()
+	session.History = contents[:len(contents)-1]
+	return session, contents[len(contents)-1].Parts, nil
+}
+
+// wrapGeminiError converts errors from the Gemini client into a *ProviderError
+func wrapGeminiError(err error) error {
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) {
+		return &ProviderError{Provider: Gemini, Kind: ErrContentFiltered, Message: blocked.Error(), Err: err}
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		message := apiErr.Message
+		if message == "" {
+			message = apiErr.Body
+		}
+		return newStatusError(Gemini, apiErr.Code, message, apiErr.Header, err)
 	}
 
-	// Convert messages to Gemini format
-	parts := convertToGeminiMessages(req.Messages)
+	return wrapTransportError(Gemini, err)
+}
+
+// CreateChatCompletion implements the LLM interface for Gemini
+func (g *GeminiLLM) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	session, parts, err := g.startChat(req)
+	if err != nil {
+		return ChatCompletionResponse{}, err
+	}
 
 	// Generate response
-	resp, err := model.GenerateContent(ctx, parts...)
+	resp, err := session.SendMessage(ctx, parts...)
 	if err != nil {
-		return ChatCompletionResponse{}, fmt.Errorf("failed to generate content: %v", err)
+		return ChatCompletionResponse{}, fmt.Errorf("failed to generate content: %w", wrapGeminiError(err))
 	}
 
 	// Convert response to our format
 	choices := make([]Choice, len(resp.Candidates))
 	for i, c := range resp.Candidates {
-		msg := Message{
-			Role:    RoleAssistant,
-			Content: "",
-		}
-
-		// Handle function calls and text separately
-		var textParts []string
-		for _, part := range c.Content.Parts {
-			switch p := part.(type) {
-			case genai.Text:
-				textParts = append(textParts, string(p))
-			case genai.FunctionCall:
-				if !inFunctionCall {
-					args, err := json.Marshal(p.Args)
-					if err != nil {
-						continue
-					}
-					msg.ToolCalls = append(msg.ToolCalls, ToolCall{
-						Type: "function",
-						Function: ToolCallFunction{
-							Name:      p.Name,
-							Arguments: string(args),
-						},
-					})
-				}
-			}
-		}
-		msg.Content = strings.Join(textParts, "")
-
-		// If we have function calls and we're not in a function calling cycle
-		if len(msg.ToolCalls) > 0 && !inFunctionCall {
-			// Create new messages array with original messages plus function results
-			var newMessages []Message
-			newMessages = append(newMessages, req.Messages...)
-			
-			// Add assistant's message with function calls
-			newMessages = append(newMessages, Message{
-				Role:      RoleAssistant,
-				Content:   msg.Content,
-				ToolCalls: msg.ToolCalls,
-			})
-
-			// Add function results
-			for _, toolCall := range msg.ToolCalls {
-				newMessages = append(newMessages, Message{
-					Role:    "function",
-					Content: toolCall.Function.Arguments,
-					Name:    toolCall.Function.Name,
-				})
-			}
-
-			// Create a new request for the final response
-			finalReq := ChatCompletionRequest{
-				Model:       req.Model,
-				Messages:    newMessages,
-				Temperature: req.Temperature,
-				TopP:       req.TopP,
-				MaxTokens:   req.MaxTokens,
-			}
-
-			// Create a new model instance for the final response
-			finalModel := g.client.GenerativeModel(finalReq.Model)
-			if finalReq.Temperature > 0 {
-				finalModel.SetTemperature(float32(finalReq.Temperature))
-			}
-			if finalReq.TopP > 0 {
-				finalModel.SetTopP(float32(finalReq.TopP))
-			}
-			if finalReq.MaxTokens > 0 {
-				finalModel.SetMaxOutputTokens(int32(finalReq.MaxTokens))
-			}
-
-			// Convert messages to Gemini format
-			finalParts := convertToGeminiMessages(newMessages)
-
-			// Get the final response
-			finalResp, err := finalModel.GenerateContent(ctx, finalParts...)
-			if err != nil {
-				return ChatCompletionResponse{}, fmt.Errorf("failed to generate final response: %v", err)
-			}
-
-			if len(finalResp.Candidates) > 0 {
-				var finalTextParts []string
-				for _, part := range finalResp.Candidates[0].Content.Parts {
-					if t, ok := part.(genai.Text); ok {
-						finalTextParts = append(finalTextParts, string(t))
-					}
-				}
-				msg.Content = strings.Join(finalTextParts, "")
-			}
-		}
-
 		choices[i] = Choice{
 			Index:        i,
-			Message:      msg,
-			FinishReason: string(c.FinishReason),
+			Message:      convertFromGeminiCandidate(c),
+			FinishReason: c.FinishReason.String(),
 		}
 	}
 
@@ -350,9 +349,10 @@ func (g *GeminiLLM) CreateChatCompletion(ctx context.Context, req ChatCompletion
 	}
 	if resp.UsageMetadata != nil {
 		response.Usage = Usage{
-			PromptTokens:     int(resp.UsageMetadata.PromptTokenCount),
-			CompletionTokens: int(resp.UsageMetadata.CandidatesTokenCount),
-			TotalTokens:      int(resp.UsageMetadata.TotalTokenCount),
+			PromptTokens:       int(resp.UsageMetadata.PromptTokenCount),
+			CompletionTokens:   int(resp.UsageMetadata.CandidatesTokenCount),
+			TotalTokens:        int(resp.UsageMetadata.TotalTokenCount),
+			CachedPromptTokens: int(resp.UsageMetadata.CachedContentTokenCount),
 		}
 	}
 
@@ -361,130 +361,46 @@ func (g *GeminiLLM) CreateChatCompletion(ctx context.Context, req ChatCompletion
 
 // geminiStreamWrapper wraps Gemini's stream to implement our ChatCompletionStream interface
 type geminiStreamWrapper struct {
-	iter              *genai.GenerateContentResponseIterator
-	client            *GeminiLLM
-	req               ChatCompletionRequest
-	ctx               context.Context
-	inFunctionCall    bool
-	currentToolCall   *ToolCall
-	toolCallBuffer    map[string]*ToolCall
+	iter *genai.GenerateContentResponseIterator
 }
 
 func (w *geminiStreamWrapper) Recv() (ChatCompletionResponse, error) {
+	if w.iter == nil {
+		return ChatCompletionResponse{}, io.EOF
+	}
+
 	// Get next response from iterator
 	resp, err := w.iter.Next()
+	if err == iterator.Done {
+		return ChatCompletionResponse{}, io.EOF
+	}
 	if err != nil {
-		if w.inFunctionCall {
-			// If we're in a function call and hit the end, start a new stream for the response
-			w.inFunctionCall = false
-			w.iter = nil
-			return w.handleFunctionResponse()
-		}
-		return ChatCompletionResponse{}, err
+		return ChatCompletionResponse{}, wrapGeminiError(err)
 	}
 
+	// Gemini streams function calls whole, so each chunk converts on its own
 	choices := make([]Choice, len(resp.Candidates))
 	for i, c := range resp.Candidates {
-		msg := Message{
-			Role:    RoleAssistant,
-			Content: "",
-		}
-
-		// Handle function calls and text separately
-		var textParts []string
-		for _, part := range c.Content.Parts {
-			switch p := part.(type) {
-			case genai.Text:
-				textParts = append(textParts, string(p))
-			case genai.FunctionCall:
-				if !w.inFunctionCall {
-					args, err := json.Marshal(p.Args)
-					if err != nil {
-						continue
-					}
-
-					// Create or update tool call
-					toolCall, exists := w.toolCallBuffer[p.Name]
-					if !exists {
-						toolCall = &ToolCall{
-							ID:   p.Name, // Use function name as ID since Gemini doesn't provide one
-							Type: "function",
-							Function: ToolCallFunction{
-								Name:      p.Name,
-								Arguments: "",
-							},
-						}
-						w.toolCallBuffer[p.Name] = toolCall
-						w.currentToolCall = toolCall
-					}
-
-					// Update arguments
-					toolCall.Function.Arguments += string(args)
-
-					// Try to parse the arguments to verify if it's complete JSON
-					var parsedArgs map[string]interface{}
-					if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &parsedArgs); err == nil {
-						// Add to message's tool calls and remove from buffer
-						msg.ToolCalls = append(msg.ToolCalls, *toolCall)
-						delete(w.toolCallBuffer, p.Name)
-						w.currentToolCall = nil
-						w.inFunctionCall = true
-					}
-				}
-			}
-		}
-		msg.Content = strings.Join(textParts, "")
-
 		choices[i] = Choice{
 			Index:        i,
-			Message:      msg,
-			FinishReason: string(c.FinishReason),
+			Message:      convertFromGeminiCandidate(c),
+			FinishReason: c.FinishReason.String(),
 		}
 	}
 
-	return ChatCompletionResponse{
+	response := ChatCompletionResponse{
 		Choices: choices,
-	}, nil
-}
-
-func (w *geminiStreamWrapper) handleFunctionResponse() (ChatCompletionResponse, error) {
-	// Create new messages array with original messages plus function results
-	var newMessages []Message
-	newMessages = append(newMessages, w.req.Messages...)
-	
-	// Add the last assistant message with function calls
-	lastAssistantMsg := w.req.Messages[len(w.req.Messages)-1]
-	newMessages = append(newMessages, lastAssistantMsg)
-
-	// Add function results from tool calls
-	for _, toolCall := range lastAssistantMsg.ToolCalls {
-		newMessages = append(newMessages, Message{
-			Role:    "function",
-			Content: toolCall.Function.Arguments,
-			Name:    toolCall.Function.Name,
-		})
-	}
-
-	// Create a new model instance for the final response
-	model := w.client.client.GenerativeModel(w.req.Model)
-	if w.req.Temperature > 0 {
-		model.SetTemperature(float32(w.req.Temperature))
-	}
-	if w.req.TopP > 0 {
-		model.SetTopP(float32(w.req.TopP))
 	}
-	if w.req.MaxTokens > 0 {
-		model.SetMaxOutputTokens(int32(w.req.MaxTokens))
+	if resp.UsageMetadata != nil {
+		response.Usage = Usage{
+			PromptTokens:       int(resp.UsageMetadata.PromptTokenCount),
+			CompletionTokens:   int(resp.UsageMetadata.CandidatesTokenCount),
+			TotalTokens:        int(resp.UsageMetadata.TotalTokenCount),
+			CachedPromptTokens: int(resp.UsageMetadata.CachedContentTokenCount),
+		}
 	}
 
-	// Convert messages to Gemini format
-	parts := convertToGeminiMessages(newMessages)
-
-	// Start new stream for the response
-	w.iter = model.GenerateContentStream(w.ctx, parts...)
-	
-	// Get first response from new stream
-	return w.Recv()
+	return response, nil
 }
 
 func (w *geminiStreamWrapper) Close() error {
@@ -494,43 +410,13 @@ func (w *geminiStreamWrapper) Close() error {
 
 // CreateChatCompletionStream implements the LLM interface for Gemini streaming
 func (g *GeminiLLM) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
-	// Create model and configure settings
-	model := g.client.GenerativeModel(req.Model)
-
-	if req.Temperature > 0 {
-		model.SetTemperature(float32(req.Temperature))
-	}
-	if req.TopP > 0 {
-		model.SetTopP(float32(req.TopP))
-	}
-	if req.MaxTokens > 0 {
-		model.SetMaxOutputTokens(int32(req.MaxTokens))
-	}
-
-	// Check if we're in a function calling cycle
-	inFunctionCall := false
-	if len(req.Messages) > 0 {
-		lastMsg := req.Messages[len(req.Messages)-1]
-		inFunctionCall = lastMsg.Role == "function" || (lastMsg.Role == RoleAssistant && len(lastMsg.ToolCalls) > 0)
-	}
-
-	// Only set tools if we're not in a function calling cycle
-	if len(req.Tools) > 0 && !inFunctionCall {
-		model.Tools = convertToGeminiTools(req.Tools)
+	session, parts, err := g.startChat(req)
+	if err != nil {
+		return nil, err
 	}
 
-	// Convert messages to Gemini format
-	parts := convertToGeminiMessages(req.Messages)
-
 	// Generate streaming response
-	iter := model.GenerateContentStream(ctx, parts...)
-
 	return &geminiStreamWrapper{
-		iter:           iter,
-		client:         g,
-		req:            req,
-		ctx:            ctx,
-		inFunctionCall: inFunctionCall,
-		toolCallBuffer: make(map[string]*ToolCall),
+		iter: session.SendMessageStream(ctx, parts...),
 	}, nil
 }
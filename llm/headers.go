@@ -0,0 +1,76 @@
+package llm
+
+import (
+	"context"
+	"net/http"
+)
+
+// headersKey is the context key of the headers added by WithHeaders
+type headersKey struct{}
+
+// WithHeaders returns a context that makes providers send headers with the
+// requests made under it, in addition to any headers already added. The OpenAI,
+// Claude, DeepSeek and Ollama providers support this; Gemini ignores them.
+func WithHeaders(ctx context.Context, headers http.Header) context.Context {
+	merged := HeadersFromContext(ctx).Clone()
+	if merged == nil {
+		merged = make(http.Header, len(headers))
+	}
+	for key, values := range headers {
+		for _, value := range values {
+			merged.Add(key, value)
+		}
+	}
+	return context.WithValue(ctx, headersKey{}, merged)
+}
+
+// HeadersFromContext returns the headers added to ctx by WithHeaders
+func HeadersFromContext(ctx context.Context) http.Header {
+	headers, _ := ctx.Value(headersKey{}).(http.Header)
+	return headers
+}
+
+// headerTransport adds the headers of each request's context before sending it
+type headerTransport struct {
+	base http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	headers := HeadersFromContext(req.Context())
+	if len(headers) == 0 {
+		return base.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	for key, values := range headers {
+		req.Header.Del(key)
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	return base.RoundTrip(req)
+}
+
+// newHeaderClient returns an HTTP client that sends the headers added with WithHeaders
+func newHeaderClient() *http.Client {
+	return &http.Client{Transport: &headerTransport{}}
+}
+
+// withHeaderTransport returns a copy of client that also sends the headers
+// added with WithHeaders. A nil client gets the default transport.
+func withHeaderTransport(client *http.Client) *http.Client {
+	if client == nil {
+		return newHeaderClient()
+	}
+	if _, ok := client.Transport.(*headerTransport); ok {
+		return client
+	}
+	wrapped := *client
+	wrapped.Transport = &headerTransport{base: client.Transport}
+	return &wrapped
+}
@@ -2,6 +2,10 @@ package llm
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
 )
 
 // Role represents the role of a message participant
@@ -31,10 +35,11 @@ const (
 
 // Message represents a single message in a chat conversation
 type Message struct {
-	Role      Role       `json:"role"`
-	Content   string     `json:"content"`
-	Name      string     `json:"name,omitempty"`
-	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	Role       Role       `json:"role"`
+	Content    string     `json:"content"`
+	Name       string     `json:"name,omitempty"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"` // For RoleTool messages, the ID of the call being answered
 }
 
 // ChatCompletionRequest represents a generic request for chat completion
@@ -51,6 +56,70 @@ type ChatCompletionRequest struct {
 	User             string    `json:"user,omitempty"`
 	Tools            []Tool    `json:"tools,omitempty"`
 	Stream           bool      `json:"stream,omitempty"`
+
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+}
+
+// ResponseFormatType selects the format of the model's reply
+type ResponseFormatType string
+
+const (
+	ResponseFormatText       ResponseFormatType = "text"
+	ResponseFormatJSONObject ResponseFormatType = "json_object"
+	ResponseFormatJSONSchema ResponseFormatType = "json_schema"
+)
+
+// DefaultResponseFormatName is used when a JSON schema response format has no name
+const DefaultResponseFormatName = "structured_output"
+
+// ResponseFormat asks the model to reply with JSON. With ResponseFormatJSONSchema
+// the reply must also match Schema. Providers without native support for schemas
+// are given the schema as an instruction instead.
+type ResponseFormat struct {
+	Type        ResponseFormatType     `json:"type"`
+	Name        string                 `json:"name,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Schema      map[string]interface{} `json:"schema,omitempty"`
+	Strict      bool                   `json:"strict,omitempty"`
+}
+
+// wantsJSON reports whether the format asks for a JSON reply
+func (f *ResponseFormat) wantsJSON() bool {
+	return f != nil && (f.Type == ResponseFormatJSONObject || f.Type == ResponseFormatJSONSchema)
+}
+
+// schemaName returns the name of the format's schema
+func (f *ResponseFormat) schemaName() string {
+	if f.Name != "" {
+		return f.Name
+	}
+	return DefaultResponseFormatName
+}
+
+// withSchemaInstruction tells the model which JSON schema its reply must match,
+// for providers that only support a plain JSON mode. The instruction is added
+// to the first system message, or sent as a new one.
+func withSchemaInstruction(messages []Message, format *ResponseFormat) []Message {
+	if format == nil || format.Type != ResponseFormatJSONSchema || len(format.Schema) == 0 {
+		return messages
+	}
+	schema, err := json.Marshal(format.Schema)
+	if err != nil {
+		return messages
+	}
+	instruction := fmt.Sprintf("Respond only with a JSON object that matches this JSON schema:\n%s", schema)
+
+	result := make([]Message, 0, len(messages)+1)
+	for i, msg := range messages {
+		if msg.Role == RoleSystem {
+			result = append(result, messages[:i]...)
+			msg.Content += "\n\n" + instruction
+			result = append(result, msg)
+			return append(result, messages[i+1:]...)
+		}
+	}
+	result = append(result, Message{Role: RoleSystem, Content: instruction})
+	return append(result, messages...)
 }
 
 // ChatCompletionResponse represents a generic response from chat completion
@@ -58,6 +127,10 @@ type ChatCompletionResponse struct {
 	ID      string   `json:"id"`
 	Choices []Choice `json:"choices"`
 	Usage   Usage    `json:"usage"`
+
+	// Set by a Fallback: the entry that answered and the model it used
+	Backend string `json:"backend,omitempty"`
+	Model   string `json:"model,omitempty"`
 }
 
 // Choice represents a completion choice
@@ -72,6 +145,9 @@ type Usage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
+
+	// CachedPromptTokens is the part of PromptTokens served from the provider's prompt cache
+	CachedPromptTokens int `json:"cached_prompt_tokens,omitempty"`
 }
 
 // LLM defines the interface that all LLM providers must implement
@@ -125,3 +201,79 @@ type ToolCallFunction struct {
 	Name      string `json:"name"`
 	Arguments string `json:"arguments"`
 }
+
+// NewToolCallID generates an ID for providers that do not assign one to their tool calls
+func NewToolCallID() string {
+	return "call_" + uuid.New().String()
+}
+
+// normalizeToolMessages prepares tool results for conversion to a provider format.
+// Legacy RoleFunction results are turned into RoleTool messages and, when they
+// carry no ToolCallID, paired by name with the first unanswered call of the
+// preceding assistant message. The results following an assistant message are
+// then ordered like its tool calls, so positional providers pair them exactly.
+func normalizeToolMessages(messages []Message) []Message {
+	normalized := make([]Message, 0, len(messages))
+
+	for i := 0; i < len(messages); i++ {
+		msg := messages[i]
+		normalized = append(normalized, msg)
+		if msg.Role != RoleAssistant || len(msg.ToolCalls) == 0 {
+			continue
+		}
+
+		// Collect the block of results answering this assistant message
+		var results []Message
+		for i+1 < len(messages) && isToolResult(messages[i+1]) {
+			i++
+			results = append(results, messages[i])
+		}
+
+		answered := make(map[string]bool)
+		for j := range results {
+			results[j].Role = RoleTool
+			if results[j].ToolCallID != "" {
+				answered[results[j].ToolCallID] = true
+			}
+		}
+		for j := range results {
+			if results[j].ToolCallID != "" {
+				continue
+			}
+			for _, call := range msg.ToolCalls {
+				if !answered[call.ID] && call.Function.Name == results[j].Name {
+					results[j].ToolCallID = call.ID
+					answered[call.ID] = true
+					break
+				}
+			}
+		}
+
+		// Emit results in call order, followed by any that match no call
+		used := make([]bool, len(results))
+		for _, call := range msg.ToolCalls {
+			for j, result := range results {
+				if !used[j] && result.ToolCallID == call.ID {
+					if result.Name == "" {
+						result.Name = call.Function.Name
+					}
+					normalized = append(normalized, result)
+					used[j] = true
+					break
+				}
+			}
+		}
+		for j, result := range results {
+			if !used[j] {
+				normalized = append(normalized, result)
+			}
+		}
+	}
+
+	return normalized
+}
+
+// isToolResult reports whether a message carries the result of a tool call
+func isToolResult(msg Message) bool {
+	return msg.Role == RoleTool || msg.Role == RoleFunction
+}
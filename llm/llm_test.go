@@ -0,0 +1,608 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/ollama/ollama/api"
+	"github.com/rsaranusc/openai-compatible"
+	"github.com/stretchr/testify/assert"
+)
+
+func toolCallTurn() Message {
+	return Message{
+		Role: RoleAssistant,
+		ToolCalls: []ToolCall{
+			{ID: "call_a", Type: "function", Function: ToolCallFunction{Name: "lookup", Arguments: `{"city":"Paris"}`}},
+			{ID: "call_b", Type: "function", Function: ToolCallFunction{Name: "lookup", Arguments: `{"city":"Rome"}`}},
+		},
+	}
+}
+
+// TestNormalizeToolMessagesOrdersByCall tests that results follow the order of their calls
+func TestNormalizeToolMessagesOrdersByCall(t *testing.T) {
+	messages := []Message{
+		{Role: RoleUser, Content: "Weather?"},
+		toolCallTurn(),
+		{Role: RoleTool, Name: "lookup", Content: "Rome", ToolCallID: "call_b"},
+		{Role: RoleTool, Name: "lookup", Content: "Paris", ToolCallID: "call_a"},
+	}
+
+	normalized := normalizeToolMessages(messages)
+
+	assert.Len(t, normalized, 4)
+	assert.Equal(t, "call_a", normalized[2].ToolCallID)
+	assert.Equal(t, "Paris", normalized[2].Content)
+	assert.Equal(t, "call_b", normalized[3].ToolCallID)
+	assert.Equal(t, "Rome", normalized[3].Content)
+}
+
+// TestNormalizeToolMessagesLegacyFunctionRole tests that legacy function results are paired in order
+func TestNormalizeToolMessagesLegacyFunctionRole(t *testing.T) {
+	messages := []Message{
+		toolCallTurn(),
+		{Role: RoleFunction, Name: "lookup", Content: "Paris"},
+		{Role: RoleFunction, Name: "lookup", Content: "Rome"},
+	}
+
+	normalized := normalizeToolMessages(messages)
+
+	assert.Equal(t, Message{Role: RoleTool, Name: "lookup", Content: "Paris", ToolCallID: "call_a"}, normalized[1])
+	assert.Equal(t, Message{Role: RoleTool, Name: "lookup", Content: "Rome", ToolCallID: "call_b"}, normalized[2])
+}
+
+// TestConvertToOpenAIMessagesToolCalls tests that tool calls and results keep their IDs
+func TestConvertToOpenAIMessagesToolCalls(t *testing.T) {
+	messages := []Message{
+		toolCallTurn(),
+		{Role: RoleTool, Name: "lookup", Content: "Paris", ToolCallID: "call_a"},
+		{Role: RoleTool, Name: "lookup", Content: "Rome", ToolCallID: "call_b"},
+	}
+
+	converted := convertToOpenAIMessages(messages)
+
+	assert.Len(t, converted[0].ToolCalls, 2)
+	assert.Equal(t, "call_b", converted[0].ToolCalls[1].ID)
+	assert.Equal(t, "tool", converted[2].Role)
+	assert.Equal(t, "call_b", converted[2].ToolCallID)
+}
+
+// TestConvertToClaudeMessagesGroupsResults tests that tool results form one user message
+func TestConvertToClaudeMessagesGroupsResults(t *testing.T) {
+	messages := []Message{
+		{Role: RoleUser, Content: "Weather?"},
+		toolCallTurn(),
+		{Role: RoleTool, Name: "lookup", Content: "Paris", ToolCallID: "call_a"},
+		{Role: RoleTool, Name: "lookup", Content: "Rome", ToolCallID: "call_b"},
+	}
+
+	converted := convertToClaudeMessages(messages)
+
+	assert.Len(t, converted, 3)
+	assert.Len(t, converted[1].Content.Value, 2)
+	assert.Len(t, converted[2].Content.Value, 2)
+}
+
+// TestConvertToOllamaToolsMissingFields tests schemas without required or descriptions
+func TestConvertToOllamaToolsMissingFields(t *testing.T) {
+	tools := []Tool{{
+		Type: "function",
+		Function: &Function{
+			Name: "lookup",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"city": map[string]interface{}{"type": "string"},
+				},
+			},
+		},
+	}}
+
+	converted := convertToOllamaTools(tools)
+
+	assert.Len(t, converted, 1)
+	assert.Empty(t, converted[0].Function.Parameters.Required)
+	assert.Equal(t, "string", converted[0].Function.Parameters.Properties["city"].Type)
+}
+
+func citySchemaFormat() *ResponseFormat {
+	return &ResponseFormat{
+		Type: ResponseFormatJSONSchema,
+		Name: "city",
+		Schema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"name": map[string]interface{}{"type": "string"},
+				"tags": map[string]interface{}{
+					"type":  "array",
+					"items": map[string]interface{}{"type": "string", "enum": []interface{}{"big", "small"}},
+				},
+			},
+			"required": []interface{}{"name"},
+		},
+	}
+}
+
+// TestConvertToOpenAIResponseFormat tests that a schema format is sent as OpenAI's json_schema
+func TestConvertToOpenAIResponseFormat(t *testing.T) {
+	assert.Nil(t, convertToOpenAIResponseFormat(nil))
+
+	format := convertToOpenAIResponseFormat(citySchemaFormat())
+
+	assert.Equal(t, "json_schema", string(format.Type))
+	assert.Equal(t, "city", format.JSONSchema.Name)
+	schema, err := format.JSONSchema.Schema.MarshalJSON()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"type":"object","properties":{"name":{"type":"string"},"tags":{"type":"array","items":{"type":"string","enum":["big","small"]}}},"required":["name"]}`, string(schema))
+
+	jsonMode := convertToOpenAIResponseFormat(&ResponseFormat{Type: ResponseFormatJSONObject})
+	assert.Equal(t, "json_object", string(jsonMode.Type))
+	assert.Nil(t, jsonMode.JSONSchema)
+}
+
+// TestWithSchemaInstruction tests that providers without schema support get the schema in the system message
+func TestWithSchemaInstruction(t *testing.T) {
+	messages := []Message{
+		{Role: RoleSystem, Content: "Be brief."},
+		{Role: RoleUser, Content: "Describe Paris"},
+	}
+
+	withSchema := withSchemaInstruction(messages, citySchemaFormat())
+
+	assert.Len(t, withSchema, 2)
+	assert.Contains(t, withSchema[0].Content, "Be brief.")
+	assert.Contains(t, withSchema[0].Content, `"required":["name"]`)
+	assert.Equal(t, "Be brief.", messages[0].Content)
+
+	withoutSystem := withSchemaInstruction(messages[1:], citySchemaFormat())
+	assert.Len(t, withoutSystem, 2)
+	assert.Equal(t, RoleSystem, withoutSystem[0].Role)
+
+	assert.Equal(t, messages, withSchemaInstruction(messages, &ResponseFormat{Type: ResponseFormatJSONObject}))
+	assert.Equal(t, &deepseekResponseFormat{Type: "json_object"}, convertToDeepSeekResponseFormat(citySchemaFormat()))
+}
+
+// TestConvertToOllamaFormat tests that Ollama receives the schema itself or plain JSON mode
+func TestConvertToOllamaFormat(t *testing.T) {
+	assert.Nil(t, convertToOllamaFormat(nil))
+	assert.Nil(t, convertToOllamaFormat(&ResponseFormat{Type: ResponseFormatText}))
+	assert.Equal(t, `"json"`, string(convertToOllamaFormat(&ResponseFormat{Type: ResponseFormatJSONObject})))
+	assert.Contains(t, string(convertToOllamaFormat(citySchemaFormat())), `"required":["name"]`)
+}
+
+// TestConvertToGeminiSchema tests that nested JSON schemas keep their items, enums and required fields
+func TestConvertToGeminiSchema(t *testing.T) {
+	schema := convertToGeminiSchema(citySchemaFormat().Schema)
+
+	assert.Equal(t, []string{"name"}, schema.Required)
+	assert.Equal(t, convertSchemaType("string"), schema.Properties["name"].Type)
+	tags := schema.Properties["tags"]
+	assert.Equal(t, convertSchemaType("array"), tags.Type)
+	assert.Equal(t, []string{"big", "small"}, tags.Items.Enum)
+
+	nullable := convertToGeminiSchema(map[string]interface{}{"type": []interface{}{"string", "null"}})
+	assert.True(t, nullable.Nullable)
+	assert.Equal(t, convertSchemaType("string"), nullable.Type)
+}
+
+// TestConvertToGeminiTools tests that tool parameters keep nested schemas such as array items
+func TestConvertToGeminiTools(t *testing.T) {
+	tools := convertToGeminiTools([]Tool{{Type: "function", Function: &Function{
+		Name:       "tag_city",
+		Parameters: citySchemaFormat().Schema,
+	}}})
+
+	params := tools[0].FunctionDeclarations[0].Parameters
+	assert.Equal(t, convertSchemaType("object"), params.Type)
+	assert.Equal(t, []string{"name"}, params.Required)
+	if assert.NotNil(t, params.Properties["tags"].Items) {
+		assert.Equal(t, []string{"big", "small"}, params.Properties["tags"].Items.Enum)
+	}
+}
+
+// TestExtractStructuredOutput tests that the call to Claude's output tool becomes the reply content
+func TestExtractStructuredOutput(t *testing.T) {
+	msg := Message{
+		Role: RoleAssistant,
+		ToolCalls: []ToolCall{
+			{ID: "toolu_1", Function: ToolCallFunction{Name: "lookup", Arguments: `{}`}},
+			{ID: "toolu_2", Function: ToolCallFunction{Name: "city", Arguments: `{"name":"Paris"}`}},
+		},
+	}
+
+	out := extractStructuredOutput(msg, "city")
+
+	assert.Equal(t, `{"name":"Paris"}`, out.Content)
+	assert.Len(t, out.ToolCalls, 1)
+	assert.Equal(t, "lookup", out.ToolCalls[0].Function.Name)
+	assert.Equal(t, msg, extractStructuredOutput(msg, ""))
+}
+
+// TestProviderErrorKinds tests classifying provider errors by status and message
+func TestProviderErrorKinds(t *testing.T) {
+	tests := []struct {
+		status  int
+		message string
+		kind    error
+	}{
+		{429, "slow down", ErrRateLimited},
+		{401, "bad key", ErrAuthentication},
+		{403, "forbidden", ErrAuthentication},
+		{400, "This model's maximum context length is 8192 tokens", ErrContextTooLong},
+		{400, "prompt is too long: 210000 tokens > 200000 maximum", ErrContextTooLong},
+		{404, "model not found", ErrInvalidRequest},
+		{500, "oops", ErrServer},
+		{529, "overloaded", ErrServer},
+		{504, "gateway timeout", ErrTimeout},
+	}
+	for _, tt := range tests {
+		err := newStatusError(OpenAI, tt.status, tt.message, nil, nil)
+		assert.ErrorIs(t, err, tt.kind, tt.message)
+	}
+
+	// Retry-After in seconds
+	header := http.Header{"Retry-After": []string{"3"}}
+	var err error = newStatusError(Claude, 429, "rate_limit_error", header, nil)
+	wait, ok := RetryAfter(fmt.Errorf("wrapped: %w", err))
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, wait)
+	assert.True(t, IsRetryable(err))
+
+	// Timeouts before the provider answered
+	err = wrapTransportError(DeepSeek, fmt.Errorf("send: %w", context.DeadlineExceeded))
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, context.Canceled, wrapTransportError(DeepSeek, context.Canceled))
+	assert.False(t, IsRetryable(context.Canceled))
+
+	// Network failures are retried; local errors that cannot succeed are not
+	assert.True(t, IsRetryable(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	assert.True(t, IsRetryable(fmt.Errorf("read body: %w", io.ErrUnexpectedEOF)))
+	assert.True(t, IsRetryable(fmt.Errorf("send: %w", context.DeadlineExceeded)))
+	assert.False(t, IsRetryable(errors.New("conversation must end with a user message")))
+	assert.False(t, IsRetryable(nil))
+}
+
+// TestWrapProviderErrors tests that each provider's own errors become provider errors
+func TestWrapProviderErrors(t *testing.T) {
+	var providerErr *ProviderError
+
+	apiErr := &openai.APIError{Code: "context_length_exceeded", Message: "too long", HTTPStatusCode: 400}
+	err := wrapOpenAIError(fmt.Errorf("request: %w", apiErr))
+	assert.ErrorIs(t, err, ErrContextTooLong)
+	assert.ErrorAs(t, err, &apiErr)
+
+	err = wrapOpenAIError(&openai.RequestError{HTTPStatusCode: 503, HTTPHeader: http.Header{"Retry-After": []string{"1"}}})
+	assert.ErrorIs(t, err, ErrServer)
+	assert.ErrorAs(t, err, &providerErr)
+	assert.Equal(t, time.Second, providerErr.RetryAfter)
+
+	err = wrapOllamaError(api.StatusError{StatusCode: 404, ErrorMessage: `model "llama9" not found`})
+	assert.ErrorIs(t, err, ErrInvalidRequest)
+	assert.ErrorAs(t, err, &providerErr)
+	assert.Equal(t, Ollama, providerErr.Provider)
+
+	err = wrapGeminiError(&genai.BlockedError{})
+	assert.ErrorIs(t, err, ErrContentFiltered)
+
+	resp := &http.Response{
+		StatusCode: 402,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(`{"error":{"message":"Insufficient Balance"}}`)),
+	}
+	err = deepseekStatusError(resp)
+	assert.ErrorIs(t, err, ErrAuthentication)
+	assert.EqualError(t, err, "DEEPSEEK: authentication failed (status 402): Insufficient Balance")
+}
+
+// TestRateLimitReset tests reading the wait from OpenAI's rate limit headers
+func TestRateLimitReset(t *testing.T) {
+	header := http.Header{
+		"X-Ratelimit-Remaining-Requests": []string{"0"},
+		"X-Ratelimit-Reset-Requests":     []string{"1.5s"},
+		"X-Ratelimit-Remaining-Tokens":   []string{"900"},
+		"X-Ratelimit-Reset-Tokens":       []string{"6m0s"},
+	}
+	err := wrapOpenAIError(&openai.APIError{HTTPStatusCode: 429, HTTPHeader: header, Message: "Rate limit reached"})
+
+	wait, ok := RetryAfter(err)
+	assert.True(t, ok)
+	assert.Equal(t, 1500*time.Millisecond, wait)
+	assert.ErrorIs(t, err, ErrRateLimited)
+}
+
+// fakeLLM replies with a fixed message and streams it in two chunks
+type fakeLLM struct {
+	requests []ChatCompletionRequest
+}
+
+func (f *fakeLLM) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	f.requests = append(f.requests, req)
+	return ChatCompletionResponse{
+		Choices: []Choice{{Message: Message{Role: RoleAssistant, Content: "Hello"}}},
+		Usage:   Usage{PromptTokens: 3, CompletionTokens: 1},
+	}, nil
+}
+
+func (f *fakeLLM) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	f.requests = append(f.requests, req)
+	return &sliceStream{chunks: []string{"Hel", "lo"}}, nil
+}
+
+// sliceStream streams one chunk per string
+type sliceStream struct {
+	chunks []string
+}
+
+func (s *sliceStream) Recv() (ChatCompletionResponse, error) {
+	if len(s.chunks) == 0 {
+		return ChatCompletionResponse{}, io.EOF
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return ChatCompletionResponse{Choices: []Choice{{Message: Message{Content: chunk}}}}, nil
+}
+
+func (s *sliceStream) Close() error { return nil }
+
+// TestChainOrder tests that the first middleware sees requests first
+func TestChainOrder(t *testing.T) {
+	var order []string
+	tag := func(name string) Middleware {
+		return RequestMiddleware(func(ctx context.Context, req ChatCompletionRequest) (context.Context, ChatCompletionRequest, error) {
+			order = append(order, name)
+			req.Model += "+" + name
+			return ctx, req, nil
+		})
+	}
+
+	fake := &fakeLLM{}
+	client := Chain(fake, tag("outer"), tag("inner"))
+
+	_, err := client.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "m"})
+	assert.NoError(t, err)
+	_, err = client.CreateChatCompletionStream(context.Background(), ChatCompletionRequest{Model: "m"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"outer", "inner", "outer", "inner"}, order)
+	assert.Equal(t, "m+outer+inner", fake.requests[0].Model)
+	assert.Equal(t, "m+outer+inner", fake.requests[1].Model)
+	assert.Equal(t, fake, Chain(fake))
+}
+
+// TestLoggingAndTimingMiddleware tests the built-in logging and timing middlewares
+func TestLoggingAndTimingMiddleware(t *testing.T) {
+	var buf strings.Builder
+	var timings []CallTiming
+	client := Chain(&fakeLLM{},
+		LoggingMiddleware(slog.New(slog.NewTextHandler(&buf, nil)), true),
+		TimingMiddleware(func(timing CallTiming) { timings = append(timings, timing) }),
+	)
+	req := ChatCompletionRequest{Model: "m", Messages: []Message{{Role: RoleUser, Content: "Hi"}}}
+
+	_, err := client.CreateChatCompletion(context.Background(), req)
+	assert.NoError(t, err)
+
+	stream, err := client.CreateChatCompletionStream(context.Background(), req)
+	assert.NoError(t, err)
+	for {
+		if _, err := stream.Recv(); err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+	}
+	assert.NoError(t, stream.Close())
+
+	logged := buf.String()
+	assert.Contains(t, logged, `level=INFO msg="llm request" model=m stream=false messages=1 tools=0`)
+	assert.Contains(t, logged, `msg="llm request content" model=m role=user content=Hi`)
+	assert.Contains(t, logged, "prompt_tokens=3 completion_tokens=1")
+	assert.Contains(t, logged, `msg="llm stream end" model=m`)
+	assert.Contains(t, logged, `msg="llm response content" model=m content=Hello`)
+
+	// The handler's level decides what is logged
+	buf.Reset()
+	quiet := Chain(&fakeLLM{}, LoggingMiddleware(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelError})), true))
+	_, err = quiet.CreateChatCompletion(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Empty(t, buf.String())
+
+	// The stream is reported once, when it ends
+	assert.Len(t, timings, 2)
+	assert.False(t, timings[0].Stream)
+	assert.True(t, timings[1].Stream)
+	assert.NoError(t, timings[1].Err)
+	assert.LessOrEqual(t, timings[1].FirstChunk, timings[1].Duration)
+}
+
+// TestHeaderMiddleware tests that headers reach the provider's HTTP requests
+func TestHeaderMiddleware(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}]}`)
+	}))
+	defer server.Close()
+
+	client := Chain(NewOpenAILLMWithHost("key", server.URL+"/v1"),
+		HeaderMiddleware(http.Header{"X-Team": []string{"search"}}),
+	)
+	ctx := WithHeaders(context.Background(), http.Header{"X-Request-Id": []string{"abc"}})
+
+	resp, err := client.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "m", Messages: []Message{{Role: RoleUser, Content: "Hi"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", resp.Choices[0].Message.Content)
+	assert.Equal(t, "search", received.Get("X-Team"))
+	assert.Equal(t, "abc", received.Get("X-Request-Id"))
+	assert.Equal(t, "Bearer key", received.Get("Authorization"))
+}
+
+// TestOpenAIReasoningMaxTokens tests that o1 and o3 requests send their limit as max_completion_tokens
+func TestOpenAIReasoningMaxTokens(t *testing.T) {
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = nil
+		_ = json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}]}`)
+	}))
+	defer server.Close()
+	client := NewOpenAILLMWithHost("key", server.URL+"/v1")
+	messages := []Message{{Role: RoleUser, Content: "Hi"}}
+
+	_, err := client.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "o3-mini", Messages: messages, MaxTokens: 100000})
+	assert.NoError(t, err)
+	assert.Equal(t, float64(100000), received["max_completion_tokens"])
+	assert.NotContains(t, received, "max_tokens")
+
+	_, err = client.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "gpt-4o", Messages: messages, MaxTokens: 512})
+	assert.NoError(t, err)
+	assert.Equal(t, float64(512), received["max_tokens"])
+}
+
+// failingLLM fails every call with err
+type failingLLM struct {
+	err   error
+	calls int
+}
+
+func (f *failingLLM) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	f.calls++
+	return ChatCompletionResponse{}, f.err
+}
+
+func (f *failingLLM) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	f.calls++
+	return nil, f.err
+}
+
+// TestFallback tests that requests move down the chain on the configured errors
+func TestFallback(t *testing.T) {
+	ctx := context.Background()
+	rateLimited := &failingLLM{err: &ProviderError{Provider: OpenAI, Kind: ErrRateLimited}}
+	local := &fakeLLM{}
+	fallback := NewFallback(
+		FallbackEntry{Name: "openai", Client: rateLimited, Model: "gpt-4o"},
+		FallbackEntry{Client: local, Model: "llama3.2", MaxTokens: 2048},
+	)
+
+	resp, err := fallback.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "default", MaxTokens: 16384})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", resp.Choices[0].Message.Content)
+	assert.Equal(t, "llama3.2", resp.Backend)
+	assert.Equal(t, "llama3.2", resp.Model)
+	assert.Equal(t, 2048, local.requests[0].MaxTokens)
+
+	// Errors that are not retryable are returned at once
+	invalid := &failingLLM{err: &ProviderError{Provider: Claude, Kind: ErrInvalidRequest}}
+	fallback.Entries[0].Client = invalid
+	_, err = fallback.CreateChatCompletion(ctx, ChatCompletionRequest{})
+	assert.ErrorIs(t, err, ErrInvalidRequest)
+	assert.Len(t, local.requests, 1)
+
+	// Custom rules choose the error kinds
+	fallback.ShouldFallback = FallbackOn(ErrInvalidRequest, ErrContextTooLong)
+	_, err = fallback.CreateChatCompletion(ctx, ChatCompletionRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, local.requests, 2)
+
+	// When every backend fails, all errors are reported
+	fallback = NewFallback(FallbackEntry{Name: "a", Client: rateLimited}, FallbackEntry{Name: "b", Client: &failingLLM{err: ErrServer}})
+	_, err = fallback.CreateChatCompletion(ctx, ChatCompletionRequest{})
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.ErrorIs(t, err, ErrServer)
+	assert.Contains(t, err.Error(), "all 2 backends failed")
+
+	_, err = NewFallback().CreateChatCompletion(ctx, ChatCompletionRequest{})
+	assert.ErrorIs(t, err, ErrNoBackends)
+}
+
+// brokenStream fails before sending any chunk
+type brokenStream struct{ err error }
+
+func (s *brokenStream) Recv() (ChatCompletionResponse, error) { return ChatCompletionResponse{}, s.err }
+func (s *brokenStream) Close() error                          { return nil }
+
+// TestFallbackStream tests falling back when a stream fails to open or to start
+func TestFallbackStream(t *testing.T) {
+	ctx := context.Background()
+	broken := LLMFuncs{
+		Completion: (&failingLLM{}).CreateChatCompletion,
+		Stream: func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+			return &brokenStream{err: &ProviderError{Provider: Claude, Kind: ErrServer}}, nil
+		},
+	}
+	fallback := NewFallback(
+		FallbackEntry{Name: "down", Client: &failingLLM{err: ErrTimeout}},
+		FallbackEntry{Name: "broken", Client: broken},
+		FallbackEntry{Name: "local", Client: &fakeLLM{}},
+	)
+
+	stream, err := fallback.CreateChatCompletionStream(ctx, ChatCompletionRequest{Model: "m"})
+	assert.NoError(t, err)
+	var content string
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, "local", chunk.Backend)
+		content += chunk.Choices[0].Message.Content
+	}
+	assert.Equal(t, "Hello", content)
+	assert.NoError(t, stream.Close())
+}
+
+// TestFallbackHistoryConvertsAcrossProviders tests that a history with turns
+// from several providers converts for each of them
+func TestFallbackHistoryConvertsAcrossProviders(t *testing.T) {
+	messages := []Message{
+		{Role: RoleSystem, Content: "Be brief."},
+		{Role: RoleUser, Content: "Weather in Paris and Rome?"},
+		// Answered by Claude, results sent back in reverse order
+		{Role: RoleAssistant, Name: "Agent", ToolCalls: []ToolCall{
+			{ID: "toolu_01", Type: "function", Function: ToolCallFunction{Name: "lookup", Arguments: `{"city":"Paris"}`}},
+			{ID: "toolu_02", Type: "function", Function: ToolCallFunction{Name: "lookup", Arguments: `{"city":"Rome"}`}},
+		}},
+		{Role: RoleTool, Name: "lookup", Content: "Rome: sunny", ToolCallID: "toolu_02"},
+		{Role: RoleTool, Name: "lookup", Content: "Paris: rain", ToolCallID: "toolu_01"},
+		// Answered by Ollama after a fallback, with generated IDs and empty arguments
+		{Role: RoleAssistant, Content: "Checking the forecast.", ToolCalls: []ToolCall{
+			{ID: NewToolCallID(), Type: "function", Function: ToolCallFunction{Name: "forecast", Arguments: ""}},
+		}},
+		{Role: RoleFunction, Name: "forecast", Content: "Dry tomorrow"},
+	}
+
+	openAIMessages := convertToOpenAIMessages(messages)
+	assert.Len(t, openAIMessages, 7)
+	assert.Equal(t, "toolu_01", openAIMessages[3].ToolCallID)
+	assert.Equal(t, messages[5].ToolCalls[0].ID, openAIMessages[6].ToolCallID)
+	assert.Equal(t, "tool", openAIMessages[6].Role)
+
+	claudeMessages := convertToClaudeMessages(messages)
+	assert.Len(t, claudeMessages, 5)
+	assert.Len(t, claudeMessages[2].Content.Value, 2)
+	assert.Len(t, claudeMessages[4].Content.Value, 1)
+
+	system, contents := convertToGeminiContents(messages)
+	assert.NotNil(t, system)
+	assert.Len(t, contents, 5)
+	assert.Len(t, contents[2].Parts, 2)
+
+	ollamaMessages := convertToOllamaMessages(messages)
+	assert.Len(t, ollamaMessages, 7)
+	assert.Equal(t, "tool", ollamaMessages[6].Role)
+}
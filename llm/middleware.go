@@ -0,0 +1,242 @@
+package llm
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Middleware wraps an LLM to add behavior around its calls, such as logging,
+// caching or metrics. A middleware returns an LLM that handles both
+// CreateChatCompletion and CreateChatCompletionStream, usually by calling next.
+type Middleware func(next LLM) LLM
+
+// Chain wraps client with middlewares. The first middleware is the outermost:
+// it sees each request first and each response last.
+func Chain(client LLM, middlewares ...Middleware) LLM {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		client = middlewares[i](client)
+	}
+	return client
+}
+
+// CompletionFunc is the signature of LLM.CreateChatCompletion
+type CompletionFunc func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error)
+
+// StreamFunc is the signature of LLM.CreateChatCompletionStream
+type StreamFunc func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error)
+
+// LLMFuncs implements LLM with a pair of functions. It is the easiest way to
+// write a middleware that handles the two calls separately.
+type LLMFuncs struct {
+	Completion CompletionFunc
+	Stream     StreamFunc
+}
+
+// CreateChatCompletion calls f.Completion
+func (f LLMFuncs) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	return f.Completion(ctx, req)
+}
+
+// CreateChatCompletionStream calls f.Stream
+func (f LLMFuncs) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	return f.Stream(ctx, req)
+}
+
+// RequestMiddleware returns a middleware that passes every request, streaming
+// or not, through prepare before sending it. prepare may change the context
+// or the request, or fail the call by returning an error.
+func RequestMiddleware(prepare func(ctx context.Context, req ChatCompletionRequest) (context.Context, ChatCompletionRequest, error)) Middleware {
+	return func(next LLM) LLM {
+		return LLMFuncs{
+			Completion: func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+				ctx, req, err := prepare(ctx, req)
+				if err != nil {
+					return ChatCompletionResponse{}, err
+				}
+				return next.CreateChatCompletion(ctx, req)
+			},
+			Stream: func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+				ctx, req, err := prepare(ctx, req)
+				if err != nil {
+					return nil, err
+				}
+				return next.CreateChatCompletionStream(ctx, req)
+			},
+		}
+	}
+}
+
+// HeaderMiddleware returns a middleware that sends headers with every request.
+// See WithHeaders for the providers that support it.
+func HeaderMiddleware(headers http.Header) Middleware {
+	return RequestMiddleware(func(ctx context.Context, req ChatCompletionRequest) (context.Context, ChatCompletionRequest, error) {
+		return WithHeaders(ctx, headers), req, nil
+	})
+}
+
+// CallTiming describes how long a call took
+type CallTiming struct {
+	Model      string
+	Stream     bool
+	Duration   time.Duration // Until the response arrived, or until a stream ended
+	FirstChunk time.Duration // Until the first chunk of a stream arrived
+	Err        error         // Error the call or stream ended with
+}
+
+// TimingMiddleware returns a middleware that reports the duration of every call
+// to observe. Streams are reported once they end or are closed.
+func TimingMiddleware(observe func(CallTiming)) Middleware {
+	return func(next LLM) LLM {
+		return LLMFuncs{
+			Completion: func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+				start := time.Now()
+				resp, err := next.CreateChatCompletion(ctx, req)
+				observe(CallTiming{Model: req.Model, Duration: time.Since(start), Err: err})
+				return resp, err
+			},
+			Stream: func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+				start := time.Now()
+				stream, err := next.CreateChatCompletionStream(ctx, req)
+				if err != nil {
+					observe(CallTiming{Model: req.Model, Stream: true, Duration: time.Since(start), Err: err})
+					return nil, err
+				}
+
+				var firstChunk time.Duration
+				return WatchStream(stream, func(ChatCompletionResponse) {
+					if firstChunk == 0 {
+						firstChunk = time.Since(start)
+					}
+				}, func(err error) {
+					observe(CallTiming{Model: req.Model, Stream: true, Duration: time.Since(start), FirstChunk: firstChunk, Err: err})
+				}), nil
+			},
+		}
+	}
+}
+
+// LoggingMiddleware returns a middleware that logs every request and its
+// outcome to logger, or to slog.Default() when logger is nil. Requests and
+// replies are logged at Info and failures at Error, so the handler's level
+// decides what is kept. With logContent, the last message of each request and
+// the reply are logged too.
+func LoggingMiddleware(logger *slog.Logger, logContent bool) Middleware {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	logRequest := func(ctx context.Context, req ChatCompletionRequest, stream bool) {
+		logger.InfoContext(ctx, "llm request", "model", req.Model, "stream", stream,
+			"messages", len(req.Messages), "tools", len(req.Tools))
+		if logContent && len(req.Messages) > 0 {
+			last := req.Messages[len(req.Messages)-1]
+			logger.InfoContext(ctx, "llm request content", "model", req.Model, "role", last.Role, "content", last.Content)
+		}
+	}
+
+	return func(next LLM) LLM {
+		return LLMFuncs{
+			Completion: func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+				logRequest(ctx, req, false)
+				start := time.Now()
+				resp, err := next.CreateChatCompletion(ctx, req)
+				if err != nil {
+					logger.ErrorContext(ctx, "llm error", "model", req.Model, "duration", time.Since(start), "error", err)
+					return resp, err
+				}
+
+				var reply Message
+				if len(resp.Choices) > 0 {
+					reply = resp.Choices[0].Message
+				}
+				logger.InfoContext(ctx, "llm response", "model", req.Model, "duration", time.Since(start),
+					"tool_calls", len(reply.ToolCalls), "prompt_tokens", resp.Usage.PromptTokens,
+					"completion_tokens", resp.Usage.CompletionTokens)
+				if logContent {
+					logger.InfoContext(ctx, "llm response content", "model", req.Model, "content", reply.Content)
+				}
+				return resp, nil
+			},
+			Stream: func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+				logRequest(ctx, req, true)
+				start := time.Now()
+				stream, err := next.CreateChatCompletionStream(ctx, req)
+				if err != nil {
+					logger.ErrorContext(ctx, "llm error", "model", req.Model, "duration", time.Since(start), "error", err)
+					return nil, err
+				}
+
+				var content string
+				var usage Usage
+				return WatchStream(stream, func(chunk ChatCompletionResponse) {
+					if len(chunk.Choices) > 0 {
+						content += chunk.Choices[0].Message.Content
+					}
+					if chunk.Usage.PromptTokens > 0 || chunk.Usage.CompletionTokens > 0 {
+						usage = chunk.Usage
+					}
+				}, func(err error) {
+					if err != nil {
+						logger.ErrorContext(ctx, "llm stream error", "model", req.Model, "duration", time.Since(start), "error", err)
+						return
+					}
+					logger.InfoContext(ctx, "llm stream end", "model", req.Model, "duration", time.Since(start),
+						"prompt_tokens", usage.PromptTokens, "completion_tokens", usage.CompletionTokens)
+					if logContent {
+						logger.InfoContext(ctx, "llm response content", "model", req.Model, "content", content)
+					}
+				}), nil
+			},
+		}
+	}
+}
+
+// watchedStream is the stream returned by WatchStream
+type watchedStream struct {
+	stream  ChatCompletionStream
+	onChunk func(ChatCompletionResponse)
+	onEnd   func(error)
+	once    sync.Once
+}
+
+// WatchStream wraps stream so onChunk sees every chunk received and onEnd is
+// called once when the stream ends: with nil at io.EOF or when it is closed
+// early, and with the error otherwise. Either callback may be nil.
+func WatchStream(stream ChatCompletionStream, onChunk func(ChatCompletionResponse), onEnd func(error)) ChatCompletionStream {
+	return &watchedStream{stream: stream, onChunk: onChunk, onEnd: onEnd}
+}
+
+func (w *watchedStream) Recv() (ChatCompletionResponse, error) {
+	resp, err := w.stream.Recv()
+	if err != nil {
+		if err == io.EOF {
+			w.end(nil)
+		} else {
+			w.end(err)
+		}
+		return resp, err
+	}
+	if w.onChunk != nil {
+		w.onChunk(resp)
+	}
+	return resp, nil
+}
+
+func (w *watchedStream) Close() error {
+	err := w.stream.Close()
+	w.end(nil)
+	return err
+}
+
+// end calls onEnd the first time the stream ends
+func (w *watchedStream) end(err error) {
+	w.once.Do(func() {
+		if w.onEnd != nil {
+			w.onEnd(err)
+		}
+	})
+}
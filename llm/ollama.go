@@ -3,11 +3,14 @@ package llm
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
 )
 
 // OllamaLLM implements the LLM interface for Ollama
@@ -17,10 +20,7 @@ type OllamaLLM struct {
 
 // NewOllamaLLM creates a new Ollama LLM client
 func NewOllamaLLM() (*OllamaLLM, error) {
-	client, err := api.ClientFromEnvironment()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create Ollama client: %w", err)
-	}
+	client := api.NewClient(envconfig.Host(), newHeaderClient())
 	return &OllamaLLM{client: client}, nil
 }
 
@@ -30,28 +30,43 @@ func NewOllamaLLMWithURL(baseURL string) (*OllamaLLM, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse URL: %w", err)
 	}
-	client := api.NewClient(parsedURL, nil)
+	client := api.NewClient(parsedURL, newHeaderClient())
 	return &OllamaLLM{client: client}, nil
 }
 
+// NewOllamaLLMWithClient creates an Ollama LLM client for the server at
+// baseURL, sending its requests with httpClient. An empty baseURL uses the
+// OLLAMA_HOST environment variable and a nil httpClient the default client.
+func NewOllamaLLMWithClient(baseURL string, httpClient *http.Client) (*OllamaLLM, error) {
+	host := envconfig.Host()
+	if baseURL != "" {
+		parsedURL, err := url.Parse(baseURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse URL: %w", err)
+		}
+		host = parsedURL
+	}
+	return &OllamaLLM{client: api.NewClient(host, withHeaderTransport(httpClient))}, nil
+}
+
 // convertToOllamaRole converts our Role type to Ollama's role string
 func convertToOllamaRole(role Role) string {
 	if role == RoleFunction {
-		return "tool"
+		return string(RoleTool)
 	}
 	return string(role)
 }
 
 // convertFromOllamaRole converts Ollama's role string to our Role type
 func convertFromOllamaRole(role string) Role {
-	if role == "tool" {
-		return RoleFunction
-	}
 	return Role(role)
 }
 
-// convertToOllamaMessages converts our generic Message type to Ollama's message format
+// convertToOllamaMessages converts our generic Message type to Ollama's message format.
+// Ollama has no tool call IDs and pairs results with calls by position, so the
+// results are sent in the order of the calls they answer.
 func convertToOllamaMessages(messages []Message) []api.Message {
+	messages = normalizeToolMessages(messages)
 	ollamaMessages := make([]api.Message, len(messages))
 	for i, msg := range messages {
 		ollamaMessages[i] = api.Message{
@@ -71,14 +86,21 @@ func convertToOllamaTools(tools []Tool) api.Tools {
 
 	ollamaTools := make([]api.Tool, len(tools))
 	for i, tool := range tools {
-		// Convert required array
-		required := make([]string, len(tool.Function.Parameters["required"].([]interface{})))
-		for i, v := range tool.Function.Parameters["required"].([]interface{}) {
-			required[i] = v.(string)
+		// Convert required array, which may be missing or of either slice type
+		var required []string
+		switch req := tool.Function.Parameters["required"].(type) {
+		case []string:
+			required = req
+		case []interface{}:
+			for _, v := range req {
+				if name, ok := v.(string); ok {
+					required = append(required, name)
+				}
+			}
 		}
 
 		// Convert properties map
-		rawProps := tool.Function.Parameters["properties"].(map[string]interface{})
+		rawProps, _ := tool.Function.Parameters["properties"].(map[string]interface{})
 		properties := make(map[string]struct {
 			Type        string   `json:"type"`
 			Description string   `json:"description"`
@@ -86,29 +108,35 @@ func convertToOllamaTools(tools []Tool) api.Tools {
 		})
 
 		for propName, propValue := range rawProps {
-			propMap := propValue.(map[string]interface{})
+			propMap, ok := propValue.(map[string]interface{})
+			if !ok {
+				continue
+			}
 			prop := struct {
 				Type        string   `json:"type"`
 				Description string   `json:"description"`
 				Enum        []string `json:"enum,omitempty"`
-			}{
-				Type:        propMap["type"].(string),
-				Description: propMap["description"].(string),
-			}
+			}{}
+			prop.Type, _ = propMap["type"].(string)
+			prop.Description, _ = propMap["description"].(string)
 
 			// Handle optional enum field
-			if enumVal, ok := propMap["enum"]; ok {
-				enumInterface := enumVal.([]interface{})
-				enumStrings := make([]string, len(enumInterface))
-				for j, e := range enumInterface {
-					enumStrings[j] = e.(string)
+			if enumInterface, ok := propMap["enum"].([]interface{}); ok {
+				for _, e := range enumInterface {
+					if str, ok := e.(string); ok {
+						prop.Enum = append(prop.Enum, str)
+					}
 				}
-				prop.Enum = enumStrings
 			}
 
 			properties[propName] = prop
 		}
 
+		paramType, _ := tool.Function.Parameters["type"].(string)
+		if paramType == "" {
+			paramType = "object"
+		}
+
 		ollamaTools[i] = api.Tool{
 			Type: "function",
 			Function: api.ToolFunction{
@@ -123,7 +151,7 @@ func convertToOllamaTools(tools []Tool) api.Tools {
 						Enum        []string `json:"enum,omitempty"`
 					} `json:"properties"`
 				}{
-					Type:       tool.Function.Parameters["type"].(string),
+					Type:       paramType,
 					Required:   required,
 					Properties: properties,
 				},
@@ -167,10 +195,8 @@ func convertFromOllamaToolCalls(toolCalls []api.ToolCall) []ToolCall {
 
 	calls := make([]ToolCall, len(toolCalls))
 	for i, call := range toolCalls {
-		// Convert api.ToolCallFunctionArguments to map[string]interface{}
-
 		calls[i] = ToolCall{
-			ID:   call.Function.Name, // Using name as ID since Ollama doesn't have a separate ID field
+			ID:   NewToolCallID(), // Ollama doesn't assign IDs to its tool calls
 			Type: "function",
 			Function: ToolCallFunction{
 				Name:      call.Function.Name,
@@ -181,6 +207,29 @@ func convertFromOllamaToolCalls(toolCalls []api.ToolCall) []ToolCall {
 	return calls
 }
 
+// convertToOllamaFormat converts our generic response format to Ollama's format,
+// which is either "json" or the JSON schema the reply must match
+func convertToOllamaFormat(format *ResponseFormat) json.RawMessage {
+	if !format.wantsJSON() {
+		return nil
+	}
+	if format.Type == ResponseFormatJSONSchema && len(format.Schema) > 0 {
+		if schema, err := json.Marshal(format.Schema); err == nil {
+			return schema
+		}
+	}
+	return json.RawMessage(`"json"`)
+}
+
+// convertFromOllamaMetrics converts the token counts Ollama reports to our usage type
+func convertFromOllamaMetrics(metrics api.Metrics) Usage {
+	return Usage{
+		PromptTokens:     metrics.PromptEvalCount,
+		CompletionTokens: metrics.EvalCount,
+		TotalTokens:      metrics.PromptEvalCount + metrics.EvalCount,
+	}
+}
+
 // CreateChatCompletion implements the LLM interface for Ollama
 func (o *OllamaLLM) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
 	stream := false
@@ -189,6 +238,7 @@ func (o *OllamaLLM) CreateChatCompletion(ctx context.Context, req ChatCompletion
 		Messages: convertToOllamaMessages(req.Messages),
 		Stream:   &stream,
 		Tools:    convertToOllamaTools(req.Tools),
+		Format:   convertToOllamaFormat(req.ResponseFormat),
 		Options:  make(map[string]interface{}),
 	}
 
@@ -202,12 +252,13 @@ func (o *OllamaLLM) CreateChatCompletion(ctx context.Context, req ChatCompletion
 				Content:   resp.Message.Content,
 				ToolCalls: convertFromOllamaToolCalls(resp.Message.ToolCalls),
 			}
+			response.Usage = convertFromOllamaMetrics(resp.Metrics)
 		}
 		return nil
 	})
 
 	if err != nil {
-		return ChatCompletionResponse{}, fmt.Errorf("Ollama chat completion failed: %w", err)
+		return ChatCompletionResponse{}, fmt.Errorf("Ollama chat completion failed: %w", wrapOllamaError(err))
 	}
 
 	response.Choices = []Choice{
@@ -221,6 +272,15 @@ func (o *OllamaLLM) CreateChatCompletion(ctx context.Context, req ChatCompletion
 	return response, nil
 }
 
+// wrapOllamaError converts errors from the Ollama client into a *ProviderError
+func wrapOllamaError(err error) error {
+	var statusErr api.StatusError
+	if errors.As(err, &statusErr) {
+		return newStatusError(Ollama, statusErr.StatusCode, statusErr.ErrorMessage, nil, err)
+	}
+	return wrapTransportError(Ollama, err)
+}
+
 type ollamaStreamWrapper struct {
 	ctx             context.Context
 	client          *api.Client
@@ -249,6 +309,7 @@ func (s *ollamaStreamWrapper) Recv() (ChatCompletionResponse, error) {
 	err := s.client.Chat(s.ctx, s.req, func(resp api.ChatResponse) error {
 		if resp.Done {
 			s.done = true
+			response.Usage = convertFromOllamaMetrics(resp.Metrics)
 			return io.EOF
 		}
 
@@ -268,12 +329,14 @@ func (s *ollamaStreamWrapper) Recv() (ChatCompletionResponse, error) {
 	})
 
 	if err == io.EOF {
-		response.Choices[0].FinishReason = "stop"
+		if len(response.Choices) > 0 {
+			response.Choices[0].FinishReason = "stop"
+		}
 		return response, nil
 	}
 
 	if err != nil {
-		return ChatCompletionResponse{}, fmt.Errorf("Ollama stream failed: %w", err)
+		return ChatCompletionResponse{}, fmt.Errorf("Ollama stream failed: %w", wrapOllamaError(err))
 	}
 
 	return response, nil
@@ -291,6 +354,7 @@ func (o *OllamaLLM) CreateChatCompletionStream(ctx context.Context, req ChatComp
 		Messages: convertToOllamaMessages(req.Messages),
 		Stream:   &stream,
 		Tools:    convertToOllamaTools(req.Tools),
+		Format:   convertToOllamaFormat(req.ResponseFormat),
 		Options:  make(map[string]interface{}),
 	}
 
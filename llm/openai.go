@@ -6,6 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/rsaranusc/openai-compatible"
 )
@@ -17,27 +20,53 @@ type OpenAILLM struct {
 
 // NewOpenAILLM creates a new OpenAI LLM client
 func NewOpenAILLM(apiKey string) *OpenAILLM {
+	return NewOpenAILLMWithConfig(DefaultOpenAIConfig(apiKey))
+}
+
+// DefaultOpenAIConfig returns the configuration NewOpenAILLM uses, to be
+// adjusted and passed to NewOpenAILLMWithConfig
+func DefaultOpenAIConfig(apiKey string) openai.ClientConfig {
 	config := openai.DefaultConfig(apiKey)
 	config.BaseURL = "https://api.studio.nebius.ai/v1/"
-	openAIClient := openai.NewClientWithConfig(config)
-	return &OpenAILLM{client: openAIClient}
+	return config
+}
+
+// NewOpenAILLMWithConfig creates an OpenAI LLM client from a full client
+// configuration, including the Azure API types. An *http.Client set in the
+// configuration is wrapped to send the headers added with WithHeaders.
+func NewOpenAILLMWithConfig(config openai.ClientConfig) *OpenAILLM {
+	switch httpClient := config.HTTPClient.(type) {
+	case nil:
+		config.HTTPClient = newHeaderClient()
+	case *http.Client:
+		config.HTTPClient = withHeaderTransport(httpClient)
+	}
+	return &OpenAILLM{client: openai.NewClientWithConfig(config)}
 }
 
 func NewOpenAILLMWithHost(apiKey string, host string) *OpenAILLM {
 	config := openai.DefaultConfig(apiKey)
 	config.BaseURL = host
+	config.HTTPClient = newHeaderClient()
 	openAIClient := openai.NewClientWithConfig(config)
 	return &OpenAILLM{client: openAIClient}
 }
 
 // convertToOpenAIMessages converts our generic Message type to OpenAI's message type
 func convertToOpenAIMessages(messages []Message) []openai.ChatCompletionMessage {
+	messages = normalizeToolMessages(messages)
 	openAIMessages := make([]openai.ChatCompletionMessage, len(messages))
 	for i, msg := range messages {
 		openAIMessages[i] = openai.ChatCompletionMessage{
-			Role:    string(msg.Role),
-			Content: msg.Content,
-			Name:    msg.Name,
+			Role:       string(msg.Role),
+			Content:    msg.Content,
+			Name:       msg.Name,
+			ToolCalls:  convertToOpenAIToolCalls(msg.ToolCalls),
+			ToolCallID: msg.ToolCallID,
+		}
+		// Tool results are identified by their call ID, not by name
+		if msg.Role == RoleTool {
+			openAIMessages[i].Name = ""
 		}
 	}
 	return openAIMessages
@@ -46,9 +75,10 @@ func convertToOpenAIMessages(messages []Message) []openai.ChatCompletionMessage
 // convertFromOpenAIMessage converts OpenAI's message type to our generic Message type
 func convertFromOpenAIMessage(msg openai.ChatCompletionMessage) Message {
 	return Message{
-		Role:    Role(msg.Role),
-		Content: msg.Content,
-		Name:    msg.Name,
+		Role:       Role(msg.Role),
+		Content:    msg.Content,
+		Name:       msg.Name,
+		ToolCallID: msg.ToolCallID,
 	}
 }
 
@@ -81,6 +111,26 @@ func convertToOpenAITools(tools []Tool) []openai.Tool {
 	return openAITools
 }
 
+// convertToOpenAIToolCalls converts our generic tool calls to OpenAI's type
+func convertToOpenAIToolCalls(toolCalls []ToolCall) []openai.ToolCall {
+	if len(toolCalls) == 0 {
+		return nil
+	}
+
+	calls := make([]openai.ToolCall, len(toolCalls))
+	for i, call := range toolCalls {
+		calls[i] = openai.ToolCall{
+			ID:   call.ID,
+			Type: openai.ToolTypeFunction,
+			Function: openai.FunctionCall{
+				Name:      call.Function.Name,
+				Arguments: call.Function.Arguments,
+			},
+		}
+	}
+	return calls
+}
+
 // convertFromOpenAIToolCalls converts OpenAI's tool calls to our generic type
 func convertFromOpenAIToolCalls(toolCalls []openai.ToolCall) []ToolCall {
 	if len(toolCalls) == 0 {
@@ -99,6 +149,102 @@ func convertFromOpenAIToolCalls(toolCalls []openai.ToolCall) []ToolCall {
 	return calls
 }
 
+// convertToOpenAIResponseFormat converts our generic response format to OpenAI's type
+func convertToOpenAIResponseFormat(format *ResponseFormat) *openai.ChatCompletionResponseFormat {
+	if format == nil || format.Type == "" {
+		return nil
+	}
+
+	openAIFormat := &openai.ChatCompletionResponseFormat{
+		Type: openai.ChatCompletionResponseFormatType(format.Type),
+	}
+	if format.Type == ResponseFormatJSONSchema {
+		schema, err := json.Marshal(format.Schema)
+		if err != nil {
+			schema = []byte(`{"type":"object"}`)
+		}
+		openAIFormat.JSONSchema = &openai.ChatCompletionResponseFormatJSONSchema{
+			Name:        format.schemaName(),
+			Description: format.Description,
+			Schema:      json.RawMessage(schema),
+			Strict:      format.Strict,
+		}
+	}
+	return openAIFormat
+}
+
+// convertFromOpenAIUsage converts OpenAI's usage to our generic type
+func convertFromOpenAIUsage(usage openai.Usage) Usage {
+	converted := Usage{
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+	}
+	if usage.PromptTokensDetails != nil {
+		converted.CachedPromptTokens = usage.PromptTokensDetails.CachedTokens
+	}
+	return converted
+}
+
+// wrapOpenAIError converts errors from the OpenAI client into a *ProviderError
+func wrapOpenAIError(err error) error {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		providerErr := newStatusError(OpenAI, apiErr.HTTPStatusCode, apiErr.Message, apiErr.HTTPHeader, err)
+		if providerErr.RetryAfter == 0 {
+			providerErr.RetryAfter = rateLimitReset(apiErr.GetRateLimitHeaders())
+		}
+		code := fmt.Sprint(apiErr.Code)
+		switch {
+		case code == "context_length_exceeded":
+			providerErr.Kind = ErrContextTooLong
+		case code == "content_filter" || apiErr.InnerError != nil && apiErr.InnerError.Code == "ResponsibleAIPolicyViolation":
+			providerErr.Kind = ErrContentFiltered
+		}
+		return providerErr
+	}
+
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		providerErr := newStatusError(OpenAI, reqErr.HTTPStatusCode, string(reqErr.Body), reqErr.HTTPHeader, err)
+		if providerErr.RetryAfter == 0 {
+			providerErr.RetryAfter = rateLimitReset(reqErr.GetRateLimitHeaders())
+		}
+		return providerErr
+	}
+
+	return wrapTransportError(OpenAI, err)
+}
+
+// rateLimitReset returns how long until the exhausted rate limits reset
+func rateLimitReset(headers openai.RateLimitHeaders) time.Duration {
+	var wait time.Duration
+	resets := []struct {
+		remaining int
+		reset     openai.ResetTime
+	}{
+		{headers.RemainingRequests, headers.ResetRequests},
+		{headers.RemainingTokens, headers.ResetTokens},
+	}
+	for _, r := range resets {
+		if r.remaining > 0 || r.reset == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(r.reset.String()); err == nil && d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// limitReasoningTokens moves the token limit of o1 and o3 requests to
+// MaxCompletionTokens, as reasoning models reject MaxTokens
+func limitReasoningTokens(req *openai.ChatCompletionRequest) {
+	if strings.HasPrefix(req.Model, "o1") || strings.HasPrefix(req.Model, "o3") {
+		req.MaxCompletionTokens, req.MaxTokens = req.MaxTokens, 0
+	}
+}
+
 // CreateChatCompletion implements the LLM interface for OpenAI
 func (o *OpenAILLM) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
 	openAIReq := openai.ChatCompletionRequest{
@@ -111,11 +257,13 @@ func (o *OpenAILLM) CreateChatCompletion(ctx context.Context, req ChatCompletion
 		MaxTokens:       req.MaxTokens,
 		PresencePenalty: req.PresencePenalty,
 		Tools:           convertToOpenAITools(req.Tools),
+		ResponseFormat:  convertToOpenAIResponseFormat(req.ResponseFormat),
 	}
+	limitReasoningTokens(&openAIReq)
 
 	resp, err := o.client.CreateChatCompletion(ctx, openAIReq)
 	if err != nil {
-		return ChatCompletionResponse{}, err
+		return ChatCompletionResponse{}, wrapOpenAIError(err)
 	}
 
 	choices := make([]Choice, len(resp.Choices))
@@ -132,11 +280,7 @@ func (o *OpenAILLM) CreateChatCompletion(ctx context.Context, req ChatCompletion
 	return ChatCompletionResponse{
 		ID:      resp.ID,
 		Choices: choices,
-		Usage: Usage{
-			PromptTokens:     resp.Usage.PromptTokens,
-			CompletionTokens: resp.Usage.CompletionTokens,
-			TotalTokens:      resp.Usage.TotalTokens,
-		},
+		Usage:   convertFromOpenAIUsage(resp.Usage),
 	}, nil
 }
 
@@ -160,11 +304,7 @@ func (w *openAIStreamWrapper) Recv() (ChatCompletionResponse, error) {
 		if err == io.EOF {
 			return ChatCompletionResponse{}, err
 		}
-		var openAIErr *openai.APIError
-		if errors.As(err, &openAIErr) {
-			return ChatCompletionResponse{}, fmt.Errorf("OpenAI API error: %s - %s", openAIErr.Code, openAIErr.Message)
-		}
-		return ChatCompletionResponse{}, fmt.Errorf("stream receive failed: %w", err)
+		return ChatCompletionResponse{}, fmt.Errorf("stream receive failed: %w", wrapOpenAIError(err))
 	}
 
 	choices := make([]Choice, len(resp.Choices))
@@ -238,10 +378,15 @@ func (w *openAIStreamWrapper) Recv() (ChatCompletionResponse, error) {
 		}
 	}
 
-	return ChatCompletionResponse{
+	response := ChatCompletionResponse{
 		ID:      resp.ID,
 		Choices: choices,
-	}, nil
+	}
+	// Usage arrives on the final chunk, which has no choices
+	if resp.Usage != nil {
+		response.Usage = convertFromOpenAIUsage(*resp.Usage)
+	}
+	return response, nil
 }
 
 func (w *openAIStreamWrapper) Close() error {
@@ -260,16 +405,15 @@ func (o *OpenAILLM) CreateChatCompletionStream(ctx context.Context, req ChatComp
 		MaxTokens:       req.MaxTokens,
 		PresencePenalty: float32(req.PresencePenalty),
 		Tools:           convertToOpenAITools(req.Tools),
+		ResponseFormat:  convertToOpenAIResponseFormat(req.ResponseFormat),
 		Stream:          true,
+		StreamOptions:   &openai.StreamOptions{IncludeUsage: true},
 	}
+	limitReasoningTokens(&openAIReq)
 
 	stream, err := o.client.CreateChatCompletionStream(ctx, openAIReq)
 	if err != nil {
-		var openAIErr *openai.APIError
-		if errors.As(err, &openAIErr) {
-			return nil, fmt.Errorf("OpenAI API error: %s - %s", openAIErr.Code, openAIErr.Message)
-		}
-		return nil, fmt.Errorf("stream creation failed: %w", err)
+		return nil, fmt.Errorf("stream creation failed: %w", wrapOpenAIError(err))
 	}
 
 	return newOpenAIStreamWrapper(stream), nil
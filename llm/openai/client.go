@@ -303,6 +303,7 @@ func (c *Client) handleErrorResp(resp *http.Response) error {
 		reqErr := &RequestError{
 			HTTPStatus:     resp.Status,
 			HTTPStatusCode: resp.StatusCode,
+			HTTPHeader:     resp.Header,
 			Err:            err,
 			Body:           body,
 		}
@@ -314,6 +315,7 @@ func (c *Client) handleErrorResp(resp *http.Response) error {
 
 	errRes.Error.HTTPStatus = resp.Status
 	errRes.Error.HTTPStatusCode = resp.StatusCode
+	errRes.Error.HTTPHeader = resp.Header
 	return errRes.Error
 }
 
@@ -3,6 +3,7 @@ package openai
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"strings"
 )
 
@@ -15,6 +16,7 @@ type APIError struct {
 	Type           string      `json:"type"`
 	HTTPStatus     string      `json:"-"`
 	HTTPStatusCode int         `json:"-"`
+	HTTPHeader     http.Header `json:"-"`
 	InnerError     *InnerError `json:"innererror,omitempty"`
 }
 
@@ -28,6 +30,7 @@ type InnerError struct {
 type RequestError struct {
 	HTTPStatus     string
 	HTTPStatusCode int
+	HTTPHeader     http.Header
 	Err            error
 	Body           []byte
 }
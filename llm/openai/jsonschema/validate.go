@@ -3,6 +3,9 @@ package jsonschema
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
 )
 
 func VerifySchemaAndUnmarshal(schema Definition, content []byte, v any) error {
@@ -91,3 +94,119 @@ func contains[S ~[]E, E comparable](s S, v E) bool {
 	}
 	return false
 }
+
+// ValidationError describes one place where data does not match a schema.
+type ValidationError struct {
+	// Path locates the offending value, e.g. "$.items[2].name".
+	Path string `json:"path"`
+	// Message explains what is wrong with the value.
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ValidateWithErrors validates data against schema like Validate, but reports
+// every mismatch it finds instead of stopping at the first one. It also checks
+// Enum values and rejects unknown properties when AdditionalProperties is false.
+// A schema without a Type accepts any value.
+func ValidateWithErrors(schema Definition, data any) []ValidationError {
+	return validateAt(schema, data, "$", nil)
+}
+
+func validateAt(schema Definition, data any, path string, errs []ValidationError) []ValidationError {
+	if schema.Type == "" {
+		return checkEnum(schema, data, path, errs)
+	}
+	if schema.Type == Object {
+		dataMap, ok := data.(map[string]any)
+		if !ok {
+			return append(errs, typeMismatch(schema.Type, data, path))
+		}
+		return validateObjectAt(schema, dataMap, path, errs)
+	}
+	if schema.Type == Array {
+		dataArray, ok := data.([]any)
+		if !ok {
+			return append(errs, typeMismatch(schema.Type, data, path))
+		}
+		if schema.Items == nil {
+			return errs
+		}
+		for i, item := range dataArray {
+			errs = validateAt(*schema.Items, item, fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+		return errs
+	}
+	if !Validate(schema, data) {
+		return append(errs, typeMismatch(schema.Type, data, path))
+	}
+	return checkEnum(schema, data, path, errs)
+}
+
+func validateObjectAt(schema Definition, data map[string]any, path string, errs []ValidationError) []ValidationError {
+	for _, field := range schema.Required {
+		if _, exists := data[field]; !exists {
+			errs = append(errs, ValidationError{Path: path + "." + field, Message: "required property is missing"})
+		}
+	}
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		valueSchema, known := schema.Properties[key]
+		if !known {
+			if allowed, ok := schema.AdditionalProperties.(bool); ok && !allowed {
+				errs = append(errs, ValidationError{Path: path + "." + key, Message: "unknown property"})
+			}
+			continue
+		}
+		errs = validateAt(valueSchema, data[key], path+"."+key, errs)
+	}
+	return errs
+}
+
+func checkEnum(schema Definition, data any, path string, errs []ValidationError) []ValidationError {
+	if len(schema.Enum) == 0 {
+		return errs
+	}
+	if s, ok := data.(string); ok && contains(schema.Enum, s) {
+		return errs
+	}
+	return append(errs, ValidationError{
+		Path:    path,
+		Message: fmt.Sprintf("must be one of [%s]", strings.Join(schema.Enum, ", ")),
+	})
+}
+
+func typeMismatch(want DataType, data any, path string) ValidationError {
+	return ValidationError{Path: path, Message: fmt.Sprintf("expected %s, got %s", want, jsonTypeOf(data))}
+}
+
+// jsonTypeOf names the JSON type of a value produced by encoding/json.
+func jsonTypeOf(data any) string {
+	switch v := data.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case int:
+		return "integer"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", data)
+	}
+}
@@ -162,3 +162,54 @@ func TestUnmarshal(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateWithErrors(t *testing.T) {
+	schema := jsonschema.Definition{
+		Type: jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{
+			"city":  {Type: jsonschema.String},
+			"unit":  {Type: jsonschema.String, Enum: []string{"celsius", "fahrenheit"}},
+			"days":  {Type: jsonschema.Integer},
+			"tags":  {Type: jsonschema.Array, Items: &jsonschema.Definition{Type: jsonschema.String}},
+			"extra": {},
+		},
+		Required:             []string{"city", "days"},
+		AdditionalProperties: false,
+	}
+
+	tests := []struct {
+		name string
+		data any
+		want []jsonschema.ValidationError
+	}{
+		{"valid", map[string]any{"city": "Paris", "days": 3.0, "extra": []any{1.0}}, nil},
+		{"not an object", "Paris", []jsonschema.ValidationError{
+			{Path: "$", Message: "expected object, got string"},
+		}},
+		{"all problems", map[string]any{
+			"days":  2.5,
+			"unit":  "kelvin",
+			"tags":  []any{"a", 1.0},
+			"other": true,
+		}, []jsonschema.ValidationError{
+			{Path: "$.city", Message: "required property is missing"},
+			{Path: "$.days", Message: "expected integer, got number"},
+			{Path: "$.other", Message: "unknown property"},
+			{Path: "$.tags[1]", Message: "expected string, got integer"},
+			{Path: "$.unit", Message: "must be one of [celsius, fahrenheit]"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := jsonschema.ValidateWithErrors(schema, tt.data)
+			if len(got) != len(tt.want) {
+				t.Fatalf("ValidateWithErrors() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("ValidateWithErrors()[%d] = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
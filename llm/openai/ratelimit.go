@@ -41,3 +41,13 @@ func newRateLimitHeaders(h http.Header) RateLimitHeaders {
 		ResetTokens:       ResetTime(h.Get("x-ratelimit-reset-tokens")),
 	}
 }
+
+// GetRateLimitHeaders returns the rate limit headers of the failed response
+func (e *APIError) GetRateLimitHeaders() RateLimitHeaders {
+	return newRateLimitHeaders(e.HTTPHeader)
+}
+
+// GetRateLimitHeaders returns the rate limit headers of the failed response
+func (e *RequestError) GetRateLimitHeaders() RateLimitHeaders {
+	return newRateLimitHeaders(e.HTTPHeader)
+}
@@ -0,0 +1,196 @@
+package agentkit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// LevelTrace is the slog level of LogTrace output, below slog.LevelDebug
+const LevelTrace = slog.LevelDebug - 4
+
+// Attribute keys shared by every log record of the library
+const (
+	LogKeyRunID = "run_id"
+	LogKeyAgent = "agent"
+	LogKeyModel = "model"
+	LogKeyTool  = "tool"
+	LogKeyStep  = "step"
+)
+
+// slogLevel returns the slog level matching a LogLevel; ok is false for LogSilent
+func (l LogLevel) slogLevel() (level slog.Level, ok bool) {
+	switch {
+	case l <= LogSilent:
+		return 0, false
+	case l == LogError:
+		return slog.LevelError, true
+	case l == LogWarning:
+		return slog.LevelWarn, true
+	case l == LogInfo:
+		return slog.LevelInfo, true
+	case l == LogDebug:
+		return slog.LevelDebug, true
+	}
+	return LevelTrace, true
+}
+
+// runIDKey is the context key of the current run's ID
+type runIDKey struct{}
+
+// withRunID returns a context carrying a new run ID, unless ctx already has one
+func withRunID(ctx context.Context) context.Context {
+	if runID(ctx) != "" {
+		return ctx
+	}
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return context.WithValue(ctx, runIDKey{}, hex.EncodeToString(b[:]))
+}
+
+// runID returns the run ID carried by ctx, if any
+func runID(ctx context.Context) string {
+	id, _ := ctx.Value(runIDKey{}).(string)
+	return id
+}
+
+// logger returns the logger for the Swarm's output, tagged with the run ID of
+// ctx. Records below Config.LogLevel are dropped; debug, or Config.Debug,
+// lowers the level to LogDebug. Without a Config.Logger the Swarm is silent,
+// except that debug output goes to slog.Default().
+func (s *Swarm) logger(ctx context.Context, debug bool) *slog.Logger {
+	var base *slog.Logger
+	level := LogSilent
+	if s.config != nil {
+		base, level = s.config.Logger, s.config.LogLevel
+		debug = debug || s.config.Debug
+	}
+	if debug {
+		level = max(level, LogDebug)
+		if base == nil {
+			base = slog.Default()
+		}
+	}
+
+	minLevel, ok := level.slogLevel()
+	if base == nil || !ok {
+		return slog.New(discardHandler{})
+	}
+	logger := slog.New(&levelHandler{level: minLevel, handler: base.Handler()})
+	if id := runID(ctx); id != "" {
+		logger = logger.With(LogKeyRunID, id)
+	}
+	return logger
+}
+
+// levelHandler drops the records of a handler below a minimum level
+type levelHandler struct {
+	level   slog.Level
+	handler slog.Handler
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level && h.handler.Enabled(ctx, level)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithGroup(name)}
+}
+
+// discardHandler drops every record
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// ConsoleHandler is a slog.Handler printing colored, human-readable lines,
+// meant for demos and local runs rather than services
+type ConsoleHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level slog.Leveler
+	attrs string
+}
+
+// NewConsoleHandler returns a ConsoleHandler writing records at level or above
+// to w; a nil level means slog.LevelInfo
+func NewConsoleHandler(w io.Writer, level slog.Leveler) *ConsoleHandler {
+	if level == nil {
+		level = slog.LevelInfo
+	}
+	return &ConsoleHandler{mu: &sync.Mutex{}, w: w, level: level}
+}
+
+// consoleColors are the ANSI colors of each level
+var consoleColors = map[slog.Level]string{
+	slog.LevelError: "\033[91m",
+	slog.LevelWarn:  "\033[93m",
+	slog.LevelInfo:  "\033[96m",
+	slog.LevelDebug: "\033[90m",
+}
+
+func (h *ConsoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *ConsoleHandler) Handle(_ context.Context, r slog.Record) error {
+	color, ok := consoleColors[r.Level]
+	if !ok {
+		color = "\033[90m"
+	}
+
+	var b strings.Builder
+	b.WriteString(color)
+	b.WriteString(r.Message)
+	b.WriteString("\033[0m")
+	b.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		writeConsoleAttr(&b, a)
+		return true
+	})
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *ConsoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	b.WriteString(h.attrs)
+	for _, a := range attrs {
+		writeConsoleAttr(&b, a)
+	}
+	clone := *h
+	clone.attrs = b.String()
+	return &clone
+}
+
+// WithGroup returns h; groups are flattened on the console
+func (h *ConsoleHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// writeConsoleAttr writes a dimmed key=value pair
+func writeConsoleAttr(b *strings.Builder, a slog.Attr) {
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	fmt.Fprintf(b, " \033[90m%s=\033[0m%v", a.Key, a.Value.Resolve())
+}
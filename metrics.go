@@ -0,0 +1,219 @@
+package agentkit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rsaranusc/agentkit/llm"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Metric names. Durations are in seconds.
+const (
+	MetricLLMDuration          = "agentkit.llm.duration"            // Histogram by provider and model
+	MetricLLMTimeToFirstToken  = "agentkit.llm.time_to_first_token" // Histogram by provider and model, for streams
+	MetricLLMInputTokens       = "agentkit.llm.tokens.input"        // Counter by provider and model
+	MetricLLMOutputTokens      = "agentkit.llm.tokens.output"       // Counter by provider and model
+	MetricLLMErrors            = "agentkit.llm.errors"              // Counter by provider, model and error kind
+	MetricLLMRetries           = "agentkit.llm.retries"             // Counter by provider and model
+	MetricLLMRateLimits        = "agentkit.llm.rate_limits"         // Counter by provider and model
+	MetricToolCalls            = "agentkit.tool.calls"              // Counter by agent and tool
+	MetricToolErrors           = "agentkit.tool.errors"             // Counter by agent and tool
+	MetricToolDuration         = "agentkit.tool.duration"           // Histogram by agent and tool
+	MetricHandoffs             = "agentkit.handoffs"                // Counter by source and target agent
+	MetricRunDuration          = "agentkit.run.duration"            // Histogram by agent, for Run and each agent of RunConcurrent
+	MetricWorkflowStepDuration = "agentkit.workflow.step.duration"  // Histogram by agent
+	MetricGraphNodeDuration    = "agentkit.graph.node.duration"     // Histogram by graph and node
+)
+
+// Label keys of the metrics
+const (
+	LabelProvider  = "provider"
+	LabelModel     = "model"
+	LabelAgent     = "agent"
+	LabelTool      = "tool"
+	LabelFrom      = "from"
+	LabelTo        = "to"
+	LabelGraph     = "graph"
+	LabelNode      = "node"
+	LabelErrorKind = "error_kind"
+	LabelOutcome   = "outcome" // "ok" or "error"
+)
+
+// Label is a metric dimension
+type Label struct {
+	Key   string
+	Value string
+}
+
+// Metrics receives agentkit's measurements: counters are added to and
+// histograms record values. Implementations must be safe for concurrent use.
+type Metrics interface {
+	Add(ctx context.Context, name string, value int64, labels ...Label)
+	Record(ctx context.Context, name string, value float64, labels ...Label)
+}
+
+// NoopMetrics discards every measurement; it is used when Config.Metrics is nil
+type NoopMetrics struct{}
+
+func (NoopMetrics) Add(context.Context, string, int64, ...Label)      {}
+func (NoopMetrics) Record(context.Context, string, float64, ...Label) {}
+
+// metricDescriptions documents the metrics for exporters
+var metricDescriptions = map[string]string{
+	MetricLLMDuration:          "Duration of LLM requests",
+	MetricLLMTimeToFirstToken:  "Time from an LLM stream request to its first chunk",
+	MetricLLMInputTokens:       "Prompt tokens sent to LLMs",
+	MetricLLMOutputTokens:      "Completion tokens received from LLMs",
+	MetricLLMErrors:            "Failed LLM requests",
+	MetricLLMRetries:           "LLM requests retried after a failure",
+	MetricLLMRateLimits:        "LLM requests rejected by a rate limit",
+	MetricToolCalls:            "Tool calls",
+	MetricToolErrors:           "Tool calls that failed",
+	MetricToolDuration:         "Duration of tool calls",
+	MetricHandoffs:             "Handoffs between agents",
+	MetricRunDuration:          "Duration of agent runs",
+	MetricWorkflowStepDuration: "Duration of workflow steps",
+	MetricGraphNodeDuration:    "Duration of graph node visits",
+}
+
+// OTelMetrics reports measurements as OpenTelemetry instruments of a meter,
+// created on first use: counters as Int64Counter, histograms as
+// Float64Histogram in seconds
+type OTelMetrics struct {
+	meter      metric.Meter
+	counters   sync.Map // name -> metric.Int64Counter
+	histograms sync.Map // name -> metric.Float64Histogram
+}
+
+// NewOTelMetrics returns Metrics reporting to meter
+func NewOTelMetrics(meter metric.Meter) *OTelMetrics {
+	return &OTelMetrics{meter: meter}
+}
+
+// Add adds value to the counter name
+func (m *OTelMetrics) Add(ctx context.Context, name string, value int64, labels ...Label) {
+	counter, ok := m.counters.Load(name)
+	if !ok {
+		created, err := m.meter.Int64Counter(name, metric.WithDescription(metricDescriptions[name]))
+		if err != nil {
+			return
+		}
+		counter, _ = m.counters.LoadOrStore(name, created)
+	}
+	counter.(metric.Int64Counter).Add(ctx, value, metric.WithAttributes(otelLabels(labels)...))
+}
+
+// Record records value in the histogram name
+func (m *OTelMetrics) Record(ctx context.Context, name string, value float64, labels ...Label) {
+	histogram, ok := m.histograms.Load(name)
+	if !ok {
+		created, err := m.meter.Float64Histogram(name,
+			metric.WithDescription(metricDescriptions[name]), metric.WithUnit("s"))
+		if err != nil {
+			return
+		}
+		histogram, _ = m.histograms.LoadOrStore(name, created)
+	}
+	histogram.(metric.Float64Histogram).Record(ctx, value, metric.WithAttributes(otelLabels(labels)...))
+}
+
+// otelLabels converts labels to attributes
+func otelLabels(labels []Label) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, len(labels))
+	for i, label := range labels {
+		attrs[i] = attribute.String(label.Key, label.Value)
+	}
+	return attrs
+}
+
+// metrics returns the configured Metrics, or NoopMetrics
+func (s *Swarm) metrics() Metrics {
+	if s.config != nil && s.config.Metrics != nil {
+		return s.config.Metrics
+	}
+	return NoopMetrics{}
+}
+
+// outcome returns the outcome label of err
+func outcome(err error) Label {
+	if err != nil {
+		return Label{LabelOutcome, "error"}
+	}
+	return Label{LabelOutcome, "ok"}
+}
+
+// since returns the seconds elapsed since start
+func since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
+
+// errorKinds are the error_kind labels of the llm error kinds
+var errorKinds = []struct {
+	err  error
+	kind string
+}{
+	{llm.ErrRateLimited, "rate_limited"},
+	{llm.ErrAuthentication, "authentication"},
+	{llm.ErrInvalidRequest, "invalid_request"},
+	{llm.ErrContextTooLong, "context_too_long"},
+	{llm.ErrContentFiltered, "content_filtered"},
+	{llm.ErrServer, "server"},
+	{llm.ErrTimeout, "timeout"},
+	{context.DeadlineExceeded, "timeout"},
+	{context.Canceled, "canceled"},
+}
+
+// errorKind returns the error_kind label of an LLM error
+func errorKind(err error) string {
+	for _, k := range errorKinds {
+		if errors.Is(err, k.err) {
+			return k.kind
+		}
+	}
+	return "other"
+}
+
+// llmLabels returns the labels of requests for model to client
+func llmLabels(client agentClient, model string) []Label {
+	return []Label{{LabelProvider, string(client.provider)}, {LabelModel, model}}
+}
+
+// recordLLMCall records the duration, token usage and failure of a request for
+// model to client that started at start
+func (s *Swarm) recordLLMCall(ctx context.Context, client agentClient, model string, start time.Time, usage llm.Usage, err error) {
+	m := s.metrics()
+	labels := llmLabels(client, model)
+	m.Record(ctx, MetricLLMDuration, since(start), append(labels, outcome(err))...)
+	if usage.PromptTokens > 0 || usage.CompletionTokens > 0 {
+		m.Add(ctx, MetricLLMInputTokens, int64(usage.PromptTokens), labels...)
+		m.Add(ctx, MetricLLMOutputTokens, int64(usage.CompletionTokens), labels...)
+	}
+	s.recordLLMError(ctx, client, model, err)
+}
+
+// recordLLMError counts a failed request, and the rate limit it hit if any
+func (s *Swarm) recordLLMError(ctx context.Context, client agentClient, model string, err error) {
+	if err == nil {
+		return
+	}
+	labels := llmLabels(client, model)
+	s.metrics().Add(ctx, MetricLLMErrors, 1, append(labels, Label{LabelErrorKind, errorKind(err)})...)
+	if isRateLimitError(err) {
+		s.metrics().Add(ctx, MetricLLMRateLimits, 1, labels...)
+	}
+}
+
+// recordToolCall records a call of agent's tool that started at start
+func (s *Swarm) recordToolCall(ctx context.Context, agent *Agent, tool string, start time.Time, err error) {
+	m := s.metrics()
+	labels := []Label{{LabelAgent, agent.Name}, {LabelTool, tool}}
+	m.Add(ctx, MetricToolCalls, 1, labels...)
+	m.Record(ctx, MetricToolDuration, since(start), labels...)
+	if err != nil {
+		m.Add(ctx, MetricToolErrors, 1, labels...)
+	}
+}
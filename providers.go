@@ -0,0 +1,217 @@
+package agentkit
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/rsaranusc/agentkit/llm"
+	"github.com/rsaranusc/openai-compatible"
+	googleoption "google.golang.org/api/option"
+)
+
+// ProviderFactory builds an LLM client from a client configuration
+type ProviderFactory func(config ClientConfig) (llm.LLM, error)
+
+// providerRegistry holds the factories registered with RegisterProvider
+var providerRegistry = struct {
+	sync.RWMutex
+	factories map[llm.LLMProvider]ProviderFactory
+}{factories: make(map[llm.LLMProvider]ProviderFactory)}
+
+func init() {
+	RegisterProvider(llm.OpenAI, newOpenAIClient)
+	RegisterProvider(llm.Azure, newOpenAIClient)
+	RegisterProvider(llm.AzureAD, newOpenAIClient)
+	RegisterProvider(llm.CloudflareAzure, newOpenAIClient)
+	RegisterProvider(llm.Claude, newClaudeClient)
+	RegisterProvider(llm.Gemini, newGeminiClient)
+	RegisterProvider(llm.Ollama, newOllamaClient)
+	RegisterProvider(llm.DeepSeek, newDeepSeekClient)
+}
+
+// RegisterProvider makes a provider available to NewClient and the Swarm
+// constructors, replacing any factory already registered for it. Packages
+// adding their own provider usually call it from an init function.
+func RegisterProvider(provider llm.LLMProvider, factory ProviderFactory) {
+	providerRegistry.Lock()
+	defer providerRegistry.Unlock()
+	providerRegistry.factories[provider] = factory
+}
+
+// Providers returns the registered providers, sorted by name
+func Providers() []llm.LLMProvider {
+	providerRegistry.RLock()
+	defer providerRegistry.RUnlock()
+
+	providers := make([]llm.LLMProvider, 0, len(providerRegistry.factories))
+	for provider := range providerRegistry.factories {
+		providers = append(providers, provider)
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i] < providers[j] })
+	return providers
+}
+
+// NewClient builds an LLM client with the factory registered for config.Provider
+func NewClient(config ClientConfig) (llm.LLM, error) {
+	providerRegistry.RLock()
+	factory, ok := providerRegistry.factories[config.Provider]
+	providerRegistry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidProvider, config.Provider)
+	}
+
+	client, err := factory(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s client: %w", config.Provider, err)
+	}
+	if client == nil {
+		return nil, fmt.Errorf("failed to create %s client: factory returned no client", config.Provider)
+	}
+	return client, nil
+}
+
+// newOpenAIClient builds a client for OpenAI and the OpenAI-compatible Azure
+// APIs. Azure deployments need BaseURL; APIVersion defaults to the Azure
+// client's and ModelMapperFunc maps models to deployment names.
+func newOpenAIClient(config ClientConfig) (llm.LLM, error) {
+	var cfg openai.ClientConfig
+	switch config.Provider {
+	case llm.Azure, llm.AzureAD, llm.CloudflareAzure:
+		if config.BaseURL == "" {
+			return nil, fmt.Errorf("%s requires a BaseURL", config.Provider)
+		}
+		cfg = openai.DefaultAzureConfig(config.AuthToken, config.BaseURL)
+		cfg.APIType = openai.APIType(config.Provider)
+	default:
+		cfg = llm.DefaultOpenAIConfig(config.AuthToken)
+	}
+
+	if config.BaseURL != "" {
+		cfg.BaseURL = config.BaseURL
+	}
+	if config.OrgID != "" {
+		cfg.OrgID = config.OrgID
+	}
+	if config.APIVersion != "" {
+		cfg.APIVersion = config.APIVersion
+	}
+	if config.AssistantVersion != "" {
+		cfg.AssistantVersion = config.AssistantVersion
+	}
+	if config.ModelMapperFunc != nil {
+		cfg.AzureModelMapperFunc = config.ModelMapperFunc
+	}
+	if config.HTTPClient != nil {
+		cfg.HTTPClient = config.HTTPClient
+	}
+	if config.EmptyMessagesLimit > 0 {
+		cfg.EmptyMessagesLimit = config.EmptyMessagesLimit
+	}
+	return llm.NewOpenAILLMWithConfig(cfg), nil
+}
+
+// newClaudeClient builds a Claude client; APIVersion sets the anthropic-version header
+func newClaudeClient(config ClientConfig) (llm.LLM, error) {
+	opts := []option.RequestOption{option.WithAPIKey(config.AuthToken)}
+	if config.BaseURL != "" {
+		opts = append(opts, option.WithBaseURL(config.BaseURL))
+	}
+	if config.HTTPClient != nil {
+		opts = append(opts, option.WithHTTPClient(config.HTTPClient))
+	}
+	if config.APIVersion != "" {
+		opts = append(opts, option.WithHeader("anthropic-version", config.APIVersion))
+	}
+	return llm.NewClaudeLLMWithOptions(opts...), nil
+}
+
+// newGeminiClient builds a Gemini client. An HTTPClient replaces the API key
+// authentication, so it must authenticate its requests itself.
+func newGeminiClient(config ClientConfig) (llm.LLM, error) {
+	var opts []googleoption.ClientOption
+	if config.BaseURL != "" {
+		opts = append(opts, googleoption.WithEndpoint(config.BaseURL))
+	}
+	if config.HTTPClient != nil {
+		opts = append(opts, googleoption.WithHTTPClient(config.HTTPClient))
+	}
+	return llm.NewGeminiLLMWithClientOptions(config.AuthToken, opts...)
+}
+
+// newOllamaClient builds an Ollama client; it needs no auth token
+func newOllamaClient(config ClientConfig) (llm.LLM, error) {
+	return llm.NewOllamaLLMWithClient(config.BaseURL, config.HTTPClient)
+}
+
+// newDeepSeekClient builds a DeepSeek client
+func newDeepSeekClient(config ClientConfig) (llm.LLM, error) {
+	return llm.NewDeepSeekLLMWithURL(config.AuthToken, config.BaseURL, config.HTTPClient), nil
+}
+
+// clientKey identifies a client resolved for an agent
+type clientKey struct {
+	config   *ClientConfig
+	provider llm.LLMProvider
+}
+
+// agentClient is a client resolved for an agent and the provider it calls
+type agentClient struct {
+	llm.LLM
+	provider llm.LLMProvider
+}
+
+// clientFor returns the client that serves agent. An agent with a Config gets
+// a client built from it; one whose Provider differs from the Swarm's gets a
+// client built from Config.Providers, and fails without an entry there. Other
+// agents use the Swarm's client. Clients are built once and reused for every
+// agent resolving to the same configuration.
+func (s *Swarm) clientFor(agent *Agent) (agentClient, error) {
+	defaultClient := agentClient{LLM: s.client, provider: s.provider}
+	if agent == nil {
+		return defaultClient, nil
+	}
+
+	key := clientKey{provider: agent.Provider}
+	switch {
+	case agent.Config != nil:
+		key.config = agent.Config
+	case agent.Provider == "" || agent.Provider == s.provider:
+		return defaultClient, nil
+	case s.config != nil && s.config.Providers[agent.Provider] != nil:
+		key.config = s.config.Providers[agent.Provider]
+	default:
+		return agentClient{}, fmt.Errorf("agent %s: %w: no client configuration for %s in Config.Providers",
+			agent.Name, ErrInvalidProvider, agent.Provider)
+	}
+
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	if client, ok := s.clients[key]; ok {
+		return client, nil
+	}
+
+	config := *key.config
+	if config.Provider == "" {
+		config.Provider = agent.Provider
+	}
+	if config.Provider == "" {
+		config.Provider = s.provider
+	}
+	// Share the Swarm's credentials with agents that only change other settings
+	if config.AuthToken == "" && config.Provider == s.provider {
+		config.AuthToken = s.clientConfig.AuthToken
+	}
+
+	built, err := NewClient(config)
+	if err != nil {
+		return agentClient{}, fmt.Errorf("agent %s: %w", agent.Name, err)
+	}
+	client := agentClient{LLM: built, provider: config.Provider}
+	if s.clients == nil {
+		s.clients = make(map[clientKey]agentClient)
+	}
+	s.clients[key] = client
+	return client, nil
+}
@@ -0,0 +1,241 @@
+package agentkit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/rsaranusc/agentkit/llm"
+)
+
+// RateLimit caps the requests and tokens sent per minute; zero means no cap
+type RateLimit struct {
+	RequestsPerMinute int
+	TokensPerMinute   int
+}
+
+// RateLimiter keeps LLM calls under per-minute request and token limits with
+// token buckets. Callers wait in the order they arrived until their request
+// fits, and stop waiting when their context is done.
+//
+// Token use is not known before a call, so each call reserves an estimate of
+// its prompt plus its MaxTokens and is corrected once the provider reports
+// the actual usage. An estimate above the tokens per minute reserves the
+// whole minute.
+type RateLimiter struct {
+	mu      sync.Mutex
+	limits  map[rateLimitKey]RateLimit
+	buckets map[rateLimitKey]*rateBuckets
+	paused  map[rateLimitKey]time.Time // Set by Pause, by provider and model
+	now     func() time.Time
+}
+
+// rateLimitKey identifies a limit; an empty model covers the whole provider
+type rateLimitKey struct {
+	provider llm.LLMProvider
+	model    string
+}
+
+// rateBuckets are the request and token buckets of one limit
+type rateBuckets struct {
+	requests *tokenBucket
+	tokens   *tokenBucket
+}
+
+// NewRateLimiter returns a RateLimiter without limits
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		limits:  make(map[rateLimitKey]RateLimit),
+		buckets: make(map[rateLimitKey]*rateBuckets),
+		paused:  make(map[rateLimitKey]time.Time),
+		now:     time.Now,
+	}
+}
+
+var defaultRateLimiter = NewRateLimiter()
+
+// DefaultRateLimiter returns the process-wide RateLimiter used by every Swarm
+// without Config.RateLimiter, including those created by workflows, graphs
+// and ConcurrentSwarm. It has no limits until SetLimit is called.
+func DefaultRateLimiter() *RateLimiter {
+	return defaultRateLimiter
+}
+
+// SetLimit sets the limit of model on provider, or of the whole provider when
+// model is empty. A call is limited by the limit of its model when there is
+// one, and otherwise by the limit of its provider.
+func (l *RateLimiter) SetLimit(provider llm.LLMProvider, model string, limit RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := rateLimitKey{provider, model}
+	l.limits[key] = limit
+	delete(l.buckets, key)
+}
+
+// bucketsFor returns the buckets limiting a call, or nil if it is not limited.
+// It must be called with l.mu held.
+func (l *RateLimiter) bucketsFor(provider llm.LLMProvider, model string) *rateBuckets {
+	key := rateLimitKey{provider, model}
+	limit, ok := l.limits[key]
+	if !ok {
+		key.model = ""
+		if limit, ok = l.limits[key]; !ok {
+			return nil
+		}
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		now := l.now()
+		b = &rateBuckets{
+			requests: newTokenBucket(limit.RequestsPerMinute, now),
+			tokens:   newTokenBucket(limit.TokensPerMinute, now),
+		}
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// Wait blocks until a call of model on provider using about tokens tokens fits
+// the limits, then reserves it. It returns ctx.Err() if ctx is done first, in
+// which case nothing is reserved.
+func (l *RateLimiter) Wait(ctx context.Context, provider llm.LLMProvider, model string, tokens int) (*RateLimitReservation, error) {
+	l.mu.Lock()
+	now := l.now()
+	var wait time.Duration
+	b := l.bucketsFor(provider, model)
+	if b != nil {
+		if b.tokens != nil {
+			tokens = min(tokens, int(b.tokens.capacity))
+		}
+		wait = max(b.requests.reserve(now, 1), b.tokens.reserve(now, float64(tokens)))
+	}
+	if until, ok := l.paused[rateLimitKey{provider, model}]; ok {
+		if until.After(now) {
+			wait = max(wait, until.Sub(now))
+		} else {
+			delete(l.paused, rateLimitKey{provider, model})
+		}
+	}
+	l.mu.Unlock()
+
+	reservation := &RateLimitReservation{limiter: l, buckets: b, tokens: tokens}
+	if wait <= 0 {
+		return reservation, nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		// Give the capacity back so callers queued behind can use it
+		reservation.Cancel()
+		return nil, ctx.Err()
+	case <-timer.C:
+		return reservation, nil
+	}
+}
+
+// Pause makes calls of model on provider wait for d, after the provider
+// signalled that its limit was reached. It applies whether or not a limit is set.
+func (l *RateLimiter) Pause(provider llm.LLMProvider, model string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := rateLimitKey{provider, model}
+	if until := l.now().Add(d); until.After(l.paused[key]) {
+		l.paused[key] = until
+	}
+}
+
+// RateLimitReservation is the capacity a call reserved with RateLimiter.Wait
+type RateLimitReservation struct {
+	limiter *RateLimiter
+	buckets *rateBuckets
+	tokens  int
+	once    sync.Once
+}
+
+// Complete corrects the reserved tokens with the usage the provider reported.
+// Without reported usage the estimate is kept. It is safe to call on a nil
+// reservation and only the first call counts.
+func (r *RateLimitReservation) Complete(usage llm.Usage) {
+	if r == nil || r.buckets == nil || usage.TotalTokens == 0 {
+		return
+	}
+	r.once.Do(func() {
+		r.limiter.mu.Lock()
+		defer r.limiter.mu.Unlock()
+		r.buckets.tokens.refund(r.limiter.now(), float64(r.tokens-usage.TotalTokens))
+	})
+}
+
+// Cancel gives the reserved request and tokens back, for calls that failed and
+// used no capacity. It is safe to call on a nil reservation and, like Complete,
+// only the first call counts.
+func (r *RateLimitReservation) Cancel() {
+	if r == nil || r.buckets == nil {
+		return
+	}
+	r.once.Do(func() {
+		r.limiter.mu.Lock()
+		defer r.limiter.mu.Unlock()
+		now := r.limiter.now()
+		r.buckets.requests.refund(now, 1)
+		r.buckets.tokens.refund(now, float64(r.tokens))
+	})
+}
+
+// tokenBucket refills at a steady rate up to its capacity. Reservations may
+// take it below zero; the caller then waits until the deficit is refilled.
+type tokenBucket struct {
+	capacity float64
+	perSec   float64
+	level    float64
+	last     time.Time
+}
+
+// newTokenBucket returns a full bucket for perMinute, or nil for no limit
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		capacity: float64(perMinute),
+		perSec:   float64(perMinute) / 60,
+		level:    float64(perMinute),
+		last:     now,
+	}
+}
+
+// refill adds what has accumulated since the last update
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.level = math.Min(b.capacity, b.level+elapsed*b.perSec)
+		b.last = now
+	}
+}
+
+// reserve takes n from the bucket and returns how long to wait until it is covered
+func (b *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	b.level -= n
+	if b.level >= 0 {
+		return 0
+	}
+	return time.Duration(-b.level / b.perSec * float64(time.Second))
+}
+
+// refund gives n back to the bucket; a negative n takes more
+func (b *tokenBucket) refund(now time.Time, n float64) {
+	if b == nil {
+		return
+	}
+	b.refill(now)
+	b.level = math.Min(b.capacity, b.level+n)
+}
@@ -0,0 +1,273 @@
+package agentkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/rsaranusc/agentkit/llm"
+)
+
+// ErrRetryBudgetExceeded is returned when waiting for another attempt would
+// exceed the retry policy's budget
+var ErrRetryBudgetExceeded = errors.New("retry budget exceeded")
+
+// RetryPolicy controls how failed LLM calls are retried. Only errors worth
+// retrying are: rate limits, server errors, timeouts and errors raised before
+// the provider answered, such as network failures.
+type RetryPolicy struct {
+	MaxRetries     int           // Attempts after the first one
+	InitialBackoff time.Duration // Wait before the first retry
+	MaxBackoff     time.Duration // Longest wait between attempts; 0 means no limit
+	Multiplier     float64       // Growth of the wait after each retry; values below 1 mean 2
+	Jitter         float64       // Fraction of each wait that is randomized, from 0 to 1
+
+	// Budget caps the total time spent waiting between attempts; 0 means no limit
+	Budget time.Duration
+
+	// FailOnRateLimit returns rate limit errors at once instead of retrying them
+	FailOnRateLimit bool
+}
+
+// DefaultRetryPolicy returns the policy used when Config.RetryPolicy is not set
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:     3,
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// Backoff returns how long to wait before retry number attempt, counting from 1,
+// after err. A wait the provider asked for is used when it is longer than the
+// computed one; the result is capped at MaxBackoff unless the provider asked
+// for more.
+func (p RetryPolicy) Backoff(attempt int, err error) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	wait := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && wait > float64(p.MaxBackoff) {
+		wait = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		wait -= wait * jitter * rand.Float64()
+	}
+	backoff := time.Duration(wait)
+
+	if retryAfter, ok := llm.RetryAfter(err); ok && retryAfter > backoff {
+		backoff = retryAfter
+	}
+	return backoff
+}
+
+// retryable reports whether err is worth another attempt under the policy
+func (p RetryPolicy) retryable(err error) bool {
+	if isRateLimitError(err) {
+		return !p.FailOnRateLimit
+	}
+	return llm.IsRetryable(err)
+}
+
+// retryPolicy returns the configured retry policy. Without one, it follows
+// MaxRetries, RetryBackoff and RateLimitStrategy.
+func (s *Swarm) retryPolicy() RetryPolicy {
+	if s.config == nil {
+		return RetryPolicy{}
+	}
+	if s.config.RetryPolicy != nil {
+		return *s.config.RetryPolicy
+	}
+
+	policy := DefaultRetryPolicy()
+	policy.MaxRetries = s.config.MaxRetries
+	policy.InitialBackoff = s.config.RetryBackoff
+	policy.FailOnRateLimit = s.config.RateLimitStrategy == RateLimitFail
+	return policy
+}
+
+// withRetries calls call until it succeeds or the retry policy gives up. Waits
+// end early when ctx is done.
+func withRetries[T any](ctx context.Context, s *Swarm, call func(context.Context) (T, error)) (T, error) {
+	policy := s.retryPolicy()
+	var waited time.Duration
+
+	for attempt := 0; ; attempt++ {
+		result, err := call(ctx)
+		if err == nil {
+			return result, nil
+		}
+
+		if ctx.Err() != nil {
+			return result, err
+		}
+		if !policy.retryable(err) {
+			if isRateLimitError(err) {
+				return result, fmt.Errorf("rate limit exceeded: %w", err)
+			}
+			return result, err
+		}
+		if attempt >= policy.MaxRetries {
+			if attempt == 0 {
+				return result, err
+			}
+			return result, fmt.Errorf("max retries exceeded: %w", err)
+		}
+
+		wait := policy.Backoff(attempt+1, err)
+		if policy.Budget > 0 && waited+wait > policy.Budget {
+			return result, fmt.Errorf("%w after %v: %w", ErrRetryBudgetExceeded, waited, err)
+		}
+		s.logger(ctx, false).Warn("retrying LLM call",
+			"attempt", attempt+1, "max_retries", policy.MaxRetries, "wait", wait, "error", err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result, ctx.Err()
+		case <-timer.C:
+		}
+		waited += wait
+	}
+}
+
+// createChatCompletion requests a chat completion from client under the retry
+// policy and the rate limiter. Each attempt is limited to the configured
+// request timeout.
+func (s *Swarm) createChatCompletion(ctx context.Context, client agentClient, req llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error) {
+	attempts := 0
+	return withRetries(ctx, s, func(ctx context.Context) (llm.ChatCompletionResponse, error) {
+		s.countRetry(ctx, client, req, &attempts)
+		reservation, err := s.waitRateLimit(ctx, client, req)
+		if err != nil {
+			return llm.ChatCompletionResponse{}, err
+		}
+
+		if s.config != nil && s.config.RequestTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, s.config.RequestTimeout)
+			defer cancel()
+		}
+		ctx, span := s.startLLMSpan(ctx, client, req)
+		start := time.Now()
+		resp, err := client.CreateChatCompletion(ctx, req)
+		s.recordLLMCall(ctx, client, req.Model, start, resp.Usage, err)
+		recordLLMResponse(span, resp)
+		endSpan(span, err)
+		if err != nil {
+			reservation.Cancel()
+		} else {
+			reservation.Complete(resp.Usage)
+		}
+		s.noteRateLimit(client, req, err)
+		return resp, err
+	})
+}
+
+// createChatCompletionStream opens a stream from client under the retry
+// policy and the rate limiter. Only opening is retried; the stream lives as
+// long as ctx.
+func (s *Swarm) createChatCompletionStream(ctx context.Context, client agentClient, req llm.ChatCompletionRequest) (llm.ChatCompletionStream, error) {
+	attempts := 0
+	return withRetries(ctx, s, func(ctx context.Context) (llm.ChatCompletionStream, error) {
+		s.countRetry(ctx, client, req, &attempts)
+		reservation, err := s.waitRateLimit(ctx, client, req)
+		if err != nil {
+			return nil, err
+		}
+
+		spanCtx, span := s.startLLMSpan(ctx, client, req)
+		start := time.Now()
+		stream, err := client.CreateChatCompletionStream(spanCtx, req)
+		s.noteRateLimit(client, req, err)
+		if err != nil {
+			reservation.Cancel()
+			s.recordLLMCall(ctx, client, req.Model, start, llm.Usage{}, err)
+			endSpan(span, err)
+			return nil, err
+		}
+
+		// The span and the metrics cover the whole stream and report what its
+		// chunks carried
+		var summary llm.ChatCompletionResponse
+		firstChunk := true
+		return llm.WatchStream(stream, func(chunk llm.ChatCompletionResponse) {
+			if firstChunk {
+				firstChunk = false
+				s.metrics().Record(ctx, MetricLLMTimeToFirstToken, since(start), llmLabels(client, req.Model)...)
+			}
+			if chunk.Usage.TotalTokens > 0 {
+				summary.Usage = chunk.Usage
+			}
+			if chunk.Model != "" {
+				summary.Model = chunk.Model
+			}
+			for _, choice := range chunk.Choices {
+				if choice.FinishReason != "" {
+					summary.Choices = []llm.Choice{{FinishReason: choice.FinishReason}}
+				}
+			}
+		}, func(err error) {
+			if err != nil {
+				reservation.Cancel()
+			} else {
+				reservation.Complete(summary.Usage)
+			}
+			s.recordLLMCall(ctx, client, req.Model, start, summary.Usage, err)
+			recordLLMResponse(span, summary)
+			endSpan(span, err)
+		}), nil
+	})
+}
+
+// countRetry counts the attempts of a request, recording every one after the first
+// as a retry
+func (s *Swarm) countRetry(ctx context.Context, client agentClient, req llm.ChatCompletionRequest, attempts *int) {
+	*attempts++
+	if *attempts > 1 {
+		s.metrics().Add(ctx, MetricLLMRetries, 1, llmLabels(client, req.Model)...)
+	}
+}
+
+// rateLimiter returns the configured rate limiter or the process-wide one
+func (s *Swarm) rateLimiter() *RateLimiter {
+	if s.config != nil && s.config.RateLimiter != nil {
+		return s.config.RateLimiter
+	}
+	return DefaultRateLimiter()
+}
+
+// waitRateLimit waits until req fits the rate limits of its provider and model.
+// It reserves the estimated prompt tokens plus MaxTokens, unless MaxTokens is
+// the catalog's default: that is the model's largest output, far more than
+// most calls use, and the actual usage corrects the estimate anyway.
+func (s *Swarm) waitRateLimit(ctx context.Context, client agentClient, req llm.ChatCompletionRequest) (*RateLimitReservation, error) {
+	tokens := countMessages(req.Messages, s.messageTokens) + s.toolTokens(req.Tools)
+	if req.MaxTokens != s.modelInfo(req.Model).MaxOutputTokens {
+		tokens += req.MaxTokens
+	}
+	return s.rateLimiter().Wait(ctx, client.provider, req.Model, tokens)
+}
+
+// noteRateLimit pauses the rate limiter after a rate limit error when the
+// RateLimitQueue strategy is set, so every caller queues until the provider
+// is ready again rather than retrying on its own
+func (s *Swarm) noteRateLimit(client agentClient, req llm.ChatCompletionRequest, err error) {
+	if err == nil || s.config == nil || s.config.RateLimitStrategy != RateLimitQueue || !isRateLimitError(err) {
+		return
+	}
+	wait, ok := llm.RetryAfter(err)
+	if !ok {
+		wait = s.retryPolicy().Backoff(1, err)
+	}
+	s.rateLimiter().Pause(client.provider, req.Model, wait)
+}
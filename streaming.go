@@ -3,9 +3,13 @@ package agentkit
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
+	"time"
 
 	"github.com/rsaranusc/agentkit/llm"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // StreamHandler represents a handler for streaming responses
@@ -17,6 +21,12 @@ type StreamHandler interface {
 	OnError(err error)
 }
 
+// UsageHandler can be implemented by a StreamHandler to receive the token usage
+// of all streamed completions, just before OnComplete
+type UsageHandler interface {
+	OnUsage(usage Usage)
+}
+
 // DefaultStreamHandler provides a basic implementation of StreamHandler
 type DefaultStreamHandler struct{}
 
@@ -35,7 +45,7 @@ func (s *Swarm) StreamingResponse(
 	modelOverride string,
 	handler StreamHandler,
 	debug bool,
-) error {
+) (err error) {
 	if handler == nil {
 		handler = &DefaultStreamHandler{}
 	}
@@ -44,91 +54,145 @@ func (s *Swarm) StreamingResponse(
 		contextVariables = make(map[string]interface{})
 	}
 
-	if debug {
-		fmt.Printf("Debug: Using model: %s\n", agent.Model)
-		fmt.Printf("Debug: Number of messages: %d\n", len(messages))
-		fmt.Printf("Debug: Number of tools: %d\n", len(agent.Functions))
-	}
+	ctx = withRunID(ctx)
+	logger := s.logger(ctx, debug).With(LogKeyAgent, agent.Name)
+
+	// The system message carries the instructions of the agent answering
+	allMessages := append([]llm.Message{{Role: llm.RoleSystem}}, messages...)
+	currentMessage := llm.Message{Role: llm.RoleAssistant, Name: agent.Name}
+	var usage Usage
+
+	hooks := s.hooks(ctx)
+	hooks.runStart(ctx, agent, messages)
+	activeAgent := agent
+	defer func() {
+		response := Response{
+			Messages:         cloneMessages(allMessages[len(messages)+1:]),
+			Agent:            activeAgent,
+			ContextVariables: contextVariables,
+			Usage:            usage,
+		}
+		if currentMessage.Content != "" {
+			response.Messages = append(response.Messages, currentMessage)
+		}
+		hooks.runEnd(ctx, agent, response, err)
+	}()
 
-	// Prepare the initial system message with agent instructions
-	instructions := agent.Instructions
-	if agent.InstructionsFunc != nil {
-		instructions = agent.InstructionsFunc(contextVariables)
-	}
-	allMessages := append([]llm.Message{
-		{
-			Role:    llm.RoleSystem,
-			Content: instructions,
-		},
-	}, messages...)
-
-	// Build tool definitions
+	// useAgent makes next answer the following turns with its instructions,
+	// tools and model
 	var tools []llm.Tool
-	for _, af := range agent.Functions {
-		def := FunctionToDefinition(af)
-		if debug {
-			fmt.Printf("Debug: Adding tool: %s\n", def.Name)
+	var model string
+	useAgent := func(next *Agent) {
+		activeAgent = next
+		instructions := next.Instructions
+		if next.InstructionsFunc != nil {
+			instructions = next.InstructionsFunc(contextVariables)
 		}
-		tools = append(tools, llm.Tool{
-			Type: "function",
-			Function: &llm.Function{
-				Name:        def.Name,
-				Description: def.Description,
-				Parameters:  def.Parameters,
-			},
-		})
-	}
+		allMessages[0].Content = instructions
 
-	// Prepare the streaming request
-	model := agent.Model
-	if modelOverride != "" {
-		model = modelOverride
+		tools = agentTools(next)
+		model = s.agentModel(next, modelOverride)
+	}
+	useAgent(agent)
+
+	logger.Debug("opening stream", LogKeyModel, model, "messages", len(allMessages), "tools", len(tools))
+
+	// newRequest builds the request of a turn from allMessages: the history is
+	// fitted to the context window, then the hooks may edit or veto it
+	newRequest := func(model string) (llm.ChatCompletionRequest, ModelInfo, error) {
+		req := llm.ChatCompletionRequest{
+			Model:    model,
+			Messages: allMessages,
+			Tools:    tools,
+			Stream:   true,
+		}
+		info, err := s.applyModelInfo(&req)
+		if err == nil {
+			err = s.fitContextWindow(ctx, &req, info)
+		}
+		if err == nil {
+			err = hooks.llmRequest(ctx, activeAgent, &req)
+		}
+		return req, info, err
 	}
 
-	if debug {
-		fmt.Printf("Debug: Final model: %s\n", model)
-		fmt.Printf("Debug: Creating stream with %d messages\n", len(allMessages))
+	req, info, err := newRequest(model)
+	if err != nil {
+		handler.OnError(err)
+		return err
 	}
 
-	req := llm.ChatCompletionRequest{
-		Model:    model,
-		Messages: allMessages,
-		Tools:    tools,
-		Stream:   true,
+	client, err := s.clientFor(activeAgent)
+	if err != nil {
+		handler.OnError(err)
+		return err
 	}
 
-	stream, err := s.client.CreateChatCompletionStream(ctx, req)
+	stream, err := s.streamWithHandlers(ctx, activeAgent, client, req)
+	if errors.Is(err, errSkipped) {
+		handler.OnComplete(currentMessage)
+		return nil
+	}
 	if err != nil {
-		if debug {
-			fmt.Printf("Debug: Stream creation error: %v\n", err)
-		}
+		logger.Error("stream creation failed", LogKeyModel, req.Model, "error", err)
 		handler.OnError(fmt.Errorf("failed to create chat completion stream: %v", err))
 		return err
 	}
-	defer stream.Close()
+	defer func() { stream.Close() }()
 
 	handler.OnStart()
 
-	var currentMessage llm.Message
-	currentMessage.Role = llm.RoleAssistant
-	currentMessage.Name = agent.Name
-
 	// Track tool calls being built
 	toolCallsInProgress := make(map[string]*llm.ToolCall)
 	processedToolCalls := make(map[string]bool)
+	argumentFailures := make(map[string]int)
+	recvAttempts := 0
+
+	// Usage is recorded once per stream; providers report it cumulatively
+	var streamUsage llm.Usage
+	usageAgent, usageModel, usageInfo := activeAgent.Name, model, info
+	recordStreamUsage := func() {
+		usage.Add(usageAgent, usageModel, streamUsage, usageInfo.Cost(streamUsage))
+		streamUsage = llm.Usage{}
+	}
 
-	// createNewStream creates a new stream and handles errors
+	// respond reports message to the hooks as the response of the turn
+	respond := func(message llm.Message) {
+		hooks.llmResponse(ctx, activeAgent, llm.ChatCompletionResponse{
+			Model:   usageModel,
+			Choices: []llm.Choice{{Message: message}},
+			Usage:   streamUsage,
+		})
+	}
+
+	// complete ends the stream with the message received so far
+	complete := func() error {
+		respond(currentMessage)
+		recordStreamUsage()
+		if usageHandler, ok := handler.(UsageHandler); ok {
+			usageHandler.OnUsage(usage)
+		}
+		handler.OnComplete(currentMessage)
+		return nil
+	}
+
+	// createNewStream creates a new stream for req and handles errors. A stream
+	// the failure handlers skip completes the response.
 	createNewStream := func() error {
+		recordStreamUsage()
+		usageAgent, usageModel, usageInfo = activeAgent.Name, model, info
 		if err := stream.Close(); err != nil {
 			handler.OnError(fmt.Errorf("failed to close stream: %v", err))
 			return err
 		}
 
-		newStream, err := s.client.CreateChatCompletionStream(ctx, req)
+		newStream, err := s.streamWithHandlers(ctx, activeAgent, client, req)
+		if errors.Is(err, errSkipped) {
+			stream = &messageStream{}
+			return nil
+		}
 		if err != nil {
-			if debug {
-				fmt.Printf("Debug: Error creating new stream: %v\n", err)
-			}
+			logger.Error("stream creation failed", LogKeyModel, req.Model, "error", err)
 			handler.OnError(fmt.Errorf("failed to create new stream after tool call: %v", err))
 			return err
 		}
@@ -145,8 +209,7 @@ func (s *Swarm) StreamingResponse(
 			response, err := stream.Recv()
 			if err != nil {
 				if err.Error() == "EOF" {
-					handler.OnComplete(currentMessage)
-					return nil
+					return complete()
 				}
 				if err.Error() == "stream closed" {
 					// If stream is closed, try to create a new one
@@ -155,13 +218,54 @@ func (s *Swarm) StreamingResponse(
 					}
 					continue
 				}
-				if debug {
-					fmt.Printf("Debug: Error receiving from stream: %v\n", err)
+				logger.Warn("stream receive failed", LogKeyModel, req.Model, "error", err)
+
+				// Let the failure handlers decide; a retry starts the turn over
+				recvAttempts++
+				decision := s.handleFailure(Failure{
+					Phase:   FailureStream,
+					Agent:   activeAgent,
+					Model:   req.Model,
+					Attempt: recvAttempts,
+					Err:     err,
+					Request: &req,
+				})
+				switch decision.Action {
+				case FailureRetry, FailureRetryWithModel:
+					if decision.Request != nil {
+						req = *decision.Request
+					}
+					if decision.Model != "" {
+						req.Model = decision.Model
+					}
+					if decision.Request != nil || decision.Model != "" {
+						model, info = req.Model, s.modelInfo(req.Model)
+					}
+					currentMessage.Content = ""
+					if err := createNewStream(); err != nil {
+						return err
+					}
+					continue
+				case FailureSubstitute:
+					currentMessage.Content += decision.Content
+					handler.OnToken(decision.Content)
+					return complete()
+				case FailureSkip:
+					return complete()
+				case FailureAbort:
+					err = decision.abortError(err)
 				}
-				handler.OnError(fmt.Errorf("error receiving from stream: %v", err))
+				handler.OnError(fmt.Errorf("error receiving from stream: %w", err))
 				return err
 			}
 
+			if response.Usage.PromptTokens > 0 || response.Usage.CompletionTokens > 0 {
+				streamUsage = response.Usage
+			}
+			if response.Model != "" && response.Model != usageModel {
+				usageModel, usageInfo = response.Model, s.modelInfo(response.Model)
+			}
+
 			if len(response.Choices) == 0 {
 				continue
 			}
@@ -177,24 +281,13 @@ func (s *Swarm) StreamingResponse(
 			// Handle tool calls
 			if len(choice.Message.ToolCalls) > 0 {
 				for _, toolCall := range choice.Message.ToolCalls {
-					if debug {
-						fmt.Printf("Debug: Processing tool call: ID=%s Name=%s\n",
-							toolCall.ID, toolCall.Function.Name)
-					}
-
 					// Skip empty tool calls
 					if toolCall.ID == "" {
-						if debug {
-							fmt.Printf("Debug: Skipping empty tool call ID\n")
-						}
 						continue
 					}
 
 					// Skip if we've already processed this tool call
 					if processedToolCalls[toolCall.ID] {
-						if debug {
-							fmt.Printf("Debug: Skipping already processed tool call: %s\n", toolCall.ID)
-						}
 						continue
 					}
 
@@ -210,43 +303,27 @@ func (s *Swarm) StreamingResponse(
 							},
 						}
 						toolCallsInProgress[toolCall.ID] = inProgress
-						if debug {
-							fmt.Printf("Debug: Created new tool call: %s, Name: %s\n",
-								toolCall.ID, toolCall.Function.Name)
-						}
+						logger.Log(ctx, LevelTrace, "tool call started", LogKeyTool, toolCall.Function.Name, "call_id", toolCall.ID)
 					}
 
 					// Update function name if provided
 					if toolCall.Function.Name != "" && inProgress.Function.Name == "" {
 						inProgress.Function.Name = toolCall.Function.Name
-						if debug {
-							fmt.Printf("Debug: Updated function name for tool call %s: %s\n",
-								toolCall.ID, toolCall.Function.Name)
-						}
 					}
 
 					// Accumulate function arguments
 					if toolCall.Function.Arguments != "" {
 						// Always append new arguments
 						inProgress.Function.Arguments += toolCall.Function.Arguments
-						if debug {
-							fmt.Printf("Debug: Updated arguments for tool call %s: %s\n",
-								toolCall.ID, inProgress.Function.Arguments)
-						}
 
 						// Try to parse the arguments to verify it's complete JSON
 						var args map[string]interface{}
 						if err := json.Unmarshal([]byte(inProgress.Function.Arguments), &args); err == nil {
-							if debug {
-								fmt.Printf("Debug: Valid JSON arguments for tool call %s: %v\n",
-									toolCall.ID, args)
-							}
-
 							// Only execute if we haven't processed this tool call yet
 							if !processedToolCalls[toolCall.ID] {
 								// Find and execute the corresponding function
 								var fn *AgentFunction
-								for _, f := range agent.Functions {
+								for _, f := range activeAgent.Functions {
 									if f.Name == inProgress.Function.Name {
 										fn = &f
 										break
@@ -259,26 +336,61 @@ func (s *Swarm) StreamingResponse(
 									continue
 								}
 
-								if debug {
-									fmt.Printf("Debug: Executing function %s with args: %v\n",
-										inProgress.Function.Name, args)
-								}
+								logger.Debug("calling tool", LogKeyTool, fn.Name)
+								logger.Log(ctx, LevelTrace, "tool arguments", LogKeyTool, fn.Name, "arguments", args)
 
-								// Execute the function
-								result := fn.Function(args, contextVariables)
+								// The turn ends with this call
+								turn := currentMessage
+								turn.ToolCalls = append(append([]llm.ToolCall(nil), currentMessage.ToolCalls...), *inProgress)
+								respond(turn)
 
-								// Create function response message
+								// Let the hooks vet the call, validate the arguments, then execute the function
+								var result Result
 								var resultContent string
-								if result.Error != nil {
+								toolCtx, toolSpan := s.tracer(ctx).Start(ctx, "agentkit.tool", trace.WithAttributes(
+									AttrAgent.String(activeAgent.Name), AttrTool.String(fn.Name)))
+								toolStart := time.Now()
+								call := *inProgress
+								var variablesBefore map[string]interface{}
+								if len(hooks) > 0 {
+									variablesBefore = copyContextVariables(contextVariables)
+								}
+								if vetoErr := hooks.toolStart(ctx, activeAgent, &call); vetoErr != nil {
+									result = Result{Success: false, Error: vetoErr}
+								} else if parsedArgs, argErr := parseToolArguments(fn, call.Function.Arguments); argErr != nil {
+									result = Result{Success: false, Error: argErr}
+								} else {
+									result = callAgentFunction(toolCtx, fn, parsedArgs, contextVariables)
+									result = s.handleToolFailure(activeAgent, fn.Name, result, func() Result {
+										return callAgentFunction(toolCtx, fn, parsedArgs, contextVariables)
+									})
+								}
+								s.recordToolCall(ctx, activeAgent, fn.Name, toolStart, result.Error)
+								endSpan(toolSpan, result.Error)
+								hooks.toolEnd(ctx, activeAgent, call, result)
+								if variablesBefore != nil && !reflect.DeepEqual(variablesBefore, contextVariables) {
+									hooks.contextVariablesChanged(ctx, activeAgent, contextVariables)
+								}
+								if errors.Is(result.Error, ErrAborted) {
+									handler.OnError(result.Error)
+									return result.Error
+								}
+								if err := s.trackToolRepairs([]ToolResult{{ToolName: fn.Name, Result: result}}, argumentFailures); err != nil {
+									handler.OnError(err)
+									return err
+								}
+
+								// Create function response message
+								var toolArgErr *ToolArgumentsError
+								if errors.As(result.Error, &toolArgErr) {
+									resultContent = toolArgErr.toolMessage()
+									logger.Warn("invalid tool arguments", LogKeyTool, fn.Name, "error", result.Error)
+								} else if result.Error != nil && !errors.Is(result.Error, errSkipped) {
 									resultContent = fmt.Sprintf("Error: %v", result.Error)
-									if debug {
-										fmt.Printf("Debug: Function execution error: %v\n", result.Error)
-									}
+									logger.Error("tool call failed", LogKeyTool, fn.Name, "error", result.Error)
 								} else {
-									resultContent = fmt.Sprintf("%v", result.Data)
-									if debug {
-										fmt.Printf("Debug: Function execution success: %v\n", result.Data)
-									}
+									resultContent = toolResultContent(result.Data)
+									logger.Log(ctx, LevelTrace, "tool result", LogKeyTool, fn.Name, "result", resultContent)
 								}
 
 								// Mark as processed and clean up
@@ -289,21 +401,32 @@ func (s *Swarm) StreamingResponse(
 								currentMessage.ToolCalls = append(currentMessage.ToolCalls, *inProgress)
 								handler.OnToolCall(*inProgress)
 
-								// Add function response message
+								// Add the tool message answering this call
 								functionMessage := llm.Message{
-									Role:    llm.RoleFunction,
-									Content: resultContent,
-									Name:    inProgress.Function.Name,
+									Role:       llm.RoleTool,
+									Content:    resultContent,
+									Name:       inProgress.Function.Name,
+									ToolCallID: inProgress.ID,
 								}
 
 								// Add messages and create new stream
 								allMessages = append(allMessages, currentMessage)
 								allMessages = append(allMessages, functionMessage)
-								req.Messages = allMessages
 
-								if debug {
-									fmt.Printf("Debug: Added function response message: %s = %s\n",
-										functionMessage.Name, functionMessage.Content)
+								// Switch to the agent the tool handed off to
+								if next := result.Agent; next != nil && next != activeAgent {
+									logger.Info("handoff", "to", next.Name)
+									s.handoff(ctx, hooks, activeAgent, next)
+									useAgent(next)
+									logger = s.logger(ctx, debug).With(LogKeyAgent, next.Name)
+									if client, err = s.clientFor(next); err != nil {
+										handler.OnError(err)
+										return err
+									}
+								}
+								if req, info, err = newRequest(model); err != nil {
+									handler.OnError(err)
+									return err
 								}
 
 								if err := createNewStream(); err != nil {
@@ -311,18 +434,14 @@ func (s *Swarm) StreamingResponse(
 									return err
 								}
 
-								if debug {
-									fmt.Printf("Debug: Created new stream after tool call, messages count: %d\n", len(allMessages))
-								}
+								logger.Debug("reopened stream after tool call", LogKeyModel, req.Model, "messages", len(allMessages))
 
 								// Reset current message for new response
 								currentMessage = llm.Message{
 									Role: llm.RoleAssistant,
-									Name: agent.Name,
+									Name: activeAgent.Name,
 								}
 							}
-						} else if debug {
-							fmt.Printf("Debug: Incomplete JSON for tool call %s: %v\n", toolCall.ID, err)
 						}
 					}
 				}
@@ -0,0 +1,137 @@
+package agentkit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/rsaranusc/agentkit/llm"
+	"github.com/rsaranusc/openai-compatible/jsonschema"
+)
+
+// DefaultStructuredAttempts is the number of replies RunStructured asks for when
+// maxAttempts is not positive
+const DefaultStructuredAttempts = 3
+
+// ErrInvalidStructuredOutput is returned by RunStructured when none of the model's
+// replies could be decoded
+var ErrInvalidStructuredOutput = errors.New("model did not return valid structured output")
+
+// schemaNamePattern matches the schema names every provider accepts
+var schemaNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// RunStructured runs the agent like Run, asking the model to reply with JSON that
+// matches the schema of T, and decodes the final reply into T. When a reply is not
+// valid JSON or does not match the schema, the model is told what was wrong and
+// asked again, up to maxAttempts replies in total. The returned Response holds
+// every message of the exchange, including the corrections.
+func RunStructured[T any](
+	ctx context.Context,
+	s *Swarm,
+	agent *Agent,
+	messages []llm.Message,
+	contextVariables map[string]interface{},
+	modelOverride string,
+	maxAttempts int,
+) (T, Response, error) {
+	var zero T
+	if agent == nil {
+		return zero, Response{}, ErrNilAgent
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultStructuredAttempts
+	}
+
+	schema, format, err := structuredFormat[T]()
+	if err != nil {
+		return zero, Response{}, fmt.Errorf("cannot build schema for %T: %w", zero, err)
+	}
+
+	if contextVariables == nil {
+		contextVariables = make(map[string]interface{})
+	}
+
+	history := cloneMessages(messages)
+	combined := Response{Agent: agent, ContextVariables: contextVariables}
+	var lastErr error
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		resp, err := s.run(ctx, combined.Agent, history, contextVariables, modelOverride, false, false, DefaultMaxTurns, true, format)
+		combined.Messages = append(combined.Messages, resp.Messages...)
+		combined.ToolResults = append(combined.ToolResults, resp.ToolResults...)
+		combined.Usage.Merge(resp.Usage)
+		if resp.Agent != nil {
+			combined.Agent = resp.Agent
+		}
+		if err != nil {
+			return zero, combined, err
+		}
+		history = append(history, resp.Messages...)
+
+		var result T
+		reply := lastMessage(resp.Messages)
+		if reply == nil || reply.Role != llm.RoleAssistant || len(reply.ToolCalls) > 0 {
+			lastErr = errors.New("the conversation ended without a final reply")
+		} else {
+			content := trimCodeFence(reply.Content)
+			if lastErr = jsonschema.VerifySchemaAndUnmarshal(*schema, []byte(content), &result); lastErr == nil {
+				return result, combined, nil
+			}
+		}
+
+		correction := llm.Message{
+			Role: llm.RoleUser,
+			Content: fmt.Sprintf("Your reply could not be used: %v. Reply again with only a JSON object that matches the requested schema.",
+				lastErr),
+		}
+		history = append(history, correction)
+		combined.Messages = append(combined.Messages, correction)
+	}
+
+	return zero, combined, fmt.Errorf("%w after %d attempts: %v", ErrInvalidStructuredOutput, maxAttempts, lastErr)
+}
+
+// structuredFormat builds the schema of T and the response format requesting it
+func structuredFormat[T any]() (*jsonschema.Definition, *llm.ResponseFormat, error) {
+	schema, err := jsonschema.GenerateSchemaForType(new(T))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var params map[string]interface{}
+	data, err := json.Marshal(schema)
+	if err == nil {
+		err = json.Unmarshal(data, &params)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	name := reflect.TypeOf((*T)(nil)).Elem().Name()
+	if !schemaNamePattern.MatchString(name) {
+		name = llm.DefaultResponseFormatName
+	}
+
+	return schema, &llm.ResponseFormat{
+		Type:   llm.ResponseFormatJSONSchema,
+		Name:   name,
+		Schema: params,
+	}, nil
+}
+
+// trimCodeFence removes a Markdown code fence the model may wrap its JSON in
+func trimCodeFence(content string) string {
+	content = strings.TrimSpace(content)
+	if !strings.HasPrefix(content, "```") {
+		return content
+	}
+	content = strings.TrimPrefix(content, "```")
+	if newline := strings.Index(content, "\n"); newline >= 0 {
+		content = content[newline+1:]
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(content), "```"))
+}
@@ -5,11 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"strings"
+	"log/slog"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/rsaranusc/agentkit/llm"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -20,28 +22,73 @@ var (
 	ErrInvalidProvider   = errors.New("invalid LLM provider specified")
 	ErrNoChoicesInResp   = errors.New("no choices in LLM response")
 	ErrMessageTooLong    = errors.New("message exceeds maximum token limit")
+
+	ErrInvalidToolArguments    = errors.New("invalid tool arguments")
+	ErrToolRepairLimitExceeded = errors.New("tool argument repair attempts exhausted")
+	ErrUnsupportedModelFeature = errors.New("model does not support the requested feature")
 )
 
+// DefaultMaxTurns is the number of model turns Run allows when maxTurns is not positive
+const DefaultMaxTurns = 10
+
+// DefaultMaxToolRepairAttempts is how many times in a row the model may retry a
+// tool call with invalid arguments when Config.MaxToolRepairAttempts is zero
+const DefaultMaxToolRepairAttempts = 2
+
 // Swarm represents the main structure
 type Swarm struct {
 	client       llm.LLM
 	tokenCounter func(string) int // Optional token counter function
 	initialized  bool             // Flag to check if Swarm is properly initialized
 	config       *Config          // Configuration settings
+
+	provider     llm.LLMProvider // Provider of client; empty when the client was supplied
+	clientConfig ClientConfig    // Configuration client was built from
+	clientsMu    sync.Mutex
+	clients      map[clientKey]agentClient // Clients built for agents, see clientFor
 }
 
 // Config holds configuration options for Swarm
 type Config struct {
-	MaxRetries        int
-	RetryBackoff      time.Duration
-	RequestTimeout    time.Duration
-	MaxTokens         int
-	DefaultModel      string
-	Debug             bool
-	LogLevel          LogLevel
-	TokenLimits       map[string]int // Model-specific token limits
-	FailureHandlers   []FailureHandler
-	RateLimitStrategy RateLimitStrategy
+	MaxRetries           int
+	RetryBackoff         time.Duration
+	RetryPolicy          *RetryPolicy // Overrides MaxRetries, RetryBackoff and RateLimitStrategy when set
+	RequestTimeout       time.Duration
+	MaxTokens            int
+	DefaultModel         string
+	Debug                bool
+	LogLevel             LogLevel           // Least severe records logged; LogSilent disables logging
+	Logger               *slog.Logger       // Receives the library's output; nil keeps it silent
+	Models               *ModelCatalog      // Model limits, prices and capabilities; nil disables the checks
+	Truncation           TruncationStrategy // Shortens history that exceeds the context window; nil disables it
+	FailureHandlers      []FailureHandler   // Decide what to do about failed LLM calls, streams and tools
+	RateLimitStrategy    RateLimitStrategy
+	MaxParallelToolCalls int // Tool calls run at once for agents with ParallelToolCalls; 0 means no limit
+
+	// RateLimiter keeps calls under per-minute limits; nil uses DefaultRateLimiter,
+	// which is shared by every Swarm in the process
+	RateLimiter *RateLimiter
+
+	// TracerProvider receives spans for runs, LLM requests, tools and handoffs.
+	// When nil, spans join the trace of the caller's context, if any.
+	TracerProvider trace.TracerProvider
+
+	// Metrics receives measurements of LLM requests, tools, handoffs and runs;
+	// nil discards them. NewOTelMetrics reports them to an OpenTelemetry meter.
+	Metrics Metrics
+
+	// Hooks observe every run of the Swarm, and may veto or modify its LLM
+	// requests and tool calls; WithHooks adds hooks to a single run
+	Hooks []Hooks
+
+	// Providers configures the clients of agents that set a Provider other than
+	// the Swarm's without a Config of their own
+	Providers map[llm.LLMProvider]*ClientConfig
+
+	// MaxToolRepairAttempts is how many times in a row the model may retry a tool
+	// call with invalid arguments before Run fails. Zero uses
+	// DefaultMaxToolRepairAttempts; a negative value allows no retries.
+	MaxToolRepairAttempts int
 }
 
 // LogLevel represents the level of logging
@@ -56,38 +103,29 @@ const (
 	LogTrace
 )
 
-// FailureHandler defines a function to handle specific failures
-type FailureHandler func(error) (bool, error)
-
 // RateLimitStrategy defines how rate limits are handled
 type RateLimitStrategy int
 
 const (
 	RateLimitRetry RateLimitStrategy = iota
 	RateLimitFail
-	RateLimitQueue
+	RateLimitQueue // Pauses every caller of the rate limited model until the wait is over
 )
 
 // DefaultConfig returns default configuration values
 func DefaultConfig() *Config {
 	return &Config{
-		MaxRetries:     3,
-		RetryBackoff:   time.Second,
-		RequestTimeout: 60 * 3 * time.Second,
-		MaxTokens:      128000,
-		DefaultModel:   "meta-llama/Llama-3.3-70B-Instruct",
-		Debug:          false,
-		LogLevel:       LogError,
-		TokenLimits: map[string]int{
-			"gpt-3.5-turbo": 4096,
-			"gpt-4":         8192,
-			"gpt-4o":        128000,
-			"claude-3-opus": 200000,
-			"meta-llama/Llama-3.3-70B-Instruct": 128000,
-			"Qwen/Qwen2.5-32B-Instruct": 128000,
-			"deepseek-ai/DeepSeek-V3" : 128000,
-		},
-		RateLimitStrategy: RateLimitRetry,
+		MaxRetries:            3,
+		RetryBackoff:          time.Second,
+		RequestTimeout:        60 * 3 * time.Second,
+		MaxTokens:             128000,
+		DefaultModel:          "meta-llama/Llama-3.3-70B-Instruct",
+		Debug:                 false,
+		LogLevel:              LogError,
+		Models:                DefaultModelCatalog(),
+		Truncation:            DropOldestTurns(),
+		RateLimitStrategy:     RateLimitRetry,
+		MaxToolRepairAttempts: DefaultMaxToolRepairAttempts,
 	}
 }
 
@@ -99,84 +137,61 @@ func NewSwarm(apiKey string, provider llm.LLMProvider) *Swarm {
 // NewSwarmWithConfig initializes a new Swarm with custom configuration
 func NewSwarmWithConfig(apiKey string, provider llm.LLMProvider, config *Config) *Swarm {
 	if apiKey == "" {
-		log.Println("Warning: Empty API key provided")
-		return &Swarm{
+		s := &Swarm{
 			initialized: false,
 			config:      config,
 		}
+		s.logger(context.Background(), false).Warn("empty API key provided", "provider", provider)
+		return s
 	}
 
-	var client llm.LLM
-	var err error
+	return NewSwarmWithClientConfig(ClientConfig{Provider: provider, AuthToken: apiKey}, config)
+}
 
-	switch provider {
-	case llm.OpenAI:
-		client = llm.NewOpenAILLM(apiKey)
-	case llm.Gemini:
-		client, err = llm.NewGeminiLLM(apiKey)
-		if err != nil {
-			log.Printf("Failed to create Gemini client: %v", err)
-			return &Swarm{
-				initialized: false,
-				config:      config,
-			}
-		}
-	case llm.Claude:
-		client = llm.NewClaudeLLM(apiKey)
-	case llm.Ollama:
-		client, err = llm.NewOllamaLLM()
-		if err != nil {
-			log.Printf("Failed to create Ollama client: %v", err)
-			return &Swarm{
-				initialized: false,
-				config:      config,
-			}
-		}
-	case llm.DeepSeek:
-		client = llm.NewDeepSeekLLM(apiKey)
-	default:
-		log.Printf("Unsupported LLM provider: %v", provider)
-		return &Swarm{
-			initialized: false,
-			config:      config,
-		}
+// NewSwarmWithClientConfig initializes a new Swarm with a client built by the
+// factory registered for clientConfig.Provider. A nil config uses DefaultConfig.
+func NewSwarmWithClientConfig(clientConfig ClientConfig, config *Config) *Swarm {
+	if config == nil {
+		config = DefaultConfig()
 	}
 
-	// Verify the client was created properly
-	if client == nil {
-		log.Println("Warning: Failed to initialize LLM client")
-		return &Swarm{
+	client, err := NewClient(clientConfig)
+	if err != nil {
+		s := &Swarm{
 			initialized: false,
 			config:      config,
 		}
+		s.logger(context.Background(), false).Error("failed to initialize LLM client",
+			"provider", clientConfig.Provider, "error", err)
+		return s
 	}
 
+	return &Swarm{
+		client:       client,
+		initialized:  true,
+		config:       config,
+		provider:     clientConfig.Provider,
+		clientConfig: clientConfig,
+	}
+}
+
+// NewSwarmWithClient creates a Swarm that sends its requests to client, which
+// may be any llm.LLM, such as a provider wrapped with llm.Chain. A nil config
+// uses DefaultConfig.
+func NewSwarmWithClient(client llm.LLM, config *Config) *Swarm {
+	if config == nil {
+		config = DefaultConfig()
+	}
 	return &Swarm{
 		client:      client,
-		initialized: true,
+		initialized: client != nil,
 		config:      config,
 	}
 }
 
 // NewSwarmWithHost creates a Swarm with a custom host
 func NewSwarmWithHost(apiKey, host string, provider llm.LLMProvider) *Swarm {
-	if provider == llm.OpenAI {
-		client := llm.NewOpenAILLMWithHost(apiKey, host)
-		if client == nil {
-			log.Println("Warning: Failed to initialize OpenAI client with custom host")
-			return &Swarm{
-				initialized: false,
-				config:      DefaultConfig(),
-			}
-		}
-		return &Swarm{
-			client:      client,
-			initialized: true,
-			config:      DefaultConfig(),
-		}
-	}
-	log.Printf("Custom host not supported for provider: %v", provider)
-	return NewSwarm(apiKey, provider)
+	return NewSwarmWithClientConfig(ClientConfig{Provider: provider, AuthToken: apiKey, BaseURL: host}, DefaultConfig())
 }
 
 // SetTokenCounter sets a function to count tokens in messages
@@ -204,8 +219,8 @@ func (s *Swarm) ValidateConnection(ctx context.Context) error {
 		MaxTokens: 5,
 	}
 
-	// Attempt to send the request
-	_, err := s.client.CreateChatCompletion(ctx, testRequest)
+	// Attempt to send the request under the retry policy and rate limiter
+	_, err := s.createChatCompletion(ctx, agentClient{LLM: s.client, provider: s.provider}, testRequest)
 	if err != nil {
 		return fmt.Errorf("connection test failed: %w", err)
 	}
@@ -213,166 +228,9 @@ func (s *Swarm) ValidateConnection(ctx context.Context) error {
 	return nil
 }
 
-// getChatCompletion requests a chat completion from the LLM with retries and error handling
-func (s *Swarm) getChatCompletion(
-	ctx context.Context,
-	agent *Agent,
-	history []llm.Message,
-	contextVariables map[string]interface{},
-	modelOverride string,
-	stream bool,
-	debug bool,
-) (llm.ChatCompletionResponse, error) {
-	// Validate inputs
-	if !s.IsInitialized() {
-		return llm.ChatCompletionResponse{}, ErrLLMClientNotReady
-	}
-
-	if agent == nil {
-		return llm.ChatCompletionResponse{}, ErrNilAgent
-	}
-
-	if len(history) == 0 {
-		// Instead of failing, create an empty initial message
-		history = []llm.Message{}
-	}
-
-	// Prepare the initial system message with agent instructions
-	instructions := agent.Instructions
-	if agent.InstructionsFunc != nil {
-		if contextVariables == nil {
-			contextVariables = make(map[string]interface{})
-		}
-		instructions = agent.InstructionsFunc(contextVariables)
-	}
-
-	if instructions != "" {
-		// Add system message at the beginning
-		messages := []llm.Message{
-			{
-				Role:    llm.RoleSystem,
-				Content: instructions,
-			},
-		}
-		messages = append(messages, history...)
-		history = messages
-	}
-
-	// Build tool definitions from agent's functions
-	var tools []llm.Tool
-	if agent.Functions != nil {
-		for _, af := range agent.Functions {
-			def := FunctionToDefinition(af)
-			tools = append(tools, llm.Tool{
-				Type: "function",
-				Function: &llm.Function{
-					Name:        def.Name,
-					Description: def.Description,
-					Parameters:  def.Parameters,
-				},
-			})
-		}
-	}
-
-	// Prepare the chat completion request
-	model := agent.Model
-	if modelOverride != "" {
-		model = modelOverride
-	}
-
-	// Use default model if none specified
-	if model == "" {
-		model = s.config.DefaultModel
-	}
-
-	req := llm.ChatCompletionRequest{
-		Model:    model,
-		Messages: history,
-		Tools:    tools,
-	}
-
-	if debug {
-		log.Printf("Debug - Model: %s, Messages: %d, Tools: %d\n",
-			model, len(history), len(tools))
-	}
-
-	// Implement retry logic
-	var lastErr error
-	for attempt := 0; attempt <= s.config.MaxRetries; attempt++ {
-		if attempt > 0 && s.config.Debug {
-			log.Printf("Retry attempt %d after error: %v", attempt, lastErr)
-		}
-
-		// Create a timeout context for this request if none was provided
-		requestCtx := ctx
-		if _, hasDeadline := ctx.Deadline(); !hasDeadline {
-			var cancel context.CancelFunc
-			requestCtx, cancel = context.WithTimeout(ctx, s.config.RequestTimeout)
-			defer cancel()
-		}
-
-		// Call the LLM to get a chat completion
-		resp, err := s.client.CreateChatCompletion(requestCtx, req)
-		if err == nil {
-			// Success
-			return resp, nil
-		}
-
-		// Handle the error
-		lastErr = err
-
-		// Check for rate limit errors and apply the rate limit strategy
-		if isRateLimitError(err) {
-			switch s.config.RateLimitStrategy {
-			case RateLimitFail:
-				return llm.ChatCompletionResponse{}, fmt.Errorf("rate limit exceeded: %w", err)
-			case RateLimitQueue:
-				// Implement exponential backoff
-				backoff := s.config.RetryBackoff * time.Duration(1<<uint(attempt))
-				if s.config.Debug {
-					log.Printf("Rate limit hit, backing off for %v", backoff)
-				}
-				select {
-				case <-ctx.Done():
-					return llm.ChatCompletionResponse{}, ctx.Err()
-				case <-time.After(backoff):
-					// Continue to next retry
-				}
-			default: // RateLimitRetry
-				// Simple retry with backoff
-				backoff := s.config.RetryBackoff * time.Duration(attempt+1)
-				if s.config.Debug {
-					log.Printf("Backing off for %v before retry", backoff)
-				}
-				time.Sleep(backoff)
-			}
-		} else if isFatalError(err) {
-			// Don't retry fatal errors
-			return llm.ChatCompletionResponse{}, err
-		} else {
-			// For other errors, apply backoff
-			backoff := s.config.RetryBackoff * time.Duration(attempt+1)
-			time.Sleep(backoff)
-		}
-	}
-
-	// All retries failed
-	return llm.ChatCompletionResponse{}, fmt.Errorf("max retries exceeded: %w", lastErr)
-}
-
-// isRateLimitError checks if an error is related to rate limiting
+// isRateLimitError checks if an error is a provider's rate limit
 func isRateLimitError(err error) bool {
-	return err != nil && (strings.Contains(strings.ToLower(err.Error()), "rate limit") ||
-		strings.Contains(strings.ToLower(err.Error()), "too many requests") ||
-		strings.Contains(strings.ToLower(err.Error()), "429"))
-}
-
-// isFatalError checks if an error is fatal and should not be retried
-func isFatalError(err error) bool {
-	return err != nil && (strings.Contains(strings.ToLower(err.Error()), "invalid auth") ||
-		strings.Contains(strings.ToLower(err.Error()), "authentication") ||
-		strings.Contains(strings.ToLower(err.Error()), "not found") ||
-		strings.Contains(strings.ToLower(err.Error()), "invalid model"))
+	return errors.Is(err, llm.ErrRateLimited)
 }
 
 // Helper function to clone a slice of messages
@@ -394,7 +252,9 @@ func lastMessage(msgs []llm.Message) *llm.Message {
 	return &msgs[len(msgs)-1]
 }
 
-// handleToolCall processes a tool call and ensures proper context
+// handleToolCall processes a tool call and ensures proper context. The returned
+// Response holds the tool message answering the call and a single ToolResult;
+// tool failures are reported there rather than as an error.
 func (s *Swarm) handleToolCall(
 	ctx context.Context,
 	toolCall *llm.ToolCall,
@@ -403,29 +263,17 @@ func (s *Swarm) handleToolCall(
 	debug bool,
 ) (Response, error) {
 	toolName := toolCall.Function.Name
-	argsJSON := toolCall.Function.Arguments
-
-	// Parse the tool call arguments
-	var args map[string]interface{}
-	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
-		errorMsg := fmt.Sprintf("Error parsing tool call arguments: %v", err)
-		if debug {
-			log.Println(errorMsg)
-		}
-		return Response{
-			Messages: []llm.Message{
-				{
-					Role:    llm.RoleFunction,
-					Content: errorMsg,
-					Name:    toolName,
-				},
-			},
-		}, nil
-	}
-
-	if debug {
-		log.Printf("Processing tool call: %s with arguments %v\n", toolName, args)
-	}
+	logger := s.logger(ctx, debug).With(LogKeyAgent, agent.Name, LogKeyTool, toolName)
+
+	// The span reports the tool's failure, which the model sees as a result
+	var toolErr error
+	ctx, span := s.tracer(ctx).Start(ctx, "agentkit.tool", trace.WithAttributes(
+		AttrAgent.String(agent.Name), AttrTool.String(toolName)))
+	start := time.Now()
+	defer func() {
+		s.recordToolCall(ctx, agent, toolName, start, toolErr)
+		endSpan(span, toolErr)
+	}()
 
 	// Find the corresponding function in the agent's functions
 	var functionFound *AgentFunction
@@ -438,37 +286,47 @@ func (s *Swarm) handleToolCall(
 
 	// Handle case where function is not found
 	if functionFound == nil {
-		errorMsg := fmt.Sprintf("Error: Tool %s not found", toolName)
-		if debug {
-			log.Println(errorMsg)
-		}
-		return Response{
-			Messages: []llm.Message{
-				{
-					Role:    llm.RoleFunction,
-					Content: errorMsg,
-					Name:    toolName,
-				},
-			},
-		}, nil
+		errorMsg := fmt.Sprintf("Error: Tool %s not found.", toolName)
+		logger.Warn("tool not found")
+		toolErr = fmt.Errorf("tool %s not found", toolName)
+		return toolErrorResponse(toolCall, errorMsg, toolErr), nil
 	}
 
-	// Execute the function
-	result := functionFound.Function(args, contextVariables)
+	// Parse and validate the arguments; problems go back to the model so it can retry
+	args, err := parseToolArguments(functionFound, toolCall.Function.Arguments)
+	if err != nil {
+		logger.Warn("invalid tool arguments", "error", err)
+		toolErr = err
+		var argErr *ToolArgumentsError
+		errors.As(err, &argErr)
+		return toolErrorResponse(toolCall, argErr.toolMessage(), err), nil
+	}
+
+	logger.Debug("calling tool")
+	logger.Log(ctx, LevelTrace, "tool arguments", "arguments", args)
+
+	// Execute the function, letting the failure handlers deal with errors
+	result := callAgentFunction(ctx, functionFound, args, contextVariables)
+	result = s.handleToolFailure(agent, toolName, result, func() Result {
+		return callAgentFunction(ctx, functionFound, args, contextVariables)
+	})
+
+	toolErr = result.Error
 
 	// Create a message with the tool result
 	var resultContent string
-	if result.Error != nil {
+	if result.Error != nil && !errors.Is(result.Error, errSkipped) {
 		resultContent = fmt.Sprintf("Error: %v", result.Error)
 	} else {
-		resultContent = fmt.Sprintf("%v", result.Data)
+		resultContent = toolResultContent(result.Data)
 	}
 
-	// Create function response message properly formatted for tool call
+	// Create the tool message answering this call
 	toolResultMessage := llm.Message{
-		Role:    llm.RoleFunction,
-		Content: resultContent,
-		Name:    toolName,
+		Role:       llm.RoleTool,
+		Content:    resultContent,
+		Name:       toolName,
+		ToolCallID: toolCall.ID,
 	}
 
 	// Return the response with the tool result
@@ -476,10 +334,153 @@ func (s *Swarm) handleToolCall(
 		Messages:         []llm.Message{toolResultMessage},
 		Agent:            result.Agent,
 		ContextVariables: contextVariables,
+		ToolResults: []ToolResult{{
+			ToolName: toolName,
+			Args:     args,
+			Result: Result{
+				Success: result.Error == nil,
+				Data:    resultContent,
+				Error:   result.Error,
+				Agent:   result.Agent,
+			},
+		}},
 	}, nil
 }
 
-// handleToolCalls handles multiple tool calls with correct context forwarding
+// callAgentFunction runs a tool function under the run's context, applying the
+// function's timeout to each attempt and retrying failed attempts up to its
+// MaxRetries. A panic is turned into an error result.
+func callAgentFunction(ctx context.Context, af *AgentFunction, args map[string]interface{}, contextVariables map[string]interface{}) Result {
+	var result Result
+	for attempt := 0; attempt <= af.MaxRetries; attempt++ {
+		if attempt > 0 && af.RetryBackoff > 0 {
+			select {
+			case <-ctx.Done():
+				return Result{Success: false, Error: fmt.Errorf("tool %s: %w", af.Name, ctx.Err())}
+			case <-time.After(af.RetryBackoff):
+			}
+		}
+
+		result = runAgentFunction(ctx, af, args, contextVariables)
+		if result.Error == nil || ctx.Err() != nil {
+			return result
+		}
+	}
+	return result
+}
+
+// runAgentFunction makes a single attempt at a tool call. When the attempt can be
+// cancelled, the function runs on its own goroutine with a copy of the context
+// variables, so the caller can stop waiting for a function that ignores ctx; its
+// changes are applied only if it finishes in time.
+func runAgentFunction(ctx context.Context, af *AgentFunction, args map[string]interface{}, contextVariables map[string]interface{}) Result {
+	if af.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, af.Timeout)
+		defer cancel()
+	}
+
+	if ctx.Done() == nil {
+		return invokeAgentFunction(ctx, af, args, contextVariables)
+	}
+
+	callVariables := copyContextVariables(contextVariables)
+	done := make(chan Result, 1)
+	go func() {
+		done <- invokeAgentFunction(ctx, af, args, callVariables)
+	}()
+
+	select {
+	case result := <-done:
+		mergeContextVariables(contextVariables, copyContextVariables(contextVariables), callVariables)
+		return result
+	case <-ctx.Done():
+		return Result{Success: false, Error: fmt.Errorf("tool %s: %w", af.Name, ctx.Err())}
+	}
+}
+
+// invokeAgentFunction calls whichever implementation the function has
+func invokeAgentFunction(ctx context.Context, af *AgentFunction, args map[string]interface{}, contextVariables map[string]interface{}) (result Result) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = Result{Success: false, Error: fmt.Errorf("tool %s panicked: %v", af.Name, r)}
+		}
+	}()
+	switch {
+	case af.FunctionWithContext != nil:
+		return af.FunctionWithContext(ctx, args, contextVariables)
+	case af.Function != nil:
+		return af.Function(args, contextVariables)
+	}
+	return Result{Success: false, Error: fmt.Errorf("tool %s has no implementation", af.Name)}
+}
+
+// toolResultContent renders a tool's data for the model: strings are sent as
+// they are and other values, such as the structs typed tools return, as JSON
+func toolResultContent(data interface{}) string {
+	if text, ok := data.(string); ok {
+		return text
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Sprintf("%v", data)
+	}
+	return string(encoded)
+}
+
+// toolErrorResponse builds the Response for a tool call that could not be executed
+func toolErrorResponse(toolCall *llm.ToolCall, content string, err error) Response {
+	var args interface{}
+	_ = json.Unmarshal([]byte(toolCall.Function.Arguments), &args)
+
+	return Response{
+		Messages: []llm.Message{
+			{
+				Role:       llm.RoleTool,
+				Content:    content,
+				Name:       toolCall.Function.Name,
+				ToolCallID: toolCall.ID,
+			},
+		},
+		ToolResults: []ToolResult{{
+			ToolName: toolCall.Function.Name,
+			Args:     args,
+			Result: Result{
+				Success: false,
+				Data:    content,
+				Error:   err,
+			},
+		}},
+	}
+}
+
+// executeToolCall runs a single tool call, reporting any failure as an error result
+func (s *Swarm) executeToolCall(
+	ctx context.Context,
+	toolCall *llm.ToolCall,
+	agent *Agent,
+	contextVariables map[string]interface{},
+	debug bool,
+) Response {
+	// Hooks see and may change a copy of the call, leaving the history as the model sent it
+	hooks := s.hooks(ctx)
+	call := *toolCall
+	toolResp, err := Response{}, hooks.toolStart(ctx, agent, &call)
+	if err == nil {
+		toolResp, err = s.handleToolCall(ctx, &call, agent, contextVariables, debug)
+	}
+	if err != nil {
+		s.logger(ctx, debug).Error("tool call failed", LogKeyAgent, agent.Name, LogKeyTool, call.Function.Name, "error", err)
+		toolResp = toolErrorResponse(&call, fmt.Sprintf("Error: %v", err), err)
+	}
+	hooks.toolEnd(ctx, agent, call, toolResp.ToolResults[0].Result)
+	return toolResp
+}
+
+// handleToolCalls executes the tool calls of a single assistant turn and appends
+// their results to the history. Asking the model for the next turn is left to Run.
+// When parallel is set, the calls run concurrently; either way the results are
+// recorded in the order the model issued the calls.
 func (s *Swarm) handleToolCalls(
 	ctx context.Context,
 	toolCalls []llm.ToolCall,
@@ -491,113 +492,59 @@ func (s *Swarm) handleToolCalls(
 	debug bool,
 	parallel bool,
 ) ([]ToolResult, []llm.Message, *Agent, error) {
-	var toolResults []ToolResult
-	updatedAgent := agent
-	updatedHistory := make([]llm.Message, len(history))
-	copy(updatedHistory, history)
-
-	// Execute tools sequentially for now for simplicity
-	for _, toolCall := range toolCalls {
-		// Execute the tool call
-		toolResp, err := s.handleToolCall(ctx, &toolCall, updatedAgent, contextVariables, debug)
-		if err != nil {
-			if debug {
-				log.Printf("Error executing tool %s: %v", toolCall.Function.Name, err)
-			}
-			continue
-		}
-
-		// Parse arguments for the result
-		var args interface{}
-		_ = json.Unmarshal([]byte(toolCall.Function.Arguments), &args)
-
-		// Record the tool result
-		toolResults = append(toolResults, ToolResult{
-			ToolName: toolCall.Function.Name,
-			Args:     args,
-			Result: Result{
-				Success: true,
-				Data:    toolResp.Messages[0].Content,
-				Error:   nil,
-				Agent:   toolResp.Agent,
-			},
-		})
-
-		// Add the function result to history with proper role and name
-		updatedHistory = append(updatedHistory, llm.Message{
-			Role:    llm.RoleFunction,
-			Content: toolResp.Messages[0].Content,
-			Name:    toolCall.Function.Name,
-		})
-
-		// Update agent if needed
-		if toolResp.Agent != nil {
-			updatedAgent = toolResp.Agent
-		}
+	if parallel && len(toolCalls) > 1 {
+		return s.handleToolCallsParallel(ctx, toolCalls, history, agent, contextVariables, modelOverride, stream, debug)
 	}
 
-	// Only try to get follow-up if we executed at least one tool successfully
-	if len(toolResults) > 0 {
-		// CRITICAL FIX: Create a new request with the updated history INCLUDING function results
-		followUpReq := llm.ChatCompletionRequest{
-			Model:    updatedAgent.Model,
-			Messages: updatedHistory,
-		}
+	responses := make([]Response, len(toolCalls))
+	for i := range toolCalls {
+		responses[i] = s.executeToolCall(ctx, &toolCalls[i], agent, contextVariables, debug)
+	}
 
-		if modelOverride != "" {
-			followUpReq.Model = modelOverride
-		}
+	toolResults, updatedHistory, updatedAgent := s.collectToolResponses(toolCalls, responses, history, agent)
+	return toolResults, updatedHistory, updatedAgent, abortedToolCall(toolResults)
+}
 
-		// Create a timeout for the follow-up request
-		followUpCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		defer cancel()
+// collectToolResponses records the responses to a turn's tool calls in call order.
+// The first handoff among them decides the next agent.
+func (s *Swarm) collectToolResponses(
+	toolCalls []llm.ToolCall,
+	responses []Response,
+	history []llm.Message,
+	agent *Agent,
+) ([]ToolResult, []llm.Message, *Agent) {
+	var toolResults []ToolResult
+	updatedAgent := agent
+	agentTransferred := false
+	updatedHistory := cloneMessages(history)
 
-		if debug {
-			log.Printf("Getting follow-up with %d messages in history", len(updatedHistory))
+	for i, toolCall := range toolCalls {
+		toolResp := responses[i]
 
-			// Print last few messages for debugging
-			lastN := 3
-			if len(updatedHistory) < lastN {
-				lastN = len(updatedHistory)
-			}
+		// Add the tool result to history, linked to the call it answers
+		updatedHistory = append(updatedHistory, toolResp.Messages...)
+		toolResults = append(toolResults, toolResp.ToolResults...)
 
-			log.Printf("Last %d messages:", lastN)
-			for i := len(updatedHistory) - lastN; i < len(updatedHistory); i++ {
-				msg := updatedHistory[i]
-				log.Printf("[%s] %s: %s", msg.Role, msg.Name, truncateString(msg.Content, 50))
-			}
+		// Only update agent if not already transferred
+		if toolResp.Agent != nil && !agentTransferred {
+			updatedAgent = toolResp.Agent
+			agentTransferred = true
 		}
 
-		// Get the follow-up response with proper context
-		followUpResp, err := s.client.CreateChatCompletion(followUpCtx, followUpReq)
-
-		if err != nil {
-			if debug {
-				log.Printf("Error getting follow-up: %v", err)
-			}
-			// Continue without follow-up rather than failing
-		} else if len(followUpResp.Choices) > 0 {
-			// Add follow-up response to history
-			followUpMessage := followUpResp.Choices[0].Message
-
-			// Only add if it has content and only append content (no tools)
-			if followUpMessage.Content != "" {
-				cleanedFollowUp := llm.Message{
-					Role:    followUpMessage.Role,
-					Content: followUpMessage.Content,
-				}
-				updatedHistory = append(updatedHistory, cleanedFollowUp)
-
-				if debug {
-					log.Printf("Added follow-up: %s", truncateString(followUpMessage.Content, 50))
-				}
-			} else if debug {
-				log.Println("Follow-up was empty")
-			}
+		// Store in memory
+		if agent.Memory != nil && len(toolResp.Messages) > 0 {
+			agent.Memory.AddMemory(Memory{
+				Content: fmt.Sprintf("Tool %s call with args: %s, result: %s",
+					toolCall.Function.Name, toolCall.Function.Arguments, toolResp.Messages[0].Content),
+				Type:       "tool_call",
+				Context:    map[string]interface{}{"tool": toolCall.Function.Name},
+				Timestamp:  time.Now(),
+				Importance: 0.7,
+			})
 		}
 	}
 
-	return toolResults, updatedHistory, updatedAgent, nil
+	return toolResults, updatedHistory, updatedAgent
 }
 
 // Helper function to truncate strings for debugging
@@ -608,7 +555,11 @@ func truncateString(s string, maxLen int) string {
 	return s[:maxLen] + "..."
 }
 
-// Run is the main entry point for agent execution
+// Run is the main entry point for agent execution. It asks the model for a
+// completion, executes the requested tools and feeds their results back,
+// repeating until the model answers without tool calls or maxTurns completions
+// have been made. When a tool hands off to another agent, the loop continues
+// with that agent's instructions and functions.
 func (s *Swarm) Run(
 	ctx context.Context,
 	agent *Agent,
@@ -620,25 +571,186 @@ func (s *Swarm) Run(
 	maxTurns int,
 	executeTools bool,
 ) (Response, error) {
+	return s.run(ctx, agent, messages, contextVariables, modelOverride, stream, debug, maxTurns, executeTools, nil)
+}
+
+// run implements Run, asking every completion for responseFormat when it is set
+func (s *Swarm) run(
+	ctx context.Context,
+	agent *Agent,
+	messages []llm.Message,
+	contextVariables map[string]interface{},
+	modelOverride string,
+	stream bool,
+	debug bool,
+	maxTurns int,
+	executeTools bool,
+	responseFormat *llm.ResponseFormat,
+) (response Response, err error) {
 	// Validate inputs
 	if agent == nil {
-		return Response{}, fmt.Errorf("agent cannot be nil")
+		return Response{}, ErrNilAgent
 	}
 
+	if maxTurns <= 0 {
+		maxTurns = DefaultMaxTurns
+	}
+
+	// Tag the run's log records, and those of nested runs, with one run ID
+	ctx = withRunID(ctx)
+	logger := s.logger(ctx, debug)
+
+	ctx, span := s.tracer(ctx).Start(ctx, "agentkit.run", trace.WithAttributes(
+		AttrAgent.String(agent.Name), AttrRunID.String(runID(ctx))))
+	start := time.Now()
+	hooks := s.hooks(ctx)
+	hooks.runStart(ctx, agent, messages)
+	defer func() {
+		s.metrics().Record(ctx, MetricRunDuration, since(start), Label{LabelAgent, agent.Name}, outcome(err))
+		span.SetAttributes(
+			AttrInputTokens.Int(response.Usage.PromptTokens),
+			AttrOutputTokens.Int(response.Usage.CompletionTokens),
+		)
+		endSpan(span, err)
+		hooks.runEnd(ctx, agent, response, err)
+	}()
+
 	// Use a cloned copy of messages for history
-	history := make([]llm.Message, len(messages))
-	copy(history, messages)
+	history := cloneMessages(messages)
 
 	if contextVariables == nil {
 		contextVariables = make(map[string]interface{})
 	}
 
-	// Set up context variables
+	activeAgent := agent
+	var toolResults []ToolResult
+	var usage Usage
+	argumentFailures := make(map[string]int)
+
+	// result builds the response for the turns completed so far
+	result := func() Response {
+		return Response{
+			Messages:         history[len(messages):],
+			Agent:            activeAgent,
+			ContextVariables: contextVariables,
+			ToolResults:      toolResults,
+			Usage:            usage,
+		}
+	}
+
+	for turn := 0; turn < maxTurns; turn++ {
+		// Stop if the caller gave up while tools were running
+		if err := ctx.Err(); err != nil {
+			return result(), err
+		}
+
+		req := s.buildRequest(activeAgent, history, contextVariables, modelOverride)
+		req.ResponseFormat = responseFormat
+		info, err := s.applyModelInfo(&req)
+		if err == nil {
+			err = s.fitContextWindow(ctx, &req, info)
+		}
+		if err != nil {
+			return result(), err
+		}
+
+		logger.Debug("starting turn", "turn", turn+1, LogKeyAgent, activeAgent.Name, LogKeyModel, req.Model,
+			"messages", len(req.Messages), "tools", len(req.Tools))
+
+		if err := hooks.llmRequest(ctx, activeAgent, &req); err != nil {
+			return result(), err
+		}
+		client, err := s.clientFor(activeAgent)
+		if err != nil {
+			return result(), err
+		}
+		resp, err := s.completeWithHandlers(ctx, activeAgent, client, req)
+		if errors.Is(err, errSkipped) {
+			return result(), nil
+		}
+		if err != nil {
+			return result(), fmt.Errorf("chat completion error: %w", err)
+		}
+		hooks.llmResponse(ctx, activeAgent, resp)
+
+		// A fallback client may have answered with another model
+		usageModel := req.Model
+		if resp.Model != "" && resp.Model != req.Model {
+			usageModel, info = resp.Model, s.modelInfo(resp.Model)
+		}
+		usage.Add(activeAgent.Name, usageModel, resp.Usage, info.Cost(resp.Usage))
+
+		if len(resp.Choices) == 0 {
+			return result(), ErrNoChoicesInResp
+		}
+
+		message := resp.Choices[0].Message
+		history = append(history, message)
+
+		// The model answered without asking for tools: the run is complete
+		if len(message.ToolCalls) == 0 || !executeTools {
+			logger.Debug("final response", LogKeyAgent, activeAgent.Name, LogKeyModel, req.Model,
+				"preview", truncateString(message.Content, 50))
+			break
+		}
+
+		logger.Debug("handling tool calls", LogKeyAgent, activeAgent.Name, "calls", len(message.ToolCalls))
+
+		var variablesBefore map[string]interface{}
+		if len(hooks) > 0 {
+			variablesBefore = copyContextVariables(contextVariables)
+		}
+		results, updatedHistory, nextAgent, err := s.handleToolCalls(
+			ctx, message.ToolCalls, history, activeAgent,
+			contextVariables, modelOverride, stream, debug,
+			activeAgent.ParallelToolCalls)
+		history = updatedHistory
+		toolResults = append(toolResults, results...)
+		if variablesBefore != nil && !reflect.DeepEqual(variablesBefore, contextVariables) {
+			hooks.contextVariablesChanged(ctx, activeAgent, contextVariables)
+		}
+		if err != nil {
+			return result(), fmt.Errorf("tool execution error: %w", err)
+		}
+
+		if err := s.trackToolRepairs(results, argumentFailures); err != nil {
+			return result(), err
+		}
+
+		// Switch to the agent a tool handed off to
+		if nextAgent != nil && nextAgent != activeAgent {
+			logger.Info("handoff", LogKeyAgent, activeAgent.Name, "to", nextAgent.Name)
+			s.handoff(ctx, hooks, activeAgent, nextAgent)
+			activeAgent = nextAgent
+		}
+	}
+
+	return result(), nil
+}
+
+// handoff traces, counts and reports a handoff from one agent to another
+func (s *Swarm) handoff(ctx context.Context, hooks hookList, from, to *Agent) {
+	_, span := s.tracer(ctx).Start(ctx, "agentkit.handoff", trace.WithAttributes(
+		AttrAgent.String(from.Name), AttrHandoffTo.String(to.Name)))
+	span.End()
+	s.metrics().Add(ctx, MetricHandoffs, 1, Label{LabelFrom, from.Name}, Label{LabelTo, to.Name})
+	hooks.handoff(ctx, from, to)
+}
+
+// buildRequest prepares a chat completion request for the agent's next turn.
+// The agent's instructions are sent as the leading system message unless the
+// history already carries one, and its functions are exposed as tools.
+func (s *Swarm) buildRequest(
+	agent *Agent,
+	history []llm.Message,
+	contextVariables map[string]interface{},
+	modelOverride string,
+) llm.ChatCompletionRequest {
+	instructions := agent.Instructions
 	if agent.InstructionsFunc != nil {
-		agent.Instructions = agent.InstructionsFunc(contextVariables)
+		instructions = agent.InstructionsFunc(contextVariables)
 	}
 
-	// Add system instruction as first message if not already present
 	hasSystemMessage := false
 	for _, msg := range history {
 		if msg.Role == llm.RoleSystem {
@@ -647,98 +759,94 @@ func (s *Swarm) Run(
 		}
 	}
 
-	if !hasSystemMessage && agent.Instructions != "" {
-		newHistory := make([]llm.Message, 0, len(history)+1)
-		newHistory = append(newHistory, llm.Message{
+	messages := history
+	if !hasSystemMessage && instructions != "" {
+		messages = make([]llm.Message, 0, len(history)+1)
+		messages = append(messages, llm.Message{
 			Role:    llm.RoleSystem,
-			Content: agent.Instructions,
+			Content: instructions,
 		})
-		newHistory = append(newHistory, history...)
-		history = newHistory
+		messages = append(messages, history...)
 	}
 
-	// Get chat completion from LLM
-	if debug {
-		log.Printf("Getting initial response with %d messages", len(history))
+	return llm.ChatCompletionRequest{
+		Model:    s.agentModel(agent, modelOverride),
+		Messages: messages,
+		Tools:    agentTools(agent),
 	}
+}
 
+// agentModel returns the model answering for agent: modelOverride if set, then
+// the agent's model, then the configured default
+func (s *Swarm) agentModel(agent *Agent, modelOverride string) string {
 	model := agent.Model
 	if modelOverride != "" {
 		model = modelOverride
 	}
-
-	// Prepare tools for the request
-	var tools []llm.Tool
-	if agent.Functions != nil {
-		for _, fn := range agent.Functions {
-			tools = append(tools, llm.Tool{
-				Type: "function",
-				Function: &llm.Function{
-					Name:        fn.Name,
-					Description: fn.Description,
-					Parameters:  fn.Parameters,
-				},
-			})
-		}
+	if model == "" && s.config != nil {
+		model = s.config.DefaultModel
 	}
+	return model
+}
 
-	// Create the request
-	req := llm.ChatCompletionRequest{
-		Model:    model,
-		Messages: history,
-		Tools:    tools,
+// modelInfo returns the catalog entry of model, or an empty one if it is unknown
+func (s *Swarm) modelInfo(model string) ModelInfo {
+	if s.config == nil {
+		return ModelInfo{}
 	}
+	info, _ := s.config.Models.Lookup(model)
+	return info
+}
 
-	// Get initial response
-	resp, err := s.client.CreateChatCompletion(ctx, req)
-	if err != nil {
-		return Response{}, fmt.Errorf("chat completion error: %v", err)
+// applyModelInfo looks up the request's model in the model catalog, fills in
+// its default MaxTokens and rejects features the model does not support. Models
+// missing from the catalog are sent as they are.
+func (s *Swarm) applyModelInfo(req *llm.ChatCompletionRequest) (ModelInfo, error) {
+	if s.config == nil {
+		return ModelInfo{}, nil
 	}
-
-	if len(resp.Choices) == 0 {
-		return Response{}, fmt.Errorf("no choices in response")
+	info, ok := s.config.Models.Lookup(req.Model)
+	if !ok {
+		return ModelInfo{}, nil
 	}
 
-	// Extract the response
-	choice := resp.Choices[0]
-	history = append(history, choice.Message)
-
-	// Handle tool calls if present and execution is enabled
-	if len(choice.Message.ToolCalls) > 0 && executeTools {
-		if debug {
-			log.Printf("Handling %d tool calls", len(choice.Message.ToolCalls))
-		}
-
-		// Execute tools and get the updated history including follow-up
-		toolResults, updatedHistory, updatedAgent, err := s.handleToolCalls(
-			ctx, choice.Message.ToolCalls, history, agent,
-			contextVariables, modelOverride, stream, debug,
-			agent.ParallelToolCalls)
-
-		if err != nil {
-			return Response{}, fmt.Errorf("tool execution error: %v", err)
-		}
-
-		// Calculate which messages to return (only the new ones)
-		newMessages := updatedHistory[len(messages):]
+	caps := info.Capabilities
+	switch {
+	case len(req.Tools) > 0 && !caps.Tools:
+		return info, fmt.Errorf("%w: %s does not support tools", ErrUnsupportedModelFeature, req.Model)
+	case req.Stream && !caps.Streaming:
+		return info, fmt.Errorf("%w: %s does not support streaming", ErrUnsupportedModelFeature, req.Model)
+	case req.ResponseFormat != nil && req.ResponseFormat.Type != "" &&
+		req.ResponseFormat.Type != llm.ResponseFormatText && !caps.JSONMode:
+		return info, fmt.Errorf("%w: %s does not support JSON responses", ErrUnsupportedModelFeature, req.Model)
+	}
 
-		return Response{
-			Messages:         newMessages,
-			Agent:            updatedAgent,
-			ContextVariables: contextVariables,
-			ToolResults:      toolResults,
-		}, nil
+	if req.MaxTokens == 0 {
+		req.MaxTokens = info.MaxOutputTokens
 	}
+	return info, nil
+}
 
-	// No tool calls - just return the normal response
-	return Response{
-		Messages:         history[len(messages):],
-		Agent:            agent,
-		ContextVariables: contextVariables,
-	}, nil
+// agentTools builds the tool definitions for an agent's functions
+func agentTools(agent *Agent) []llm.Tool {
+	var tools []llm.Tool
+	for _, af := range agent.Functions {
+		def := FunctionToDefinition(af)
+		tools = append(tools, llm.Tool{
+			Type: "function",
+			Function: &llm.Function{
+				Name:        def.Name,
+				Description: def.Description,
+				Parameters:  def.Parameters,
+			},
+		})
+	}
+	return tools
 }
 
-// handleToolCallsParallel executes multiple tool calls concurrently
+// handleToolCallsParallel executes multiple tool calls concurrently, at most
+// toolConcurrency(agent) at a time. Each call works on its own copy of the
+// context variables; their changes are merged back in call order.
 func (s *Swarm) handleToolCallsParallel(
 	ctx context.Context,
 	toolCalls []llm.ToolCall,
@@ -749,88 +857,87 @@ func (s *Swarm) handleToolCallsParallel(
 	stream bool,
 	debug bool,
 ) ([]ToolResult, []llm.Message, *Agent, error) {
-	type toolCallResult struct {
-		index  int
-		result Response
-		err    error
+	responses := make([]Response, len(toolCalls))
+	callVariables := make([]map[string]interface{}, len(toolCalls))
+
+	var sem chan struct{}
+	if limit := s.toolConcurrency(agent); limit > 0 {
+		sem = make(chan struct{}, limit)
 	}
 
-	resultChan := make(chan toolCallResult, len(toolCalls))
-	updatedHistory := make([]llm.Message, len(history))
-	copy(updatedHistory, history)
-	updatedAgent := agent
+	var wg sync.WaitGroup
+	for i := range toolCalls {
+		callVariables[i] = copyContextVariables(contextVariables)
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-ctx.Done():
+					responses[idx] = toolErrorResponse(&toolCalls[idx], fmt.Sprintf("Error: %v", ctx.Err()), ctx.Err())
+					return
+				}
+			}
+			responses[idx] = s.executeToolCall(ctx, &toolCalls[idx], agent, callVariables[idx], debug)
+		}(i)
+	}
 
-	// Create a cancellable context for all tool calls
-	execCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	// Wait for every call, unless the run is cancelled first
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
 
-	// Launch goroutines for each tool call
-	for i, toolCall := range toolCalls {
-		go func(idx int, tc llm.ToolCall) {
-			toolResp, err := s.handleToolCall(execCtx, &tc, agent, contextVariables, debug)
-			resultChan <- toolCallResult{index: idx, result: toolResp, err: err}
-		}(i, toolCall)
+	select {
+	case <-ctx.Done():
+		return nil, history, agent, ctx.Err()
+	case <-done:
 	}
 
-	// Collect results
-	var toolResults []ToolResult
-	agentTransferred := false
-
-	for i := 0; i < len(toolCalls); i++ {
-		select {
-		case <-ctx.Done():
-			return nil, history, agent, ctx.Err()
-		case result := <-resultChan:
-			if result.err != nil {
-				if debug {
-					log.Printf("Error in tool call %d: %v", result.index, result.err)
-				}
-				continue
-			}
+	snapshot := copyContextVariables(contextVariables)
+	for _, vars := range callVariables {
+		mergeContextVariables(contextVariables, snapshot, vars)
+	}
 
-			// Get the original tool call
-			toolCall := toolCalls[result.index]
-			var args interface{}
-			_ = json.Unmarshal([]byte(toolCall.Function.Arguments), &args)
-
-			// Add to tool results
-			toolResults = append(toolResults, ToolResult{
-				ToolName: toolCall.Function.Name,
-				Args:     args,
-				Result: Result{
-					Success: true,
-					Data:    result.result.Messages[0].Content,
-					Error:   nil,
-					Agent:   result.result.Agent,
-				},
-			})
+	toolResults, updatedHistory, updatedAgent := s.collectToolResponses(toolCalls, responses, history, agent)
+	return toolResults, updatedHistory, updatedAgent, abortedToolCall(toolResults)
+}
 
-			// Add to history
-			updatedHistory = append(updatedHistory, llm.Message{
-				Role:    llm.RoleFunction,
-				Content: result.result.Messages[0].Content,
-				Name:    toolCall.Function.Name,
-			})
+// toolConcurrency returns how many tool calls may run at once for an agent.
+// The agent's limit takes precedence over the Swarm's; zero means no limit.
+func (s *Swarm) toolConcurrency(agent *Agent) int {
+	if agent.MaxParallelToolCalls > 0 {
+		return agent.MaxParallelToolCalls
+	}
+	if s.config != nil {
+		return s.config.MaxParallelToolCalls
+	}
+	return 0
+}
 
-			// Only update agent if not already transferred
-			if result.result.Agent != nil && !agentTransferred {
-				updatedAgent = result.result.Agent
-				agentTransferred = true
-			}
+// copyContextVariables returns a shallow copy of the context variables
+func copyContextVariables(vars map[string]interface{}) map[string]interface{} {
+	cloned := make(map[string]interface{}, len(vars))
+	for k, v := range vars {
+		cloned[k] = v
+	}
+	return cloned
+}
 
-			// Store in memory
-			if agent.Memory != nil {
-				agent.Memory.AddMemory(Memory{
-					Content: fmt.Sprintf("Tool %s call with args: %v, result: %s",
-						toolCall.Function.Name, args, result.result.Messages[0].Content),
-					Type:       "tool_call",
-					Context:    map[string]interface{}{"tool": toolCall.Function.Name},
-					Timestamp:  time.Now(),
-					Importance: 0.7,
-				})
-			}
+// mergeContextVariables applies the changes a tool made to its copy of the
+// context variables, relative to snapshot, onto dst
+func mergeContextVariables(dst, snapshot, changed map[string]interface{}) {
+	for k, v := range changed {
+		if old, ok := snapshot[k]; !ok || !reflect.DeepEqual(old, v) {
+			dst[k] = v
+		}
+	}
+	for k := range snapshot {
+		if _, ok := changed[k]; !ok {
+			delete(dst, k)
 		}
 	}
-
-	return toolResults, updatedHistory, updatedAgent, nil
 }
@@ -3,15 +3,33 @@ package agentkit
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/rsaranusc/agentkit/llm"
+	"github.com/rsaranusc/agentkit/llm/cassette"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 // MockLLM is a mock implementation of the LLM interface
@@ -53,214 +71,2896 @@ func TestNewSwarmWithHost(t *testing.T) {
 	assert.NotNil(t, sw.client)
 }
 
+// TestProviderRegistry tests building clients through registered provider factories
+func TestProviderRegistry(t *testing.T) {
+	assert.Subset(t, Providers(), []llm.LLMProvider{
+		llm.OpenAI, llm.Azure, llm.AzureAD, llm.CloudflareAzure, llm.Gemini, llm.Claude, llm.Ollama, llm.DeepSeek,
+	})
+
+	const gateway llm.LLMProvider = "TEST_GATEWAY"
+	mockClient := new(MockLLM)
+	var built ClientConfig
+	RegisterProvider(gateway, func(config ClientConfig) (llm.LLM, error) {
+		built = config
+		return mockClient, nil
+	})
+	defer func() {
+		providerRegistry.Lock()
+		delete(providerRegistry.factories, gateway)
+		providerRegistry.Unlock()
+	}()
+
+	sw := NewSwarmWithClientConfig(ClientConfig{
+		Provider:  gateway,
+		AuthToken: "token",
+		BaseURL:   "https://gateway.internal",
+		Options:   map[string]interface{}{"team": "search"},
+	}, nil)
+	assert.True(t, sw.IsInitialized())
+	assert.Same(t, mockClient, sw.client)
+	assert.Equal(t, "https://gateway.internal", built.BaseURL)
+	assert.Equal(t, "search", built.Options["team"])
+
+	sw = NewSwarmWithConfig("token", gateway, DefaultConfig())
+	assert.Same(t, mockClient, sw.client)
+
+	_, err := NewClient(ClientConfig{Provider: "UNKNOWN"})
+	assert.ErrorIs(t, err, ErrInvalidProvider)
+	assert.False(t, NewSwarm("token", "UNKNOWN").IsInitialized())
+
+	_, err = NewClient(ClientConfig{Provider: llm.Azure, AuthToken: "key"})
+	assert.ErrorContains(t, err, "requires a BaseURL")
+}
+
+// TestNewClientFromConfig tests that the built-in factories honor the client configuration
+func TestNewClientFromConfig(t *testing.T) {
+	var received *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Clone(context.Background())
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"1","choices":[{"index":0,"message":{"role":"assistant","content":"ok"}}]}`)
+	}))
+	defer server.Close()
+
+	req := llm.ChatCompletionRequest{Model: "gpt-4o", Messages: []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}}
+	tests := []struct {
+		name   string
+		config ClientConfig
+		path   string
+		check  func(r *http.Request)
+	}{
+		{
+			name: "Azure",
+			config: ClientConfig{Provider: llm.Azure, AuthToken: "key", BaseURL: server.URL, APIVersion: "2024-02-01",
+				ModelMapperFunc: func(model string) string { return "prod-" + model }},
+			path: "/openai/deployments/prod-gpt-4o/chat/completions",
+			check: func(r *http.Request) {
+				assert.Equal(t, "key", r.Header.Get("api-key"))
+				assert.Equal(t, "2024-02-01", r.URL.Query().Get("api-version"))
+			},
+		},
+		{
+			name:   "AzureAD",
+			config: ClientConfig{Provider: llm.AzureAD, AuthToken: "token", BaseURL: server.URL},
+			path:   "/openai/deployments/gpt-4o/chat/completions",
+			check: func(r *http.Request) {
+				assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+			},
+		},
+		{
+			name:   "OpenAI",
+			config: ClientConfig{Provider: llm.OpenAI, AuthToken: "key", BaseURL: server.URL + "/v1", OrgID: "org"},
+			path:   "/v1/chat/completions",
+			check: func(r *http.Request) {
+				assert.Equal(t, "org", r.Header.Get("OpenAI-Organization"))
+			},
+		},
+		{
+			name:   "DeepSeek",
+			config: ClientConfig{Provider: llm.DeepSeek, AuthToken: "key", BaseURL: server.URL},
+			path:   "/chat/completions",
+			check: func(r *http.Request) {
+				assert.Equal(t, "Bearer key", r.Header.Get("Authorization"))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewClient(tt.config)
+			assert.NoError(t, err)
+
+			resp, err := client.CreateChatCompletion(context.Background(), req)
+			assert.NoError(t, err)
+			assert.Equal(t, "ok", resp.Choices[0].Message.Content)
+			assert.Equal(t, tt.path, received.URL.Path)
+			tt.check(received)
+		})
+	}
+}
+
+// registerTestProvider registers a provider whose factory returns client and
+// records the configurations it was called with, until the test ends
+func registerTestProvider(t *testing.T, provider llm.LLMProvider, client llm.LLM) *[]ClientConfig {
+	var built []ClientConfig
+	RegisterProvider(provider, func(config ClientConfig) (llm.LLM, error) {
+		built = append(built, config)
+		return client, nil
+	})
+	t.Cleanup(func() {
+		providerRegistry.Lock()
+		delete(providerRegistry.factories, provider)
+		providerRegistry.Unlock()
+	})
+	return &built
+}
+
+// TestRunUsesAgentProviders tests that agents run on their own provider, across handoffs
+func TestRunUsesAgentProviders(t *testing.T) {
+	const local, remote llm.LLMProvider = "TEST_LOCAL", "TEST_REMOTE"
+	localClient, remoteClient := new(MockLLM), new(MockLLM)
+	localBuilds := registerTestProvider(t, local, localClient)
+	remoteBuilds := registerTestProvider(t, remote, remoteClient)
+
+	config := &Config{Providers: map[llm.LLMProvider]*ClientConfig{remote: {AuthToken: "remote-key"}}}
+	sw := NewSwarmWithClientConfig(ClientConfig{Provider: local, AuthToken: "local-key"}, config)
+
+	specialist := &Agent{Name: "Specialist", Model: "big-model", Provider: remote}
+	triage := &Agent{
+		Name:     "Triage",
+		Model:    "small-model",
+		Provider: local,
+		Functions: []AgentFunction{{
+			Name: "transfer",
+			Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				return Result{Success: true, Data: "transferred", Agent: specialist}
+			},
+		}},
+	}
+
+	localClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(singleToolTurn("transfer"), nil).Twice()
+	remoteClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Solved"), nil).Twice()
+
+	for i := 0; i < 2; i++ {
+		response, err := sw.Run(context.Background(), triage,
+			[]llm.Message{{Role: llm.RoleUser, Content: "Help"}}, nil, "", false, false, 5, true)
+		assert.NoError(t, err)
+		assert.Equal(t, "Solved", response.Messages[len(response.Messages)-1].Content)
+		assert.Equal(t, "Specialist", response.Agent.Name)
+	}
+	localClient.AssertExpectations(t)
+	remoteClient.AssertExpectations(t)
+
+	// The Swarm's client serves the triage agent; the specialist's is built once
+	assert.Len(t, *localBuilds, 1)
+	if assert.Len(t, *remoteBuilds, 1) {
+		assert.Equal(t, "remote-key", (*remoteBuilds)[0].AuthToken)
+		assert.Equal(t, remote, (*remoteBuilds)[0].Provider)
+	}
+
+	// An agent Config on the Swarm's provider shares its credentials
+	proxied := &Agent{Name: "Proxied", Model: "small-model", Config: &ClientConfig{BaseURL: "https://proxy.internal"}}
+	localClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Hi"), nil).Once()
+	_, err := sw.Run(context.Background(), proxied, []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}, nil, "", false, false, 1, true)
+	assert.NoError(t, err)
+	if assert.Len(t, *localBuilds, 2) {
+		assert.Equal(t, "local-key", (*localBuilds)[1].AuthToken)
+		assert.Equal(t, "https://proxy.internal", (*localBuilds)[1].BaseURL)
+	}
+
+	// An agent whose client cannot be built fails the run
+	broken := &Agent{Name: "Broken", Model: "m", Config: &ClientConfig{Provider: "UNKNOWN"}}
+	_, err = sw.Run(context.Background(), broken, []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}, nil, "", false, false, 1, true)
+	assert.ErrorIs(t, err, ErrInvalidProvider)
+
+	// An agent on a provider missing from Config.Providers fails rather than
+	// running on the Swarm's client
+	stray := &Agent{Name: "Stray", Model: "m", Provider: "TEST_MISSING"}
+	_, err = sw.Run(context.Background(), stray, []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}, nil, "", false, false, 1, true)
+	assert.ErrorIs(t, err, ErrInvalidProvider)
+
+	// A Swarm given its client directly still resolves agent providers
+	injected := new(MockLLM)
+	sw = NewSwarmWithClient(injected, config)
+	remoteClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Solved"), nil).Once()
+	_, err = sw.Run(context.Background(), specialist, []llm.Message{{Role: llm.RoleUser, Content: "Help"}}, nil, "", false, false, 1, true)
+	assert.NoError(t, err)
+	remoteClient.AssertExpectations(t)
+	injected.AssertNotCalled(t, "CreateChatCompletion", mock.Anything, mock.Anything)
+}
+
+// TestGraphAgentNodeUsesAgentProvider tests that agent nodes honor the agent's provider
+func TestGraphAgentNodeUsesAgentProvider(t *testing.T) {
+	const local llm.LLMProvider = "TEST_LOCAL"
+	localClient := new(MockLLM)
+	builds := registerTestProvider(t, local, localClient)
+	localClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Done"), nil).Twice()
+
+	g := NewGraph("test", "")
+	node := CreateAgentNode(g, "agent", "Agent", "Be brief.", "small-model", nil, local)
+	state := GraphState{"api_key": "key", "provider": string(llm.OpenAI), MessageKey: []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}}
+
+	for i := 0; i < 2; i++ {
+		_, err := node.Process(context.Background(), state)
+		assert.NoError(t, err)
+	}
+	localClient.AssertExpectations(t)
+	assert.Len(t, *builds, 1, "nodes share the Swarm for the same key and provider")
+}
+
+// TestRunRecordsFallbackModel tests that usage is recorded under the model that answered
+func TestRunRecordsFallbackModel(t *testing.T) {
+	primary, secondary := new(MockLLM), new(MockLLM)
+	primary.On("CreateChatCompletion", mock.Anything, mock.Anything).
+		Return(llm.ChatCompletionResponse{}, &llm.ProviderError{Provider: llm.OpenAI, Kind: llm.ErrServer}).Once()
+	reply := assistantReply("Hi")
+	reply.Usage = llm.Usage{PromptTokens: 1000000, TotalTokens: 1000000}
+	secondary.On("CreateChatCompletion", mock.Anything, mock.MatchedBy(func(req llm.ChatCompletionRequest) bool {
+		return req.Model == "gpt-4o-mini"
+	})).Return(reply, nil).Once()
+
+	sw := NewSwarmWithClient(llm.NewFallback(
+		llm.FallbackEntry{Client: primary},
+		llm.FallbackEntry{Client: secondary, Model: "gpt-4o-mini"},
+	), &Config{Models: DefaultModelCatalog()})
+
+	response, err := sw.Run(context.Background(), &Agent{Name: "Agent", Model: "gpt-4o"},
+		[]llm.Message{{Role: llm.RoleUser, Content: "Hello"}}, nil, "", false, false, 1, true)
+	assert.NoError(t, err)
+	primary.AssertExpectations(t)
+	secondary.AssertExpectations(t)
+
+	assert.Contains(t, response.Usage.ByModel, "gpt-4o-mini")
+	assert.NotContains(t, response.Usage.ByModel, "gpt-4o")
+	info, _ := DefaultModelCatalog().Lookup("gpt-4o-mini")
+	assert.InDelta(t, info.InputPrice, response.Usage.Cost, 1e-9)
+}
+
+// TestRateLimiter tests request and token buckets, usage correction and pauses
+func TestRateLimiter(t *testing.T) {
+	const provider llm.LLMProvider = "TEST_LIMITED"
+	limiter := NewRateLimiter()
+	limiter.SetLimit(provider, "", RateLimit{TokensPerMinute: 6000})
+	limiter.SetLimit(provider, "small", RateLimit{RequestsPerMinute: 1})
+
+	shortWait := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), 20*time.Millisecond)
+	}
+
+	// The first call takes the whole minute of tokens
+	first, err := limiter.Wait(context.Background(), provider, "big", 6000)
+	assert.NoError(t, err)
+	ctx, cancel := shortWait()
+	_, err = limiter.Wait(ctx, provider, "big", 3000)
+	cancel()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Reporting the actual usage gives back what was not used
+	first.Complete(llm.Usage{TotalTokens: 1000})
+	ctx, cancel = shortWait()
+	_, err = limiter.Wait(ctx, provider, "big", 3000)
+	cancel()
+	assert.NoError(t, err)
+
+	// A model limit replaces the provider limit
+	_, err = limiter.Wait(context.Background(), provider, "small", 100000)
+	assert.NoError(t, err)
+	ctx, cancel = shortWait()
+	_, err = limiter.Wait(ctx, provider, "small", 1)
+	cancel()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Failed calls give their reservation back in full
+	mockClient := new(MockLLM)
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).
+		Return(llm.ChatCompletionResponse{}, &llm.ProviderError{Kind: llm.ErrServer, StatusCode: 500}).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Hi"), nil).Once()
+	sw := NewSwarmWithClient(mockClient, &Config{RateLimiter: limiter, RetryPolicy: &RetryPolicy{}})
+	limiter.SetLimit(sw.provider, "tiny", RateLimit{RequestsPerMinute: 1})
+	agent := &Agent{Name: "Agent", Model: "tiny"}
+	messages := []llm.Message{{Role: llm.RoleUser, Content: "Hello"}}
+	_, err = sw.Run(context.Background(), agent, messages, nil, "", false, false, 1, true)
+	assert.ErrorIs(t, err, llm.ErrServer)
+	ctx, cancel = shortWait()
+	_, err = sw.Run(ctx, agent, messages, nil, "", false, false, 1, true)
+	cancel()
+	assert.NoError(t, err)
+	mockClient.AssertExpectations(t)
+
+	// Calls without a limit pass, unless paused
+	_, err = limiter.Wait(context.Background(), llm.OpenAI, "gpt-4o", 1000000)
+	assert.NoError(t, err)
+	limiter.Pause(llm.OpenAI, "gpt-4o", 50*time.Millisecond)
+	start := time.Now()
+	_, err = limiter.Wait(context.Background(), llm.OpenAI, "gpt-4o", 1)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+}
+
+// TestRateLimitEstimate tests that the catalog's output limit does not inflate reservations
+func TestRateLimitEstimate(t *testing.T) {
+	limiter := NewRateLimiter()
+	mockClient := new(MockLLM)
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Hi"), nil)
+	sw := NewSwarmWithClient(mockClient, &Config{RateLimiter: limiter, Models: NewModelCatalog(
+		ModelInfo{Name: "gpt-4o", ContextWindow: 128000, MaxOutputTokens: 16384, Capabilities: ModelCapabilities{Tools: true}},
+	)})
+	limiter.SetLimit(sw.provider, "gpt-4o", RateLimit{TokensPerMinute: 30000})
+
+	// Without MaxTokens, several calls fit in a minute at once
+	agent := &Agent{Name: "Agent", Model: "gpt-4o"}
+	messages := []llm.Message{{Role: llm.RoleUser, Content: "Hello"}}
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		_, err := sw.Run(ctx, agent, messages, nil, "", false, false, 1, true)
+		cancel()
+		assert.NoError(t, err)
+	}
+
+	// An estimate above the limit reserves the whole minute instead of waiting longer
+	_, err := limiter.Wait(context.Background(), sw.provider, "gpt-4o", 100000)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = limiter.Wait(ctx, sw.provider, "gpt-4o", 1000)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// TestRunQueuesAfterRateLimit tests that a rate limit pauses every Swarm sharing the limiter
+func TestRunQueuesAfterRateLimit(t *testing.T) {
+	limiter := NewRateLimiter()
+	config := &Config{
+		RateLimiter:       limiter,
+		RateLimitStrategy: RateLimitQueue,
+		RetryPolicy:       &RetryPolicy{},
+	}
+	messages := []llm.Message{{Role: llm.RoleUser, Content: "Hello"}}
+	agent := &Agent{Name: "Agent", Model: "test-model"}
+
+	limited := new(MockLLM)
+	limited.On("CreateChatCompletion", mock.Anything, mock.Anything).
+		Return(llm.ChatCompletionResponse{}, &llm.ProviderError{Kind: llm.ErrRateLimited, RetryAfter: 100 * time.Millisecond}).Once()
+	_, err := NewSwarmWithClient(limited, config).Run(context.Background(), agent, messages, nil, "", false, false, 1, true)
+	assert.ErrorIs(t, err, llm.ErrRateLimited)
+
+	other := new(MockLLM)
+	other.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Hi"), nil).Once()
+	start := time.Now()
+	_, err = NewSwarmWithClient(other, config).Run(context.Background(), agent, messages, nil, "", false, false, 1, true)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 80*time.Millisecond)
+	other.AssertExpectations(t)
+}
+
+// completionRecorder is a StreamHandler that records the completed message
+type completionRecorder struct {
+	DefaultStreamHandler
+	message llm.Message
+}
+
+func (h *completionRecorder) OnComplete(message llm.Message) { h.message = message }
+
+// TestFailureHandlersLLMCall tests the decisions handlers can make about failed completions
+func TestFailureHandlersLLMCall(t *testing.T) {
+	ctx := context.Background()
+	messages := []llm.Message{{Role: llm.RoleUser, Content: "Hello"}}
+	agent := &Agent{Name: "Agent", Model: "test-model", Functions: []AgentFunction{{
+		Name:     "lookup",
+		Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result { return Result{} },
+	}}}
+	badRequest := &llm.ProviderError{Kind: llm.ErrInvalidRequest, Message: "invalid tool schema"}
+
+	newSwarm := func(handlers ...FailureHandler) (*Swarm, *MockLLM) {
+		mockClient := new(MockLLM)
+		return NewSwarmWithClient(mockClient, &Config{RetryPolicy: &RetryPolicy{}, FailureHandlers: handlers}), mockClient
+	}
+
+	// Retry without tools when the model rejects their schema
+	var failures []Failure
+	sw, mockClient := newSwarm(
+		func(f Failure) FailureDecision { return FailureDecision{} },
+		func(f Failure) FailureDecision {
+			failures = append(failures, f)
+			if f.Phase == FailureLLMCall && errors.Is(f.Err, llm.ErrInvalidRequest) && len(f.Request.Tools) > 0 {
+				req := *f.Request
+				req.Tools = nil
+				return RetryWithRequest(req)
+			}
+			return FailureDecision{}
+		})
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.MatchedBy(func(req llm.ChatCompletionRequest) bool {
+		return len(req.Tools) > 0
+	})).Return(llm.ChatCompletionResponse{}, badRequest).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.MatchedBy(func(req llm.ChatCompletionRequest) bool {
+		return len(req.Tools) == 0
+	})).Return(assistantReply("Hi"), nil).Once()
+	response, err := sw.Run(ctx, agent, messages, nil, "", false, false, 1, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi", response.Messages[0].Content)
+	if assert.Len(t, failures, 1) {
+		assert.Equal(t, FailureLLMCall, failures[0].Phase)
+		assert.Equal(t, agent, failures[0].Agent)
+		assert.Equal(t, "test-model", failures[0].Model)
+		assert.Equal(t, 1, failures[0].Attempt)
+		var providerErr *llm.ProviderError
+		assert.ErrorAs(t, failures[0].Err, &providerErr)
+	}
+	mockClient.AssertExpectations(t)
+
+	// Retry with another model, recording usage under it
+	sw, mockClient = newSwarm(func(f Failure) FailureDecision { return RetryWithModel("backup-model") })
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.MatchedBy(func(req llm.ChatCompletionRequest) bool {
+		return req.Model == "test-model"
+	})).Return(llm.ChatCompletionResponse{}, badRequest).Once()
+	reply := assistantReply("Hi")
+	reply.Usage = llm.Usage{PromptTokens: 3, CompletionTokens: 1, TotalTokens: 4}
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.MatchedBy(func(req llm.ChatCompletionRequest) bool {
+		return req.Model == "backup-model"
+	})).Return(reply, nil).Once()
+	response, err = sw.Run(ctx, agent, messages, nil, "", false, false, 1, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, response.Usage.ByModel["backup-model"].TotalTokens)
+	mockClient.AssertExpectations(t)
+
+	// Retrying with an empty model keeps the model
+	sw, mockClient = newSwarm(func(f Failure) FailureDecision { return RetryWithModel("") })
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{}, badRequest).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.MatchedBy(func(req llm.ChatCompletionRequest) bool {
+		return req.Model == "test-model"
+	})).Return(assistantReply("Hi"), nil).Once()
+	_, err = sw.Run(ctx, agent, messages, nil, "", false, false, 1, true)
+	assert.NoError(t, err)
+	mockClient.AssertExpectations(t)
+
+	// Substitute a canned response
+	sw, mockClient = newSwarm(func(f Failure) FailureDecision { return Substitute("Sorry, try again later.") })
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{}, badRequest).Once()
+	response, err = sw.Run(ctx, agent, messages, nil, "", false, false, 1, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "Sorry, try again later.", response.Messages[0].Content)
+	assert.Equal(t, llm.RoleAssistant, response.Messages[0].Role)
+
+	// Skip ends the run with the turns completed so far
+	sw, mockClient = newSwarm(func(f Failure) FailureDecision { return Skip() })
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{}, badRequest).Once()
+	response, err = sw.Run(ctx, agent, messages, nil, "", false, false, 1, true)
+	assert.NoError(t, err)
+	assert.Empty(t, response.Messages)
+
+	// Abort keeps the original error
+	sw, mockClient = newSwarm(func(f Failure) FailureDecision { return Abort(nil) })
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{}, badRequest).Once()
+	_, err = sw.Run(ctx, agent, messages, nil, "", false, false, 1, true)
+	assert.ErrorIs(t, err, ErrAborted)
+	assert.ErrorIs(t, err, llm.ErrInvalidRequest)
+
+	// A handler that always retries is eventually ignored
+	attempts := 0
+	sw, mockClient = newSwarm(func(f Failure) FailureDecision {
+		attempts = f.Attempt
+		return Retry()
+	})
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{}, badRequest)
+	_, err = sw.Run(ctx, agent, messages, nil, "", false, false, 1, true)
+	assert.ErrorIs(t, err, llm.ErrInvalidRequest)
+	assert.Equal(t, maxFailureAttempts, attempts)
+}
+
+// TestFailureHandlersTool tests retrying, substituting and aborting failed tool calls
+func TestFailureHandlersTool(t *testing.T) {
+	ctx := context.Background()
+	messages := []llm.Message{{Role: llm.RoleUser, Content: "Hello"}}
+	calls := 0
+	agent := &Agent{Name: "Agent", Model: "test-model", Functions: []AgentFunction{{
+		Name: "flaky",
+		Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			calls++
+			if calls == 1 {
+				return Result{Error: errors.New("temporarily unavailable")}
+			}
+			return Result{Success: true, Data: "done"}
+		},
+	}}}
+
+	run := func(handler FailureHandler) (Response, error) {
+		calls = 0
+		mockClient := new(MockLLM)
+		mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(singleToolTurn("flaky"), nil).Once()
+		mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("OK"), nil).Maybe()
+		sw := NewSwarmWithClient(mockClient, &Config{FailureHandlers: []FailureHandler{handler}})
+		return sw.Run(ctx, agent, messages, nil, "", false, false, 2, true)
+	}
+
+	var failure Failure
+	response, err := run(func(f Failure) FailureDecision {
+		failure = f
+		return Retry()
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "done", response.Messages[1].Content)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, FailureTool, failure.Phase)
+	assert.Equal(t, "flaky", failure.Tool)
+	assert.EqualError(t, failure.Err, "temporarily unavailable")
+
+	response, err = run(func(f Failure) FailureDecision { return Substitute("cached result") })
+	assert.NoError(t, err)
+	assert.Equal(t, "cached result", response.Messages[1].Content)
+	assert.True(t, response.ToolResults[0].Result.Success)
+
+	response, err = run(func(f Failure) FailureDecision { return Skip() })
+	assert.NoError(t, err)
+	assert.Equal(t, "Tool flaky was skipped.", response.Messages[1].Content)
+	assert.False(t, response.ToolResults[0].Result.Success)
+	assert.ErrorContains(t, response.ToolResults[0].Result.Error, "temporarily unavailable")
+
+	// Tools use no model, so retrying with another one is not theirs to decide
+	response, err = run(func(f Failure) FailureDecision { return RetryWithModel("backup-model") })
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	assert.EqualError(t, response.ToolResults[0].Result.Error, "temporarily unavailable")
+
+	response, err = run(func(f Failure) FailureDecision { return Abort(errors.New("tool outage")) })
+	assert.ErrorIs(t, err, ErrAborted)
+	assert.ErrorContains(t, err, "tool outage")
+	assert.Len(t, response.ToolResults, 1)
+}
+
+// TestFailureHandlersStream tests handlers deciding about failed streams
+func TestFailureHandlersStream(t *testing.T) {
+	ctx := context.Background()
+	messages := []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}
+	agent := &Agent{Name: "Streamer", Model: "test-model"}
+	serverErr := &llm.ProviderError{Kind: llm.ErrServer, StatusCode: 500}
+
+	// A stream that cannot be opened is answered with a substitute
+	mockClient := new(MockLLM)
+	mockClient.On("CreateChatCompletionStream", mock.Anything, mock.Anything).Return((*scriptedStream)(nil), serverErr).Once()
+	var phase FailurePhase
+	sw := NewSwarmWithClient(mockClient, &Config{FailureHandlers: []FailureHandler{func(f Failure) FailureDecision {
+		phase = f.Phase
+		return Substitute("Service unavailable.")
+	}}})
+	handler := &completionRecorder{}
+	assert.NoError(t, sw.StreamingResponse(ctx, agent, messages, nil, "", handler, false))
+	assert.Equal(t, FailureStream, phase)
+	assert.Equal(t, "Service unavailable.", handler.message.Content)
+
+	// A stream failing midway is started over
+	mockClient = new(MockLLM)
+	mockClient.On("CreateChatCompletionStream", mock.Anything, mock.Anything).Return(&brokenChunkStream{
+		chunk: llm.ChatCompletionResponse{Choices: []llm.Choice{{Message: llm.Message{Content: "Hel"}}}},
+		err:   serverErr,
+	}, nil).Once()
+	mockClient.On("CreateChatCompletionStream", mock.Anything, mock.Anything).Return(&scriptedStream{chunks: []llm.ChatCompletionResponse{
+		{Choices: []llm.Choice{{Message: llm.Message{Content: "Hello"}}}},
+	}}, nil).Once()
+	sw = NewSwarmWithClient(mockClient, &Config{FailureHandlers: []FailureHandler{func(f Failure) FailureDecision { return Retry() }}})
+	handler = &completionRecorder{}
+	assert.NoError(t, sw.StreamingResponse(ctx, agent, messages, nil, "", handler, false))
+	assert.Equal(t, "Hello", handler.message.Content)
+	mockClient.AssertExpectations(t)
+}
+
+// brokenChunkStream sends one chunk, then fails
+type brokenChunkStream struct {
+	chunk llm.ChatCompletionResponse
+	err   error
+	sent  bool
+}
+
+func (s *brokenChunkStream) Recv() (llm.ChatCompletionResponse, error) {
+	if s.sent {
+		return llm.ChatCompletionResponse{}, s.err
+	}
+	s.sent = true
+	return s.chunk, nil
+}
+
+func (s *brokenChunkStream) Close() error { return nil }
+
+// TestFailureHandlersWorkflowStep tests substituting the output of a failed workflow step
+func TestFailureHandlersWorkflowStep(t *testing.T) {
+	mockClient := new(MockLLM)
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).
+		Return(llm.ChatCompletionResponse{}, &llm.ProviderError{Kind: llm.ErrInvalidRequest}).Once()
+
+	// The Swarm's handlers see the LLM call and the workflow's the step
+	var phases []FailurePhase
+	record := func(f Failure) FailureDecision {
+		phases = append(phases, f.Phase)
+		return FailureDecision{}
+	}
+	wf := NewWorkflow("", llm.OpenAI, CollaborativeWorkflow)
+	wf.swarm = NewSwarmWithClient(mockClient, &Config{FailureHandlers: []FailureHandler{record}})
+	wf.AddAgent(&Agent{Name: "Writer", Model: "test-model"})
+	wf.SetFailureHandlers(record, func(f Failure) FailureDecision {
+		return Substitute("Final answer: unavailable")
+	})
+
+	result, err := wf.Execute("Writer", "Write a haiku")
+	assert.NoError(t, err)
+	assert.Equal(t, []FailurePhase{FailureLLMCall, FailureWorkflowStep}, phases)
+	assert.Len(t, wf.swarm.config.FailureHandlers, 1)
+	assert.Equal(t, "Final answer: unavailable", result.FinalOutput[len(result.FinalOutput)-1].Content)
+	mockClient.AssertExpectations(t)
+}
+
+// TestWorkflowStepRetry tests that a retried step is charged for its failed attempts
+func TestWorkflowStepRetry(t *testing.T) {
+	toolTurn := singleToolTurn("lookup")
+	toolTurn.Usage = llm.Usage{PromptTokens: 3, CompletionTokens: 1, TotalTokens: 4}
+	reply := assistantReply("Final answer: done")
+	reply.Usage = llm.Usage{PromptTokens: 5, CompletionTokens: 1, TotalTokens: 6}
+	mockClient := new(MockLLM)
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(toolTurn, nil).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).
+		Return(llm.ChatCompletionResponse{}, &llm.ProviderError{Kind: llm.ErrInvalidRequest}).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(reply, nil).Once()
+
+	var models []string
+	wf := NewWorkflow("", llm.OpenAI, CollaborativeWorkflow)
+	wf.swarm = NewSwarmWithClient(mockClient, &Config{DefaultModel: "default-model"})
+	wf.AddAgent(&Agent{Name: "Writer", Functions: []AgentFunction{{
+		Name: "lookup",
+		Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			return Result{Data: "found"}
+		},
+	}}})
+	wf.SetFailureHandlers(func(f Failure) FailureDecision {
+		models = append(models, f.Model)
+		return RetryWithModel("")
+	})
+
+	result, err := wf.Execute("Writer", "Write a haiku")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"default-model"}, models)
+	assert.Equal(t, 10, result.Usage.TotalTokens)
+	assert.Equal(t, 10, result.Steps[0].Usage.TotalTokens)
+	mockClient.AssertExpectations(t)
+
+	// A step for an agent that was never added fails instead of panicking
+	_, err = wf.executeStep(context.Background(), 2, "Editor", nil)
+	assert.EqualError(t, err, "agent Editor does not exist")
+}
+
+// TestLogging tests that runs log structured records at the configured level
+func TestLogging(t *testing.T) {
+	ctx := context.Background()
+	messages := []llm.Message{{Role: llm.RoleUser, Content: "Hello"}}
+	agent := &Agent{Name: "Agent", Model: "test-model", Functions: []AgentFunction{{
+		Name: "lookup",
+		Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			return Result{Data: "found"}
+		},
+	}}}
+
+	run := func(config *Config) {
+		mockClient := new(MockLLM)
+		mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(singleToolTurn("lookup"), nil).Once()
+		mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Done"), nil).Once()
+		_, err := NewSwarmWithClient(mockClient, config).Run(ctx, agent, messages, nil, "", false, false, 2, true)
+		assert.NoError(t, err)
+	}
+
+	// The library is silent without a logger
+	assert.False(t, NewSwarmWithClient(new(MockLLM), DefaultConfig()).logger(ctx, false).Enabled(ctx, slog.LevelError))
+
+	var buf bytes.Buffer
+	run(&Config{Logger: slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: LevelTrace})), LogLevel: LogDebug})
+
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	assert.NotEmpty(t, records)
+	runID := records[0][LogKeyRunID]
+	assert.NotEmpty(t, runID)
+	var tools []string
+	for _, record := range records {
+		assert.Equal(t, runID, record[LogKeyRunID])
+		assert.NotEqual(t, "tool arguments", record["msg"], "trace records are below LogDebug")
+		if record["msg"] == "starting turn" {
+			assert.Equal(t, "Agent", record[LogKeyAgent])
+			assert.Equal(t, "test-model", record[LogKeyModel])
+		}
+		if tool, ok := record[LogKeyTool].(string); ok {
+			tools = append(tools, tool)
+		}
+	}
+	assert.Contains(t, tools, "lookup")
+
+	// Records below the configured level are dropped
+	buf.Reset()
+	run(&Config{Logger: slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: LevelTrace})), LogLevel: LogWarning})
+	assert.Empty(t, buf.String())
+}
+
+// TestConsoleHandler tests the colored console output
+func TestConsoleHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewConsoleHandler(&buf, nil)).With(LogKeyAgent, "Writer")
+	logger.Debug("hidden")
+	logger.Info("workflow transition", "to", "Editor")
+	assert.Equal(t, "\033[96mworkflow transition\033[0m \033[90magent=\033[0mWriter \033[90mto=\033[0mEditor\n", buf.String())
+}
+
+// spanTree indexes exported spans by name and ID
+type spanTree struct {
+	spans []sdktrace.ReadOnlySpan
+}
+
+func newSpanTree(exporter *tracetest.InMemoryExporter) spanTree {
+	return spanTree{spans: exporter.GetSpans().Snapshots()}
+}
+
+// named returns the spans with the given name
+func (st spanTree) named(name string) []sdktrace.ReadOnlySpan {
+	var spans []sdktrace.ReadOnlySpan
+	for _, span := range st.spans {
+		if span.Name() == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// parent returns the name of a span's parent, or "" for a root span
+func (st spanTree) parent(span sdktrace.ReadOnlySpan) string {
+	for _, candidate := range st.spans {
+		if candidate.SpanContext().SpanID() == span.Parent().SpanID() {
+			return candidate.Name()
+		}
+	}
+	return ""
+}
+
+// spanAttr returns the value of a span attribute
+func spanAttr(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+// TestRunTracing tests the spans of a run with parallel tool calls and a handoff
+func TestRunTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	specialist := &Agent{Name: "Specialist", Model: "test-model"}
+	agent := &Agent{Name: "Triage", Model: "test-model", ParallelToolCalls: true, Functions: []AgentFunction{
+		{Name: "lookup", Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			return Result{Data: "found"}
+		}},
+		{Name: "transfer", Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			return Result{Agent: specialist, Data: "transferred"}
+		}},
+	}}
+
+	toolTurn := singleToolTurn("lookup")
+	toolTurn.Choices[0].Message.ToolCalls = append(toolTurn.Choices[0].Message.ToolCalls, llm.ToolCall{
+		ID: "call_2", Type: "function", Function: llm.ToolCallFunction{Name: "transfer", Arguments: `{}`},
+	})
+	toolTurn.Choices[0].FinishReason = "tool_calls"
+	reply := assistantReply("Done")
+	reply.Choices[0].FinishReason = "stop"
+	reply.Usage = llm.Usage{PromptTokens: 20, CompletionTokens: 5, TotalTokens: 25}
+
+	mockClient := new(MockLLM)
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(toolTurn, nil).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(reply, nil).Once()
+	sw := NewSwarmWithClient(mockClient, &Config{TracerProvider: tp})
+	_, err := sw.Run(context.Background(), agent, []llm.Message{{Role: llm.RoleUser, Content: "Help"}}, nil, "", false, false, 3, true)
+	assert.NoError(t, err)
+
+	tree := newSpanTree(exporter)
+	runs := tree.named("agentkit.run")
+	if assert.Len(t, runs, 1) {
+		assert.Equal(t, "", tree.parent(runs[0]))
+		assert.Equal(t, "Triage", spanAttr(runs[0], AttrAgent).AsString())
+		assert.NotEmpty(t, spanAttr(runs[0], AttrRunID).AsString())
+		assert.Equal(t, int64(20), spanAttr(runs[0], AttrInputTokens).AsInt64())
+	}
+
+	calls := tree.named("agentkit.llm")
+	if assert.Len(t, calls, 2) {
+		for _, call := range calls {
+			assert.Equal(t, "agentkit.run", tree.parent(call))
+			assert.Equal(t, "test-model", spanAttr(call, AttrRequestModel).AsString())
+		}
+		assert.Equal(t, []string{"tool_calls"}, spanAttr(calls[0], AttrFinishReasons).AsStringSlice())
+		assert.Equal(t, int64(5), spanAttr(calls[1], AttrOutputTokens).AsInt64())
+	}
+
+	tools := tree.named("agentkit.tool")
+	if assert.Len(t, tools, 2) {
+		for _, tool := range tools {
+			assert.Equal(t, "agentkit.run", tree.parent(tool))
+		}
+	}
+
+	handoffs := tree.named("agentkit.handoff")
+	if assert.Len(t, handoffs, 1) {
+		assert.Equal(t, "agentkit.run", tree.parent(handoffs[0]))
+		assert.Equal(t, "Specialist", spanAttr(handoffs[0], AttrHandoffTo).AsString())
+	}
+
+	// Failed calls are recorded with an error status
+	exporter.Reset()
+	mockClient = new(MockLLM)
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).
+		Return(llm.ChatCompletionResponse{}, &llm.ProviderError{Kind: llm.ErrInvalidRequest}).Once()
+	sw = NewSwarmWithClient(mockClient, &Config{TracerProvider: tp})
+	_, err = sw.Run(context.Background(), agent, []llm.Message{{Role: llm.RoleUser, Content: "Help"}}, nil, "", false, false, 1, true)
+	assert.Error(t, err)
+	for _, span := range newSpanTree(exporter).spans {
+		assert.Equal(t, codes.Error, span.Status().Code, span.Name())
+	}
+}
+
+// TestGraphTracing tests that node visits and parallel branches parent the runs they make
+func TestGraphTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	mockClient := new(MockLLM)
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Done"), nil).Twice()
+	sw := NewMockSwarm(mockClient)
+
+	branch := func(name string) NodeFunc {
+		return func(ctx context.Context, state GraphState) (GraphState, error) {
+			_, err := sw.Run(ctx, &Agent{Name: name, Model: "test-model"}, nil, nil, "", false, false, 1, true)
+			return state, err
+		}
+	}
+
+	g := NewGraph("research", "")
+	g.TracerProvider = tp
+	CreateParallelNode(g, "fanout", []NodeFunc{branch("A"), branch("B")})
+	assert.NoError(t, g.SetEntryPoint("fanout"))
+	assert.NoError(t, g.AddExitPoint("fanout"))
+	_, err := g.ExecuteGraph(context.Background(), GraphState{})
+	assert.NoError(t, err)
+
+	tree := newSpanTree(exporter)
+	assert.Len(t, tree.named("agentkit.graph"), 1)
+	nodes := tree.named("agentkit.graph.node")
+	if assert.Len(t, nodes, 1) {
+		assert.Equal(t, "agentkit.graph", tree.parent(nodes[0]))
+		assert.Equal(t, "fanout", spanAttr(nodes[0], AttrNode).AsString())
+	}
+	branches := tree.named("agentkit.graph.branch")
+	assert.Len(t, branches, 2)
+	for _, span := range branches {
+		assert.Equal(t, "agentkit.graph.node", tree.parent(span))
+	}
+	runs := tree.named("agentkit.run")
+	assert.Len(t, runs, 2)
+	for _, span := range runs {
+		assert.Equal(t, "agentkit.graph.branch", tree.parent(span))
+	}
+	for _, span := range tree.named("agentkit.llm") {
+		assert.Equal(t, "agentkit.run", tree.parent(span))
+	}
+}
+
+// TestParallelNodeMergesUsage tests that a parallel node adds up the usage of its branches
+func TestParallelNodeMergesUsage(t *testing.T) {
+	branch := func(name string, tokens int) NodeFunc {
+		return func(ctx context.Context, state GraphState) (GraphState, error) {
+			var usage Usage
+			usage.Merge(state[UsageKey].(Usage))
+			usage.Add(name, "test-model", llm.Usage{PromptTokens: tokens - 1, CompletionTokens: 1}, 0)
+			state[UsageKey] = usage
+			return state, nil
+		}
+	}
+
+	g := NewGraph("research", "")
+	CreateParallelNode(g, "fanout", []NodeFunc{branch("A", 5), branch("B", 7)})
+	assert.NoError(t, g.SetEntryPoint("fanout"))
+	assert.NoError(t, g.AddExitPoint("fanout"))
+
+	// The usage from before the fan-out is counted once
+	var before Usage
+	before.Add("Planner", "test-model", llm.Usage{PromptTokens: 2, CompletionTokens: 1}, 0)
+	state, err := g.ExecuteGraph(context.Background(), GraphState{UsageKey: before})
+	assert.NoError(t, err)
+
+	usage := state[UsageKey].(Usage)
+	assert.Equal(t, 3, usage.Calls)
+	assert.Equal(t, 15, usage.TotalTokens)
+	assert.Equal(t, 5, usage.ByAgent["A"].TotalTokens)
+	assert.Equal(t, 7, usage.ByAgent["B"].TotalTokens)
+	assert.Equal(t, 15, usage.ByModel["test-model"].TotalTokens)
+	assert.Equal(t, 3, before.TotalTokens)
+}
+
+// TestWorkflowTracing tests that workflow steps parent the runs they make
+func TestWorkflowTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	mockClient := new(MockLLM)
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Final answer: done"), nil).Once()
+
+	wf := NewWorkflow("", llm.OpenAI, CollaborativeWorkflow)
+	wf.swarm = NewMockSwarm(mockClient)
+	wf.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	wf.AddAgent(&Agent{Name: "Writer", Model: "test-model"})
+	_, err := wf.Execute("Writer", "Write a haiku")
+	assert.NoError(t, err)
+
+	tree := newSpanTree(exporter)
+	steps := tree.named("agentkit.workflow.step")
+	if assert.Len(t, steps, 1) {
+		assert.Equal(t, "agentkit.workflow", tree.parent(steps[0]))
+		assert.Equal(t, int64(1), spanAttr(steps[0], AttrStep).AsInt64())
+	}
+	runs := tree.named("agentkit.run")
+	if assert.Len(t, runs, 1) {
+		assert.Equal(t, "agentkit.workflow.step", tree.parent(runs[0]))
+	}
+}
+
+// metricSample is a measurement taken by metricsRecorder
+type metricSample struct {
+	name   string
+	value  float64
+	labels []Label
+}
+
+// metricsRecorder is a Metrics keeping every measurement
+type metricsRecorder struct {
+	mu      sync.Mutex
+	samples []metricSample
+}
+
+func (m *metricsRecorder) Add(ctx context.Context, name string, value int64, labels ...Label) {
+	m.Record(ctx, name, float64(value), labels...)
+}
+
+func (m *metricsRecorder) Record(_ context.Context, name string, value float64, labels ...Label) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = append(m.samples, metricSample{name: name, value: value, labels: labels})
+}
+
+// matching returns the samples of name carrying every label of labels
+func (m *metricsRecorder) matching(name string, labels ...Label) []metricSample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var matched []metricSample
+	for _, sample := range m.samples {
+		if sample.name == name && assert.ObjectsAreEqual(labels, intersectLabels(sample.labels, labels)) {
+			matched = append(matched, sample)
+		}
+	}
+	return matched
+}
+
+// total returns the sum of the samples of name carrying every label of labels
+func (m *metricsRecorder) total(name string, labels ...Label) float64 {
+	var total float64
+	for _, sample := range m.matching(name, labels...) {
+		total += sample.value
+	}
+	return total
+}
+
+// intersectLabels returns the labels of want found in have, in want's order
+func intersectLabels(have, want []Label) []Label {
+	var found []Label
+	for _, w := range want {
+		for _, h := range have {
+			if h == w {
+				found = append(found, w)
+				break
+			}
+		}
+	}
+	return found
+}
+
+// TestRunMetrics tests the measurements of a run with a retry, tool calls and a handoff
+func TestRunMetrics(t *testing.T) {
+	specialist := &Agent{Name: "Specialist", Model: "test-model"}
+	agent := &Agent{Name: "Triage", Model: "test-model", Functions: []AgentFunction{
+		{Name: "lookup", Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			return Result{Data: "found"}
+		}},
+		{Name: "broken", Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			return Result{Error: errors.New("backend down")}
+		}},
+		{Name: "transfer", Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			return Result{Agent: specialist, Data: "transferred"}
+		}},
+	}}
+
+	toolTurn := singleToolTurn("lookup")
+	for i, name := range []string{"broken", "transfer"} {
+		toolTurn.Choices[0].Message.ToolCalls = append(toolTurn.Choices[0].Message.ToolCalls, llm.ToolCall{
+			ID: fmt.Sprintf("call_%d", i+2), Type: "function", Function: llm.ToolCallFunction{Name: name, Arguments: `{}`},
+		})
+	}
+	reply := assistantReply("Done")
+	reply.Usage = llm.Usage{PromptTokens: 20, CompletionTokens: 5, TotalTokens: 25}
+
+	mockClient := new(MockLLM)
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).
+		Return(llm.ChatCompletionResponse{}, &llm.ProviderError{Kind: llm.ErrRateLimited, RetryAfter: time.Millisecond}).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(toolTurn, nil).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(reply, nil).Once()
+	metrics := &metricsRecorder{}
+	sw := NewSwarmWithClient(mockClient, &Config{
+		RetryPolicy: &RetryPolicy{MaxRetries: 1},
+		RateLimiter: NewRateLimiter(),
+		Metrics:     metrics,
+	})
+	_, err := sw.Run(context.Background(), agent, []llm.Message{{Role: llm.RoleUser, Content: "Help"}}, nil, "", false, false, 3, true)
+	assert.NoError(t, err)
+
+	model := Label{LabelModel, "test-model"}
+	assert.Len(t, metrics.matching(MetricLLMDuration, model), 3)
+	assert.Len(t, metrics.matching(MetricLLMDuration, model, Label{LabelOutcome, "error"}), 1)
+	assert.Equal(t, 1.0, metrics.total(MetricLLMRetries, model))
+	assert.Equal(t, 1.0, metrics.total(MetricLLMRateLimits, model))
+	assert.Equal(t, 1.0, metrics.total(MetricLLMErrors, model, Label{LabelErrorKind, "rate_limited"}))
+	assert.Equal(t, 20.0, metrics.total(MetricLLMInputTokens, model))
+	assert.Equal(t, 5.0, metrics.total(MetricLLMOutputTokens, model))
+
+	triage := Label{LabelAgent, "Triage"}
+	assert.Equal(t, 3.0, metrics.total(MetricToolCalls, triage))
+	assert.Equal(t, 1.0, metrics.total(MetricToolCalls, triage, Label{LabelTool, "lookup"}))
+	assert.Equal(t, 1.0, metrics.total(MetricToolErrors, triage))
+	assert.Equal(t, 1.0, metrics.total(MetricToolErrors, triage, Label{LabelTool, "broken"}))
+	assert.Len(t, metrics.matching(MetricToolDuration, triage), 3)
+	assert.Equal(t, 1.0, metrics.total(MetricHandoffs, Label{LabelFrom, "Triage"}, Label{LabelTo, "Specialist"}))
+	assert.Len(t, metrics.matching(MetricRunDuration, triage, Label{LabelOutcome, "ok"}), 1)
+}
+
+// TestStreamingMetrics tests the time to first token and usage of a stream
+func TestStreamingMetrics(t *testing.T) {
+	mockClient := new(MockLLM)
+	mockClient.On("CreateChatCompletionStream", mock.Anything, mock.Anything).Return(&scriptedStream{chunks: []llm.ChatCompletionResponse{
+		{Choices: []llm.Choice{{Message: llm.Message{Content: "Hel"}}}},
+		{Choices: []llm.Choice{{Message: llm.Message{Content: "lo"}}}},
+		{Usage: llm.Usage{PromptTokens: 8, CompletionTokens: 2, TotalTokens: 10}},
+	}}, nil).Once()
+	metrics := &metricsRecorder{}
+	sw := NewSwarmWithClient(mockClient, &Config{Metrics: metrics})
+	agent := &Agent{Name: "Streamer", Model: "test-model"}
+	err := sw.StreamingResponse(context.Background(), agent, []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}, nil, "", &DefaultStreamHandler{}, false)
+	assert.NoError(t, err)
+
+	model := Label{LabelModel, "test-model"}
+	ttft := metrics.matching(MetricLLMTimeToFirstToken, model)
+	duration := metrics.matching(MetricLLMDuration, model, Label{LabelOutcome, "ok"})
+	if assert.Len(t, ttft, 1) && assert.Len(t, duration, 1) {
+		assert.LessOrEqual(t, ttft[0].value, duration[0].value)
+	}
+	assert.Equal(t, 8.0, metrics.total(MetricLLMInputTokens, model))
+	assert.Equal(t, 2.0, metrics.total(MetricLLMOutputTokens, model))
+}
+
+// TestWorkflowAndGraphMetrics tests the durations of workflow steps and graph node visits
+func TestWorkflowAndGraphMetrics(t *testing.T) {
+	mockClient := new(MockLLM)
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Final answer: done"), nil).Once()
+	metrics := &metricsRecorder{}
+	wf := NewWorkflow("", llm.OpenAI, CollaborativeWorkflow)
+	wf.swarm = NewMockSwarm(mockClient)
+	wf.SetMetrics(metrics)
+	wf.AddAgent(&Agent{Name: "Writer", Model: "test-model"})
+	_, err := wf.Execute("Writer", "Write a haiku")
+	assert.NoError(t, err)
+	assert.Len(t, metrics.matching(MetricWorkflowStepDuration, Label{LabelAgent, "Writer"}, Label{LabelOutcome, "ok"}), 1)
+	assert.Len(t, metrics.matching(MetricRunDuration, Label{LabelAgent, "Writer"}), 1)
+
+	// Without metrics of its own, a graph uses its Swarm's
+	g := NewGraph("research", "")
+	g.Swarm = wf.swarm
+	g.AddNode("gather", "Gather", func(ctx context.Context, state GraphState) (GraphState, error) { return state, nil })
+	g.AddNode("fail", "Fail", func(ctx context.Context, state GraphState) (GraphState, error) {
+		return state, errors.New("no sources")
+	})
+	assert.NoError(t, g.AddDirectedEdge("gather", "fail"))
+	assert.NoError(t, g.SetEntryPoint("gather"))
+	_, err = g.ExecuteGraph(context.Background(), GraphState{})
+	assert.Error(t, err)
+	graph := Label{LabelGraph, "research"}
+	assert.Len(t, metrics.matching(MetricGraphNodeDuration, graph, Label{LabelNode, "gather"}, Label{LabelOutcome, "ok"}), 1)
+	assert.Len(t, metrics.matching(MetricGraphNodeDuration, graph, Label{LabelNode, "fail"}, Label{LabelOutcome, "error"}), 1)
+}
+
+// TestOTelMetrics tests that measurements reach an OpenTelemetry meter
+func TestOTelMetrics(t *testing.T) {
+	ctx := context.Background()
+	reader := sdkmetric.NewManualReader()
+	metrics := NewOTelMetrics(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test"))
+	metrics.Add(ctx, MetricToolCalls, 1, Label{LabelTool, "lookup"})
+	metrics.Add(ctx, MetricToolCalls, 2, Label{LabelTool, "lookup"})
+	metrics.Record(ctx, MetricToolDuration, 0.25, Label{LabelTool, "lookup"})
+
+	var rm metricdata.ResourceMetrics
+	assert.NoError(t, reader.Collect(ctx, &rm))
+	found := make(map[string]metricdata.Metrics)
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			found[m.Name] = m
+		}
+	}
+
+	if sum, ok := found[MetricToolCalls].Data.(metricdata.Sum[int64]); assert.True(t, ok) && assert.Len(t, sum.DataPoints, 1) {
+		assert.Equal(t, int64(3), sum.DataPoints[0].Value)
+		tool, _ := sum.DataPoints[0].Attributes.Value(attribute.Key(LabelTool))
+		assert.Equal(t, "lookup", tool.AsString())
+	}
+	assert.Equal(t, "s", found[MetricToolDuration].Unit)
+	if hist, ok := found[MetricToolDuration].Data.(metricdata.Histogram[float64]); assert.True(t, ok) && assert.Len(t, hist.DataPoints, 1) {
+		assert.Equal(t, uint64(1), hist.DataPoints[0].Count)
+		assert.Equal(t, 0.25, hist.DataPoints[0].Sum)
+	}
+}
+
+// hookRecorder is a Hooks recording the events it sees
+type hookRecorder struct {
+	DefaultHooks
+	mu     sync.Mutex
+	events []string
+}
+
+func (h *hookRecorder) record(format string, args ...interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, fmt.Sprintf(format, args...))
+}
+
+func (h *hookRecorder) OnRunStart(ctx context.Context, agent *Agent, messages []llm.Message) {
+	h.record("run start %s", agent.Name)
+}
+
+func (h *hookRecorder) OnLLMRequest(ctx context.Context, agent *Agent, req *llm.ChatCompletionRequest) error {
+	h.record("llm request %s", req.Model)
+	return nil
+}
+
+func (h *hookRecorder) OnLLMResponse(ctx context.Context, agent *Agent, resp llm.ChatCompletionResponse) {
+	h.record("llm response")
+}
+
+func (h *hookRecorder) OnToolStart(ctx context.Context, agent *Agent, call *llm.ToolCall) error {
+	h.record("tool start %s", call.Function.Name)
+	return nil
+}
+
+func (h *hookRecorder) OnToolEnd(ctx context.Context, agent *Agent, call llm.ToolCall, result Result) {
+	h.record("tool end %s %v", call.Function.Name, result.Data)
+}
+
+func (h *hookRecorder) OnHandoff(ctx context.Context, from, to *Agent) {
+	h.record("handoff %s -> %s", from.Name, to.Name)
+}
+
+func (h *hookRecorder) OnContextVariablesChanged(ctx context.Context, agent *Agent, contextVariables map[string]interface{}) {
+	h.record("variables %v", contextVariables)
+}
+
+func (h *hookRecorder) OnError(ctx context.Context, agent *Agent, err error) {
+	h.record("error %v", err)
+}
+
+func (h *hookRecorder) OnRunEnd(ctx context.Context, agent *Agent, response Response, err error) {
+	h.record("run end %s", response.Agent.Name)
+}
+
+func (h *hookRecorder) OnWorkflowEvent(ctx context.Context, event WorkflowEvent) {
+	h.record("%s %s%s->%s", event.Name, event.Node, event.From, event.To)
+}
+
+// toolPolicy is a Hooks that rewrites requests and tool calls, and vetoes a tool
+type toolPolicy struct {
+	DefaultHooks
+}
+
+func (p *toolPolicy) OnLLMRequest(ctx context.Context, agent *Agent, req *llm.ChatCompletionRequest) error {
+	req.Model = "reviewed-model"
+	return nil
+}
+
+func (p *toolPolicy) OnToolStart(ctx context.Context, agent *Agent, call *llm.ToolCall) error {
+	if call.Function.Name == "delete" {
+		return errors.New("deleting is not allowed")
+	}
+	call.Function.Arguments = `{"city": "Paris"}`
+	return nil
+}
+
+// TestRunHooks tests the events hooks see during a run, and their vetoes and changes
+func TestRunHooks(t *testing.T) {
+	specialist := &Agent{Name: "Specialist", Model: "test-model"}
+	var lookedUp interface{}
+	agent := &Agent{Name: "Triage", Model: "test-model", Functions: []AgentFunction{
+		{Name: "lookup", Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			lookedUp = args["city"]
+			contextVariables["city"] = args["city"]
+			return Result{Data: "found"}
+		}},
+		{Name: "delete", Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			t.Error("vetoed tool was called")
+			return Result{}
+		}},
+		{Name: "transfer", Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			return Result{Agent: specialist, Data: "transferred"}
+		}},
+	}}
+
+	toolTurn := singleToolTurn("lookup")
+	for i, name := range []string{"delete", "transfer"} {
+		toolTurn.Choices[0].Message.ToolCalls = append(toolTurn.Choices[0].Message.ToolCalls, llm.ToolCall{
+			ID: fmt.Sprintf("call_%d", i+2), Type: "function", Function: llm.ToolCallFunction{Name: name, Arguments: `{}`},
+		})
+	}
+	mockClient := new(MockLLM)
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.MatchedBy(func(req llm.ChatCompletionRequest) bool {
+		return req.Model == "reviewed-model"
+	})).Return(toolTurn, nil).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Done"), nil).Once()
+
+	// Swarm hooks run before those of the context; later hooks miss a vetoed tool's start
+	recorder := &hookRecorder{}
+	sw := NewSwarmWithClient(mockClient, &Config{Hooks: []Hooks{&toolPolicy{}}})
+	ctx := WithHooks(context.Background(), recorder)
+	resp, err := sw.Run(ctx, agent, []llm.Message{{Role: llm.RoleUser, Content: "Help"}}, nil, "", false, false, 3, true)
+	assert.NoError(t, err)
+	mockClient.AssertExpectations(t)
+
+	assert.Equal(t, "Paris", lookedUp)
+	assert.Equal(t, `{}`, resp.Messages[0].ToolCalls[0].Function.Arguments)
+	if assert.Len(t, resp.ToolResults, 3) {
+		assert.ErrorIs(t, resp.ToolResults[1].Result.Error, ErrVetoed)
+	}
+	assert.Equal(t, []string{
+		"run start Triage",
+		"llm request reviewed-model",
+		"llm response",
+		"tool start lookup",
+		"tool end lookup found",
+		"tool end delete Error: vetoed by hook: deleting is not allowed",
+		"tool start transfer",
+		"tool end transfer transferred",
+		"variables map[city:Paris]",
+		"handoff Triage -> Specialist",
+		"llm request reviewed-model",
+		"llm response",
+		"run end Specialist",
+	}, recorder.events)
+
+	// A vetoed request ends the run
+	recorder = &hookRecorder{}
+	sw = NewSwarmWithClient(new(MockLLM), &Config{Hooks: []Hooks{recorder, &vetoRequests{}}})
+	_, err = sw.Run(context.Background(), agent, []llm.Message{{Role: llm.RoleUser, Content: "Help"}}, nil, "", false, false, 1, true)
+	assert.ErrorIs(t, err, ErrVetoed)
+	assert.Equal(t, []string{
+		"run start Triage",
+		"llm request test-model",
+		"error vetoed by hook: over budget",
+		"run end Triage",
+	}, recorder.events)
+}
+
+// TestStreamingHooks tests that streamed runs report their start, handoffs, errors and end
+func TestStreamingHooks(t *testing.T) {
+	specialist := &Agent{Name: "Specialist", Model: "specialist-model", Instructions: "You are a specialist."}
+	agent := &Agent{Name: "Triage", Model: "test-model", Functions: []AgentFunction{{
+		Name: "transfer",
+		Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			contextVariables["topic"] = "billing"
+			return Result{Agent: specialist, Data: "transferred"}
+		},
+	}}}
+
+	var sent []llm.ChatCompletionRequest
+	mockClient := new(MockLLM)
+	mockClient.On("CreateChatCompletionStream", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		sent = append(sent, args.Get(1).(llm.ChatCompletionRequest))
+	}).Return(&scriptedStream{chunks: []llm.ChatCompletionResponse{singleToolTurn("transfer")}}, nil).Once()
+	mockClient.On("CreateChatCompletionStream", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		sent = append(sent, args.Get(1).(llm.ChatCompletionRequest))
+	}).Return(&scriptedStream{chunks: []llm.ChatCompletionResponse{assistantReply("Hi")}}, nil).Once()
+
+	recorder := &hookRecorder{}
+	sw := NewSwarmWithClient(mockClient, &Config{Hooks: []Hooks{recorder}})
+	err := sw.StreamingResponse(context.Background(), agent, []llm.Message{{Role: llm.RoleUser, Content: "Help"}}, nil, "", &DefaultStreamHandler{}, false)
+	assert.NoError(t, err)
+	mockClient.AssertExpectations(t)
+
+	assert.Equal(t, []string{
+		"run start Triage",
+		"llm request test-model",
+		"llm response",
+		"tool start transfer",
+		"tool end transfer transferred",
+		"variables map[topic:billing]",
+		"handoff Triage -> Specialist",
+		"llm request specialist-model",
+		"llm response",
+		"run end Specialist",
+	}, recorder.events)
+	if assert.Len(t, sent, 2) {
+		assert.Equal(t, "You are a specialist.", sent[1].Messages[0].Content)
+		assert.Empty(t, sent[1].Tools)
+	}
+
+	// A stream that cannot be opened reports the error before the end
+	mockClient = new(MockLLM)
+	mockClient.On("CreateChatCompletionStream", mock.Anything, mock.Anything).
+		Return((*scriptedStream)(nil), &llm.ProviderError{Kind: llm.ErrAuthentication}).Once()
+	recorder = &hookRecorder{}
+	sw = NewSwarmWithClient(mockClient, &Config{Hooks: []Hooks{recorder}, RetryPolicy: &RetryPolicy{}})
+	err = sw.StreamingResponse(context.Background(), agent, []llm.Message{{Role: llm.RoleUser, Content: "Help"}}, nil, "", &DefaultStreamHandler{}, false)
+	assert.ErrorIs(t, err, llm.ErrAuthentication)
+	assert.Equal(t, []string{
+		"run start Triage",
+		"llm request test-model",
+		"error : authentication failed",
+		"run end Triage",
+	}, recorder.events)
+}
+
+// vetoRequests is a Hooks vetoing every LLM request
+type vetoRequests struct {
+	DefaultHooks
+}
+
+func (v *vetoRequests) OnLLMRequest(ctx context.Context, agent *Agent, req *llm.ChatCompletionRequest) error {
+	return errors.New("over budget")
+}
+
+// TestWorkflowAndGraphHooks tests that hooks observe workflow transitions, graph events and the runs they make
+func TestWorkflowAndGraphHooks(t *testing.T) {
+	mockClient := new(MockLLM)
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Final answer: done"), nil).Twice()
+
+	recorder := &hookRecorder{}
+	wf := NewWorkflow("", llm.OpenAI, CollaborativeWorkflow)
+	wf.swarm = NewMockSwarm(mockClient)
+	wf.SetHooks(recorder)
+	wf.AddAgent(&Agent{Name: "Writer", Model: "test-model"})
+	_, err := wf.Execute("Writer", "Write a haiku")
+	assert.NoError(t, err)
+	assert.Equal(t, "transition start->Writer", recorder.events[0])
+	assert.Contains(t, recorder.events, "run start Writer")
+	assert.Equal(t, "transition Writer->end", recorder.events[len(recorder.events)-1])
+
+	recorder = &hookRecorder{}
+	g := NewGraph("research", "")
+	g.Hooks = []Hooks{recorder}
+	g.AddAgentNode("write", "Write", &Agent{Name: "Writer", Model: "test-model"})
+	g.Swarm = NewMockSwarm(mockClient)
+	assert.NoError(t, g.SetEntryPoint("write"))
+	assert.NoError(t, g.AddExitPoint("write"))
+	_, err = g.ExecuteGraph(context.Background(), GraphState{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"graph_start ->",
+		"node_enter_write write->",
+		"run start Writer",
+		"llm request test-model",
+		"llm response",
+		"run end Writer",
+		"node_exit_write write->",
+		"graph_complete write->",
+	}, recorder.events)
+}
+
+// TestWorkflowSettersCopyConfig tests that workflow setters leave the Swarm's Config as it was
+func TestWorkflowSettersCopyConfig(t *testing.T) {
+	swarmHooks, workflowHooks := &hookRecorder{}, &hookRecorder{}
+	config := &Config{DefaultModel: "test-model", Hooks: []Hooks{swarmHooks}}
+	wf := NewWorkflow("", llm.OpenAI, CollaborativeWorkflow)
+	wf.swarm = NewSwarmWithClient(new(MockLLM), config)
+
+	metrics := &metricsRecorder{}
+	wf.SetHooks(workflowHooks)
+	wf.SetMetrics(metrics)
+	assert.Equal(t, []Hooks{swarmHooks, workflowHooks}, wf.swarm.config.Hooks)
+	assert.Equal(t, metrics, wf.swarm.config.Metrics)
+	assert.Equal(t, "test-model", wf.swarm.config.DefaultModel)
+	assert.Equal(t, []Hooks{swarmHooks}, config.Hooks)
+	assert.Nil(t, config.Metrics)
+}
+
 // TestFunctionToDefinition tests the FunctionToDefinition function
 func TestFunctionToDefinition(t *testing.T) {
 	af := AgentFunction{
 		Name:        "testFunction",
 		Description: "A test function",
-		Parameters: map[string]interface{}{
-			"type": "object",
-			"properties": map[string]interface{}{
-				"arg1": map[string]interface{}{
-					"type":        "string",
-					"description": "Argument 1",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"arg1": map[string]interface{}{
+					"type":        "string",
+					"description": "Argument 1",
+				},
+			},
+			"required": []interface{}{"arg1"},
+		},
+	}
+
+	def := FunctionToDefinition(af)
+
+	assert.Equal(t, af.Name, def.Name)
+	assert.Equal(t, af.Description, def.Description)
+	assert.Equal(t, af.Parameters, def.Parameters)
+}
+
+type weatherArgs struct {
+	City string `json:"city" jsonschema:"description=The city to look up"`
+	Days int    `json:"days,omitempty" jsonschema:"description=Number of forecast days"`
+}
+
+// TestNewTypedFunction tests schema generation and argument decoding for typed tools
+func TestNewTypedFunction(t *testing.T) {
+	var received weatherArgs
+	af := NewTypedFunction("get_weather", "Get the weather",
+		func(ctx context.Context, args weatherArgs, contextVariables map[string]interface{}) (string, error) {
+			received = args
+			return "sunny in " + args.City, nil
+		})
+
+	assert.Equal(t, "object", af.Parameters["type"])
+	assert.Equal(t, []interface{}{"city"}, af.Parameters["required"])
+	properties := af.Parameters["properties"].(map[string]interface{})
+	assert.Equal(t, "The city to look up", properties["city"].(map[string]interface{})["description"])
+	assert.Equal(t, "integer", properties["days"].(map[string]interface{})["type"])
+
+	result := af.Function(map[string]interface{}{"city": "Paris", "days": float64(3)}, nil)
+	assert.True(t, result.Success)
+	assert.Equal(t, "sunny in Paris", result.Data)
+	assert.Equal(t, weatherArgs{City: "Paris", Days: 3}, received)
+
+	// Arguments of the wrong type are reported instead of reaching the handler
+	result = af.Function(map[string]interface{}{"city": 42}, nil)
+	assert.False(t, result.Success)
+	assert.Error(t, result.Error)
+}
+
+// TestNewTypedFunctionHandoff tests that a typed tool returning an agent hands off to it
+func TestNewTypedFunctionHandoff(t *testing.T) {
+	target := &Agent{Name: "SalesAgent"}
+	af := NewTypedFunction("transfer_to_sales", "Transfer to sales",
+		func(ctx context.Context, args struct{}, contextVariables map[string]interface{}) (*Agent, error) {
+			return target, nil
+		})
+
+	result := af.Function(map[string]interface{}{}, nil)
+	assert.Equal(t, target, result.Agent)
+	assert.Equal(t, map[string]interface{}{}, af.Parameters["properties"])
+}
+
+// TestNewTypedFunctionResultAsJSON tests that struct results reach the model as JSON
+func TestNewTypedFunctionResultAsJSON(t *testing.T) {
+	af := NewTypedFunction("city_info", "Describe a city",
+		func(ctx context.Context, args weatherArgs, contextVariables map[string]interface{}) (cityInfo, error) {
+			return cityInfo{Name: args.City, Population: 2100000}, nil
+		})
+	agent := &Agent{Name: "TestAgent", Functions: []AgentFunction{af}}
+	toolCall := llm.ToolCall{ID: "call_1", Type: "function", Function: llm.ToolCallFunction{Name: "city_info", Arguments: `{"city": "Paris"}`}}
+
+	response, err := NewSwarm("test-api-key", llm.OpenAI).handleToolCall(context.Background(), &toolCall, agent, map[string]interface{}{}, false)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"name": "Paris", "population": 2100000}`, response.Messages[0].Content)
+}
+
+// TestHandleToolCall tests the handleToolCall method
+func TestHandleToolCall(t *testing.T) {
+	sw := NewSwarm("test-api-key", llm.OpenAI)
+	ctx := context.Background()
+
+	toolCall := llm.ToolCall{
+		ID:   "testFunction",
+		Type: "function",
+		Function: struct {
+			Name      string "json:\"name\""
+			Arguments string "json:\"arguments\""
+		}{
+			Name:      "testFunction",
+			Arguments: `{"arg1": "value1"}`,
+		},
+	}
+
+	agentFunction := AgentFunction{
+		Name:        "testFunction",
+		Description: "A test function",
+		Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			return Result{
+				Success: true,
+				Data:    "Function executed successfully",
+			}
+		},
+	}
+
+	agent := &Agent{
+		Name:      "TestAgent",
+		Functions: []AgentFunction{agentFunction},
+	}
+
+	contextVariables := map[string]interface{}{}
+
+	response, err := sw.handleToolCall(ctx, &toolCall, agent, contextVariables, false)
+
+	assert.NoError(t, err)
+	assert.Len(t, response.Messages, 1)
+	assert.Equal(t, llm.RoleTool, response.Messages[0].Role)
+	assert.Equal(t, "testFunction", response.Messages[0].ToolCallID)
+	assert.Equal(t, "Function executed successfully", response.Messages[0].Content)
+}
+
+// TestHandleToolCallFunctionNotFound tests handleToolCall when function is not found
+func TestHandleToolCallFunctionNotFound(t *testing.T) {
+	sw := NewSwarm("test-api-key", llm.OpenAI)
+	ctx := context.Background()
+
+	toolCall := llm.ToolCall{
+		ID:   "nonExistentFunction",
+		Type: "function",
+		Function: struct {
+			Name      string "json:\"name\""
+			Arguments string "json:\"arguments\""
+		}{
+			Name:      "nonExistentFunction",
+			Arguments: `{}`,
+		},
+	}
+
+	agent := &Agent{
+		Name:      "TestAgent",
+		Functions: []AgentFunction{},
+	}
+
+	contextVariables := map[string]interface{}{}
+
+	response, err := sw.handleToolCall(ctx, &toolCall, agent, contextVariables, false)
+
+	assert.NoError(t, err)
+	assert.Len(t, response.Messages, 1)
+	assert.Equal(t, llm.RoleTool, response.Messages[0].Role)
+	assert.Contains(t, response.Messages[0].Content, "Error: Tool nonExistentFunction not found.")
+}
+
+// TestRun tests the Run method
+func TestRun(t *testing.T) {
+	mockClient := new(MockLLM)
+	sw := NewMockSwarm(mockClient)
+	ctx := context.Background()
+
+	agentFunction := AgentFunction{
+		Name:        "testFunction",
+		Description: "A test function",
+		Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			return Result{
+				Success: true,
+				Data:    "Function executed successfully",
+			}
+		},
+	}
+
+	agent := &Agent{
+		Name:      "TestAgent",
+		Functions: []AgentFunction{agentFunction},
+		Model:     "test-model",
+	}
+
+	messages := []llm.Message{
+		{Role: llm.RoleUser, Content: "Hello"},
+	}
+
+	// Mock the LLM API response
+	mockResponse1 := llm.ChatCompletionResponse{
+		Choices: []llm.Choice{
+			{
+				Message: llm.Message{
+					Role:    llm.RoleAssistant,
+					Content: "",
+					ToolCalls: []llm.ToolCall{
+						{
+							ID:   "testFunction",
+							Type: "function",
+							Function: struct {
+								Name      string "json:\"name\""
+								Arguments string "json:\"arguments\""
+							}{
+								Name:      "testFunction",
+								Arguments: `{"arg1": "value1"}`,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	mockResponse2 := llm.ChatCompletionResponse{
+		Choices: []llm.Choice{
+			{
+				Message: llm.Message{
+					Role:    llm.RoleAssistant,
+					Content: "Here is the result of the function.",
+				},
+			},
+		},
+	}
+
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(mockResponse1, nil).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(mockResponse2, nil).Once()
+
+	response, err := sw.Run(ctx, agent, messages, nil, "", false, false, 5, true)
+
+	assert.NoError(t, err)
+	assert.Len(t, response.Messages, 3)
+	assert.Equal(t, "TestAgent", response.Agent.Name)
+	assert.Equal(t, "Here is the result of the function.", response.Messages[2].Content)
+}
+
+// TestRunChainedToolCalls tests that Run keeps looping while the model requests tools
+func TestRunChainedToolCalls(t *testing.T) {
+	mockClient := new(MockLLM)
+	sw := NewMockSwarm(mockClient)
+	ctx := context.Background()
+
+	calls := 0
+	agent := &Agent{
+		Name:  "TestAgent",
+		Model: "test-model",
+		Functions: []AgentFunction{{
+			Name: "step",
+			Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				calls++
+				return Result{Success: true, Data: "ok"}
+			},
+		}},
+	}
+
+	toolTurn := llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{
+			Message: llm.Message{
+				Role: llm.RoleAssistant,
+				ToolCalls: []llm.ToolCall{{
+					ID:       "call_1",
+					Type:     "function",
+					Function: llm.ToolCallFunction{Name: "step", Arguments: `{}`},
+				}},
+			},
+		}},
+	}
+	finalTurn := llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{
+			Message: llm.Message{Role: llm.RoleAssistant, Content: "done"},
+		}},
+	}
+
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(toolTurn, nil).Twice()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(finalTurn, nil).Once()
+
+	response, err := sw.Run(ctx, agent, []llm.Message{{Role: llm.RoleUser, Content: "Hello"}}, nil, "", false, false, 5, true)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Len(t, response.Messages, 5)
+	assert.Len(t, response.ToolResults, 2)
+	assert.Equal(t, "done", response.Messages[4].Content)
+
+	// Tools must stay attached on the turns that follow tool results
+	for _, call := range mockClient.Calls {
+		req := call.Arguments.Get(1).(llm.ChatCompletionRequest)
+		assert.Len(t, req.Tools, 1)
+	}
+}
+
+// TestRunSameToolTwice tests that results of repeated calls to one tool keep their call IDs
+func TestRunSameToolTwice(t *testing.T) {
+	mockClient := new(MockLLM)
+	sw := NewMockSwarm(mockClient)
+	ctx := context.Background()
+
+	agent := &Agent{
+		Name:  "TestAgent",
+		Model: "test-model",
+		Functions: []AgentFunction{{
+			Name: "lookup",
+			Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				return Result{Success: true, Data: args["city"]}
+			},
+		}},
+	}
+
+	toolTurn := llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{
+			Message: llm.Message{
+				Role: llm.RoleAssistant,
+				ToolCalls: []llm.ToolCall{
+					{ID: "call_a", Type: "function", Function: llm.ToolCallFunction{Name: "lookup", Arguments: `{"city":"Paris"}`}},
+					{ID: "call_b", Type: "function", Function: llm.ToolCallFunction{Name: "lookup", Arguments: `{"city":"Rome"}`}},
+				},
+			},
+		}},
+	}
+	finalTurn := llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{
+			Message: llm.Message{Role: llm.RoleAssistant, Content: "done"},
+		}},
+	}
+
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(toolTurn, nil).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(finalTurn, nil).Once()
+
+	response, err := sw.Run(ctx, agent, []llm.Message{{Role: llm.RoleUser, Content: "Weather?"}}, nil, "", false, false, 5, true)
+
+	assert.NoError(t, err)
+	assert.Equal(t, llm.Message{Role: llm.RoleTool, Name: "lookup", Content: "Paris", ToolCallID: "call_a"}, response.Messages[1])
+	assert.Equal(t, llm.Message{Role: llm.RoleTool, Name: "lookup", Content: "Rome", ToolCallID: "call_b"}, response.Messages[2])
+}
+
+// TestRunParallelToolCalls tests concurrent tool execution with a concurrency limit
+func TestRunParallelToolCalls(t *testing.T) {
+	mockClient := new(MockLLM)
+	sw := NewMockSwarm(mockClient)
+	ctx := context.Background()
+
+	var running, maxRunning int32
+	agent := &Agent{
+		Name:  "TestAgent",
+		Model: "test-model",
+		Functions: []AgentFunction{{
+			Name: "lookup",
+			Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				n := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+				for {
+					m := atomic.LoadInt32(&maxRunning)
+					if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+
+				city := args["city"].(string)
+				if city == "Atlantis" {
+					return Result{Error: errors.New("unknown city")}
+				}
+				contextVariables["last_"+city] = true
+				return Result{Success: true, Data: city}
+			},
+		}},
+	}
+	agent.WithParallelToolCalls(true).WithMaxParallelToolCalls(2)
+
+	cities := []string{"Paris", "Rome", "Atlantis", "Oslo"}
+	var calls []llm.ToolCall
+	for i, city := range cities {
+		calls = append(calls, llm.ToolCall{
+			ID:       fmt.Sprintf("call_%d", i),
+			Type:     "function",
+			Function: llm.ToolCallFunction{Name: "lookup", Arguments: fmt.Sprintf(`{"city":%q}`, city)},
+		})
+	}
+	toolTurn := llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{Message: llm.Message{Role: llm.RoleAssistant, ToolCalls: calls}}},
+	}
+	finalTurn := llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{Message: llm.Message{Role: llm.RoleAssistant, Content: "done"}}},
+	}
+
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(toolTurn, nil).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(finalTurn, nil).Once()
+
+	response, err := sw.Run(ctx, agent, []llm.Message{{Role: llm.RoleUser, Content: "Weather?"}}, nil, "", false, false, 5, true)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxRunning))
+
+	// Results are recorded in the order of the calls, failures included
+	assert.Len(t, response.ToolResults, 4)
+	for i, city := range cities {
+		msg := response.Messages[i+1]
+		assert.Equal(t, llm.RoleTool, msg.Role)
+		assert.Equal(t, fmt.Sprintf("call_%d", i), msg.ToolCallID)
+		if city == "Atlantis" {
+			assert.Equal(t, "Error: unknown city", msg.Content)
+			assert.False(t, response.ToolResults[i].Result.Success)
+			assert.Error(t, response.ToolResults[i].Result.Error)
+		} else {
+			assert.Equal(t, city, msg.Content)
+			assert.True(t, response.ToolResults[i].Result.Success)
+			assert.Equal(t, true, response.ContextVariables["last_"+city])
+		}
+	}
+}
+
+// TestRunMaxTurns tests that Run stops after maxTurns completions
+func TestRunMaxTurns(t *testing.T) {
+	mockClient := new(MockLLM)
+	sw := NewMockSwarm(mockClient)
+	ctx := context.Background()
+
+	agent := &Agent{
+		Name:  "TestAgent",
+		Model: "test-model",
+		Functions: []AgentFunction{{
+			Name: "step",
+			Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				return Result{Success: true, Data: "ok"}
+			},
+		}},
+	}
+
+	toolTurn := llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{
+			Message: llm.Message{
+				Role: llm.RoleAssistant,
+				ToolCalls: []llm.ToolCall{{
+					ID:       "call_1",
+					Type:     "function",
+					Function: llm.ToolCallFunction{Name: "step", Arguments: `{}`},
+				}},
+			},
+		}},
+	}
+
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(toolTurn, nil)
+
+	response, err := sw.Run(ctx, agent, []llm.Message{{Role: llm.RoleUser, Content: "Hello"}}, nil, "", false, false, 2, true)
+
+	assert.NoError(t, err)
+	mockClient.AssertNumberOfCalls(t, "CreateChatCompletion", 2)
+	assert.Len(t, response.Messages, 4)
+}
+
+// TestRunHandoff tests that Run continues with the agent a tool hands off to
+func TestRunHandoff(t *testing.T) {
+	mockClient := new(MockLLM)
+	sw := NewMockSwarm(mockClient)
+	ctx := context.Background()
+
+	spanishAgent := &Agent{
+		Name:         "SpanishAgent",
+		Model:        "test-model",
+		Instructions: "Habla solo en español.",
+	}
+	englishAgent := &Agent{
+		Name:         "EnglishAgent",
+		Model:        "test-model",
+		Instructions: "Only speak English.",
+		Functions: []AgentFunction{{
+			Name: "transfer_to_spanish_agent",
+			Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				return Result{Success: true, Data: "Transferred", Agent: spanishAgent}
+			},
+		}},
+	}
+
+	handoffTurn := llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{
+			Message: llm.Message{
+				Role: llm.RoleAssistant,
+				ToolCalls: []llm.ToolCall{{
+					ID:       "call_1",
+					Type:     "function",
+					Function: llm.ToolCallFunction{Name: "transfer_to_spanish_agent", Arguments: `{}`},
+				}},
+			},
+		}},
+	}
+	finalTurn := llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{
+			Message: llm.Message{Role: llm.RoleAssistant, Content: "¡Hola!"},
+		}},
+	}
+
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(handoffTurn, nil).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(finalTurn, nil).Once()
+
+	response, err := sw.Run(ctx, englishAgent, []llm.Message{{Role: llm.RoleUser, Content: "Hola"}}, nil, "", false, false, 5, true)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "SpanishAgent", response.Agent.Name)
+	assert.Equal(t, "¡Hola!", response.Messages[len(response.Messages)-1].Content)
+
+	// The second turn must use the new agent's instructions and tools
+	req := mockClient.Calls[1].Arguments.Get(1).(llm.ChatCompletionRequest)
+	assert.Equal(t, llm.RoleSystem, req.Messages[0].Role)
+	assert.Equal(t, "Habla solo en español.", req.Messages[0].Content)
+	assert.Empty(t, req.Tools)
+}
+
+// TestRunFunctionCallError tests the Run method when function call returns an error
+func TestRunFunctionCallError(t *testing.T) {
+	mockClient := new(MockLLM)
+	sw := NewMockSwarm(mockClient)
+	ctx := context.Background()
+
+	agentFunction := AgentFunction{
+		Name:        "testFunction",
+		Description: "A test function",
+		Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			return Result{
+				Success: true,
+				Data:    "Function executed successfully",
+			}
+		},
+	}
+
+	agent := &Agent{
+		Name:      "TestAgent",
+		Functions: []AgentFunction{agentFunction},
+		Model:     "test-model",
+	}
+
+	messages := []llm.Message{
+		{Role: llm.RoleUser, Content: "Hello"},
+	}
+
+	// Mock the LLM API to return an error
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{}, errors.New("API error"))
+
+	response, err := sw.Run(ctx, agent, messages, nil, "", false, false, 5, true)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "API error")
+	assert.Len(t, response.Messages, 0)
+}
+
+// TestRunRepairsInvalidToolArguments tests that arguments failing the schema are sent back to the model instead of reaching the tool
+func TestRunRepairsInvalidToolArguments(t *testing.T) {
+	mockClient := new(MockLLM)
+	sw := NewMockSwarm(mockClient)
+	ctx := context.Background()
+
+	var received []map[string]interface{}
+	agent := &Agent{
+		Name:  "TestAgent",
+		Model: "test-model",
+		Functions: []AgentFunction{{
+			Name: "getWeather",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"city": map[string]interface{}{"type": "string"},
+				},
+				"required": []string{"city"},
+			},
+			Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				received = append(received, args)
+				return Result{Success: true, Data: "sunny"}
+			},
+		}},
+	}
+
+	toolTurn := func(id, arguments string) llm.ChatCompletionResponse {
+		return llm.ChatCompletionResponse{
+			Choices: []llm.Choice{{
+				Message: llm.Message{
+					Role: llm.RoleAssistant,
+					ToolCalls: []llm.ToolCall{{
+						ID:       id,
+						Type:     "function",
+						Function: llm.ToolCallFunction{Name: "getWeather", Arguments: arguments},
+					}},
 				},
+			}},
+		}
+	}
+
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(toolTurn("call_1", `{"city": 42}`), nil).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(toolTurn("call_2", `{"city": "Paris"}`), nil).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{Message: llm.Message{Role: llm.RoleAssistant, Content: "It is sunny in Paris"}}},
+	}, nil).Once()
+
+	response, err := sw.Run(ctx, agent, []llm.Message{{Role: llm.RoleUser, Content: "Weather?"}}, nil, "", false, false, 5, true)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]interface{}{{"city": "Paris"}}, received)
+	assert.Len(t, response.ToolResults, 2)
+	assert.ErrorIs(t, response.ToolResults[0].Result.Error, ErrInvalidToolArguments)
+	assert.True(t, response.ToolResults[1].Result.Success)
+
+	// The model sees a structured error answering the invalid call
+	var feedback map[string]interface{}
+	assert.Equal(t, "call_1", response.Messages[1].ToolCallID)
+	assert.NoError(t, json.Unmarshal([]byte(response.Messages[1].Content), &feedback))
+	assert.Equal(t, "invalid_arguments", feedback["error"])
+	assert.Equal(t, "getWeather", feedback["tool"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"path": "$.city", "message": "expected string, got integer"}}, feedback["details"])
+}
+
+// TestRunToolRepairLimit tests that Run gives up once the model keeps sending unusable arguments
+func TestRunToolRepairLimit(t *testing.T) {
+	mockClient := new(MockLLM)
+	sw := NewMockSwarm(mockClient)
+	sw.config = &Config{MaxToolRepairAttempts: 1}
+	ctx := context.Background()
+
+	calls := 0
+	agent := &Agent{
+		Name:  "TestAgent",
+		Model: "test-model",
+		Functions: []AgentFunction{{
+			Name: "getWeather",
+			Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				calls++
+				return Result{Success: true, Data: "sunny"}
+			},
+		}},
+	}
+
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{
+			Message: llm.Message{
+				Role: llm.RoleAssistant,
+				ToolCalls: []llm.ToolCall{{
+					ID:       "call_1",
+					Type:     "function",
+					Function: llm.ToolCallFunction{Name: "getWeather", Arguments: `{"city": "Par`},
+				}},
+			},
+		}},
+	}, nil)
+
+	response, err := sw.Run(ctx, agent, []llm.Message{{Role: llm.RoleUser, Content: "Weather?"}}, nil, "", false, false, 5, true)
+
+	assert.ErrorIs(t, err, ErrToolRepairLimitExceeded)
+	assert.ErrorIs(t, err, ErrInvalidToolArguments)
+	assert.Equal(t, 0, calls)
+	assert.Len(t, mockClient.Calls, 2)
+	assert.Len(t, response.ToolResults, 2)
+	assert.Contains(t, response.Messages[1].Content, `"error":"invalid_json"`)
+}
+
+// singleToolTurn returns a completion asking for one call to the named tool
+func singleToolTurn(name string) llm.ChatCompletionResponse {
+	return llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{
+			Message: llm.Message{
+				Role: llm.RoleAssistant,
+				ToolCalls: []llm.ToolCall{{
+					ID:       "call_1",
+					Type:     "function",
+					Function: llm.ToolCallFunction{Name: name, Arguments: `{}`},
+				}},
+			},
+		}},
+	}
+}
+
+// TestRunToolCancelledWithContext tests that a context-aware tool sees the run's context being cancelled
+func TestRunToolCancelledWithContext(t *testing.T) {
+	mockClient := new(MockLLM)
+	sw := NewMockSwarm(mockClient)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	agent := &Agent{
+		Name:  "TestAgent",
+		Model: "test-model",
+		Functions: []AgentFunction{{
+			Name: "fetch",
+			FunctionWithContext: func(ctx context.Context, args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				cancel()
+				<-ctx.Done()
+				return Result{Success: false, Error: ctx.Err()}
+			},
+		}},
+	}
+
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(singleToolTurn("fetch"), nil).Once()
+
+	response, err := sw.Run(ctx, agent, []llm.Message{{Role: llm.RoleUser, Content: "Fetch"}}, nil, "", false, false, 5, true)
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, mockClient.Calls, 1)
+	assert.Len(t, response.ToolResults, 1)
+	assert.ErrorIs(t, response.ToolResults[0].Result.Error, context.Canceled)
+}
+
+// TestRunToolTimeout tests that Swarm stops waiting for a tool that outlives its timeout, even if it ignores its context
+func TestRunToolTimeout(t *testing.T) {
+	mockClient := new(MockLLM)
+	sw := NewMockSwarm(mockClient)
+	ctx := context.Background()
+
+	release := make(chan struct{})
+	defer close(release)
+
+	agent := &Agent{
+		Name:  "TestAgent",
+		Model: "test-model",
+		Functions: []AgentFunction{{
+			Name:    "slow",
+			Timeout: 20 * time.Millisecond,
+			Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				<-release
+				contextVariables["late"] = true
+				return Result{Success: true, Data: "too late"}
+			},
+		}},
+	}
+
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(singleToolTurn("slow"), nil).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{Message: llm.Message{Role: llm.RoleAssistant, Content: "gave up"}}},
+	}, nil).Once()
+
+	vars := map[string]interface{}{}
+	response, err := sw.Run(ctx, agent, []llm.Message{{Role: llm.RoleUser, Content: "Go"}}, vars, "", false, false, 5, true)
+
+	assert.NoError(t, err)
+	assert.ErrorIs(t, response.ToolResults[0].Result.Error, context.DeadlineExceeded)
+	assert.Contains(t, response.Messages[1].Content, "deadline exceeded")
+	assert.NotContains(t, vars, "late")
+}
+
+// TestRunToolRetries tests that a failing tool is retried up to its MaxRetries
+func TestRunToolRetries(t *testing.T) {
+	mockClient := new(MockLLM)
+	sw := NewMockSwarm(mockClient)
+	ctx := context.Background()
+
+	attempts := 0
+	agent := &Agent{
+		Name:  "TestAgent",
+		Model: "test-model",
+		Functions: []AgentFunction{{
+			Name:         "flaky",
+			MaxRetries:   2,
+			RetryBackoff: time.Millisecond,
+			Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				attempts++
+				if attempts < 3 {
+					return Result{Success: false, Error: errors.New("temporary failure")}
+				}
+				return Result{Success: true, Data: "ok"}
+			},
+		}},
+	}
+
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(singleToolTurn("flaky"), nil).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{Message: llm.Message{Role: llm.RoleAssistant, Content: "done"}}},
+	}, nil).Once()
+
+	response, err := sw.Run(ctx, agent, []llm.Message{{Role: llm.RoleUser, Content: "Go"}}, nil, "", false, false, 5, true)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.True(t, response.ToolResults[0].Result.Success)
+	assert.Equal(t, "ok", response.Messages[1].Content)
+}
+
+// TestNewTypedFunctionReceivesContext tests that typed handlers get the run's context
+func TestNewTypedFunctionReceivesContext(t *testing.T) {
+	type ctxKey struct{}
+	fn := NewTypedFunction("whoami", "Report the caller",
+		func(ctx context.Context, args struct{}, contextVariables map[string]interface{}) (string, error) {
+			return ctx.Value(ctxKey{}).(string), nil
+		})
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "caller-1")
+	result := callAgentFunction(ctx, &fn, map[string]interface{}{}, map[string]interface{}{})
+
+	assert.NoError(t, result.Error)
+	assert.Equal(t, "caller-1", result.Data)
+}
+
+type cityInfo struct {
+	Name       string `json:"name"`
+	Population int    `json:"population"`
+}
+
+// assistantReply returns a completion answering with the given text
+func assistantReply(content string) llm.ChatCompletionResponse {
+	return llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{Message: llm.Message{Role: llm.RoleAssistant, Content: content}}},
+	}
+}
+
+// TestRunStructured tests that RunStructured requests a schema, re-prompts on invalid output and decodes the result
+func TestRunStructured(t *testing.T) {
+	mockClient := new(MockLLM)
+	sw := NewMockSwarm(mockClient)
+	ctx := context.Background()
+
+	agent := &Agent{Name: "TestAgent", Model: "test-model"}
+
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply(`{"name": "Paris"}`), nil).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("```json\n{\"name\": \"Paris\", \"population\": 2100000}\n```"), nil).Once()
+
+	city, response, err := RunStructured[cityInfo](ctx, sw, agent, []llm.Message{{Role: llm.RoleUser, Content: "Describe Paris"}}, nil, "", 3)
+
+	assert.NoError(t, err)
+	assert.Equal(t, cityInfo{Name: "Paris", Population: 2100000}, city)
+
+	// The invalid reply is answered with a correction before the second attempt
+	assert.Len(t, response.Messages, 3)
+	assert.Equal(t, llm.RoleUser, response.Messages[1].Role)
+	assert.Contains(t, response.Messages[1].Content, "could not be used")
+
+	req := mockClient.Calls[0].Arguments.Get(1).(llm.ChatCompletionRequest)
+	assert.Equal(t, llm.ResponseFormatJSONSchema, req.ResponseFormat.Type)
+	assert.Equal(t, "cityInfo", req.ResponseFormat.Name)
+	assert.Equal(t, []interface{}{"name", "population"}, req.ResponseFormat.Schema["required"])
+}
+
+// TestRunStructuredGivesUp tests that RunStructured fails once its attempts are used up
+func TestRunStructuredGivesUp(t *testing.T) {
+	mockClient := new(MockLLM)
+	sw := NewMockSwarm(mockClient)
+	ctx := context.Background()
+
+	agent := &Agent{Name: "TestAgent", Model: "test-model"}
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Paris is lovely."), nil)
+
+	_, _, err := RunStructured[cityInfo](ctx, sw, agent, []llm.Message{{Role: llm.RoleUser, Content: "Describe Paris"}}, nil, "", 2)
+
+	assert.ErrorIs(t, err, ErrInvalidStructuredOutput)
+	assert.Len(t, mockClient.Calls, 2)
+}
+
+// TestRunAggregatesUsage tests that Run sums token usage across turns, broken down by agent and model
+func TestRunAggregatesUsage(t *testing.T) {
+	mockClient := new(MockLLM)
+	sw := NewMockSwarm(mockClient)
+	ctx := context.Background()
+
+	writer := &Agent{Name: "Writer", Model: "small-model"}
+	supervisor := &Agent{
+		Name:  "Supervisor",
+		Model: "large-model",
+		Functions: []AgentFunction{{
+			Name: "transfer_to_writer",
+			Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				return Result{Success: true, Data: "Transferred", Agent: writer}
 			},
-			"required": []interface{}{"arg1"},
-		},
+		}},
 	}
 
-	def := FunctionToDefinition(af)
+	handoffTurn := singleToolTurn("transfer_to_writer")
+	handoffTurn.Usage = llm.Usage{PromptTokens: 100, CompletionTokens: 10, TotalTokens: 110}
+	finalTurn := assistantReply("Draft ready")
+	finalTurn.Usage = llm.Usage{PromptTokens: 40, CompletionTokens: 20}
 
-	assert.Equal(t, af.Name, def.Name)
-	assert.Equal(t, af.Description, def.Description)
-	assert.Equal(t, af.Parameters, def.Parameters)
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(handoffTurn, nil).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(finalTurn, nil).Once()
+
+	response, err := sw.Run(ctx, supervisor, []llm.Message{{Role: llm.RoleUser, Content: "Write"}}, nil, "", false, false, 5, true)
+
+	assert.NoError(t, err)
+	usage := response.Usage
+	assert.Equal(t, 2, usage.Calls)
+	assert.Equal(t, 140, usage.PromptTokens)
+	assert.Equal(t, 30, usage.CompletionTokens)
+	assert.Equal(t, 170, usage.TotalTokens)
+	assert.Equal(t, llm.Usage{PromptTokens: 100, CompletionTokens: 10, TotalTokens: 110}, usage.ByAgent["Supervisor"])
+	assert.Equal(t, llm.Usage{PromptTokens: 40, CompletionTokens: 20, TotalTokens: 60}, usage.ByModel["small-model"])
+	assert.Equal(t, []string{"Supervisor", "Writer"}, []string{usage.Turns[0].Agent, usage.Turns[1].Agent})
+
+	// Merging keeps the breakdowns
+	var total Usage
+	total.Merge(usage)
+	total.Merge(usage)
+	assert.Equal(t, 340, total.TotalTokens)
+	assert.Equal(t, 4, total.Calls)
+	assert.Equal(t, 220, total.ByAgent["Supervisor"].TotalTokens)
 }
 
-// TestHandleToolCall tests the handleToolCall method
-func TestHandleToolCall(t *testing.T) {
-	sw := NewSwarm("test-api-key", llm.OpenAI)
-	ctx := context.Background()
+// scriptedStream replays a fixed list of chunks
+type scriptedStream struct {
+	chunks []llm.ChatCompletionResponse
+}
 
-	toolCall := llm.ToolCall{
-		ID:   "testFunction",
-		Type: "function",
-		Function: struct {
-			Name      string "json:\"name\""
-			Arguments string "json:\"arguments\""
-		}{
-			Name:      "testFunction",
-			Arguments: `{"arg1": "value1"}`,
-		},
+func (s *scriptedStream) Recv() (llm.ChatCompletionResponse, error) {
+	if len(s.chunks) == 0 {
+		return llm.ChatCompletionResponse{}, io.EOF
 	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return chunk, nil
+}
 
-	agentFunction := AgentFunction{
-		Name:        "testFunction",
-		Description: "A test function",
-		Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
-			return Result{
-				Success: true,
-				Data:    "Function executed successfully",
-			}
-		},
+func (s *scriptedStream) Close() error { return nil }
+
+// usageRecorder is a StreamHandler that records the usage it is given
+type usageRecorder struct {
+	DefaultStreamHandler
+	usage Usage
+}
+
+func (h *usageRecorder) OnUsage(usage Usage) { h.usage = usage }
+
+// TestStreamingResponseReportsUsage tests that streamed usage reaches handlers implementing UsageHandler
+func TestStreamingResponseReportsUsage(t *testing.T) {
+	mockClient := new(MockLLM)
+	sw := NewMockSwarm(mockClient)
+	ctx := context.Background()
+
+	agent := &Agent{Name: "Streamer", Model: "test-model"}
+	stream := &scriptedStream{chunks: []llm.ChatCompletionResponse{
+		{Choices: []llm.Choice{{Message: llm.Message{Role: llm.RoleAssistant, Content: "Hel"}}}},
+		{Choices: []llm.Choice{{Message: llm.Message{Content: "lo"}}}},
+		{Usage: llm.Usage{PromptTokens: 12, CompletionTokens: 2, TotalTokens: 14}},
+	}}
+	mockClient.On("CreateChatCompletionStream", mock.Anything, mock.Anything).Return(stream, nil).Once()
+
+	handler := &usageRecorder{}
+	err := sw.StreamingResponse(ctx, agent, []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}, nil, "", handler, false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, handler.usage.Calls)
+	assert.Equal(t, 14, handler.usage.TotalTokens)
+	assert.Equal(t, 14, handler.usage.ByAgent["Streamer"].TotalTokens)
+}
+
+// TestModelCatalogLookup tests matching models by name, alias and prefix
+func TestModelCatalogLookup(t *testing.T) {
+	catalog := NewModelCatalog(
+		ModelInfo{Name: "gpt-4o", Aliases: []string{"chatgpt-4o-latest"}, ContextWindow: 128000},
+		ModelInfo{Name: "gpt-4o-mini", ContextWindow: 64000},
+		ModelInfo{Name: "llama3.1", ContextWindow: 8192},
+	)
+
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{"gpt-4o", "gpt-4o"},
+		{"GPT-4o", "gpt-4o"},
+		{"chatgpt-4o-latest", "gpt-4o"},
+		{"gpt-4o-2024-08-06", "gpt-4o"},
+		{"gpt-4o-mini-2024-07-18", "gpt-4o-mini"},
+		{"llama3.1:8b", "llama3.1"},
+		{"gpt-4oo", ""},
+		{"claude-3-opus", ""},
+	}
+	for _, tt := range tests {
+		info, ok := catalog.Lookup(tt.model)
+		assert.Equal(t, tt.want != "", ok, tt.model)
+		assert.Equal(t, tt.want, info.Name, tt.model)
 	}
 
-	agent := &Agent{
-		Name:      "TestAgent",
-		Functions: []AgentFunction{agentFunction},
+	// Replacing an entry drops its old aliases
+	catalog.Add(ModelInfo{Name: "gpt-4o", ContextWindow: 100})
+	_, ok := catalog.Lookup("chatgpt-4o-latest")
+	assert.False(t, ok)
+	info, _ := catalog.Lookup("gpt-4o")
+	assert.Equal(t, 100, info.ContextWindow)
+	assert.Len(t, catalog.Models(), 3)
+}
+
+// TestDefaultModelCatalogLookup tests that dated and preview names of the default catalog find their model
+func TestDefaultModelCatalogLookup(t *testing.T) {
+	catalog := DefaultModelCatalog()
+	tests := []struct {
+		model   string
+		want    string
+		context int
+	}{
+		{"gpt-4", "gpt-4", 8192},
+		{"gpt-4-0613", "gpt-4", 8192},
+		{"gpt-4-32k-0613", "gpt-4-32k", 32768},
+		{"gpt-4-turbo", "gpt-4-turbo", 128000},
+		{"gpt-4-turbo-2024-04-09", "gpt-4-turbo", 128000},
+		{"gpt-4-turbo-preview", "gpt-4-turbo-preview", 128000},
+		{"gpt-4-0125-preview", "gpt-4-turbo-preview", 128000},
+		{"gpt-4-1106-preview", "gpt-4-turbo-preview", 128000},
+		{"o3-mini-2025-01-31", "o3-mini", 200000},
+	}
+	for _, tt := range tests {
+		info, ok := catalog.Lookup(tt.model)
+		assert.True(t, ok, tt.model)
+		assert.Equal(t, tt.want, info.Name, tt.model)
+		assert.Equal(t, tt.context, info.ContextWindow, tt.model)
 	}
 
-	contextVariables := map[string]interface{}{}
+	info, _ := catalog.Lookup("gpt-4-0125-preview")
+	assert.True(t, info.Capabilities.JSONMode)
+}
 
-	response, err := sw.handleToolCall(ctx, &toolCall, agent, contextVariables, false)
+// TestModelCatalogLoad tests reading catalogs from JSON and YAML files
+func TestModelCatalogLoad(t *testing.T) {
+	dir := t.TempDir()
 
+	jsonPath := filepath.Join(dir, "models.json")
+	err := os.WriteFile(jsonPath, []byte(`{"models": [
+		{"name": "house-model", "aliases": ["house"], "context_window": 32000, "max_output_tokens": 2048,
+		 "input_price": 1, "output_price": 2, "capabilities": {"tools": true, "streaming": true}}
+	]}`), 0o644)
 	assert.NoError(t, err)
-	assert.Len(t, response.Messages, 1)
-	assert.Equal(t, llm.RoleAssistant, response.Messages[0].Role)
-	assert.Equal(t, "Function executed successfully", response.Messages[0].Content)
+
+	yamlPath := filepath.Join(dir, "models.yaml")
+	err = os.WriteFile(yamlPath, []byte(`models:
+  - name: gpt-4o
+    context_window: 1000
+    capabilities:
+      json_mode: true
+`), 0o644)
+	assert.NoError(t, err)
+
+	catalog, err := LoadModelCatalog(jsonPath)
+	assert.NoError(t, err)
+	info, ok := catalog.Lookup("house")
+	assert.True(t, ok)
+	assert.Equal(t, ModelInfo{
+		Name: "house-model", Aliases: []string{"house"}, ContextWindow: 32000, MaxOutputTokens: 2048,
+		InputPrice: 1, OutputPrice: 2, Capabilities: ModelCapabilities{Tools: true, Streaming: true},
+	}, info)
+
+	// Loading into the default catalog overrides its entries
+	defaults := DefaultModelCatalog()
+	assert.NoError(t, defaults.LoadFile(yamlPath))
+	info, _ = defaults.Lookup("gpt-4o")
+	assert.Equal(t, 1000, info.ContextWindow)
+	assert.False(t, info.Capabilities.Tools)
+
+	assert.Error(t, catalog.LoadJSON([]byte(`{"models": [{"context_window": 10}]}`)))
+	_, err = LoadModelCatalog(filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
 }
 
-// TestHandleToolCallFunctionNotFound tests handleToolCall when function is not found
-func TestHandleToolCallFunctionNotFound(t *testing.T) {
-	sw := NewSwarm("test-api-key", llm.OpenAI)
+// TestModelInfoCost tests turning usage into dollars
+func TestModelInfoCost(t *testing.T) {
+	info := ModelInfo{InputPrice: 2, OutputPrice: 10, CachedInputPrice: 1}
+	cost := info.Cost(llm.Usage{PromptTokens: 1000000, CompletionTokens: 100000, CachedPromptTokens: 400000})
+	assert.InDelta(t, 0.6*2+0.4*1+0.1*10, cost, 1e-9)
+
+	// Without a cached price cached tokens cost the same as the others
+	info.CachedInputPrice = 0
+	cost = info.Cost(llm.Usage{PromptTokens: 1000000, CachedPromptTokens: 400000})
+	assert.InDelta(t, 2.0, cost, 1e-9)
+}
+
+// TestRunUsesModelCatalog tests that Run applies the catalog's limits and prices
+func TestRunUsesModelCatalog(t *testing.T) {
+	mockClient := new(MockLLM)
+	sw := NewMockSwarm(mockClient)
+	sw.config = &Config{Models: NewModelCatalog(
+		ModelInfo{Name: "priced-model", MaxOutputTokens: 4096, InputPrice: 3, OutputPrice: 15,
+			Capabilities: ModelCapabilities{Tools: true}},
+		ModelInfo{Name: "plain-model", MaxOutputTokens: 1024},
+	)}
 	ctx := context.Background()
+	messages := []llm.Message{{Role: llm.RoleUser, Content: "Hello"}}
 
-	toolCall := llm.ToolCall{
-		ID:   "nonExistentFunction",
-		Type: "function",
-		Function: struct {
-			Name      string "json:\"name\""
-			Arguments string "json:\"arguments\""
-		}{
-			Name:      "nonExistentFunction",
-			Arguments: `{}`,
-		},
+	reply := assistantReply("Hi")
+	reply.Usage = llm.Usage{PromptTokens: 1000, CompletionTokens: 200}
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.MatchedBy(func(req llm.ChatCompletionRequest) bool {
+		return req.MaxTokens == 4096
+	})).Return(reply, nil).Once()
+
+	response, err := sw.Run(ctx, &Agent{Name: "Priced", Model: "priced-model"}, messages, nil, "", false, false, 1, true)
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.006, response.Usage.Cost, 1e-9)
+	assert.InDelta(t, 0.006, response.Usage.Turns[0].Cost, 1e-9)
+
+	// Tools on a model without tool support are rejected before any call
+	toolAgent := &Agent{
+		Name:  "Tooled",
+		Model: "plain-model",
+		Functions: []AgentFunction{{
+			Name: "noop",
+			Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				return Result{Success: true}
+			},
+		}},
 	}
+	_, err = sw.Run(ctx, toolAgent, messages, nil, "", false, false, 1, true)
+	assert.ErrorIs(t, err, ErrUnsupportedModelFeature)
 
-	agent := &Agent{
-		Name:      "TestAgent",
-		Functions: []AgentFunction{},
+	err = sw.StreamingResponse(ctx, &Agent{Name: "Streamer", Model: "plain-model"}, messages, nil, "", nil, false)
+	assert.ErrorIs(t, err, ErrUnsupportedModelFeature)
+
+	mockClient.AssertExpectations(t)
+}
+
+// truncationHistory builds a conversation of three turns; the second one calls a tool
+func truncationHistory() []llm.Message {
+	call := llm.ToolCall{ID: "call_1", Type: "function"}
+	call.Function.Name = "lookup"
+	call.Function.Arguments = "{}"
+	return []llm.Message{
+		{Role: llm.RoleSystem, Content: "system"},
+		{Role: llm.RoleUser, Content: "first"},
+		{Role: llm.RoleAssistant, Content: "reply one"},
+		{Role: llm.RoleUser, Content: "second"},
+		{Role: llm.RoleAssistant, ToolCalls: []llm.ToolCall{call}},
+		{Role: llm.RoleTool, Content: strings.Repeat("x", 100), ToolCallID: "call_1"},
+		{Role: llm.RoleAssistant, Content: "reply two"},
+		{Role: llm.RoleUser, Content: "third"},
 	}
+}
 
-	contextVariables := map[string]interface{}{}
+// TestTruncationStrategies tests the built-in strategies keep whole turns
+func TestTruncationStrategies(t *testing.T) {
+	count := func(msg llm.Message) int { return 10 + len(msg.Content) }
+	contents := func(messages []llm.Message) []string {
+		var out []string
+		for _, msg := range messages {
+			out = append(out, string(msg.Role)+":"+msg.Content)
+		}
+		return out
+	}
+	history := truncationHistory()
 
-	response, err := sw.handleToolCall(ctx, &toolCall, agent, contextVariables, false)
+	// Dropping the first turn is not enough, so the tool turn goes with it
+	trimmed := DropOldestTurns().Truncate(history, 60, count)
+	assert.Equal(t, []string{"system:system", "user:third"}, contents(trimmed))
 
-	assert.NoError(t, err)
-	assert.Len(t, response.Messages, 1)
-	assert.Equal(t, llm.RoleAssistant, response.Messages[0].Role)
-	assert.Contains(t, response.Messages[0].Content, "Error: Tool nonExistentFunction not found.")
+	trimmed = DropOldestTurns().Truncate(history, 200, count)
+	assert.Equal(t, "user:second", contents(trimmed)[1])
+	assert.Len(t, trimmed, 6)
+
+	trimmed = KeepFirstTurn().Truncate(history, 100, count)
+	assert.Equal(t, []string{"system:system", "user:first", "assistant:reply one", "user:third"}, contents(trimmed))
+
+	// Emptying the old tool result is enough; the call and its result both stay
+	trimmed = DropToolResultsFirst(nil).Truncate(history, 200, count)
+	assert.Len(t, trimmed, len(history))
+	assert.Equal(t, removedToolResult, trimmed[5].Content)
+	assert.Equal(t, "call_1", trimmed[5].ToolCallID)
+	assert.Equal(t, strings.Repeat("x", 100), history[5].Content, "input must not be modified")
+
+	trimmed = DropToolResultsFirst(nil).Truncate(history, 60, count)
+	assert.Equal(t, []string{"system:system", "user:third"}, contents(trimmed))
 }
 
-// TestRun tests the Run method
-func TestRun(t *testing.T) {
+// TestRunTruncatesHistory tests that Run trims requests to the model's context window
+func TestRunTruncatesHistory(t *testing.T) {
 	mockClient := new(MockLLM)
 	sw := NewMockSwarm(mockClient)
+	sw.SetTokenCounter(func(text string) int { return len(text) })
+	sw.config = &Config{
+		Models:     NewModelCatalog(ModelInfo{Name: "small-model", ContextWindow: 120, MaxOutputTokens: 20}),
+		Truncation: DropOldestTurns(),
+	}
 	ctx := context.Background()
+	agent := &Agent{Name: "Agent", Model: "small-model"}
 
-	agentFunction := AgentFunction{
-		Name:        "testFunction",
-		Description: "A test function",
+	var sent []llm.Message
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		sent = args.Get(1).(llm.ChatCompletionRequest).Messages
+	}).Return(assistantReply("done"), nil).Once()
+
+	history := truncationHistory()[1:]
+	response, err := sw.Run(ctx, agent, history, nil, "", false, false, 1, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []llm.Message{{Role: llm.RoleUser, Content: "third"}}, sent)
+	assert.Equal(t, "done", response.Messages[0].Content)
+
+	// Nothing fits when the latest turn alone is too long
+	history = append(history, llm.Message{Role: llm.RoleUser, Content: strings.Repeat("y", 200)})
+	_, err = sw.Run(ctx, agent, history, nil, "", false, false, 1, true)
+	assert.ErrorIs(t, err, ErrMessageTooLong)
+
+	mockClient.AssertExpectations(t)
+}
+
+// TestStreamingTruncatesEveryTurn tests that the request after a streamed tool
+// call is fitted to the context window and seen by the hooks, like the first
+func TestStreamingTruncatesEveryTurn(t *testing.T) {
+	mockClient := new(MockLLM)
+	recorder := &hookRecorder{}
+	sw := NewMockSwarm(mockClient)
+	sw.SetTokenCounter(func(text string) int { return len(text) })
+	sw.config = &Config{
+		Models:     NewModelCatalog(ModelInfo{Name: "small-model", ContextWindow: 1000, MaxOutputTokens: 20, Capabilities: ModelCapabilities{Tools: true, Streaming: true}}),
+		Truncation: DropOldestTurns(),
+		Hooks:      []Hooks{recorder},
+	}
+	agent := &Agent{Name: "Agent", Model: "small-model", Functions: []AgentFunction{{
+		Name: "lookup",
 		Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
-			return Result{
-				Success: true,
-				Data:    "Function executed successfully",
-			}
+			return Result{Data: "found"}
 		},
+	}}}
+
+	var sent [][]llm.Message
+	record := func(args mock.Arguments) {
+		sent = append(sent, args.Get(1).(llm.ChatCompletionRequest).Messages)
 	}
+	mockClient.On("CreateChatCompletionStream", mock.Anything, mock.Anything).Run(record).
+		Return(&scriptedStream{chunks: []llm.ChatCompletionResponse{singleToolTurn("lookup")}}, nil).Once()
+	mockClient.On("CreateChatCompletionStream", mock.Anything, mock.Anything).Run(record).
+		Return(&scriptedStream{chunks: []llm.ChatCompletionResponse{assistantReply("done")}}, nil).Once()
 
-	agent := &Agent{
-		Name:      "TestAgent",
-		Functions: []AgentFunction{agentFunction},
-		Model:     "test-model",
+	history := []llm.Message{
+		{Role: llm.RoleUser, Content: strings.Repeat("x", 900)},
+		{Role: llm.RoleAssistant, Content: "reply one"},
+		{Role: llm.RoleUser, Content: "second"},
 	}
+	err := sw.StreamingResponse(context.Background(), agent, history, nil, "", &DefaultStreamHandler{}, false)
+	assert.NoError(t, err)
+	mockClient.AssertExpectations(t)
 
-	messages := []llm.Message{
-		{Role: llm.RoleUser, Content: "Hello"},
+	if assert.Len(t, sent, 2) {
+		for _, messages := range sent {
+			for _, msg := range messages {
+				assert.NotEqual(t, history[0].Content, msg.Content)
+			}
+		}
+		assert.Equal(t, llm.RoleTool, sent[1][len(sent[1])-1].Role)
 	}
+	assert.Equal(t, []string{
+		"run start Agent",
+		"llm request small-model",
+		"llm response",
+		"tool start lookup",
+		"tool end lookup found",
+		"llm request small-model",
+		"llm response",
+		"run end Agent",
+	}, recorder.events)
+}
 
-	// Mock the LLM API response
-	mockResponse1 := llm.ChatCompletionResponse{
-		Choices: []llm.Choice{
-			{
-				Message: llm.Message{
-					Role:    llm.RoleAssistant,
-					Content: "",
-					ToolCalls: []llm.ToolCall{
-						{
-							ID:   "testFunction",
-							Type: "function",
-							Function: struct {
-								Name      string "json:\"name\""
-								Arguments string "json:\"arguments\""
-							}{
-								Name:      "testFunction",
-								Arguments: `{"arg1": "value1"}`,
-							},
-						},
-					},
-				},
-			},
+// TestStreamingHandoff tests that a tool returning an agent hands the stream off to it
+func TestStreamingHandoff(t *testing.T) {
+	specialist := &Agent{Name: "Specialist", Instructions: "You are a specialist."}
+	agent := &Agent{Name: "Triage", Model: "test-model", Functions: []AgentFunction{{
+		Name: "transfer",
+		Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			return Result{Agent: specialist, Data: "transferred"}
 		},
+	}}}
+
+	var sent []llm.ChatCompletionRequest
+	record := func(args mock.Arguments) {
+		sent = append(sent, args.Get(1).(llm.ChatCompletionRequest))
 	}
+	mockClient := new(MockLLM)
+	mockClient.On("CreateChatCompletionStream", mock.Anything, mock.Anything).Run(record).
+		Return(&scriptedStream{chunks: []llm.ChatCompletionResponse{singleToolTurn("transfer")}}, nil).Once()
+	mockClient.On("CreateChatCompletionStream", mock.Anything, mock.Anything).Run(record).
+		Return(&scriptedStream{chunks: []llm.ChatCompletionResponse{assistantReply("Hi")}}, nil).Once()
 
-	mockResponse2 := llm.ChatCompletionResponse{
-		Choices: []llm.Choice{
-			{
-				Message: llm.Message{
-					Role:    llm.RoleAssistant,
-					Content: "Here is the result of the function.",
-				},
-			},
-		},
+	// The specialist has no model of its own, so it gets the default
+	recorder := &completionRecorder{}
+	sw := NewSwarmWithClient(mockClient, &Config{DefaultModel: "default-model"})
+	err := sw.StreamingResponse(context.Background(), agent, []llm.Message{{Role: llm.RoleUser, Content: "Help"}}, nil, "", recorder, false)
+	assert.NoError(t, err)
+	mockClient.AssertExpectations(t)
+
+	assert.Equal(t, "Specialist", recorder.message.Name)
+	if assert.Len(t, sent, 2) {
+		assert.Len(t, sent[0].Tools, 1)
+		assert.Equal(t, "You are a specialist.", sent[1].Messages[0].Content)
+		assert.Equal(t, "default-model", sent[1].Model)
+		assert.Empty(t, sent[1].Tools)
 	}
+}
 
-	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(mockResponse1, nil).Once()
-	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(mockResponse2, nil).Once()
+// TestStreamingHandoffUsage tests that streamed usage is booked under each turn's model
+func TestStreamingHandoffUsage(t *testing.T) {
+	specialist := &Agent{Name: "Specialist", Model: "gpt-4o-mini"}
+	agent := &Agent{Name: "Triage", Model: "gpt-4o", Functions: []AgentFunction{{
+		Name: "transfer",
+		Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			return Result{Agent: specialist, Data: "transferred"}
+		},
+	}}}
 
-	response, err := sw.Run(ctx, agent, messages, nil, "", false, false, 5, true)
+	// The tool runs as soon as its call is complete, so the usage comes with it
+	transfer := singleToolTurn("transfer")
+	transfer.Usage = llm.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}
+	mockClient := new(MockLLM)
+	mockClient.On("CreateChatCompletionStream", mock.Anything, mock.Anything).
+		Return(&scriptedStream{chunks: []llm.ChatCompletionResponse{transfer}}, nil).Once()
+	mockClient.On("CreateChatCompletionStream", mock.Anything, mock.Anything).
+		Return(&scriptedStream{chunks: []llm.ChatCompletionResponse{
+			assistantReply("Hi"),
+			{Usage: llm.Usage{PromptTokens: 20, CompletionTokens: 3, TotalTokens: 23}},
+		}}, nil).Once()
 
+	capabilities := ModelCapabilities{Tools: true, Streaming: true}
+	sw := NewSwarmWithClient(mockClient, &Config{Models: NewModelCatalog(
+		ModelInfo{Name: "gpt-4o", ContextWindow: 128000, InputPrice: 2, OutputPrice: 10, Capabilities: capabilities},
+		ModelInfo{Name: "gpt-4o-mini", ContextWindow: 128000, InputPrice: 1, OutputPrice: 2, Capabilities: capabilities},
+	)})
+	handler := &usageRecorder{}
+	err := sw.StreamingResponse(context.Background(), agent, []llm.Message{{Role: llm.RoleUser, Content: "Help"}}, nil, "", handler, false)
 	assert.NoError(t, err)
-	assert.Len(t, response.Messages, 3)
-	assert.Equal(t, "TestAgent", response.Agent.Name)
-	assert.Equal(t, "Here is the result of the function.", response.Messages[2].Content)
+	mockClient.AssertExpectations(t)
+
+	assert.Equal(t, 15, handler.usage.ByModel["gpt-4o"].TotalTokens)
+	assert.Equal(t, 23, handler.usage.ByModel["gpt-4o-mini"].TotalTokens)
+	assert.Equal(t, 15, handler.usage.ByAgent["Triage"].TotalTokens)
+	assert.Equal(t, 23, handler.usage.ByAgent["Specialist"].TotalTokens)
+	assert.InDelta(t, (10*2+5*10+20*1+3*2)/1e6, handler.usage.Cost, 1e-12)
 }
 
-// TestRunFunctionCallError tests the Run method when function call returns an error
-func TestRunFunctionCallError(t *testing.T) {
-	mockClient := new(MockLLM)
-	sw := NewMockSwarm(mockClient)
+// TestRunRetriesByErrorKind tests that retries follow the provider error kind
+func TestRunRetriesByErrorKind(t *testing.T) {
 	ctx := context.Background()
+	agent := &Agent{Name: "Agent", Model: "test-model"}
+	history := []llm.Message{{Role: llm.RoleUser, Content: "Hello"}}
 
-	agentFunction := AgentFunction{
-		Name:        "testFunction",
-		Description: "A test function",
-		Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
-			return Result{
-				Success: true,
-				Data:    "Function executed successfully",
-			}
-		},
+	newSwarm := func() (*Swarm, *MockLLM) {
+		mockClient := new(MockLLM)
+		sw := NewMockSwarm(mockClient)
+		sw.initialized = true
+		sw.config = &Config{MaxRetries: 2, RetryBackoff: time.Millisecond, RequestTimeout: time.Second}
+		return sw, mockClient
 	}
 
-	agent := &Agent{
-		Name:      "TestAgent",
-		Functions: []AgentFunction{agentFunction},
-		Model:     "test-model",
+	// Authentication errors are not retried
+	sw, mockClient := newSwarm()
+	authErr := &llm.ProviderError{Provider: llm.OpenAI, Kind: llm.ErrAuthentication, StatusCode: 401}
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{}, authErr).Once()
+	_, err := sw.Run(ctx, agent, history, nil, "", false, false, 1, true)
+	assert.ErrorIs(t, err, llm.ErrAuthentication)
+	mockClient.AssertExpectations(t)
+
+	// Server errors are retried, and so are network errors that only mention "not found"
+	sw, mockClient = newSwarm()
+	serverErr := &llm.ProviderError{Provider: llm.OpenAI, Kind: llm.ErrServer, StatusCode: 502}
+	resetErr := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset: not found")}
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{}, serverErr).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{}, resetErr).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Hi"), nil).Once()
+	resp, err := sw.Run(ctx, agent, history, nil, "", false, false, 1, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi", resp.Messages[0].Content)
+	mockClient.AssertExpectations(t)
+
+	// Rate limits fail at once with RateLimitFail
+	sw, mockClient = newSwarm()
+	sw.config.RateLimitStrategy = RateLimitFail
+	rateErr := &llm.ProviderError{Provider: llm.OpenAI, Kind: llm.ErrRateLimited, StatusCode: 429}
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{}, rateErr).Once()
+	_, err = sw.Run(ctx, agent, history, nil, "", false, false, 1, true)
+	assert.ErrorIs(t, err, llm.ErrRateLimited)
+	mockClient.AssertExpectations(t)
+
+	// Connection checks follow the same policy
+	sw, mockClient = newSwarm()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{}, serverErr).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Hi"), nil).Once()
+	assert.NoError(t, sw.ValidateConnection(ctx))
+	mockClient.AssertExpectations(t)
+}
+
+// TestRetryPolicyBackoff tests exponential backoff, its cap and Retry-After
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 2}
+	serverErr := &llm.ProviderError{Kind: llm.ErrServer}
+
+	assert.Equal(t, 100*time.Millisecond, policy.Backoff(1, serverErr))
+	assert.Equal(t, 400*time.Millisecond, policy.Backoff(3, serverErr))
+	assert.Equal(t, time.Second, policy.Backoff(10, serverErr))
+
+	// The provider's Retry-After wins when it is longer
+	rateErr := &llm.ProviderError{Kind: llm.ErrRateLimited, RetryAfter: 5 * time.Second}
+	assert.Equal(t, 5*time.Second, policy.Backoff(1, rateErr))
+
+	// Jitter only ever shortens the wait
+	policy.Jitter = 0.5
+	for i := 0; i < 20; i++ {
+		wait := policy.Backoff(2, serverErr)
+		assert.True(t, wait >= 100*time.Millisecond && wait <= 200*time.Millisecond, wait)
+	}
+}
+
+// TestRunRetriesWithPolicy tests that Run and StreamingResponse retry failed calls under the policy
+func TestRunRetriesWithPolicy(t *testing.T) {
+	ctx := context.Background()
+	agent := &Agent{Name: "Agent", Model: "test-model"}
+	messages := []llm.Message{{Role: llm.RoleUser, Content: "Hello"}}
+	serverErr := &llm.ProviderError{Provider: llm.OpenAI, Kind: llm.ErrServer, StatusCode: 503}
+
+	newSwarm := func(policy RetryPolicy) (*Swarm, *MockLLM) {
+		mockClient := new(MockLLM)
+		sw := NewMockSwarm(mockClient)
+		sw.config = &Config{RetryPolicy: &policy}
+		return sw, mockClient
 	}
 
-	messages := []llm.Message{
-		{Role: llm.RoleUser, Content: "Hello"},
+	sw, mockClient := newSwarm(RetryPolicy{MaxRetries: 2, InitialBackoff: time.Millisecond})
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{}, serverErr).Twice()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Hi"), nil).Once()
+	response, err := sw.Run(ctx, agent, messages, nil, "", false, false, 1, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi", response.Messages[0].Content)
+	mockClient.AssertExpectations(t)
+
+	// Stream creation is retried too
+	sw, mockClient = newSwarm(RetryPolicy{MaxRetries: 1, InitialBackoff: time.Millisecond})
+	stream := &scriptedStream{chunks: []llm.ChatCompletionResponse{
+		{Choices: []llm.Choice{{Message: llm.Message{Role: llm.RoleAssistant, Content: "Hi"}}}},
+	}}
+	mockClient.On("CreateChatCompletionStream", mock.Anything, mock.Anything).Return((*scriptedStream)(nil), serverErr).Once()
+	mockClient.On("CreateChatCompletionStream", mock.Anything, mock.Anything).Return(stream, nil).Once()
+	assert.NoError(t, sw.StreamingResponse(ctx, agent, messages, nil, "", nil, false))
+	mockClient.AssertExpectations(t)
+
+	// A wait longer than the budget ends the retries
+	sw, mockClient = newSwarm(RetryPolicy{MaxRetries: 5, InitialBackoff: time.Millisecond, Budget: time.Second})
+	rateErr := &llm.ProviderError{Provider: llm.OpenAI, Kind: llm.ErrRateLimited, RetryAfter: time.Minute}
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{}, rateErr).Once()
+	_, err = sw.Run(ctx, agent, messages, nil, "", false, false, 1, true)
+	assert.ErrorIs(t, err, ErrRetryBudgetExceeded)
+	assert.ErrorIs(t, err, llm.ErrRateLimited)
+	mockClient.AssertExpectations(t)
+
+	// Cancelling the context ends a wait early
+	sw, mockClient = newSwarm(RetryPolicy{MaxRetries: 1, InitialBackoff: time.Minute})
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{}, serverErr).Once()
+	cancelCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = sw.Run(cancelCtx, agent, messages, nil, "", false, false, 1, true)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	mockClient.AssertExpectations(t)
+}
+
+// TestNewSwarmWithClient tests running agents through a client wrapped with middleware
+func TestNewSwarmWithClient(t *testing.T) {
+	mockClient := new(MockLLM)
+	var seen []string
+	client := llm.Chain(mockClient, llm.RequestMiddleware(
+		func(ctx context.Context, req llm.ChatCompletionRequest) (context.Context, llm.ChatCompletionRequest, error) {
+			seen = append(seen, req.Model)
+			return ctx, req, nil
+		}))
+
+	sw := NewSwarmWithClient(client, nil)
+	assert.True(t, sw.IsInitialized())
+	assert.NotNil(t, sw.config)
+	assert.False(t, NewSwarmWithClient(nil, nil).IsInitialized())
+
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("Hi"), nil).Once()
+	response, err := sw.Run(context.Background(), &Agent{Name: "Agent", Model: "test-model"},
+		[]llm.Message{{Role: llm.RoleUser, Content: "Hello"}}, nil, "", false, false, 1, true)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi", response.Messages[0].Content)
+	assert.Equal(t, []string{"test-model"}, seen)
+	mockClient.AssertExpectations(t)
+}
+
+// TestRunReplaysCassette tests that a recorded agent run replays offline with the same outcome
+func TestRunReplaysCassette(t *testing.T) {
+	mockClient := new(MockLLM)
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(singleToolTurn("lookup"), nil).Once()
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(assistantReply("It is sunny"), nil).Once()
+
+	agent := &Agent{
+		Name:  "Agent",
+		Model: "test-model",
+		Functions: []AgentFunction{{
+			Name: "lookup",
+			Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				return Result{Success: true, Data: "sunny"}
+			},
+		}},
 	}
+	messages := []llm.Message{{Role: llm.RoleUser, Content: "Weather?"}}
 
-	// Mock the LLM API to return an error
-	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(llm.ChatCompletionResponse{}, errors.New("API error"))
+	recorder := cassette.NewRecorder(mockClient)
+	recorded, err := NewSwarmWithClient(recorder, nil).Run(context.Background(), agent, messages, nil, "", false, false, 5, true)
+	assert.NoError(t, err)
+	mockClient.AssertExpectations(t)
 
-	response, err := sw.Run(ctx, agent, messages, nil, "", false, false, 5, true)
+	path := filepath.Join(t.TempDir(), "weather.json")
+	assert.NoError(t, recorder.Save(path))
 
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "API error")
-	assert.Len(t, response.Messages, 0)
+	replayer, err := cassette.LoadReplayer(path, cassette.ReplayOptions{InOrder: true})
+	assert.NoError(t, err)
+	replayed, err := NewSwarmWithClient(replayer, nil).Run(context.Background(), agent, messages, nil, "", false, false, 5, true)
+	assert.NoError(t, err)
+	assert.Equal(t, recorded.Messages, replayed.Messages)
+	assert.Empty(t, replayer.Unused())
 }
 
 // TestProcessAndPrintResponse tests the ProcessAndPrintResponse function
@@ -7,9 +7,11 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/rsaranusc/agentkit/llm"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // LangGraph inspired workflow system
@@ -78,6 +80,9 @@ func (s GraphState) GetBool(key StateKey) (bool, bool) {
 // MessageKey is the default key for storing messages in state
 const MessageKey StateKey = "messages"
 
+// UsageKey is the key under which agent nodes accumulate their token Usage
+const UsageKey StateKey = "usage"
+
 // NodeFunc is a function that processes state and returns updates
 type NodeFunc func(ctx context.Context, state GraphState) (GraphState, error)
 
@@ -114,6 +119,25 @@ type Graph struct {
 	ExitPoints  []NodeID // Optional exit points
 	mutex       sync.RWMutex
 	eventHooks  map[string][]func(state GraphState)
+
+	// Swarm runs the agent nodes. When nil, nodes use a Swarm created from the
+	// api_key and provider in the state, shared by nodes with the same ones.
+	Swarm *Swarm
+
+	// TracerProvider receives spans for the graph and its node visits. When
+	// nil, Swarm's provider is used, then that of the caller's context.
+	TracerProvider trace.TracerProvider
+
+	// Metrics receives the durations of node visits. When nil, Swarm's Metrics
+	// are used, if any.
+	Metrics Metrics
+
+	// Hooks observe the graph's events, passed to OnWorkflowEvent, and the runs
+	// of its nodes. Swarm's Hooks observe the events too.
+	Hooks []Hooks
+
+	swarmsMu sync.Mutex
+	swarms   map[[2]string]*Swarm
 }
 
 // NewGraph creates a new workflow graph
@@ -169,15 +193,7 @@ func (g *Graph) AddAgentNode(id NodeID, name string, agent *Agent) *Node {
 			return state, fmt.Errorf("error unmarshaling messages: %w", err)
 		}
 
-		// Create swarm client if needed
-		apiKey, _ := state.GetString("api_key")
-		providerStr, _ := state.GetString("provider")
-		provider := llm.LLMProvider(providerStr)
-		if provider == "" {
-			provider = llm.OpenAI
-		}
-
-		client := NewSwarm(apiKey, provider)
+		client := g.agentSwarm(state, agent)
 
 		// Extract context variables
 		contextVars := make(map[string]interface{})
@@ -189,7 +205,7 @@ func (g *Graph) AddAgentNode(id NodeID, name string, agent *Agent) *Node {
 		}
 
 		// Run the agent
-		response, err := client.Run(ctx, agent, messages, contextVars, "", false, false, 1, true)
+		response, err := client.Run(ctx, agent, messages, contextVars, "", false, false, 0, true)
 		if err != nil {
 			return state, fmt.Errorf("error running agent: %w", err)
 		}
@@ -201,6 +217,14 @@ func (g *Graph) AddAgentNode(id NodeID, name string, agent *Agent) *Node {
 		newState := state.Clone()
 		newState[MessageKey] = newMessages
 
+		// Accumulate token usage across agent nodes
+		var usage Usage
+		if previous, ok := state[UsageKey].(Usage); ok {
+			usage.Merge(previous)
+		}
+		usage.Merge(response.Usage)
+		newState[UsageKey] = usage
+
 		// Add tool results to state if any
 		if len(response.ToolResults) > 0 {
 			toolResultsMap := make(map[string]interface{})
@@ -311,8 +335,9 @@ func (g *Graph) AddEventHook(event string, hook func(state GraphState)) {
 	g.eventHooks[event] = append(g.eventHooks[event], hook)
 }
 
-// fireEvent triggers event hooks
-func (g *Graph) fireEvent(event string, state GraphState) {
+// fireEvent triggers event hooks, then passes the event to the Hooks of the
+// Swarm and ctx
+func (g *Graph) fireEvent(ctx context.Context, event string, node NodeID, state GraphState) {
 	g.mutex.RLock()
 	hooks, exists := g.eventHooks[event]
 	g.mutex.RUnlock()
@@ -322,20 +347,35 @@ func (g *Graph) fireEvent(event string, state GraphState) {
 			hook(state)
 		}
 	}
+
+	var lifecycle hookList
+	if g.Swarm != nil {
+		lifecycle = g.Swarm.hooks(ctx)
+	} else {
+		lifecycle = hooksFrom(ctx)
+	}
+	lifecycle.workflowEvent(ctx, WorkflowEvent{Name: event, Graph: g.Name, Node: node, State: state})
 }
 
 // ExecuteGraph runs the workflow graph from the entry point
-func (g *Graph) ExecuteGraph(ctx context.Context, initialState GraphState) (GraphState, error) {
+func (g *Graph) ExecuteGraph(ctx context.Context, initialState GraphState) (_ GraphState, err error) {
 	if g.EntryPoint == "" {
 		return initialState, errors.New("no entry point defined for graph")
 	}
 
+	ctx, span := g.tracer(ctx).Start(ctx, "agentkit.graph", trace.WithAttributes(
+		AttrGraph.String(g.Name)))
+	defer func() { endSpan(span, err) }()
+
+	// The graph's hooks also observe the runs its nodes make
+	ctx = WithHooks(ctx, g.Hooks...)
+
 	currentNodeID := g.EntryPoint
 	currentState := initialState
 	visited := make(map[NodeID]int) // Track visited nodes to detect cycles
 
 	// Start execution event
-	g.fireEvent("graph_start", currentState)
+	g.fireEvent(ctx, "graph_start", "", currentState)
 
 	for {
 		// Check for cancellation
@@ -362,19 +402,28 @@ func (g *Graph) ExecuteGraph(ctx context.Context, initialState GraphState) (Grap
 		}
 
 		// Fire node entry event
-		g.fireEvent(fmt.Sprintf("node_enter_%s", currentNodeID), currentState)
+		g.fireEvent(ctx, fmt.Sprintf("node_enter_%s", currentNodeID), currentNodeID, currentState)
 
 		// Execute node process
-		newState, err := node.Process(ctx, currentState)
+		nodeCtx, nodeSpan := g.tracer(ctx).Start(ctx, "agentkit.graph.node", trace.WithAttributes(
+			AttrNode.String(string(currentNodeID)), AttrVisit.Int(visited[currentNodeID])))
+		if node.Agent != nil {
+			nodeSpan.SetAttributes(AttrAgent.String(node.Agent.Name))
+		}
+		nodeStart := time.Now()
+		newState, err := node.Process(nodeCtx, currentState)
+		g.metrics().Record(ctx, MetricGraphNodeDuration, since(nodeStart),
+			Label{LabelGraph, g.Name}, Label{LabelNode, string(currentNodeID)}, outcome(err))
+		endSpan(nodeSpan, err)
 		if err != nil {
-			g.fireEvent("node_error", currentState)
+			g.fireEvent(ctx, "node_error", currentNodeID, currentState)
 			return currentState, fmt.Errorf("error processing node %s: %w", currentNodeID, err)
 		}
 
 		currentState = newState
 
 		// Fire node exit event
-		g.fireEvent(fmt.Sprintf("node_exit_%s", currentNodeID), currentState)
+		g.fireEvent(ctx, fmt.Sprintf("node_exit_%s", currentNodeID), currentNodeID, currentState)
 
 		// Check if we've reached an exit point
 		isExitPoint := false
@@ -386,7 +435,7 @@ func (g *Graph) ExecuteGraph(ctx context.Context, initialState GraphState) (Grap
 		}
 
 		if isExitPoint {
-			g.fireEvent("graph_complete", currentState)
+			g.fireEvent(ctx, "graph_complete", currentNodeID, currentState)
 			return currentState, nil
 		}
 
@@ -438,6 +487,62 @@ func (g *Graph) ExecuteGraph(ctx context.Context, initialState GraphState) (Grap
 	}
 }
 
+// tracer returns the tracer for the graph's spans
+func (g *Graph) tracer(ctx context.Context) trace.Tracer {
+	if g.TracerProvider == nil && g.Swarm != nil {
+		return g.Swarm.tracer(ctx)
+	}
+	return tracerFrom(ctx, g.TracerProvider)
+}
+
+// metrics returns Graph.Metrics, or those of the Graph's Swarm
+func (g *Graph) metrics() Metrics {
+	if g.Metrics != nil {
+		return g.Metrics
+	}
+	if g.Swarm != nil {
+		return g.Swarm.metrics()
+	}
+	return NoopMetrics{}
+}
+
+// agentSwarm returns the Swarm that runs agent nodes. Without Graph.Swarm, the
+// provider comes from the agent, then from the state, and defaults to OpenAI.
+// The Swarm resolves the agent's own Config from there.
+func (g *Graph) agentSwarm(state GraphState, agent *Agent) *Swarm {
+	if g.Swarm != nil {
+		return g.Swarm
+	}
+
+	apiKey, _ := state.GetString("api_key")
+	var provider llm.LLMProvider
+	if agent != nil {
+		provider = agent.Provider
+	}
+	if provider == "" {
+		providerStr, _ := state.GetString("provider")
+		provider = llm.LLMProvider(providerStr)
+	}
+	if provider == "" {
+		provider = llm.OpenAI
+	}
+
+	g.swarmsMu.Lock()
+	defer g.swarmsMu.Unlock()
+	key := [2]string{apiKey, string(provider)}
+	if swarm, ok := g.swarms[key]; ok {
+		return swarm
+	}
+	swarm := NewSwarm(apiKey, provider)
+	if swarm.IsInitialized() {
+		if g.swarms == nil {
+			g.swarms = make(map[[2]string]*Swarm)
+		}
+		g.swarms[key] = swarm
+	}
+	return swarm
+}
+
 // CreateAgentNode is a helper function to create common agent node types
 func CreateAgentNode(g *Graph, id NodeID, name string, instructions string, model string, functions []AgentFunction, provider llm.LLMProvider) *Node {
 	agent := &Agent{
@@ -511,7 +616,8 @@ func CreateRouterNode(g *Graph, id NodeID, destinations map[string]NodeID) *Node
 	return node
 }
 
-// CreateParallelNode creates a node that processes tasks in parallel
+// CreateParallelNode creates a node that processes tasks in parallel. Each
+// branch is traced as a child of the node's span.
 func CreateParallelNode(g *Graph, id NodeID, parallelProcesses []NodeFunc) *Node {
 	parallelFunc := func(ctx context.Context, state GraphState) (GraphState, error) {
 		var wg sync.WaitGroup
@@ -523,7 +629,10 @@ func CreateParallelNode(g *Graph, id NodeID, parallelProcesses []NodeFunc) *Node
 			wg.Add(1)
 			go func(idx int, processFunc NodeFunc) {
 				defer wg.Done()
-				result, err := processFunc(ctx, state.Clone())
+				branchCtx, span := tracerFrom(ctx, nil).Start(ctx, "agentkit.graph.branch", trace.WithAttributes(
+					AttrNode.String(string(id)), AttrBranch.Int(idx)))
+				result, err := processFunc(branchCtx, state.Clone())
+				endSpan(span, err)
 				results[idx] = result
 				errors[idx] = err
 			}(i, process)
@@ -539,10 +648,23 @@ func CreateParallelNode(g *Graph, id NodeID, parallelProcesses []NodeFunc) *Node
 			}
 		}
 
-		// Merge results
+		// Merge results. Each branch starts from the usage so far, so only the
+		// turns a branch added are merged into it.
 		mergedState := state.Clone()
+		baseUsage, hasUsage := state[UsageKey].(Usage)
+		var mergedUsage Usage
+		mergedUsage.Merge(baseUsage)
 		for _, result := range results {
 			for k, v := range result {
+				branchUsage, isUsage := v.(Usage)
+				if k == UsageKey && isUsage && len(branchUsage.Turns) >= len(baseUsage.Turns) {
+					for _, turn := range branchUsage.Turns[len(baseUsage.Turns):] {
+						mergedUsage.Add(turn.Agent, turn.Model, turn.Usage, turn.Cost)
+					}
+					hasUsage = true
+					continue
+				}
+
 				// Special handling for messages - combine them
 				if k == MessageKey {
 					// Combine message arrays
@@ -562,6 +684,9 @@ func CreateParallelNode(g *Graph, id NodeID, parallelProcesses []NodeFunc) *Node
 				}
 			}
 		}
+		if hasUsage {
+			mergedState[UsageKey] = mergedUsage
+		}
 
 		return mergedState, nil
 	}
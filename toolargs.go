@@ -0,0 +1,137 @@
+package agentkit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rsaranusc/openai-compatible/jsonschema"
+)
+
+// ToolArgumentsError reports tool call arguments that are not valid JSON or do
+// not match the function's parameter schema. It matches ErrInvalidToolArguments.
+type ToolArgumentsError struct {
+	Tool     string                       // Name of the tool that was called
+	Problems []jsonschema.ValidationError // Schema violations, if the JSON was well formed
+	Err      error                        // JSON decoding error, if any
+}
+
+func (e *ToolArgumentsError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("invalid arguments for tool %s: %v", e.Tool, e.Err)
+	}
+	problems := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		problems[i] = p.Error()
+	}
+	return fmt.Sprintf("invalid arguments for tool %s: %s", e.Tool, strings.Join(problems, "; "))
+}
+
+func (e *ToolArgumentsError) Unwrap() []error {
+	if e.Err != nil {
+		return []error{ErrInvalidToolArguments, e.Err}
+	}
+	return []error{ErrInvalidToolArguments}
+}
+
+// toolMessage renders the error as the tool result sent back to the model, so
+// it can correct the arguments and call the tool again
+func (e *ToolArgumentsError) toolMessage() string {
+	payload := struct {
+		Error   string                       `json:"error"`
+		Tool    string                       `json:"tool"`
+		Message string                       `json:"message"`
+		Details []jsonschema.ValidationError `json:"details,omitempty"`
+	}{
+		Error:   "invalid_arguments",
+		Tool:    e.Tool,
+		Message: "The arguments do not match the tool's parameter schema. Fix the listed problems and call the tool again.",
+		Details: e.Problems,
+	}
+	if e.Err != nil {
+		payload.Error = "invalid_json"
+		payload.Message = fmt.Sprintf("The arguments are not valid JSON (%v). Call the tool again with a JSON object matching its parameter schema.", e.Err)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Sprintf("Error: %v", e)
+	}
+	return string(data)
+}
+
+// parseToolArguments decodes a tool call's arguments and validates them against
+// the function's parameter schema. Empty arguments are treated as an empty object.
+func parseToolArguments(af *AgentFunction, argsJSON string) (map[string]interface{}, error) {
+	if strings.TrimSpace(argsJSON) == "" {
+		argsJSON = "{}"
+	}
+
+	var data interface{}
+	if err := json.Unmarshal([]byte(argsJSON), &data); err != nil {
+		return nil, &ToolArgumentsError{Tool: af.Name, Err: err}
+	}
+
+	if schema, ok := parameterSchema(af.Parameters); ok {
+		if problems := jsonschema.ValidateWithErrors(schema, data); len(problems) > 0 {
+			return nil, &ToolArgumentsError{Tool: af.Name, Problems: problems}
+		}
+	}
+
+	args, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, &ToolArgumentsError{Tool: af.Name, Problems: []jsonschema.ValidationError{{
+			Path:    "$",
+			Message: "arguments must be a JSON object",
+		}}}
+	}
+	return args, nil
+}
+
+// parameterSchema converts a function's parameters to a schema definition.
+// It reports false when there is nothing to validate against or the schema uses
+// constructs the validator does not understand.
+func parameterSchema(params map[string]interface{}) (jsonschema.Definition, bool) {
+	var schema jsonschema.Definition
+	if len(params) == 0 {
+		return schema, false
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return schema, false
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return schema, false
+	}
+	return schema, true
+}
+
+// toolRepairAttempts returns how many times in a row the model may retry a tool
+// call whose arguments were invalid
+func (s *Swarm) toolRepairAttempts() int {
+	if s.config == nil || s.config.MaxToolRepairAttempts == 0 {
+		return DefaultMaxToolRepairAttempts
+	}
+	if s.config.MaxToolRepairAttempts < 0 {
+		return 0
+	}
+	return s.config.MaxToolRepairAttempts
+}
+
+// trackToolRepairs counts consecutive calls with invalid arguments per tool and
+// returns an error once a tool has used up its repair attempts
+func (s *Swarm) trackToolRepairs(results []ToolResult, failures map[string]int) error {
+	limit := s.toolRepairAttempts()
+	for _, r := range results {
+		if !errors.Is(r.Result.Error, ErrInvalidToolArguments) {
+			delete(failures, r.ToolName)
+			continue
+		}
+		failures[r.ToolName]++
+		if failures[r.ToolName] > limit {
+			return fmt.Errorf("%w: %w", ErrToolRepairLimitExceeded, r.Result.Error)
+		}
+	}
+	return nil
+}
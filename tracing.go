@@ -0,0 +1,97 @@
+package agentkit
+
+import (
+	"context"
+
+	"github.com/rsaranusc/agentkit/llm"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of agentkit's spans
+const tracerName = "github.com/rsaranusc/agentkit"
+
+// Span attribute keys. LLM spans follow the OpenTelemetry GenAI conventions.
+const (
+	AttrAgent         = attribute.Key("agentkit.agent")
+	AttrRunID         = attribute.Key("agentkit.run_id")
+	AttrTool          = attribute.Key("agentkit.tool")
+	AttrHandoffTo     = attribute.Key("agentkit.handoff.to")
+	AttrStep          = attribute.Key("agentkit.step")
+	AttrGraph         = attribute.Key("agentkit.graph")
+	AttrNode          = attribute.Key("agentkit.node")
+	AttrVisit         = attribute.Key("agentkit.visit")
+	AttrBranch        = attribute.Key("agentkit.branch")
+	AttrProvider      = attribute.Key("gen_ai.system")
+	AttrRequestModel  = attribute.Key("gen_ai.request.model")
+	AttrResponseModel = attribute.Key("gen_ai.response.model")
+	AttrInputTokens   = attribute.Key("gen_ai.usage.input_tokens")
+	AttrOutputTokens  = attribute.Key("gen_ai.usage.output_tokens")
+	AttrFinishReasons = attribute.Key("gen_ai.response.finish_reasons")
+)
+
+// tracerFrom returns the tracer of provider or, when it is nil, of the span in
+// ctx, so work started under a traced caller joins its trace. Without either,
+// the tracer records nothing.
+func tracerFrom(ctx context.Context, provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = trace.SpanFromContext(ctx).TracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+// tracer returns the tracer for the Swarm's spans: Config.TracerProvider's, or
+// that of the span in ctx
+func (s *Swarm) tracer(ctx context.Context) trace.Tracer {
+	var provider trace.TracerProvider
+	if s.config != nil {
+		provider = s.config.TracerProvider
+	}
+	return tracerFrom(ctx, provider)
+}
+
+// endSpan records err on span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startLLMSpan starts the span of a single request to client
+func (s *Swarm) startLLMSpan(ctx context.Context, client agentClient, req llm.ChatCompletionRequest) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{AttrRequestModel.String(req.Model)}
+	if client.provider != "" {
+		attrs = append(attrs, AttrProvider.String(string(client.provider)))
+	}
+	if id := runID(ctx); id != "" {
+		attrs = append(attrs, AttrRunID.String(id))
+	}
+	return s.tracer(ctx).Start(ctx, "agentkit.llm",
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// recordLLMResponse sets the response model, token usage and finish reasons of
+// a response on its span
+func recordLLMResponse(span trace.Span, resp llm.ChatCompletionResponse) {
+	if resp.Model != "" {
+		span.SetAttributes(AttrResponseModel.String(resp.Model))
+	}
+	if resp.Usage.TotalTokens > 0 || resp.Usage.PromptTokens > 0 {
+		span.SetAttributes(
+			AttrInputTokens.Int(resp.Usage.PromptTokens),
+			AttrOutputTokens.Int(resp.Usage.CompletionTokens),
+		)
+	}
+	var reasons []string
+	for _, choice := range resp.Choices {
+		if choice.FinishReason != "" {
+			reasons = append(reasons, choice.FinishReason)
+		}
+	}
+	if len(reasons) > 0 {
+		span.SetAttributes(AttrFinishReasons.StringSlice(reasons))
+	}
+}
@@ -0,0 +1,190 @@
+package agentkit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/rsaranusc/agentkit/llm"
+)
+
+// removedToolResult replaces the content of tool results dropped by DropToolResultsFirst
+const removedToolResult = "[tool result removed to fit the context window]"
+
+// messageOverheadTokens approximates the tokens a provider adds around each message
+const messageOverheadTokens = 4
+
+// TruncationStrategy shortens a conversation that does not fit a model's
+// context window. Truncate receives the messages of a request, including any
+// leading system messages, and returns messages whose tokens, as measured by
+// count, should add up to no more than budget. Tool calls and the tool results
+// answering them must be kept or dropped together.
+type TruncationStrategy interface {
+	Truncate(messages []llm.Message, budget int, count func(llm.Message) int) []llm.Message
+}
+
+// TruncationFunc adapts a function to the TruncationStrategy interface
+type TruncationFunc func(messages []llm.Message, budget int, count func(llm.Message) int) []llm.Message
+
+// Truncate calls f
+func (f TruncationFunc) Truncate(messages []llm.Message, budget int, count func(llm.Message) int) []llm.Message {
+	return f(messages, budget, count)
+}
+
+// DropOldestTurns returns a strategy that drops the oldest turns until the
+// conversation fits. A turn is a user message and everything up to the next one.
+// Leading system messages and the latest turn are always kept.
+func DropOldestTurns() TruncationStrategy {
+	return TruncationFunc(func(messages []llm.Message, budget int, count func(llm.Message) int) []llm.Message {
+		system, turns := splitTurns(messages)
+		total := countMessages(messages, count)
+		for len(turns) > 1 && total > budget {
+			total -= countMessages(turns[0], count)
+			turns = turns[1:]
+		}
+		return joinTurns(system, turns)
+	})
+}
+
+// KeepFirstTurn returns a strategy that keeps the first turn, which usually
+// states the task, and drops the turns after it, oldest first, until the
+// conversation fits. Leading system messages and the latest turn are always kept.
+func KeepFirstTurn() TruncationStrategy {
+	return TruncationFunc(func(messages []llm.Message, budget int, count func(llm.Message) int) []llm.Message {
+		system, turns := splitTurns(messages)
+		total := countMessages(messages, count)
+		for len(turns) > 2 && total > budget {
+			total -= countMessages(turns[1], count)
+			turns = append(turns[:1:1], turns[2:]...)
+		}
+		return joinTurns(system, turns)
+	})
+}
+
+// DropToolResultsFirst returns a strategy that replaces the content of old tool
+// results with a short note, oldest first, keeping the results of the latest
+// turn. If the conversation still does not fit, fallback is applied to it;
+// a nil fallback uses DropOldestTurns.
+func DropToolResultsFirst(fallback TruncationStrategy) TruncationStrategy {
+	if fallback == nil {
+		fallback = DropOldestTurns()
+	}
+	return TruncationFunc(func(messages []llm.Message, budget int, count func(llm.Message) int) []llm.Message {
+		system, turns := splitTurns(messages)
+		trimmed := cloneMessages(messages)
+		total := countMessages(messages, count)
+
+		// Tool results of the latest turn are still being worked on
+		end := len(trimmed)
+		if len(turns) > 0 {
+			end -= len(turns[len(turns)-1])
+		}
+		for i := len(system); i < end && total > budget; i++ {
+			if trimmed[i].Role != llm.RoleTool || trimmed[i].Content == removedToolResult {
+				continue
+			}
+			before := count(trimmed[i])
+			trimmed[i].Content = removedToolResult
+			total -= before - count(trimmed[i])
+		}
+
+		if total > budget {
+			return fallback.Truncate(trimmed, budget, count)
+		}
+		return trimmed
+	})
+}
+
+// splitTurns splits messages into the leading system messages and turns. Each
+// turn starts at a user message; messages before the first one form a turn of
+// their own. Tool results always stay in the turn of the call they answer.
+func splitTurns(messages []llm.Message) ([]llm.Message, [][]llm.Message) {
+	start := 0
+	for start < len(messages) && messages[start].Role == llm.RoleSystem {
+		start++
+	}
+
+	var turns [][]llm.Message
+	for i := start; i < len(messages); i++ {
+		if len(turns) == 0 || messages[i].Role == llm.RoleUser {
+			turns = append(turns, nil)
+		}
+		turns[len(turns)-1] = append(turns[len(turns)-1], messages[i])
+	}
+	return messages[:start], turns
+}
+
+// joinTurns reassembles the messages split by splitTurns
+func joinTurns(system []llm.Message, turns [][]llm.Message) []llm.Message {
+	messages := append([]llm.Message{}, system...)
+	for _, turn := range turns {
+		messages = append(messages, turn...)
+	}
+	return messages
+}
+
+// countMessages adds up the tokens of messages
+func countMessages(messages []llm.Message, count func(llm.Message) int) int {
+	total := 0
+	for _, msg := range messages {
+		total += count(msg)
+	}
+	return total
+}
+
+// countTokens counts the tokens in text with the configured token counter, or
+// estimates them at four characters per token
+func (s *Swarm) countTokens(text string) int {
+	if s.tokenCounter != nil {
+		return s.tokenCounter(text)
+	}
+	return (len(text) + 3) / 4
+}
+
+// messageTokens counts the tokens of a message, including its tool calls
+func (s *Swarm) messageTokens(msg llm.Message) int {
+	tokens := messageOverheadTokens + s.countTokens(msg.Content)
+	for _, call := range msg.ToolCalls {
+		tokens += s.countTokens(call.Function.Name) + s.countTokens(call.Function.Arguments)
+	}
+	return tokens
+}
+
+// toolTokens counts the tokens of the tool schemas sent with a request
+func (s *Swarm) toolTokens(tools []llm.Tool) int {
+	if len(tools) == 0 {
+		return 0
+	}
+	data, err := json.Marshal(tools)
+	if err != nil {
+		return 0
+	}
+	return s.countTokens(string(data))
+}
+
+// fitContextWindow makes the request fit the model's context window. The
+// budget for messages is what is left after the tool schemas and the tokens
+// reserved for the reply, which are MaxTokens but at most half the window; when
+// the messages exceed it, the configured truncation strategy shortens them.
+// Requests for models without a known context window are left alone.
+func (s *Swarm) fitContextWindow(ctx context.Context, req *llm.ChatCompletionRequest, info ModelInfo) error {
+	if s.config == nil || s.config.Truncation == nil || info.ContextWindow == 0 {
+		return nil
+	}
+
+	reserved := min(req.MaxTokens, info.ContextWindow/2)
+	budget := info.ContextWindow - reserved - s.toolTokens(req.Tools)
+	if countMessages(req.Messages, s.messageTokens) <= budget {
+		return nil
+	}
+
+	trimmed := s.config.Truncation.Truncate(req.Messages, budget, s.messageTokens)
+	if tokens := countMessages(trimmed, s.messageTokens); tokens > budget {
+		return fmt.Errorf("%w: %d tokens for %s after truncation, %d available",
+			ErrMessageTooLong, tokens, req.Model, budget)
+	}
+	s.logger(ctx, false).Info("truncated history to fit the context window",
+		LogKeyModel, req.Model, "from", len(req.Messages), "to", len(trimmed))
+	req.Messages = trimmed
+	return nil
+}
@@ -0,0 +1,94 @@
+package agentkit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/invopop/jsonschema"
+)
+
+// TypedFunc is the handler of a typed tool. It receives the model's arguments
+// decoded into T and returns a value that is sent back to the model.
+type TypedFunc[T any, R any] func(ctx context.Context, args T, contextVariables map[string]interface{}) (R, error)
+
+// NewTypedFunction builds an AgentFunction from a Go argument struct and a
+// typed handler. The parameter schema is generated from T's fields, using their
+// json and jsonschema tags, and the model's arguments are decoded into T before
+// the handler runs with the run's context. A handler returning a Result passes
+// it through unchanged, and one returning an *Agent hands the conversation off
+// to that agent.
+func NewTypedFunction[T any, R any](name, description string, handler TypedFunc[T, R]) AgentFunction {
+	call := func(ctx context.Context, args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		typedArgs, err := decodeArguments[T](args)
+		if err != nil {
+			return Result{Success: false, Error: fmt.Errorf("invalid arguments for %s: %w", name, err)}
+		}
+
+		value, err := handler(ctx, typedArgs, contextVariables)
+		if err != nil {
+			return Result{Success: false, Error: err}
+		}
+
+		switch v := any(value).(type) {
+		case Result:
+			return v
+		case *Agent:
+			return Result{Success: true, Data: fmt.Sprintf("Transferred to %s", v.Name), Agent: v}
+		}
+		return Result{Success: true, Data: value}
+	}
+
+	return AgentFunction{
+		Name:                name,
+		Description:         description,
+		Parameters:          SchemaFor[T](),
+		FunctionWithContext: call,
+		Function: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			return call(context.Background(), args, contextVariables)
+		},
+	}
+}
+
+// SchemaFor generates the JSON Schema of a tool's parameters from the Go type T
+func SchemaFor[T any]() map[string]interface{} {
+	reflector := jsonschema.Reflector{
+		AllowAdditionalProperties: false,
+		DoNotReference:            true,
+	}
+	var v T
+	schema := reflector.Reflect(v)
+
+	// Round-trip through JSON so the schema has the same shape as a hand-written one
+	var params map[string]interface{}
+	data, err := json.Marshal(schema)
+	if err == nil {
+		err = json.Unmarshal(data, &params)
+	}
+	if err != nil || params == nil {
+		params = make(map[string]interface{})
+	}
+	delete(params, "$schema")
+	delete(params, "$id")
+
+	// Providers expect an object schema with properties and required fields
+	params["type"] = "object"
+	if _, ok := params["properties"]; !ok {
+		params["properties"] = map[string]interface{}{}
+	}
+	if _, ok := params["required"]; !ok {
+		params["required"] = []interface{}{}
+	}
+	return params
+}
+
+// decodeArguments converts the arguments parsed from a tool call into T
+func decodeArguments[T any](args map[string]interface{}) (T, error) {
+	var typed T
+	data, err := json.Marshal(args)
+	if err != nil {
+		return typed, err
+	}
+	err = json.Unmarshal(data, &typed)
+	return typed, err
+}
@@ -10,6 +10,7 @@ type Response struct {
 	Agent            *Agent
 	ContextVariables map[string]interface{}
 	ToolResults      []ToolResult // Results from tool calls
+	Usage            Usage        // Tokens used by the LLM calls that produced this response
 }
 
 // ToolResult represents the result of a tool call
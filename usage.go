@@ -0,0 +1,72 @@
+package agentkit
+
+import (
+	"github.com/rsaranusc/agentkit/llm"
+)
+
+// Usage is the token usage of a run: the totals across all of its LLM calls,
+// broken down by agent and by model, and the usage of each call in order. Cost
+// is in US dollars and only covers models with prices in the model catalog.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+	Cost             float64
+	Calls            int                  // Number of LLM calls
+	ByAgent          map[string]llm.Usage // Usage per agent name
+	ByModel          map[string]llm.Usage // Usage per model
+	Turns            []TurnUsage          // Usage of each call, in the order they were made
+}
+
+// TurnUsage is the token usage of a single LLM call
+type TurnUsage struct {
+	Agent string
+	Model string
+	Usage llm.Usage
+	Cost  float64
+}
+
+// Add records the usage and dollar cost of one LLM call made for agent with model
+func (u *Usage) Add(agent, model string, usage llm.Usage, cost float64) {
+	if usage.TotalTokens == 0 {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	u.Turns = append(u.Turns, TurnUsage{Agent: agent, Model: model, Usage: usage, Cost: cost})
+	u.Calls++
+	u.PromptTokens += usage.PromptTokens
+	u.CompletionTokens += usage.CompletionTokens
+	u.TotalTokens += usage.TotalTokens
+	u.Cost += cost
+	u.ByAgent = addUsage(u.ByAgent, agent, usage)
+	u.ByModel = addUsage(u.ByModel, model, usage)
+}
+
+// Merge adds the usage recorded in other
+func (u *Usage) Merge(other Usage) {
+	u.Turns = append(u.Turns, other.Turns...)
+	u.Calls += other.Calls
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.TotalTokens += other.TotalTokens
+	u.Cost += other.Cost
+	for agent, usage := range other.ByAgent {
+		u.ByAgent = addUsage(u.ByAgent, agent, usage)
+	}
+	for model, usage := range other.ByModel {
+		u.ByModel = addUsage(u.ByModel, model, usage)
+	}
+}
+
+// addUsage adds usage to the entry for key, allocating the map if needed
+func addUsage(m map[string]llm.Usage, key string, usage llm.Usage) map[string]llm.Usage {
+	if m == nil {
+		m = make(map[string]llm.Usage)
+	}
+	total := m[key]
+	total.PromptTokens += usage.PromptTokens
+	total.CompletionTokens += usage.CompletionTokens
+	total.TotalTokens += usage.TotalTokens
+	total.CachedPromptTokens += usage.CachedPromptTokens
+	m[key] = total
+	return m
+}
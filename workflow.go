@@ -5,11 +5,13 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"log/slog"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/rsaranusc/agentkit/llm"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // WorkflowType defines the type of agent interaction pattern
@@ -56,6 +58,8 @@ type Workflow struct {
 	cycleCallback func(from, to string) (bool, error) // Callback for cycle detection
 	stepResults   []StepResult                        // Track results of each step
 	currentStep   int                                 // Current step number
+	stepHandlers  []FailureHandler                    // Decide what to do about failed steps
+	config        *Config                             // The workflow's own copy of the Swarm's config, made by the first setter
 }
 
 
@@ -81,17 +85,67 @@ func (wf *Workflow) SetCycleCallback(callback func(from, to string) (bool, error
 	wf.cycleCallback = callback
 }
 
+// SetFailureHandlers sets the handlers consulted when a step fails. They are
+// separate from the Swarm's Config.FailureHandlers, which decide about the LLM
+// calls and tools within each step.
+func (wf *Workflow) SetFailureHandlers(handlers ...FailureHandler) {
+	wf.stepHandlers = handlers
+}
+
+// ownConfig returns the config of the workflow's Swarm for the setters to
+// change. The first call copies it, so a Config shared with other Swarms is
+// left as it was.
+func (wf *Workflow) ownConfig() *Config {
+	if wf.config == nil || wf.swarm.config != wf.config {
+		config := DefaultConfig()
+		if wf.swarm.config != nil {
+			*config = *wf.swarm.config
+		}
+		wf.config = config
+		wf.swarm.config = config
+	}
+	return wf.config
+}
+
+// SetLogger sets the logger receiving the workflow's output and the least
+// severe level it logs; use NewConsoleHandler for colored console output
+func (wf *Workflow) SetLogger(logger *slog.Logger, level LogLevel) {
+	config := wf.ownConfig()
+	config.Logger = logger
+	config.LogLevel = level
+}
+
+// SetTracerProvider sets the provider receiving the spans of the workflow, its
+// steps and the runs they make
+func (wf *Workflow) SetTracerProvider(provider trace.TracerProvider) {
+	wf.ownConfig().TracerProvider = provider
+}
+
+// SetMetrics sets where the measurements of the workflow's steps and the runs
+// they make are recorded
+func (wf *Workflow) SetMetrics(metrics Metrics) {
+	wf.ownConfig().Metrics = metrics
+}
+
+// SetHooks adds hooks observing the workflow's transitions and the runs of its
+// steps, after those of the Swarm's config
+func (wf *Workflow) SetHooks(hooks ...Hooks) {
+	config := wf.ownConfig()
+	config.Hooks = append(config.Hooks[:len(config.Hooks):len(config.Hooks)], hooks...)
+}
+
 // SetCycleHandling sets how cycles should be handled
 func (wf *Workflow) SetCycleHandling(handling CycleHandling) {
 	wf.cycleHandling = handling
 }
 
 
-// logTransition logs agent transitions for debugging
-func (wf *Workflow) logTransition(from, to string, reason string) {
+// logTransition records an agent transition in the routing log and logs it
+func (wf *Workflow) logTransition(ctx context.Context, from, to string, reason string) {
 	log := fmt.Sprintf("Transition: %s -> %s (%s)", from, to, reason)
 	wf.routingLog = append(wf.routingLog, log)
-	fmt.Printf("\033[93m%s\033[0m\n", log)
+	wf.swarm.logger(ctx, false).Info("workflow transition", "from", from, "to", to, "reason", reason)
+	wf.swarm.hooks(ctx).workflowEvent(ctx, WorkflowEvent{Name: "transition", From: from, To: to, Reason: reason})
 }
 
 // GetCurrentAgent returns the currently active agent
@@ -147,8 +201,8 @@ func (wf *Workflow) SetTeamLeader(agentName string, team TeamType) error {
 }
 
 // Execute runs the workflow and returns detailed results including step outcomes
-func (wf *Workflow) Execute(startAgent string, userRequest string) (*WorkflowResult, error) {
-	result := &WorkflowResult{
+func (wf *Workflow) Execute(startAgent string, userRequest string) (result *WorkflowResult, err error) {
+	result = &WorkflowResult{
 		Steps:     make([]StepResult, 0),
 		StartTime: time.Now(),
 	}
@@ -158,12 +212,17 @@ func (wf *Workflow) Execute(startAgent string, userRequest string) (*WorkflowRes
 	}
 
 
+	// Every step of the workflow logs under the same run ID and traces under one span
+	ctx := withRunID(context.Background())
+	ctx, span := wf.swarm.tracer(ctx).Start(ctx, "agentkit.workflow", trace.WithAttributes(
+		AttrAgent.String(startAgent), AttrRunID.String(runID(ctx))))
+	defer func() { endSpan(span, err) }()
 	messageHistory := []llm.Message{{Role: llm.RoleUser, Content: userRequest}}
 	visited := make(map[string]bool)
 	cycleCount := make(map[string]int)
 	wf.currentAgent = startAgent
 	wf.currentStep = 0
-	wf.logTransition("start", startAgent, "workflow initialization")
+	wf.logTransition(ctx, "start", startAgent, "workflow initialization")
 
 	for {
 		// Start new step
@@ -176,9 +235,10 @@ func (wf *Workflow) Execute(startAgent string, userRequest string) (*WorkflowRes
 
 
 		// Execute current agent
-		fmt.Printf("\033[96mExecuting agent: %s (Step %d)\033[0m\n", wf.currentAgent, stepResult.StepNumber)
-		response, err := wf.executeAgent(wf.currentAgent, messageHistory)
+		response, err := wf.executeStep(ctx, stepResult.StepNumber, wf.currentAgent, messageHistory)
 		stepResult.EndTime = time.Now()
+		stepResult.Usage = response.Usage
+		result.Usage.Merge(response.Usage)
 
 
 		if err != nil {
@@ -189,8 +249,8 @@ func (wf *Workflow) Execute(startAgent string, userRequest string) (*WorkflowRes
 			return result, err
 		}
 
-		stepResult.Output = response
-		messageHistory = append(messageHistory, response...)
+		stepResult.Output = response.Messages
+		messageHistory = append(messageHistory, response.Messages...)
 
 
 		// Determine next agent
@@ -203,7 +263,7 @@ func (wf *Workflow) Execute(startAgent string, userRequest string) (*WorkflowRes
 		wf.currentStep++
 
 		if !shouldContinue {
-			wf.logTransition(wf.currentAgent, "end", "workflow complete")
+			wf.logTransition(ctx, wf.currentAgent, "end", "workflow complete")
 			break
 		}
 
@@ -211,7 +271,7 @@ func (wf *Workflow) Execute(startAgent string, userRequest string) (*WorkflowRes
 		if visited[nextAgent] {
 			cycleCount[nextAgent]++
 			reason := fmt.Sprintf("cycle detected (%d times)", cycleCount[nextAgent])
-			wf.logTransition(wf.currentAgent, nextAgent, reason)
+			wf.logTransition(ctx, wf.currentAgent, nextAgent, reason)
 
 			switch wf.cycleHandling {
 			case StopOnCycle:
@@ -238,7 +298,7 @@ func (wf *Workflow) Execute(startAgent string, userRequest string) (*WorkflowRes
 		}
 
 		// Log transition and update current agent
-		wf.logTransition(wf.currentAgent, nextAgent, "normal routing")
+		wf.logTransition(ctx, wf.currentAgent, nextAgent, "normal routing")
 		wf.currentAgent = nextAgent
 		visited[nextAgent] = true
 	}
@@ -270,10 +330,64 @@ func (wf *Workflow) GetLastStepResult() (*StepResult, error) {
 	return &wf.stepResults[len(wf.stepResults)-1], nil
 }
 
+// executeStep executes an agent for a workflow step, consulting the workflow's
+// failure handlers when it fails. A skipped step has no output.
+func (wf *Workflow) executeStep(ctx context.Context, step int, agentName string, messageHistory []llm.Message) (response Response, err error) {
+	agent := wf.agents[agentName]
+	ctx, span := wf.swarm.tracer(ctx).Start(ctx, "agentkit.workflow.step", trace.WithAttributes(
+		AttrStep.Int(step), AttrAgent.String(agentName)))
+	start := time.Now()
+	defer func() {
+		wf.swarm.metrics().Record(ctx, MetricWorkflowStepDuration, since(start), Label{LabelAgent, agentName}, outcome(err))
+		endSpan(span, err)
+	}()
+
+	if agent == nil {
+		err = fmt.Errorf("agent %s does not exist", agentName)
+		return response, err
+	}
+
+	// The usage of failed attempts is charged to the step as well
+	var spent Usage
+	model := ""
+	for attempt := 1; ; attempt++ {
+		response, err := wf.executeAgent(ctx, step, agentName, messageHistory, model)
+		spent.Merge(response.Usage)
+		response.Usage = spent
+		if err == nil {
+			return response, nil
+		}
+
+		decision := decideFailure(wf.stepHandlers, Failure{
+			Phase:   FailureWorkflowStep,
+			Agent:   agent,
+			Model:   wf.swarm.agentModel(agent, model),
+			Attempt: attempt,
+			Err:     err,
+		})
+		switch decision.Action {
+		case FailureRetry:
+		case FailureRetryWithModel:
+			model = decision.Model
+		case FailureSubstitute:
+			response.Messages = []llm.Message{decision.substituteMessage(agent)}
+			return response, nil
+		case FailureSkip:
+			response.Messages = nil
+			return response, nil
+		case FailureAbort:
+			return response, decision.abortError(err)
+		default:
+			return response, err
+		}
+	}
+}
+
 // executeAgent executes a single agent and manages its state
-func (wf *Workflow) executeAgent(agentName string, messageHistory []llm.Message) ([]llm.Message, error) {
+func (wf *Workflow) executeAgent(ctx context.Context, step int, agentName string, messageHistory []llm.Message, modelOverride string) (Response, error) {
 	agent := wf.agents[agentName]
-	fmt.Printf("\033[95mAgent %s processing message...\033[0m\n", agentName)
+	logger := wf.swarm.logger(ctx, false).With(LogKeyStep, step, LogKeyAgent, agentName)
+	logger.Info("executing workflow step")
 
 	// Prepare agent state
 	var state map[string]interface{}
@@ -285,22 +399,22 @@ func (wf *Workflow) executeAgent(agentName string, messageHistory []llm.Message)
 
 	// Execute agent
 	response, err := wf.swarm.Run(
-		context.Background(),
+		ctx,
 		agent,
 		messageHistory,
 		state,
-		"",
+		modelOverride,
 		false,
 		false,
 		0,
 		true,
 	)
 	if err != nil {
-		fmt.Printf("\033[91mError executing agent %s: %v\033[0m\n", agentName, err)
-		return nil, err
+		logger.Error("workflow step failed", "error", err)
+		return response, err
 	}
 
-	fmt.Printf("\033[92mAgent %s completed processing\033[0m\n", agentName)
+	logger.Info("workflow step completed")
 
 	// Update state
 	if wf.workflowType == CollaborativeWorkflow {
@@ -309,7 +423,7 @@ func (wf *Workflow) executeAgent(agentName string, messageHistory []llm.Message)
 		wf.agentStates[agentName] = state
 	}
 
-	return response.Messages, nil
+	return response, nil
 }
 
 // routeToNextAgent determines the next agent based on workflow type and message content
@@ -651,6 +765,7 @@ type StepResult struct {
 	EndTime    time.Time
 	NextAgent  string
 	StepNumber int
+	Usage      Usage // Tokens used by the agent in this step
 }
 
 // WorkflowResult represents the complete workflow execution result
@@ -660,4 +775,5 @@ type WorkflowResult struct {
 	Error       error
 	StartTime   time.Time
 	EndTime     time.Time
+	Usage       Usage // Tokens used across all steps
 }